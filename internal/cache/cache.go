@@ -0,0 +1,214 @@
+package cache
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Returned by DiskCache.Create when the key is already being written
+var ErrInProgress = errors.New("cache entry is already being written")
+
+/* DiskCache is a directory of files that is kept under a maximum total size
+ * by removing the least recently used files. Each file is named after its
+ * key, so the cache survives restarts; the last use of a file is tracked with
+ * its modification time. */
+type DiskCache struct {
+    dir string
+    maxBytes int64
+
+    mu sync.Mutex
+    size int64
+    lru *list.List // of *entry, most recently used first
+    entries map[string]*list.Element
+    pending map[string]bool
+}
+
+type entry struct {
+    key string
+    size int64
+}
+
+/* Opens the cache in dir, creating the directory if needed. Files left in
+ * the directory by a previous run are added to the cache, and the least
+ * recently used of them are removed if they exceed maxBytes. */
+func NewDiskCache(dir string, maxBytes int64) (*DiskCache,error) {
+    err := os.MkdirAll(dir, 0755)
+    if err != nil {
+        return nil, err
+    }
+    c := &DiskCache{
+        dir: dir,
+        maxBytes: maxBytes,
+        lru: list.New(),
+        entries: make(map[string]*list.Element),
+        pending: make(map[string]bool),
+    }
+    dirEntries, err := os.ReadDir(dir)
+    if err != nil {
+        return nil, err
+    }
+    var infos []fs.FileInfo
+    for _,d := range dirEntries {
+        if !d.Type().IsRegular() {
+            continue
+        }
+        if filepath.Ext(d.Name()) == ".tmp" {
+            // left over from an interrupted write
+            os.Remove(filepath.Join(dir, d.Name()))
+            continue
+        }
+        info, err := d.Info()
+        if err != nil {
+            return nil, err
+        }
+        infos = append(infos, info)
+    }
+    sort.Slice(infos, func(i, j int) bool {
+        return infos[i].ModTime().After(infos[j].ModTime())
+    })
+    for _,info := range infos {
+        c.entries[info.Name()] = c.lru.PushBack(&entry{info.Name(), info.Size()})
+        c.size += info.Size()
+    }
+    c.mu.Lock()
+    c.evict()
+    c.mu.Unlock()
+    return c, nil
+}
+
+func (c *DiskCache) path(key string) string {
+    return filepath.Join(c.dir, key)
+}
+
+/* Returns the path of the cached file for key and marks it as recently used.
+ * The file may be removed by a later eviction, but an open file stays
+ * readable after it is removed. */
+func (c *DiskCache) Get(key string) (string,bool) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    el, ok := c.entries[key]
+    if !ok {
+        return "", false
+    }
+    c.lru.MoveToFront(el)
+    now := time.Now()
+    os.Chtimes(c.path(key), now, now)
+    return c.path(key), true
+}
+
+// Returns the total size of the files in the cache in bytes
+func (c *DiskCache) Size() int64 {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.size
+}
+
+/* Starts writing the file for key. The file only becomes part of the cache
+ * once Commit is called; Abort discards it. Only one writer per key is
+ * allowed at a time, ErrInProgress is returned to the others. */
+func (c *DiskCache) Create(key string) (*Writer,error) {
+    if key == "" || key != filepath.Base(key) || filepath.Ext(key) == ".tmp" {
+        return nil, fmt.Errorf("Invalid cache key, \"%s\"", key)
+    }
+    c.mu.Lock()
+    if c.pending[key] {
+        c.mu.Unlock()
+        return nil, ErrInProgress
+    }
+    c.pending[key] = true
+    c.mu.Unlock()
+
+    f, err := os.CreateTemp(c.dir, key + ".*.tmp")
+    if err != nil {
+        c.mu.Lock()
+        delete(c.pending, key)
+        c.mu.Unlock()
+        return nil, err
+    }
+    return &Writer{File: f, cache: c, key: key}, nil
+}
+
+// Removes least recently used files until the cache fits, the caller must hold c.mu
+func (c *DiskCache) evict() {
+    for c.size > c.maxBytes && c.lru.Len() > 0 {
+        el := c.lru.Back()
+        e := el.Value.(*entry)
+        c.lru.Remove(el)
+        delete(c.entries, e.key)
+        c.size -= e.size
+        os.Remove(c.path(e.key))
+    }
+}
+
+// Writer is a file that is being added to a DiskCache
+type Writer struct {
+    *os.File
+    cache *DiskCache
+    key string
+    done bool
+}
+
+// Adds the written file to the cache, evicting older files if needed
+func (w *Writer) Commit() error {
+    if w.done {
+        return errors.New("Cache entry was already committed or aborted")
+    }
+    w.done = true
+    c := w.cache
+    defer func() {
+        c.mu.Lock()
+        delete(c.pending, w.key)
+        c.mu.Unlock()
+    }()
+    info, err := w.File.Stat()
+    if err != nil {
+        w.File.Close()
+        os.Remove(w.File.Name())
+        return err
+    }
+    err = w.File.Close()
+    if err != nil {
+        os.Remove(w.File.Name())
+        return err
+    }
+    if info.Size() > c.maxBytes {
+        os.Remove(w.File.Name())
+        return nil
+    }
+    err = os.Rename(w.File.Name(), c.path(w.key))
+    if err != nil {
+        os.Remove(w.File.Name())
+        return err
+    }
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if el, ok := c.entries[w.key]; ok {
+        c.size -= el.Value.(*entry).size
+        c.lru.Remove(el)
+    }
+    c.entries[w.key] = c.lru.PushFront(&entry{w.key, info.Size()})
+    c.size += info.Size()
+    c.evict()
+    return nil
+}
+
+// Discards the written file, it is safe to call after Commit
+func (w *Writer) Abort() {
+    if w.done {
+        return
+    }
+    w.done = true
+    w.File.Close()
+    os.Remove(w.File.Name())
+    w.cache.mu.Lock()
+    delete(w.cache.pending, w.key)
+    w.cache.mu.Unlock()
+}
@@ -0,0 +1,86 @@
+package cache
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func put(t *testing.T, c *DiskCache, key string, size int) {
+    w, err := c.Create(key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    w.WriteString(strings.Repeat("x", size))
+    if err := w.Commit(); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestDiskCache(t *testing.T) {
+    dir := t.TempDir()
+    c, err := NewDiskCache(dir, 100)
+    if err != nil {
+        t.Fatal(err)
+    }
+    put(t, c, "a", 40)
+    put(t, c, "b", 40)
+    if _,ok := c.Get("a"); !ok {
+        t.Fatal("Expected \"a\" to be cached")
+    }
+    // "b" is now the least recently used
+    put(t, c, "c", 40)
+    if _,ok := c.Get("b"); ok {
+        t.Error("Expected \"b\" to be evicted")
+    }
+    if _,err := os.Stat(dir + "/b"); !os.IsNotExist(err) {
+        t.Error("Expected the file for \"b\" to be removed")
+    }
+    if path,ok := c.Get("c"); !ok {
+        t.Error("Expected \"c\" to be cached")
+    } else if b,_ := os.ReadFile(path); len(b) != 40 {
+        t.Errorf("Expected \"c\" to contain 40 bytes, got %d", len(b))
+    }
+    if c.Size() != 80 {
+        t.Errorf("Expected a size of 80, got %d", c.Size())
+    }
+
+    // files larger than the whole cache are not kept
+    put(t, c, "huge", 101)
+    if _,ok := c.Get("huge"); ok {
+        t.Error("Expected \"huge\" not to be cached")
+    }
+
+    w, err := c.Create("d")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _,err := c.Create("d"); !errors.Is(err, ErrInProgress) {
+        t.Errorf("Expected ErrInProgress for a second writer, got %v", err)
+    }
+    w.WriteString("partial")
+    w.Abort()
+    if _,ok := c.Get("d"); ok {
+        t.Error("Expected an aborted entry not to be cached")
+    }
+    if _,err := c.Create("../escape"); err == nil {
+        t.Error("Expected an error for a key containing a path")
+    }
+
+    // the cache is restored from the directory
+    c, err = NewDiskCache(dir, 100)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _,ok := c.Get("a"); !ok {
+        t.Error("Expected \"a\" to be cached after reopening")
+    }
+    if c.Size() != 80 {
+        t.Errorf("Expected a size of 80 after reopening, got %d", c.Size())
+    }
+    entries, _ := os.ReadDir(dir)
+    if len(entries) != 2 {
+        t.Errorf("Expected 2 files in the cache directory, got %d", len(entries))
+    }
+}
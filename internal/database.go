@@ -5,7 +5,10 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"time"
 
+	"github.com/TSchreiber/melo/internal/fingerprint"
+	"github.com/TSchreiber/melo/internal/jobs"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -13,12 +16,33 @@ import (
 )
 
 type Song struct {
-    Id string `json:"id" bson:"_id"`
-    AudioURL string `json:"audioURL"`
+    Id string `json:"id" bson:"_id,omitempty"`
+    AudioURL string `json:"audioURL" bson:"audioUrl"`
     Artwork string `json:"artwork"`
     Title string `json:"title"`
     Artist string `json:"artist"`
     Album string `json:"album"`
+    // The song's number on its album, 0 if unknown
+    Track int `json:"track,omitempty" bson:"track,omitempty"`
+    // Duration of the audio in seconds, 0 if unknown
+    Duration int64 `json:"duration,omitempty" bson:"duration,omitempty"`
+    // The key of the video or URL that the song was downloaded from, see
+    // download.SourceId, ex. "youtube:<id>"
+    Source string `json:"source,omitempty" bson:"source,omitempty"`
+    // The email of the user that added the song to the library
+    AddedBy string `json:"addedBy,omitempty" bson:"addedBy,omitempty"`
+    // The codec of the audio file, ex. "mp3" or "opus"
+    Codec string `json:"codec,omitempty" bson:"codec,omitempty"`
+    // The average bitrate of the audio file in bits per second, 0 if unknown
+    Bitrate int64 `json:"bitrate,omitempty" bson:"bitrate,omitempty"`
+    // Size of the audio file in bytes, 0 if unknown
+    Size int64 `json:"size,omitempty" bson:"size,omitempty"`
+    // The ReplayGain track gain in dB, the change in volume that brings the
+    // song to a loudness of -18 LUFS
+    Gain float64 `json:"gain,omitempty" bson:"gain,omitempty"`
+    // The true peak of the audio as a linear amplitude, 0 if the loudness of
+    // the song was never measured
+    Peak float64 `json:"peak,omitempty" bson:"peak,omitempty"`
 }
 
 type Playlist struct {
@@ -43,7 +67,23 @@ type MeloDatabase interface {
     GetSong(songId string) (Song,error)
     SampleSongs() ([]Song,error)
     SearchForSong(search string) ([]Song,error)
-    PostSong(req map[string]string) (primitive.ObjectID,error)
+    // Lists the songs that were downloaded from any of the sources
+    GetSongsBySource(sources ...string) ([]Song,error)
+    // Returns the song that plays the audio URL, ErrNotFound if there is none
+    GetSongByAudioURL(audioURL string) (Song,error)
+    PostSong(song Song) (primitive.ObjectID,error)
+    // Changes the song's title, artist, album and artwork
+    UpdateSong(songId string, data Song) error
+    // Changes what the song knows of its audio file, its audio URL, source,
+    // duration, codec, bitrate, size, gain and peak, ex. once it has moved
+    UpdateSongAudio(songId string, data Song) error
+    // Removes the song, its fingerprint and its place in every playlist
+    DeleteSong(songId string) error
+    // Stores the acoustic fingerprint of a song's audio, replacing any that
+    // the song already has
+    PutFingerprint(songId string, fp fingerprint.Fingerprint) error
+    // Returns the fingerprint of every song that has one, keyed by song id
+    GetFingerprints() (map[string]fingerprint.Fingerprint,error)
 
     GetPlaylist(playlistId string) (Playlist,error)
     SamplePlaylists() ([]Playlist,error)
@@ -56,9 +96,55 @@ type MeloDatabase interface {
 
     GetUserPermissions(email string) ([]string,error)
 
+    // download jobs
+    jobs.Store
+
+    // The files of the music library directories, see scanLibrary
+    GetLibraryFiles() ([]LibraryFile,error)
+    // Stores the file, replacing the one at the same path
+    PutLibraryFile(file LibraryFile) error
+    DeleteLibraryFile(path string) error
+
+    // Takes the named lock for holder until expires, or extends it if holder
+    // already has it. Reports false if another holder has it and it hasn't
+    // expired, a lock of a process that crashed expires on its own.
+    TryLock(name, holder string, expires time.Time) (bool,error)
+    // Releases the named lock if holder has it
+    Unlock(name, holder string) error
+
     Disconnect()
 }
 
+// Returned (wrapped) by MeloDatabase implementations when the requested
+// document does not exist
+var ErrNotFound = errors.New("not found")
+
+// Returned (wrapped) by MeloDatabase implementations when the provided id is
+// not a valid ObjectID
+var ErrInvalidId = errors.New("invalid id")
+
+type DatabaseConfig struct {
+    // The storage backend to use, "mongodb" (the default), "sqlite" or "memory"
+    Type string
+    MongoDBConfig
+    SQLiteDBConfig
+    MemoryDBConfig
+}
+
+// Creates the MeloDatabase selected by config.Type
+func NewMeloDatabase(config DatabaseConfig) (MeloDatabase, error) {
+    switch config.Type {
+    case "", "mongodb":
+        return NewMongoDB(config.MongoDBConfig)
+    case "sqlite":
+        return NewSQLiteDB(config.SQLiteDBConfig)
+    case "memory":
+        return NewMemoryDB(config.MemoryDBConfig)
+    default:
+        return nil, fmt.Errorf("Unknown database type, \"%s\"", config.Type)
+    }
+}
+
 type MongoDatabase struct {
     database *mongo.Database
     client *mongo.Client
@@ -87,12 +173,113 @@ func (db MongoDatabase) Disconnect() {
 }
 
 func (db MongoDatabase) GetSong(songId string) (Song,error) {
-    return Song{}, errors.New("Not implemented")
+    var song Song
+    id,err := primitive.ObjectIDFromHex(songId)
+    if err != nil {
+        return song, fmt.Errorf(
+            "MongoDatabase.GetSong Invalid ObjectID %s: %w", songId, ErrInvalidId)
+    }
+    res := db.database.Collection("song").FindOne(context.Background(),
+        bson.M{"_id": id})
+    err = res.Err()
+    if err == mongo.ErrNoDocuments {
+        return song, fmt.Errorf(
+            "MongoDatabase.GetSong Song %s: %w", songId, ErrNotFound)
+    }
+    if err != nil {
+        return song, fmt.Errorf("MongoDatabase.GetSong FindOne: %v", err)
+    }
+    err = res.Decode(&song)
+    if err != nil {
+        return song, fmt.Errorf(
+            "MongoDatabase.GetSong Failed to decode song: %v", err)
+    }
+    return song, nil
 }
 
-func (db MongoDatabase) PostSong(req map[string]string) (primitive.ObjectID,error) {
+func (db MongoDatabase) UpdateSong(songId string, data Song) error {
+    id,err := primitive.ObjectIDFromHex(songId)
+    if err != nil {
+        return fmt.Errorf(
+            "MongoDatabase.UpdateSong Invalid ObjectID %s: %w", songId, ErrInvalidId)
+    }
+    update := bson.D{{
+        Key: "$set",
+        Value: bson.D{
+            {Key: "title", Value: data.Title},
+            {Key: "artist", Value: data.Artist},
+            {Key: "album", Value: data.Album},
+            {Key: "artwork", Value: data.Artwork},
+        }}}
+    res, err := db.database.Collection("song").UpdateOne(context.TODO(),
+        bson.M{"_id": id}, update)
+    if err != nil {
+        return fmt.Errorf("MongoDatabase.UpdateSong UpdateOne: %v", err)
+    }
+    if res.MatchedCount == 0 {
+        return fmt.Errorf("MongoDatabase.UpdateSong Song %s: %w", songId, ErrNotFound)
+    }
+    return nil
+}
+
+func (db MongoDatabase) UpdateSongAudio(songId string, data Song) error {
+    id,err := primitive.ObjectIDFromHex(songId)
+    if err != nil {
+        return fmt.Errorf(
+            "MongoDatabase.UpdateSongAudio Invalid ObjectID %s: %w", songId, ErrInvalidId)
+    }
+    update := bson.D{{
+        Key: "$set",
+        Value: bson.D{
+            {Key: "audioUrl", Value: data.AudioURL},
+            {Key: "source", Value: data.Source},
+            {Key: "duration", Value: data.Duration},
+            {Key: "codec", Value: data.Codec},
+            {Key: "bitrate", Value: data.Bitrate},
+            {Key: "size", Value: data.Size},
+            {Key: "gain", Value: data.Gain},
+            {Key: "peak", Value: data.Peak},
+        }}}
+    res, err := db.database.Collection("song").UpdateOne(context.TODO(),
+        bson.M{"_id": id}, update)
+    if err != nil {
+        return fmt.Errorf("MongoDatabase.UpdateSongAudio UpdateOne: %v", err)
+    }
+    if res.MatchedCount == 0 {
+        return fmt.Errorf("MongoDatabase.UpdateSongAudio Song %s: %w", songId, ErrNotFound)
+    }
+    return nil
+}
+
+func (db MongoDatabase) DeleteSong(songId string) error {
+    id,err := primitive.ObjectIDFromHex(songId)
+    if err != nil {
+        return fmt.Errorf(
+            "MongoDatabase.DeleteSong Invalid ObjectID %s: %w", songId, ErrInvalidId)
+    }
+    res, err := db.database.Collection("song").DeleteOne(context.TODO(), bson.M{"_id": id})
+    if err != nil {
+        return fmt.Errorf("MongoDatabase.DeleteSong DeleteOne: %v", err)
+    }
+    if res.DeletedCount == 0 {
+        return fmt.Errorf("MongoDatabase.DeleteSong Song %s: %w", songId, ErrNotFound)
+    }
+    _, err = db.database.Collection("fingerprint").DeleteOne(context.TODO(), bson.M{"_id": songId})
+    if err != nil {
+        return fmt.Errorf("MongoDatabase.DeleteSong Failed to delete the fingerprint: %v", err)
+    }
+    _, err = db.database.Collection("playlist").UpdateMany(context.TODO(),
+        bson.M{"songs": id}, bson.M{"$pull": bson.M{"songs": id}})
+    if err != nil {
+        return fmt.Errorf("MongoDatabase.DeleteSong Failed to remove the song from playlists: %v", err)
+    }
+    return nil
+}
+
+func (db MongoDatabase) PostSong(song Song) (primitive.ObjectID,error) {
+    song.Id = ""
     col := db.database.Collection("song")
-    res,err := col.InsertOne(context.Background(), req)
+    res,err := col.InsertOne(context.Background(), song)
     if err != nil {
         return primitive.NilObjectID, err
     }
@@ -136,6 +323,126 @@ func (db MongoDatabase) SearchForSong(search string) ([]Song,error) {
     return list, nil
 }
 
+func (db MongoDatabase) GetSongsBySource(sources ...string) ([]Song,error) {
+    cursor, err := db.database.Collection("song").Find(context.Background(),
+        bson.M{"source": bson.M{"$in": sources}})
+    if err != nil {
+        return []Song{}, fmt.Errorf("MongoDatabase.GetSongsBySource Find: %v", err)
+    }
+    list := []Song{}
+    err = cursor.All(context.Background(), &list)
+    if err != nil {
+        return []Song{}, fmt.Errorf("MongoDatabase.GetSongsBySource Failed to decode songs: %v", err)
+    }
+    return list, nil
+}
+
+func (db MongoDatabase) GetSongByAudioURL(audioURL string) (Song,error) {
+    var song Song
+    err := db.database.Collection("song").FindOne(context.Background(),
+        bson.M{"audioUrl": audioURL}).Decode(&song)
+    if err == mongo.ErrNoDocuments {
+        return song, fmt.Errorf("MongoDatabase.GetSongByAudioURL %s: %w", audioURL, ErrNotFound)
+    }
+    if err != nil {
+        return song, fmt.Errorf("MongoDatabase.GetSongByAudioURL: %v", err)
+    }
+    return song, nil
+}
+
+func (db MongoDatabase) PutFingerprint(songId string, fp fingerprint.Fingerprint) error {
+    _, err := db.database.Collection("fingerprint").ReplaceOne(context.Background(),
+        bson.M{"_id": songId}, bson.M{"data": fp.Bytes()}, options.Replace().SetUpsert(true))
+    if err != nil {
+        return fmt.Errorf("MongoDatabase.PutFingerprint ReplaceOne: %v", err)
+    }
+    return nil
+}
+
+func (db MongoDatabase) GetFingerprints() (map[string]fingerprint.Fingerprint,error) {
+    cursor, err := db.database.Collection("fingerprint").Find(context.Background(), bson.M{})
+    if err != nil {
+        return nil, fmt.Errorf("MongoDatabase.GetFingerprints Find: %v", err)
+    }
+    defer cursor.Close(context.Background())
+    fps := make(map[string]fingerprint.Fingerprint)
+    for cursor.Next(context.Background()) {
+        var r struct {
+            Id string `bson:"_id"`
+            Data []byte `bson:"data"`
+        }
+        err = cursor.Decode(&r)
+        if err != nil {
+            return nil, fmt.Errorf(
+                "MongoDatabase.GetFingerprints Failed to decode fingerprint: %v", err)
+        }
+        fps[r.Id], err = fingerprint.FromBytes(r.Data)
+        if err != nil {
+            return nil, fmt.Errorf("MongoDatabase.GetFingerprints Song %s: %v", r.Id, err)
+        }
+    }
+    return fps, cursor.Err()
+}
+
+func (db MongoDatabase) GetLibraryFiles() ([]LibraryFile,error) {
+    cursor, err := db.database.Collection("library_file").Find(context.Background(), bson.M{})
+    if err != nil {
+        return nil, fmt.Errorf("MongoDatabase.GetLibraryFiles Find: %v", err)
+    }
+    list := []LibraryFile{}
+    err = cursor.All(context.Background(), &list)
+    if err != nil {
+        return nil, fmt.Errorf("MongoDatabase.GetLibraryFiles Failed to decode files: %v", err)
+    }
+    return list, nil
+}
+
+func (db MongoDatabase) PutLibraryFile(file LibraryFile) error {
+    _, err := db.database.Collection("library_file").ReplaceOne(context.Background(),
+        bson.M{"_id": file.Path}, file, options.Replace().SetUpsert(true))
+    if err != nil {
+        return fmt.Errorf("MongoDatabase.PutLibraryFile ReplaceOne: %v", err)
+    }
+    return nil
+}
+
+func (db MongoDatabase) DeleteLibraryFile(path string) error {
+    _, err := db.database.Collection("library_file").DeleteOne(context.Background(),
+        bson.M{"_id": path})
+    if err != nil {
+        return fmt.Errorf("MongoDatabase.DeleteLibraryFile DeleteOne: %v", err)
+    }
+    return nil
+}
+
+func (db MongoDatabase) TryLock(name, holder string, expires time.Time) (bool,error) {
+    filter := bson.M{"_id": name, "$or": bson.A{
+        bson.M{"holder": holder},
+        bson.M{"expires": bson.M{"$lt": time.Now().UnixNano()}},
+    }}
+    update := bson.M{"$set": bson.M{"holder": holder, "expires": expires.UnixNano()}}
+    // when another holder has the lock the upsert inserts a second one, which
+    // fails on the duplicate _id
+    _, err := db.database.Collection("lock").UpdateOne(context.Background(), filter, update,
+        options.Update().SetUpsert(true))
+    if mongo.IsDuplicateKeyError(err) {
+        return false, nil
+    }
+    if err != nil {
+        return false, fmt.Errorf("MongoDatabase.TryLock UpdateOne: %v", err)
+    }
+    return true, nil
+}
+
+func (db MongoDatabase) Unlock(name, holder string) error {
+    _, err := db.database.Collection("lock").DeleteOne(context.Background(),
+        bson.M{"_id": name, "holder": holder})
+    if err != nil {
+        return fmt.Errorf("MongoDatabase.Unlock DeleteOne: %v", err)
+    }
+    return nil
+}
+
 func (db MongoDatabase) GetUserPermissions(email string) ([]string,error) {
     res := db.database.Collection("user_permissions").FindOne(context.Background(),
     bson.M{"email":email} )
@@ -352,3 +659,167 @@ func (db MongoDatabase) RemoveSongFromPlaylist(uid string, playlistId string, so
     }
     return nil
 }
+
+func (db MongoDatabase) EachSong(fn func(Song) error) error {
+    cursor, err := db.database.Collection("song").Find(context.Background(), bson.M{})
+    if err != nil {
+        return fmt.Errorf("MongoDatabase.EachSong Find: %v", err)
+    }
+    defer cursor.Close(context.Background())
+    for cursor.Next(context.Background()) {
+        var song Song
+        err = cursor.Decode(&song)
+        if err != nil {
+            return fmt.Errorf("MongoDatabase.EachSong Failed to decode song: %v", err)
+        }
+        err = fn(song)
+        if err != nil {
+            return err
+        }
+    }
+    return cursor.Err()
+}
+
+func (db MongoDatabase) EachPlaylist(fn func(NormalizedPlaylist) error) error {
+    cursor, err := db.database.Collection("playlist").Find(context.Background(), bson.M{})
+    if err != nil {
+        return fmt.Errorf("MongoDatabase.EachPlaylist Find: %v", err)
+    }
+    defer cursor.Close(context.Background())
+    for cursor.Next(context.Background()) {
+        var playlist NormalizedPlaylist
+        err = cursor.Decode(&playlist)
+        if err != nil {
+            return fmt.Errorf("MongoDatabase.EachPlaylist Failed to decode playlist: %v", err)
+        }
+        err = fn(playlist)
+        if err != nil {
+            return err
+        }
+    }
+    return cursor.Err()
+}
+
+func (db MongoDatabase) EachUserPermissions(fn func(string, []string) error) error {
+    cursor, err := db.database.Collection("user_permissions").Find(context.Background(), bson.M{})
+    if err != nil {
+        return fmt.Errorf("MongoDatabase.EachUserPermissions Find: %v", err)
+    }
+    defer cursor.Close(context.Background())
+    for cursor.Next(context.Background()) {
+        type Result struct { Email string; Permissions []string }
+        var r Result
+        err = cursor.Decode(&r)
+        if err != nil {
+            return fmt.Errorf(
+                "MongoDatabase.EachUserPermissions Failed to decode permissions: %v", err)
+        }
+        err = fn(r.Email, r.Permissions)
+        if err != nil {
+            return err
+        }
+    }
+    return cursor.Err()
+}
+
+func (db MongoDatabase) ImportSong(song Song) error {
+    id, err := primitive.ObjectIDFromHex(song.Id)
+    if err != nil {
+        return fmt.Errorf(
+            "MongoDatabase.ImportSong Invalid ObjectID %s: %w", song.Id, ErrInvalidId)
+    }
+    song.Id = ""
+    _, err = db.database.Collection("song").ReplaceOne(context.Background(),
+        bson.M{"_id": id}, song, options.Replace().SetUpsert(true))
+    return err
+}
+
+func (db MongoDatabase) ImportPlaylist(playlist NormalizedPlaylist) error {
+    id, err := primitive.ObjectIDFromHex(playlist.Id)
+    if err != nil {
+        return fmt.Errorf(
+            "MongoDatabase.ImportPlaylist Invalid ObjectID %s: %w", playlist.Id, ErrInvalidId)
+    }
+    songs := playlist.Songs
+    if songs == nil {
+        songs = []primitive.ObjectID{}
+    }
+    data := bson.M{
+        "artwork": playlist.Artwork,
+        "description": playlist.Description,
+        "title": playlist.Title,
+        "owner": playlist.Owner,
+        "songs": songs,
+    }
+    _, err = db.database.Collection("playlist").ReplaceOne(context.Background(),
+        bson.M{"_id": id}, data, options.Replace().SetUpsert(true))
+    return err
+}
+
+// Replaces the permissions of the user with the given email
+func (db MongoDatabase) SetUserPermissions(email string, permissions []string) error {
+    _, err := db.database.Collection("user_permissions").UpdateOne(context.Background(),
+        bson.M{"email": email},
+        bson.M{"$set": bson.M{"permissions": permissions}},
+        options.Update().SetUpsert(true))
+    return err
+}
+
+func (db MongoDatabase) CreateJob(job jobs.Job) (string,error) {
+    job.Id = primitive.NewObjectID().Hex()
+    _, err := db.database.Collection("job").InsertOne(context.TODO(), job)
+    if err != nil {
+        return "", fmt.Errorf("MongoDatabase.CreateJob InsertOne: %v", err)
+    }
+    return job.Id, nil
+}
+
+func (db MongoDatabase) UpdateJob(job jobs.Job) error {
+    res, err := db.database.Collection("job").ReplaceOne(context.TODO(),
+        bson.M{"_id": job.Id}, job)
+    if err != nil {
+        return fmt.Errorf("MongoDatabase.UpdateJob ReplaceOne: %v", err)
+    }
+    if res.MatchedCount == 0 {
+        return fmt.Errorf("MongoDatabase.UpdateJob Job %s: %w", job.Id, ErrNotFound)
+    }
+    return nil
+}
+
+func (db MongoDatabase) GetJob(jobId string) (jobs.Job,error) {
+    var job jobs.Job
+    if _,err := primitive.ObjectIDFromHex(jobId); err != nil {
+        return job, fmt.Errorf(
+            "MongoDatabase.GetJob Invalid ObjectID %s: %w", jobId, ErrInvalidId)
+    }
+    err := db.database.Collection("job").FindOne(context.TODO(),
+        bson.M{"_id": jobId}).Decode(&job)
+    if err == mongo.ErrNoDocuments {
+        return job, fmt.Errorf("MongoDatabase.GetJob Job %s: %w", jobId, ErrNotFound)
+    }
+    if err != nil {
+        return job, fmt.Errorf("MongoDatabase.GetJob FindOne: %v", err)
+    }
+    return job, nil
+}
+
+func (db MongoDatabase) ListJobs(states ...jobs.State) ([]jobs.Job,error) {
+    filter := bson.M{}
+    if len(states) > 0 {
+        filter["state"] = bson.M{"$in": states}
+    }
+    opts := options.Find().SetSort(bson.D{
+        {Key: "createdat", Value: 1},
+        {Key: "_id", Value: 1},
+    })
+    cursor, err := db.database.Collection("job").Find(context.TODO(), filter, opts)
+    if err != nil {
+        return nil, fmt.Errorf("MongoDatabase.ListJobs Find: %v", err)
+    }
+    list := []jobs.Job{}
+    err = cursor.All(context.TODO(), &list)
+    if err != nil {
+        return nil, fmt.Errorf("MongoDatabase.ListJobs: %v", err)
+    }
+    return list, nil
+}
@@ -0,0 +1,493 @@
+package internal
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/TSchreiber/melo/internal/download"
+	"github.com/TSchreiber/melo/internal/fingerprint"
+	"github.com/TSchreiber/melo/internal/jobs"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/* The MeloDatabase implementations that can be tested without any external
+ * services. Every test in this file is run against each of them. */
+var testDatabases = map[string]func(t *testing.T) MeloDatabase{
+    "memory": func(t *testing.T) MeloDatabase {
+        db, err := NewMemoryDB(MemoryDBConfig{})
+        if err != nil {
+            t.Fatal(err)
+        }
+        return db
+    },
+    "sqlite": func(t *testing.T) MeloDatabase {
+        path := filepath.Join(t.TempDir(), "melo.db")
+        db, err := NewSQLiteDB(SQLiteDBConfig{SQLitePath: path})
+        if err != nil {
+            t.Fatal(err)
+        }
+        t.Cleanup(db.Disconnect)
+        return db
+    },
+}
+
+func forEachDatabase(t *testing.T, test func(t *testing.T, db MeloDatabase)) {
+    for name, newDB := range testDatabases {
+        t.Run(name, func(t *testing.T) {
+            test(t, newDB(t))
+        })
+    }
+}
+
+func TestDatabaseSongs(t *testing.T) {
+    forEachDatabase(t, func(t *testing.T, db MeloDatabase) {
+        want := Song{
+            AudioURL: "/song/FXzE9eP1U_E.mp3",
+            Title: "Sand In My Boots",
+            Artist: "Morgan Wallen",
+            Album: "Dangerous: The Double Album",
+            Track: 4,
+            Duration: 202,
+            Source: "FXzE9eP1U_E",
+            AddedBy: testAdmin,
+            Codec: "opus",
+            Bitrate: 131072,
+            Size: 3309568,
+            Gain: -4.52,
+            Peak: 0.988553,
+        }
+        id, err := db.PostSong(want)
+        if err != nil {
+            t.Fatal(err)
+        }
+        want.Id = id.Hex()
+        got, err := db.GetSong(id.Hex())
+        if err != nil {
+            t.Fatal(err)
+        }
+        if got != want {
+            t.Errorf("GetSong: expected %+v, got %+v", want, got)
+        }
+
+        _, err = db.GetSong(primitive.NewObjectID().Hex())
+        if !errors.Is(err, ErrNotFound) {
+            t.Errorf("GetSong with an unknown id: expected ErrNotFound, got %v", err)
+        }
+        _, err = db.GetSong("FXzE9eP1U_E")
+        if !errors.Is(err, ErrInvalidId) {
+            t.Errorf("GetSong with a malformed id: expected ErrInvalidId, got %v", err)
+        }
+
+        songs, err := db.SampleSongs()
+        if err != nil || len(songs) != 1 {
+            t.Errorf("SampleSongs: expected 1 song, got %v %v", songs, err)
+        }
+        songs, err = db.GetSongsBySource("https://youtu.be/FXzE9eP1U_E", "FXzE9eP1U_E")
+        if err != nil || len(songs) != 1 || songs[0] != want {
+            t.Errorf("GetSongsBySource: expected the song, got %v %v", songs, err)
+        }
+        got, err = db.GetSongByAudioURL(want.AudioURL)
+        if err != nil || got != want {
+            t.Errorf("GetSongByAudioURL: expected %+v, got %+v, %v", want, got, err)
+        }
+        _, err = db.GetSongByAudioURL("/song/dQw4w9WgXcQ.mp3")
+        if !errors.Is(err, ErrNotFound) {
+            t.Errorf("GetSongByAudioURL with another URL: expected ErrNotFound, got %v", err)
+        }
+        songs, err = db.GetSongsBySource("dQw4w9WgXcQ")
+        if err != nil || songs == nil || len(songs) != 0 {
+            t.Errorf("GetSongsBySource with another source: expected no songs, got %v %v", songs, err)
+        }
+
+        err = db.UpdateSong(id.Hex(), Song{
+            Title: "Sand in My Boots",
+            Artist: "Morgan Wallen",
+            Album: "Dangerous",
+            Artwork: "https://example.com/dangerous.jpg",
+            // only the editable fields are changed
+            Duration: 1,
+        })
+        if err != nil {
+            t.Fatal(err)
+        }
+        want.Title = "Sand in My Boots"
+        want.Album = "Dangerous"
+        want.Artwork = "https://example.com/dangerous.jpg"
+        got, _ = db.GetSong(id.Hex())
+        if got != want {
+            t.Errorf("UpdateSong: expected %+v, got %+v", want, got)
+        }
+        songs, _ = db.SearchForSong("dangerous")
+        if len(songs) != 1 {
+            t.Errorf("SearchForSong after UpdateSong: expected 1 song, got %v", songs)
+        }
+        err = db.UpdateSong(primitive.NewObjectID().Hex(), want)
+        if !errors.Is(err, ErrNotFound) {
+            t.Errorf("UpdateSong with an unknown id: expected ErrNotFound, got %v", err)
+        }
+        err = db.UpdateSong("FXzE9eP1U_E", want)
+        if !errors.Is(err, ErrInvalidId) {
+            t.Errorf("UpdateSong with a malformed id: expected ErrInvalidId, got %v", err)
+        }
+    })
+}
+
+func TestDatabaseSearchForSong(t *testing.T) {
+    forEachDatabase(t, func(t *testing.T, db MeloDatabase) {
+        boots, _ := db.PostSong(Song{Title: "Sand In My Boots", Artist: "Morgan Wallen"})
+        iu, _ := db.PostSong(Song{Title: "You & I", Artist: "IU", Album: "Last Fantasy"})
+        wasted, _ := db.PostSong(Song{Title: "Wasted On You", Artist: "Morgan Wallen"})
+
+        tests := []struct {
+            search string
+            want []primitive.ObjectID
+        }{
+            {"boots", []primitive.ObjectID{boots}},
+            {"MORGAN", []primitive.ObjectID{boots, wasted}},
+            {"morgan -boots", []primitive.ObjectID{wasted}},
+            {"fantasy", []primitive.ObjectID{iu}},
+            {"nothing matches", nil},
+            {"", nil},
+        }
+        for _,test := range tests {
+            songs, err := db.SearchForSong(test.search)
+            if err != nil {
+                t.Errorf("SearchForSong(%q): %v", test.search, err)
+                continue
+            }
+            got := make(map[string]bool)
+            for _,s := range songs {
+                got[s.Id] = true
+            }
+            if len(got) != len(test.want) {
+                t.Errorf("SearchForSong(%q): expected %d songs, got %+v",
+                    test.search, len(test.want), songs)
+                continue
+            }
+            for _,id := range test.want {
+                if !got[id.Hex()] {
+                    t.Errorf("SearchForSong(%q): missing song %s", test.search, id.Hex())
+                }
+            }
+        }
+    })
+}
+
+func TestDatabasePlaylists(t *testing.T) {
+    forEachDatabase(t, func(t *testing.T, db MeloDatabase) {
+        song1, _ := db.PostSong(Song{Title: "One"})
+        song2, _ := db.PostSong(Song{Title: "Two"})
+        song3, _ := db.PostSong(Song{Title: "Three"})
+
+        id, err := db.PostPlaylist(NormalizedPlaylist{
+            Title: "Mix",
+            Owner: testUser,
+            Songs: []primitive.ObjectID{song3, song1},
+        })
+        if err != nil {
+            t.Fatal(err)
+        }
+        plid := id.Hex()
+        db.AddSongToPlaylist(testUser, plid, song2.Hex())
+        db.AddSongToPlaylist(testUser, plid, song1.Hex())
+        db.RemoveSongFromPlaylist(testUser, plid, song3.Hex())
+        db.UpdatePlaylist(testUser, plid, Playlist{Title: "Mix 2", Description: "Updated"})
+        // not the owner
+        db.AddSongToPlaylist(testAdmin, plid, song3.Hex())
+        db.UpdatePlaylist(testAdmin, plid, Playlist{Title: "Hijacked"})
+
+        playlist, err := db.GetPlaylist(plid)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if playlist.Title != "Mix 2" || playlist.Description != "Updated" ||
+        playlist.Owner != testUser {
+            t.Errorf("GetPlaylist: unexpected metadata %+v", playlist)
+        }
+        var titles []string
+        for _,s := range playlist.Songs {
+            titles = append(titles, s.Title)
+        }
+        if len(titles) != 3 || titles[0] != "One" || titles[1] != "Two" || titles[2] != "One" {
+            t.Errorf("GetPlaylist: expected songs [One Two One], got %v", titles)
+        }
+
+        _, err = db.GetPlaylist(primitive.NewObjectID().Hex())
+        if !errors.Is(err, ErrNotFound) {
+            t.Errorf("GetPlaylist with an unknown id: expected ErrNotFound, got %v", err)
+        }
+
+        personal, err := db.GetPersonalPlaylists(testUser)
+        if err != nil || len(personal) != 1 || personal[0].Id != plid {
+            t.Errorf("GetPersonalPlaylists: expected playlist %s, got %+v %v", plid, personal, err)
+        }
+        personal, err = db.GetPersonalPlaylists(testAdmin)
+        if err != nil || len(personal) != 0 {
+            t.Errorf("GetPersonalPlaylists: expected no playlists, got %+v %v", personal, err)
+        }
+        sample, err := db.SamplePlaylists()
+        if err != nil || len(sample) != 1 {
+            t.Errorf("SamplePlaylists: expected 1 playlist, got %+v %v", sample, err)
+        }
+    })
+}
+
+func TestDatabaseFingerprints(t *testing.T) {
+    forEachDatabase(t, func(t *testing.T, db MeloDatabase) {
+        fps, err := db.GetFingerprints()
+        if err != nil || len(fps) != 0 {
+            t.Errorf("GetFingerprints: expected none, got %v %v", fps, err)
+        }
+        boots := primitive.NewObjectID().Hex()
+        iu := primitive.NewObjectID().Hex()
+        if err := db.PutFingerprint(boots, fingerprint.Fingerprint{ 1, 2, 3 }); err != nil {
+            t.Fatal(err)
+        }
+        if err := db.PutFingerprint(iu, fingerprint.Fingerprint{ 0xffffffff }); err != nil {
+            t.Fatal(err)
+        }
+        // replaces the first
+        if err := db.PutFingerprint(boots, fingerprint.Fingerprint{ 4, 5 }); err != nil {
+            t.Fatal(err)
+        }
+        fps, err = db.GetFingerprints()
+        want := map[string]fingerprint.Fingerprint{
+            boots: { 4, 5 },
+            iu: { 0xffffffff },
+        }
+        if err != nil || !reflect.DeepEqual(fps, want) {
+            t.Errorf("GetFingerprints: expected %v, got %v %v", want, fps, err)
+        }
+    })
+}
+
+func TestDatabaseDeleteSong(t *testing.T) {
+    forEachDatabase(t, func(t *testing.T, db MeloDatabase) {
+        song1, _ := db.PostSong(Song{Title: "One", AudioURL: "file:///music/one.mp3"})
+        song2, _ := db.PostSong(Song{Title: "Two"})
+        db.PutFingerprint(song1.Hex(), fingerprint.Fingerprint{ 1, 2, 3 })
+        id, _ := db.PostPlaylist(NormalizedPlaylist{
+            Title: "Mix",
+            Owner: testUser,
+            Songs: []primitive.ObjectID{song1, song2, song1},
+        })
+
+        err := db.UpdateSongAudio(song1.Hex(), Song{
+            AudioURL: "file:///music/moved/one.flac",
+            Source: "file:///music/moved/one.flac",
+            Duration: 180,
+            Codec: "flac",
+            Bitrate: 900000,
+            Size: 20000000,
+        })
+        if err != nil {
+            t.Fatal(err)
+        }
+        song, err := db.GetSong(song1.Hex())
+        if err != nil || song.Title != "One" || song.AudioURL != "file:///music/moved/one.flac" ||
+        song.Codec != "flac" || song.Size != 20000000 || song.Duration != 180 {
+            t.Errorf("GetSong after UpdateSongAudio: unexpected song %+v %v", song, err)
+        }
+
+        if err := db.DeleteSong(song1.Hex()); err != nil {
+            t.Fatal(err)
+        }
+        _, err = db.GetSong(song1.Hex())
+        if !errors.Is(err, ErrNotFound) {
+            t.Errorf("GetSong after DeleteSong: expected ErrNotFound, got %v", err)
+        }
+        if fps, _ := db.GetFingerprints(); len(fps) != 0 {
+            t.Errorf("GetFingerprints after DeleteSong: expected none, got %v", fps)
+        }
+        playlist, err := db.GetPlaylist(id.Hex())
+        if err != nil || len(playlist.Songs) != 1 || playlist.Songs[0].Title != "Two" {
+            t.Errorf("GetPlaylist after DeleteSong: expected [Two], got %+v %v", playlist.Songs, err)
+        }
+
+        err = db.DeleteSong(song1.Hex())
+        if !errors.Is(err, ErrNotFound) {
+            t.Errorf("DeleteSong twice: expected ErrNotFound, got %v", err)
+        }
+        err = db.UpdateSongAudio(song1.Hex(), Song{})
+        if !errors.Is(err, ErrNotFound) {
+            t.Errorf("UpdateSongAudio of a deleted song: expected ErrNotFound, got %v", err)
+        }
+        err = db.DeleteSong("not an id")
+        if !errors.Is(err, ErrInvalidId) {
+            t.Errorf("DeleteSong with an invalid id: expected ErrInvalidId, got %v", err)
+        }
+    })
+}
+
+func TestDatabaseLibraryFiles(t *testing.T) {
+    forEachDatabase(t, func(t *testing.T, db MeloDatabase) {
+        files, err := db.GetLibraryFiles()
+        if err != nil || len(files) != 0 {
+            t.Errorf("GetLibraryFiles: expected none, got %v %v", files, err)
+        }
+        a := LibraryFile{ Path: "/music/a.mp3", SongId: "1", Size: 10, ModTime: 100, Hash: "aa" }
+        b := LibraryFile{ Path: "/music/b.flac", SongId: "2", Size: 20, ModTime: 200, Hash: "bb" }
+        db.PutLibraryFile(b)
+        db.PutLibraryFile(a)
+        // replaces the first
+        b.ModTime = 300
+        b.Hash = "cc"
+        if err := db.PutLibraryFile(b); err != nil {
+            t.Fatal(err)
+        }
+        files, err = db.GetLibraryFiles()
+        if err != nil || !reflect.DeepEqual(files, []LibraryFile{ a, b }) {
+            t.Errorf("GetLibraryFiles: expected %v, got %v %v", []LibraryFile{ a, b }, files, err)
+        }
+        if err := db.DeleteLibraryFile(a.Path); err != nil {
+            t.Fatal(err)
+        }
+        files, err = db.GetLibraryFiles()
+        if err != nil || !reflect.DeepEqual(files, []LibraryFile{ b }) {
+            t.Errorf("GetLibraryFiles after DeleteLibraryFile: expected %v, got %v %v", []LibraryFile{ b }, files, err)
+        }
+    })
+}
+
+func TestDatabaseLocks(t *testing.T) {
+    forEachDatabase(t, func(t *testing.T, db MeloDatabase) {
+        later := time.Now().Add(time.Minute)
+        if ok, err := db.TryLock("scan", "a", later); !ok || err != nil {
+            t.Fatalf("TryLock: expected the lock, got %v %v", ok, err)
+        }
+        if ok, err := db.TryLock("scan", "b", later); ok || err != nil {
+            t.Errorf("TryLock of a held lock: expected false, got %v %v", ok, err)
+        }
+        if ok, err := db.TryLock("scan", "a", later.Add(time.Minute)); !ok || err != nil {
+            t.Errorf("TryLock by its holder: expected the lock to be renewed, got %v %v", ok, err)
+        }
+        if ok, err := db.TryLock("other", "b", later); !ok || err != nil {
+            t.Errorf("TryLock of another lock: expected it, got %v %v", ok, err)
+        }
+        db.Unlock("scan", "b")
+        if ok, _ := db.TryLock("scan", "b", later); ok {
+            t.Errorf("Unlock by another holder: expected the lock to be kept")
+        }
+        if err := db.Unlock("scan", "a"); err != nil {
+            t.Fatal(err)
+        }
+        if ok, err := db.TryLock("scan", "b", time.Now().Add(-time.Second)); !ok || err != nil {
+            t.Errorf("TryLock after Unlock: expected the lock, got %v %v", ok, err)
+        }
+        // b's lock has expired
+        if ok, err := db.TryLock("scan", "a", later); !ok || err != nil {
+            t.Errorf("TryLock of an expired lock: expected it, got %v %v", ok, err)
+        }
+    })
+}
+
+func TestDatabaseUserPermissions(t *testing.T) {
+    forEachDatabase(t, func(t *testing.T, db MeloDatabase) {
+        setter := db.(interface{
+            SetUserPermissions(email string, permissions []string) error
+        })
+        if err := setter.SetUserPermissions(testAdmin, []string{"admin"}); err != nil {
+            t.Fatal(err)
+        }
+        permissions, err := db.GetUserPermissions(testAdmin)
+        if err != nil || len(permissions) != 1 || permissions[0] != "admin" {
+            t.Errorf("GetUserPermissions: expected [admin], got %v %v", permissions, err)
+        }
+        permissions, err = db.GetUserPermissions(testUser)
+        if err != nil || len(permissions) != 0 {
+            t.Errorf("GetUserPermissions: expected no permissions, got %v %v", permissions, err)
+        }
+    })
+}
+
+func TestDatabaseJobs(t *testing.T) {
+    forEachDatabase(t, func(t *testing.T, db MeloDatabase) {
+        list, err := db.ListJobs()
+        if err != nil || len(list) != 0 {
+            t.Fatalf("ListJobs: expected no jobs, got %v %v", list, err)
+        }
+        start := time.Now()
+        var ids []string
+        for i, title := range []string{"One", "Two", "Three"} {
+            id, err := db.CreateJob(jobs.Job{
+                Request: download.DownloadRequest{Title: title, Source: "dQw4w9WgXcQ"},
+                CreatedBy: testAdmin,
+                CreatedAt: start.Add(time.Duration(i) * time.Second),
+                State: jobs.Queued,
+            })
+            if err != nil {
+                t.Fatal(err)
+            }
+            ids = append(ids, id)
+        }
+
+        job, err := db.GetJob(ids[1])
+        if err != nil {
+            t.Fatal(err)
+        }
+        if job.Id != ids[1] || job.Request.Title != "Two" || job.CreatedBy != testAdmin ||
+        !job.CreatedAt.Equal(start.Add(time.Second)) {
+            t.Errorf("GetJob: unexpected job %+v", job)
+        }
+        job.State = jobs.Running
+        job.Step = jobs.StepSave
+        job.Song = &download.Song{Title: "Two", AudioUrl: "/song/dQw4w9WgXcQ.mp3"}
+        if err := db.UpdateJob(job); err != nil {
+            t.Fatal(err)
+        }
+        job, _ = db.GetJob(ids[1])
+        if job.State != jobs.Running || job.Step != jobs.StepSave ||
+        job.Song == nil || job.Song.AudioUrl != "/song/dQw4w9WgXcQ.mp3" {
+            t.Errorf("UpdateJob: the job was not updated, %+v", job)
+        }
+
+        list, _ = db.ListJobs(jobs.Queued)
+        if len(list) != 2 || list[0].Id != ids[0] || list[1].Id != ids[2] {
+            t.Errorf("ListJobs(queued): expected jobs %s and %s, got %+v", ids[0], ids[2], list)
+        }
+        list, _ = db.ListJobs(jobs.Running, jobs.Queued)
+        if len(list) != 3 || list[0].Id != ids[0] || list[1].Id != ids[1] || list[2].Id != ids[2] {
+            t.Errorf("ListJobs: expected every job oldest first, got %+v", list)
+        }
+        list, _ = db.ListJobs(jobs.Failed)
+        if len(list) != 0 {
+            t.Errorf("ListJobs(failed): expected no jobs, got %+v", list)
+        }
+
+        _, err = db.GetJob(primitive.NewObjectID().Hex())
+        if !errors.Is(err, ErrNotFound) {
+            t.Errorf("GetJob with an unknown id: expected ErrNotFound, got %v", err)
+        }
+        _, err = db.GetJob("not-an-id")
+        if !errors.Is(err, ErrInvalidId) {
+            t.Errorf("GetJob with a malformed id: expected ErrInvalidId, got %v", err)
+        }
+        err = db.UpdateJob(jobs.Job{Id: primitive.NewObjectID().Hex()})
+        if !errors.Is(err, ErrNotFound) {
+            t.Errorf("UpdateJob with an unknown id: expected ErrNotFound, got %v", err)
+        }
+    })
+}
+
+func TestSQLiteReopen(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "melo.db")
+    db, err := NewSQLiteDB(SQLiteDBConfig{SQLitePath: path})
+    if err != nil {
+        t.Fatal(err)
+    }
+    id, _ := db.PostSong(Song{Title: "Persisted"})
+    db.Disconnect()
+
+    db, err = NewSQLiteDB(SQLiteDBConfig{SQLitePath: path})
+    if err != nil {
+        t.Fatalf("Reopening the database failed: %v", err)
+    }
+    defer db.Disconnect()
+    song, err := db.GetSong(id.Hex())
+    if err != nil || song.Title != "Persisted" {
+        t.Errorf("GetSong after reopening: expected \"Persisted\", got %+v %v", song, err)
+    }
+}
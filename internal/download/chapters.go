@@ -0,0 +1,60 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	yt_dlp "github.com/TSchreiber/melo/internal/yt_dlp"
+)
+
+// Returned by PreviewChapters for a video that has no chapters
+var ErrNoChapters = errors.New("The video has no chapters")
+
+/* Lists the chapters of a video, ex. a full album, as the entries of a
+ * playlist. Each entry is the section of the video that is the chapter, with
+ * the chapter's title and track number and the album's artist and artwork.
+ * The entries are reviewed and posted like a playlist's, the jobs of the
+ * same video share its download, see jobs.Queue.EnqueueGroup. */
+func PreviewChapters(ctx context.Context, source string) (PlaylistPreview,error) {
+    var preview PlaylistPreview
+    video, err := yt_dlp.GetVideo(ctx, source)
+    if err != nil {
+        return preview, fmt.Errorf("Failed to look up the video: %w", err)
+    }
+    if len(video.Chapters) == 0 {
+        return preview, ErrNoChapters
+    }
+    artist, album := splitVideoTitle(video.Title)
+    album = firstNonEmpty(video.Album, album)
+    artist = firstNonEmpty(video.Artist, artist,
+        strings.TrimSuffix(firstNonEmpty(video.Channel, video.Uploader), " - Topic"))
+    preview.Title = album
+    preview.Uploader = firstNonEmpty(video.Channel, video.Uploader)
+    preview.URL = firstNonEmpty(video.WebpageURL, source)
+    preview.Entries = make([]PlaylistEntry, 0, len(video.Chapters))
+    for i,chapter := range video.Chapters {
+        var entry PlaylistEntry
+        entry.VideoTitle = chapter.Title
+        entry.Artist, entry.Title = splitVideoTitle(trackNumber.ReplaceAllString(chapter.Title, ""))
+        if entry.Artist == "" {
+            entry.Artist = artist
+        }
+        entry.Album = album
+        entry.Artwork = video.Thumbnail
+        entry.Source = firstNonEmpty(video.Id, source)
+        entry.Start = chapter.StartTime
+        entry.End = chapter.EndTime
+        entry.Duration = int64(chapter.EndTime - chapter.StartTime)
+        entry.Track = i + 1
+        preview.Entries = append(preview.Entries, entry)
+    }
+    return preview, nil
+}
+
+/* Matches the track number at the start of a chapter's title, ex. "01. " or
+ * "3 - ". A number without a separator is left, it is likely part of the
+ * title, ex. "7 rings". */
+var trackNumber = regexp.MustCompile(`^\s*\d{1,3}\s*(?:[.)]|\s-)\s*`)
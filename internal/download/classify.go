@@ -0,0 +1,142 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/TSchreiber/melo/internal/ffmpeg"
+	yt_dlp "github.com/TSchreiber/melo/internal/yt_dlp"
+)
+
+// How a failed download step should be handled
+type ErrorClass int
+
+const (
+    // A transient failure, ex. throttling, the step is tried again
+    Retryable ErrorClass = iota
+    // Trying again will not help, ex. the video was removed
+    Permanent
+    // The downloaded file is incomplete or corrupt, it is downloaded again
+    BadDownload
+)
+
+func (c ErrorClass) String() string {
+    switch c {
+    case Permanent:
+        return "permanent"
+    case BadDownload:
+        return "bad-download"
+    default:
+        return "retryable"
+    }
+}
+
+type permanentError struct {
+    err error
+}
+
+func (e permanentError) Error() string {
+    return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+    return e.err
+}
+
+// Marks the error as Permanent, ex. an invalid request
+func PermanentError(err error) error {
+    return permanentError{ err }
+}
+
+/* Messages from yt-dlp and ffmpeg that mean trying again will not help.
+ * They are checked before badDownloadMessages. */
+var permanentMessages = []string{
+    "Video unavailable",
+    "Private video",
+    "This video has been removed",
+    "This video is no longer available",
+    "Sign in to confirm your age",
+    "members-only",
+    "copyright grounds",
+    "Unsupported URL",
+    "is not a valid URL",
+    "Requested format is not available",
+    "This live event will begin",
+    "executable file not found",
+}
+
+// Messages from ffmpeg and ffprobe about a file that was not fully downloaded
+var badDownloadMessages = []string{
+    "Invalid data found when processing input",
+    "moov atom not found",
+    "End of file",
+    "Truncating packet",
+}
+
+/* Decides whether a failed step is worth trying again. The kind of a
+ * yt_dlp.Error or ffmpeg.Error is used when there is one, otherwise the
+ * message is matched against known errors. Errors that are not recognized are
+ * Retryable, ex. "HTTP Error 429" or a timeout, the number of attempts is
+ * limited by the caller anyways. A cancelled context is Permanent. */
+func Classify(err error) ErrorClass {
+    var permanent permanentError
+    if errors.As(err, &permanent) ||
+    errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+        return Permanent
+    }
+    var ytdlpErr *yt_dlp.Error
+    if errors.As(err, &ytdlpErr) {
+        switch ytdlpErr.Kind {
+        case yt_dlp.ErrorUnavailable, yt_dlp.ErrorSignIn, yt_dlp.ErrorUnsupportedURL,
+        yt_dlp.ErrorNotInstalled:
+            return Permanent
+        case yt_dlp.ErrorThrottled, yt_dlp.ErrorForbidden, yt_dlp.ErrorNetwork:
+            return Retryable
+        }
+    }
+    var ffmpegErr *ffmpeg.Error
+    if errors.As(err, &ffmpegErr) {
+        switch ffmpegErr.Kind {
+        case ffmpeg.ErrorInvalidInput, ffmpeg.ErrorMissingInput:
+            return BadDownload
+        case ffmpeg.ErrorUnsupported, ffmpeg.ErrorNotInstalled:
+            return Permanent
+        case ffmpeg.ErrorNoSpace:
+            return Retryable
+        }
+    }
+    msg := err.Error()
+    if containsAny(msg, permanentMessages) {
+        return Permanent
+    }
+    if containsAny(msg, badDownloadMessages) {
+        return BadDownload
+    }
+    return Retryable
+}
+
+/* Returns the kind of a yt_dlp.Error or ffmpeg.Error and the lines of
+ * output that explain it, or "" and nil for any other error */
+func ErrorDetails(err error) (string,[]string) {
+    var ytdlpErr *yt_dlp.Error
+    if errors.As(err, &ytdlpErr) {
+        return string(ytdlpErr.Kind), ytdlpErr.Messages
+    }
+    var ffmpegErr *ffmpeg.Error
+    if errors.As(err, &ffmpegErr) {
+        return string(ffmpegErr.Kind), ffmpegErr.Messages
+    }
+    return "", nil
+}
+
+// reports whether s contains any of the substrings, ignoring case
+func containsAny(s string, substrs []string) bool {
+    s = strings.ToLower(s)
+    for _,substr := range substrs {
+        if strings.Contains(s, strings.ToLower(substr)) {
+            return true
+        }
+    }
+    return false
+}
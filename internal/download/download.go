@@ -1,16 +1,20 @@
 package download
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
 	"path/filepath"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/TSchreiber/melo/internal/ffmpeg"
+	"github.com/TSchreiber/melo/internal/fingerprint"
 	spotify "github.com/TSchreiber/melo/internal/spotify_api"
 	youtube "github.com/TSchreiber/melo/internal/youtube_api"
-	yt_dlp "github.com/TSchreiber/melo/internal/yt_dlp"
 	"github.com/sosodev/duration"
 )
 
@@ -35,12 +39,16 @@ type searchResultsSong struct {
 type SearchResults struct {
     Videos []searchResultsVideo `json:"videos"`
     Songs  []searchResultsSong  `json:"songs"`
+    // The videos ranked for each song, see Suggest
+    Suggestions []Suggestion `json:"suggestions"`
 }
 
+/* Searches the enabled sources for videos and Spotify for songs, then ranks
+ * the videos for each song */
 func Search(query string) (SearchResults,error) {
     var out SearchResults
     var err error
-    out.Videos,err = ytSearch(query)
+    out.Videos,err = searchSources(context.Background(), query)
 
     var e error
     out.Songs,e = spotifySearch(query)
@@ -52,6 +60,7 @@ func Search(query string) (SearchResults,error) {
         }
     }
 
+    out.Suggestions = Suggest(out.Songs, out.Videos)
     return out,err
 }
 
@@ -77,29 +86,12 @@ func ytSearch(query string) ([]searchResultsVideo,error) {
     return videos,nil
 }
 
+// Fetches the details of the videos with a single request
 func getAllVideos(vids []string) ([]youtube.YouTubeVideo,error) {
-    wg := sync.WaitGroup{}
-    var videos []youtube.YouTubeVideo
-    var err error
-    f := func(vid string) {
-        defer wg.Done()
-        video,e := youtube.GetVideoDetails(vid)
-        if e != nil {
-            if err == nil {
-                err = e
-            } else {
-                err = fmt.Errorf("%w;%w", err, e)
-            }
-        } else {
-            videos = append(videos, video)
-        }
+    if len(vids) == 0 {
+        return nil, nil
     }
-    for _,vid := range(vids) {
-        wg.Add(1)
-        go f(vid)
-    }
-    wg.Wait()
-    return videos, err
+    return youtube.GetVideos(vids)
 }
 
 func youtubeVideoToSearchResultsVideo(yt_vid youtube.YouTubeVideo) searchResultsVideo {
@@ -168,7 +160,11 @@ func spotifyTrackToSearchResultsSong(track spotify.SpotifyTrack) searchResultsSo
     out.Title = track.Name
     out.Album = track.Album.Name
 
-    artwork := track.Album.Images[0].Url
+    // some tracks have no artwork
+    artwork := ""
+    if len(track.Album.Images) > 0 {
+        artwork = track.Album.Images[0].Url
+    }
     for _,a := range(track.Album.Images) {
         if a.Width >= 300 {
             artwork = a.Url
@@ -197,53 +193,284 @@ type Song struct {
     Album string `json:"album"`
     Artist string `json:"artist"`
     Artwork string `json:"artwork"`
+    // The track number on its album, 0 if unknown
+    Track int `json:"track,omitempty"`
     AudioUrl string `json:"audioUrl"`
+    // Duration of the audio in seconds
+    Duration int64 `json:"duration"`
+    Source string `json:"source"`
+    // The codec of the audio file, ex. "mp3"
+    Codec string `json:"codec"`
+    // The average bitrate of the audio file in bits per second
+    Bitrate int64 `json:"bitrate"`
+    // Size of the audio file in bytes
+    Size int64 `json:"size"`
+    // ReplayGain track gain in dB and peak as a linear amplitude, both are 0
+    // if the loudness could not be measured
+    Gain float64 `json:"gain"`
+    Peak float64 `json:"peak"`
+    // The acoustic fingerprint of the audio, nil if it could not be computed
+    Fingerprint fingerprint.Fingerprint `json:"fingerprint,omitempty"`
 }
 
+/* A song to download. The embedded ffmpeg.Options choose how the audio is
+ * encoded, ex. {"codec":"opus","bitrate":"128k"}, anything left out is taken
+ * from the defaults passed to ApplyDefaults. */
 type DownloadRequest struct {
     Title string `json:"title"`
     Album string `json:"album"`
     Artist string `json:"artist"`
     Artwork string `json:"artwork"`
     Source string `json:"source"`
+    // The expected duration in seconds, 0 if unknown. It is only used to find
+    // songs that are already in the library.
+    Duration int64 `json:"duration,omitempty"`
+    // The section of the source's audio that is the song, in seconds, ex. a
+    // chapter of a full album video. An End of 0 is the end of the audio
+    Start float64 `json:"start,omitempty"`
+    End float64 `json:"end,omitempty"`
+    // The song's track number on its album, 0 if unknown
+    Track int `json:"track,omitempty"`
+    ffmpeg.Options
+}
+
+// Reports whether the song is only a section of the source's audio
+func (req DownloadRequest) IsSection() bool {
+    return req.Start > 0 || req.End > 0
+}
+
+// Checks the encoding options and the section of the audio
+func (req DownloadRequest) Validate() error {
+    if req.Start < 0 || req.End < 0 || (req.End > 0 && req.End <= req.Start) {
+        return fmt.Errorf("Invalid section, from %gs to %gs", req.Start, req.End)
+    }
+    if req.Track < 0 {
+        return fmt.Errorf("Invalid track number, %d", req.Track)
+    }
+    return req.Options.Validate()
+}
+
+/* Fills in the encoding options that the request left out. The default
+ * bitrate and quality are only used when the request did not choose a
+ * different codec, since they rarely make sense for another codec. */
+func (req *DownloadRequest) ApplyDefaults(defaults ffmpeg.Options) {
+    if defaults.Codec == "" {
+        defaults.Codec = "mp3"
+    }
+    if req.Codec == "" || req.Codec == defaults.Codec {
+        req.Codec = defaults.Codec
+        if req.Bitrate == "" && req.Quality == "" {
+            req.Bitrate = defaults.Bitrate
+            req.Quality = defaults.Quality
+        }
+    }
+    if req.SampleRate == 0 {
+        req.SampleRate = defaults.SampleRate
+    }
 }
 
 type SongWriter interface {
     WriteSong(Song) error
 }
 
+/* Downloads the audio of req.Source and converts it with req.Options, which
+ * must be valid (see ApplyDefaults), to ./static/song/<video id>.<extension>.
+ * It is DownloadAudio followed by ConvertAudio and writeSong. */
 func Download(req DownloadRequest, writeSong func(Song) error,
 downloadProgressHandler, convertProgressHandler func(uint8)) error {
-    var downloader yt_dlp.Downloader
-    downloader.OnProgressUpdate(downloadProgressHandler)
-    downloader.DownloadAudio(req.Source)
-    downloader.Wait()
-    inputFile,err := downloader.GetFilepath()
+    err := req.Validate()
+    if err != nil {
+        return err
+    }
+    inputFile, err := DownloadAudio(context.Background(), req.Source, downloadProgressHandler)
     if err != nil {
-        return fmt.Errorf("Failed to download video: %w", err)
+        return err
+    }
+    song, err := ConvertAudio(context.Background(), inputFile, req, convertProgressHandler, nil)
+    if err != nil {
+        return err
+    }
+    err = writeSong(song)
+    if err != nil {
+        return fmt.Errorf("Failed to write song to database: %w", err)
+    }
+
+    return nil
+}
+
+/* Downloads the audio of source with the enabled source that handles it and
+ * returns the file's path. Cancelling ctx stops the download and removes what
+ * was written of it. */
+func DownloadAudio(ctx context.Context, source string, onProgressUpdate func(uint8)) (string,error) {
+    s, err := lookupSource(source)
+    if err != nil {
+        return "", err
+    }
+    return s.Fetch(ctx, source, onProgressUpdate)
+}
+
+/* Converts the downloaded audio, or the section of it that the request asks
+ * for, with req.Options, measures its loudness and tags it. The input file is
+ * removed once it has been converted. The returned song has not been written
+ * to the database yet. If ctx is cancelled the converted file is removed, the
+ * input file is only kept if the conversion had not finished. Problems that
+ * still leave a playable song, like a failed loudness measurement, are passed
+ * to onWarning, which may be nil. */
+func ConvertAudio(ctx context.Context, inputFile string, req DownloadRequest,
+onProgressUpdate func(uint8), onWarning func(error)) (Song,error) {
+    var song Song
+    err := req.Validate()
+    if err != nil {
+        return song, PermanentError(err)
     }
     fileBase := strings.TrimSuffix(filepath.Base(inputFile), filepath.Ext(inputFile))
-    outputFile := "./static/song/" + fileBase + ".mp3"
+    // a forced re-download gets a file of its own instead of overwriting the
+    // one that the existing song plays
+    outputFile, err := uniquePath("./static/song/" + fileBase + "." + ffmpeg.Codecs[req.Codec].Extension)
+    if err != nil {
+        return song, fmt.Errorf("Failed to pick the output file: %w", err)
+    }
 
     var converter ffmpeg.Converter
-    converter.OnProgressUpdate(convertProgressHandler)
-    converter.ConvertToMP3(inputFile, outputFile)
+    converter.OnProgressUpdate(onProgressUpdate)
+    converter.Cut(req.Start, req.End)
+    converter.ConvertContext(ctx, inputFile, outputFile, req.Options)
     converter.Wait()
     err = converter.Err()
     if err != nil {
-        return fmt.Errorf("Failed to convert audio: %w", err)
+        return song, fmt.Errorf("Failed to convert audio: %w", err)
+    }
+    err = os.Remove(inputFile)
+    if err != nil {
+        return song, fmt.Errorf("Failed to remove downloaded video: %w", err)
+    }
+    warn := func(err error) {
+        log.Printf("%s: %v\n", outputFile, err)
+        if onWarning != nil {
+            onWarning(err)
+        }
+    }
+    var gain, peak float64
+    loudness, err := ffmpeg.AnalyzeLoudness(ctx, outputFile)
+    if ctx.Err() != nil {
+        os.Remove(outputFile)
+        return song, ctx.Err()
+    }
+    if err != nil {
+        warn(fmt.Errorf("Failed to measure the loudness: %w", err))
+    } else {
+        gain, peak = loudness.TrackGain(), loudness.TrackPeak()
+    }
+    fp, err := fingerprint.FromFile(ctx, outputFile)
+    if ctx.Err() != nil {
+        os.Remove(outputFile)
+        return song, ctx.Err()
+    }
+    if err != nil {
+        // the song can't be checked for duplicates but is otherwise fine
+        warn(fmt.Errorf("Failed to fingerprint the audio: %w", err))
+    }
+    err = TagFile(outputFile, ffmpeg.Tags{
+        Title: req.Title,
+        Artist: req.Artist,
+        Album: req.Album,
+        Track: req.Track,
+        Gain: gain,
+        Peak: peak,
+    }, req.Artwork)
+    if err != nil {
+        // the song is still playable without tags
+        warn(fmt.Errorf("Failed to tag the song: %w", err))
+    }
+    if ctx.Err() != nil {
+        os.Remove(outputFile)
+        return song, ctx.Err()
+    }
+    info, err := ffmpeg.Probe(outputFile)
+    if err != nil {
+        return song, fmt.Errorf("Failed to probe converted audio: %w", err)
     }
 
-    var song Song
     song.Title = req.Title
     song.Album = req.Album
     song.Artist = req.Artist
     song.Artwork = req.Artwork
+    song.Track = req.Track
     song.AudioUrl = "/song/" + filepath.Base(outputFile)
-    err = writeSong(song)
-    if err != nil {
-        return fmt.Errorf("Failed to write song to database: %w", err)
+    song.Duration = int64(converter.Duration() / 1000)
+    song.Source = SourceId(req.Source)
+    song.Codec = info.Codec
+    song.Bitrate = info.Bitrate
+    song.Size = info.Size
+    song.Gain = gain
+    song.Peak = peak
+    song.Fingerprint = fp
+    return song, nil
+}
+
+// The path of the song's audio file, the inverse of the AudioUrl given by ConvertAudio
+func SongFile(song Song) string {
+    return "./static/song/" + filepath.Base(song.AudioUrl)
+}
+
+/* Writes the tags into the audio file along with the artwork at artworkURL
+ * as its cover. The file is still tagged if the artwork can not be fetched. */
+func TagFile(fileName string, tags ffmpeg.Tags, artworkURL string) error {
+    artworkFile := ""
+    if strings.HasPrefix(artworkURL, "https://") || strings.HasPrefix(artworkURL, "http://") {
+        var err error
+        artworkFile, err = fetchArtwork(artworkURL)
+        if err != nil {
+            log.Printf("Failed to fetch artwork for %s: %v\n", fileName, err)
+        } else {
+            defer os.Remove(artworkFile)
+        }
     }
+    return ffmpeg.WriteTags(fileName, tags, artworkFile)
+}
 
-    return nil
+// Artwork larger than this is not embedded
+const maxArtworkSize = 10 << 20
+
+var artworkClient = http.Client{ Timeout: 15 * time.Second }
+
+// Downloads the JPEG or PNG image to a temporary file and returns its path
+func fetchArtwork(url string) (string,error) {
+    res, err := artworkClient.Get(url)
+    if err != nil {
+        return "", err
+    }
+    defer res.Body.Close()
+    if res.StatusCode != http.StatusOK {
+        return "", fmt.Errorf("fetchArtwork %s: %s", url, res.Status)
+    }
+    b, err := io.ReadAll(io.LimitReader(res.Body, maxArtworkSize + 1))
+    if err != nil {
+        return "", err
+    }
+    if len(b) > maxArtworkSize {
+        return "", fmt.Errorf("fetchArtwork %s: larger than %d bytes", url, maxArtworkSize)
+    }
+    var ext string
+    switch http.DetectContentType(b) {
+    case "image/jpeg":
+        ext = ".jpg"
+    case "image/png":
+        ext = ".png"
+    default:
+        return "", fmt.Errorf("fetchArtwork %s: not a JPEG or PNG image", url)
+    }
+    f, err := os.CreateTemp("", "melo-artwork-*" + ext)
+    if err != nil {
+        return "", err
+    }
+    _, err = f.Write(b)
+    if e := f.Close(); err == nil {
+        err = e
+    }
+    if err != nil {
+        os.Remove(f.Name())
+        return "", err
+    }
+    return f.Name(), nil
 }
@@ -1,17 +1,226 @@
 package download
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+
+	"github.com/TSchreiber/melo/internal/fakebin"
+	"github.com/TSchreiber/melo/internal/ffmpeg"
+	spotify "github.com/TSchreiber/melo/internal/spotify_api"
+	youtube "github.com/TSchreiber/melo/internal/youtube_api"
+	yt_dlp "github.com/TSchreiber/melo/internal/yt_dlp"
 )
 
+/* Runs the tests in a temporary directory, where the songs are written to
+ * ./static/song, with the fake yt-dlp and ffmpeg from package fakebin */
+func TestMain(m *testing.M) {
+    dir, err := os.MkdirTemp("", "melo-download-test-")
+    if err != nil {
+        panic(err)
+    }
+    paths, err := fakebin.Build(dir)
+    if err != nil {
+        panic(err)
+    }
+    yt_dlp.Path = paths.YtDlp
+    ffmpeg.FFmpegPath = paths.FFmpeg
+    ffmpeg.FFprobePath = paths.FFprobe
+    err = os.MkdirAll(filepath.Join(dir, "static", "song"), 0755)
+    if err != nil {
+        panic(err)
+    }
+    err = os.Chdir(dir)
+    if err != nil {
+        panic(err)
+    }
+    code := m.Run()
+    os.RemoveAll(dir)
+    os.Exit(code)
+}
+
+// The videos served by newTestAPIServer, and the videos found by each search
+var (
+    testVideos = map[string]struct{ title, channel, duration string }{
+        "rsvKskQcFD4": { "IU - You & I", "WINGCR", "PT4M1S" },
+        "liveYouAndI": { "IU - You & I (Live at the Olympic Hall)", "KBS Kpop", "PT4M48S" },
+        "goodDay0000": { "Good Day", "IU - Topic", "PT3M54S" },
+        "goodDayCovr": { "Good Day - IU (Piano Cover)", "Pianist", "PT3M50S" },
+    }
+    testSearches = map[string][]string{
+        "You & I - IU audio": { "rsvKskQcFD4" },
+        "IU - You & I audio": { "liveYouAndI", "rsvKskQcFD4" },
+        "IU - Good Day audio": { "goodDayCovr", "goodDay0000" },
+    }
+)
+
+// Serves canned YouTube Data API and Spotify API responses
+func newTestAPIServer(t *testing.T) {
+    var server *httptest.Server
+    mux := http.NewServeMux()
+    mux.HandleFunc("/youtube/search", func(w http.ResponseWriter, r *http.Request) {
+        ids, ok := testSearches[r.URL.Query().Get("q")]
+        if r.URL.Query().Get("key") != "test-key" || !ok {
+            w.WriteHeader(http.StatusBadRequest)
+            return
+        }
+        var items []string
+        for _,id := range ids {
+            items = append(items, fmt.Sprintf(`{"id":{"kind":"youtube#video","videoId":%q}}`, id))
+        }
+        fmt.Fprintf(w, `{"items":[%s]}`, strings.Join(items, ","))
+    })
+    mux.HandleFunc("/youtube/videos", func(w http.ResponseWriter, r *http.Request) {
+        var items []string
+        for _,id := range strings.Split(r.URL.Query().Get("id"), ",") {
+            video, ok := testVideos[id]
+            if !ok {
+                continue
+            }
+            items = append(items, fmt.Sprintf(`{"id":%q,"snippet":{"publishedAt":"2011-11-28T15:15:46Z",
+                "title":%q,"thumbnails":{"default":{"url":"https://i.ytimg.com/default.jpg"},
+                "medium":{"url":"https://i.ytimg.com/mqdefault.jpg"}},"channelTitle":%q},
+                "contentDetails":{"duration":%q},"statistics":{"viewCount":"6715524"}}`,
+                id, video.title, video.channel, video.duration))
+        }
+        fmt.Fprintf(w, `{"items":[%s]}`, strings.Join(items, ","))
+    })
+    mux.HandleFunc("/spotify/api/token", func(w http.ResponseWriter, r *http.Request) {
+        fmt.Fprint(w, `{"access_token":"test-token","token_type":"Bearer","expires_in":3600}`)
+    })
+    mux.HandleFunc("/spotify/v1/search", func(w http.ResponseWriter, r *http.Request) {
+        if r.Header.Get("Authorization") != "Bearer test-token" {
+            w.WriteHeader(http.StatusUnauthorized)
+            return
+        }
+        fmt.Fprint(w, `{"tracks":{"items":[{"id":"1","name":"You & I","duration_ms":241000,
+            "album":{"name":"Last Fantasy","images":[{"url":"https://i.scdn.co/640","width":640},
+            {"url":"https://i.scdn.co/300","width":300}]},"artists":[{"name":"IU"}]}]}}`)
+    })
+    // the tracks are on two pages, with a local file, an unavailable track and
+    // an episode that are left out
+    mux.HandleFunc("/spotify/v1/playlists/PL1", func(w http.ResponseWriter, r *http.Request) {
+        fmt.Fprintf(w, `{"id":"PL1","name":"IU Mix","description":"Songs by IU",
+            "images":[{"url":"https://i.scdn.co/mix","width":640}],"owner":{"display_name":"Fan"},
+            "tracks":{"items":[
+                {"is_local":false,"track":{"type":"track","id":"1","name":"You & I","duration_ms":241000,
+                    "album":{"name":"Last Fantasy","images":[]},"artists":[{"name":"IU"}]}},
+                {"is_local":true,"track":{"type":"track","id":null,"name":"My Demo"}},
+                {"is_local":false,"track":null}
+            ],"next":"%s/spotify/v1/playlists/PL1/tracks?offset=3"}}`, server.URL)
+    })
+    mux.HandleFunc("/spotify/v1/playlists/PL1/tracks", func(w http.ResponseWriter, r *http.Request) {
+        fmt.Fprint(w, `{"items":[
+            {"is_local":false,"track":{"type":"episode","id":"e","name":"A Podcast"}},
+            {"is_local":false,"track":{"type":"track","id":"2","name":"Good Day","duration_ms":233000,
+                "album":{"name":"Real","images":[{"url":"https://i.scdn.co/real","width":300}]},
+                "artists":[{"name":"IU"}]}},
+            {"is_local":false,"track":{"type":"track","id":"3","name":"Unsearchable","duration_ms":1000,
+                "album":{"name":"","images":[]},"artists":[{"name":"Nobody"}]}}
+        ],"next":null}`)
+    })
+    server = httptest.NewServer(mux)
+    t.Cleanup(server.Close)
+
+    t.Setenv("MELO_YT_API_KEY", "test-key")
+    t.Setenv("SPOTIFY_API_CLIENT_ID", "test-id")
+    t.Setenv("SPOTIFY_API_CLIENT_SECRET", "test-secret")
+    apis := []struct{ url *string; test string }{
+        { &youtube.BaseURL, server.URL + "/youtube" },
+        { &spotify.AccountsURL, server.URL + "/spotify" },
+        { &spotify.BaseURL, server.URL + "/spotify/v1" },
+    }
+    for _,api := range apis {
+        original := *api.url
+        *api.url = api.test
+        t.Cleanup(func() { *api.url = original })
+    }
+    token = spotify.AuthToken{}
+}
+
 func TestSearch(t *testing.T) {
-    results,err := Search("YOU&I - IU")
+    newTestAPIServer(t)
+    results,err := Search("You & I - IU")
     if err != nil {
         t.Fatal(err)
     }
-    bytes,_ := json.Marshal(results)
-    t.Log(string(bytes))
+    if len(results.Videos) != 1 || results.Videos[0].Id != "rsvKskQcFD4" ||
+    results.Videos[0].Duration != 241 || results.Videos[0].Thumbnail != "https://i.ytimg.com/mqdefault.jpg" {
+        t.Errorf("Expected the video, got %+v", results.Videos)
+    }
+    if len(results.Songs) != 1 || results.Songs[0].Artist != "IU" ||
+    results.Songs[0].Artwork != "https://i.scdn.co/640" || results.Songs[0].Duration != 241 {
+        t.Errorf("Expected the song, got %+v", results.Songs)
+    }
+    if len(results.Suggestions) != 1 || len(results.Suggestions[0].Videos) != 1 ||
+    results.Suggestions[0].Videos[0].Id != "rsvKskQcFD4" || results.Suggestions[0].Videos[0].Confidence < 0.8 {
+        t.Errorf("Expected the video to be suggested for the song, got %+v", results.Suggestions)
+    }
+}
+
+func TestScoreMatch(t *testing.T) {
+    song := searchResultsSong{ Title: "Blinding Lights", Artist: "The Weeknd", Duration: 200 }
+    video := func(title, channel string, duration int64) searchResultsVideo {
+        return searchResultsVideo{ Title: title, ChannelTitle: channel, Duration: duration }
+    }
+    // most likely first
+    videos := []struct{ name string; video searchResultsVideo }{
+        { "topic", video("Blinding Lights", "The Weeknd - Topic", 201) },
+        { "vevo", video("The Weeknd - Blinding Lights (Official Audio)", "TheWeekndVEVO", 203) },
+        { "fan upload", video("The Weeknd - Blinding Lights", "Music Fan", 200) },
+        { "long video", video("The Weeknd - Blinding Lights (Official Video)", "TheWeekndVEVO", 263) },
+        { "remix", video("The Weeknd - Blinding Lights (Major Lazer Remix)", "Music Fan", 200) },
+        { "live", video("The Weeknd - Blinding Lights (Live)", "Music Fan", 230) },
+        { "other song", video("The Weeknd - Save Your Tears", "The Weeknd - Topic", 215) },
+    }
+    prev := 2.0
+    for _,v := range videos {
+        score := ScoreMatch(song, v.video)
+        if score.Confidence >= prev {
+            t.Errorf("Expected %s to score below %.2f, got %+v", v.name, prev, score)
+        }
+        prev = score.Confidence
+    }
+
+    if score := ScoreMatch(song, videos[0].video); score.Confidence < 0.95 || score.Channel != 1 {
+        t.Errorf("Expected the topic channel to be a sure match, got %+v", score)
+    }
+    other := ScoreMatch(searchResultsSong{ Title: "Blinding Lights", Artist: "Someone" }, videos[0].video)
+    if other.Channel != 0.5 || other.Artist != 0 || other.Duration != 0.5 {
+        t.Errorf("Expected another artist's topic channel to count for less, got %+v", other)
+    }
+    if score := ScoreMatch(song, videos[4].video); score.Penalty < 0.35 {
+        t.Errorf("Expected a remix to be penalized, got %+v", score)
+    }
+    // the song is the live version
+    live := searchResultsSong{ Title: "Blinding Lights - Live", Artist: "The Weeknd", Duration: 230 }
+    if score := ScoreMatch(live, videos[5].video); score.Penalty != 0 || score.Confidence < 0.8 {
+        t.Errorf("Expected the live video to match the live song, got %+v", score)
+    }
+    // extra artists and remasters don't count against the title
+    feat := searchResultsSong{ Title: "Save Your Tears (feat. Ariana Grande) - 2021 Remaster",
+        Artist: "The Weeknd,Ariana Grande", Duration: 215 }
+    if score := ScoreMatch(feat, videos[6].video); score.Title != 1 || score.Confidence < 0.95 {
+        t.Errorf("Expected the featured song to match, got %+v", score)
+    }
+
+    suggestions := Suggest([]searchResultsSong{ song, feat }, []searchResultsVideo{
+        videos[6].video, videos[5].video, videos[0].video })
+    if len(suggestions) != 2 || suggestions[0].Song != 0 || suggestions[1].Song != 1 ||
+    len(suggestions[0].Videos) != 3 || suggestions[0].Videos[0].Confidence != ScoreMatch(song, videos[0].video).Confidence ||
+    suggestions[1].Videos[0].Confidence != ScoreMatch(feat, videos[6].video).Confidence {
+        t.Errorf("Expected the videos to be ranked for each song, got %+v", suggestions)
+    }
 }
 
 func TestDownload(t *testing.T) {
@@ -20,27 +229,546 @@ func TestDownload(t *testing.T) {
     {
       "title": "Sand In My Boots",
       "album": "Dangerous: The Double Album",
-      "artwork": "https://i.scdn.co/image/ab67616d0000b2737d6813fd233f3bc4977cceca",
       "artist": "Morgan Wallen",
       "source": "FXzE9eP1U_E"
     }`), &req)
+    req.ApplyDefaults(ffmpeg.Options{})
 
+    var written []Song
     writeSong := func(song Song) error {
-        s,_ := json.Marshal(song)
-        t.Logf("Writing song to database: %s", s)
+        written = append(written, song)
         return nil
     }
-
+    var downloadProgress, convertProgress []uint8
     downloadProgressHandler := func(progress uint8) {
-        t.Logf("Downloading [%3d%%]", progress)
+        downloadProgress = append(downloadProgress, progress)
     }
-
     convertProgressHandler := func(progress uint8) {
-        t.Logf("Extracting [%3d%%]", progress)
+        convertProgress = append(convertProgress, progress)
     }
 
     err := Download(req, writeSong, downloadProgressHandler, convertProgressHandler)
     if err != nil {
         t.Fatalf("Download failed: %v", err)
     }
+    if len(written) != 1 {
+        t.Fatalf("Expected a song to be written, got %v", written)
+    }
+    song := written[0]
+    if song.AudioUrl != "/song/FXzE9eP1U_E.mp3" || song.Title != req.Title || song.Duration != 3 ||
+    song.Codec != "mp3" || song.Bitrate != 128000 || song.Source != "youtube:" + req.Source {
+        t.Errorf("Expected the converted song, got %+v", song)
+    }
+    // -11 LUFS is 7 dB louder than the reference
+    if song.Gain != -7 {
+        t.Errorf("Expected a gain of -7 dB, got %v", song.Gain)
+    }
+    // the fake ffmpeg decodes every file to 10 seconds of audio
+    if d := song.Fingerprint.Duration(); d < 9 || d > 10 {
+        t.Errorf("Expected the fingerprint of 10 seconds of audio, got %.2f seconds", d)
+    }
+    if _, err := os.Stat(SongFile(song)); err != nil {
+        t.Errorf("Expected the song file to exist: %v", err)
+    }
+    if _, err := os.Stat("FXzE9eP1U_E.opus"); !os.IsNotExist(err) {
+        t.Errorf("Expected the downloaded file to be removed, got %v", err)
+    }
+    if fmt.Sprint(downloadProgress) != "[0 12 37 64 100]" || fmt.Sprint(convertProgress) != "[0 50 100]" {
+        t.Errorf("Expected the progress of both steps, got %v and %v", downloadProgress, convertProgress)
+    }
+}
+
+func TestDownloadErrors(t *testing.T) {
+    req := DownloadRequest{ Title: "Test", Options: ffmpeg.Options{ Codec: "mp3" } }
+    writeSong := func(Song) error {
+        t.Error("Expected no song to be written")
+        return nil
+    }
+    tests := []struct{
+        source string
+        kind string
+        class ErrorClass
+    }{
+        { "unavailable", "unavailable", Permanent },
+        { "throttled01", "throttled", Retryable },
+        { "crash000001", "unknown", Retryable },
+        { "corrupt0001", "invalid-input", BadDownload },
+    }
+    for _,test := range tests {
+        req.Source = test.source
+        err := Download(req, writeSong, nil, nil)
+        if err == nil {
+            t.Errorf("Download %s: expected an error", test.source)
+            continue
+        }
+        kind, diagnostics := ErrorDetails(err)
+        if kind != test.kind || len(diagnostics) == 0 || Classify(err) != test.class {
+            t.Errorf("Download %s: expected a %s error, got %s %v: %v", test.source,
+                test.kind, kind, diagnostics, err)
+        }
+    }
+    // the corrupt download is kept so that the caller can decide what to do with it
+    os.Remove("corrupt0001.opus")
+
+    ctx, cancel := context.WithCancel(context.Background())
+    var once sync.Once
+    _, err := DownloadAudio(ctx, "slow0000001", func(uint8) {
+        once.Do(cancel)
+    })
+    if !errors.Is(err, context.Canceled) {
+        t.Errorf("Expected the download to be cancelled, got %v", err)
+    }
+    entries, _ := os.ReadDir(".")
+    for _,entry := range entries {
+        if strings.HasPrefix(entry.Name(), "slow") {
+            t.Errorf("Expected the partial download to be removed, found %s", entry.Name())
+        }
+    }
+}
+
+func TestPreviewPlaylist(t *testing.T) {
+    preview, err := PreviewPlaylist(context.Background(), "https://www.youtube.com/playlist?list=PLfake")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if preview.Title != "Fake Mix" || preview.Uploader != "Fake Uploader" || len(preview.Entries) != 3 {
+        t.Fatalf("Expected the playlist without the channel tab, got %+v", preview)
+    }
+    expected := []PlaylistEntry{
+        {
+            DownloadRequest: DownloadRequest{ Title: "You & I", Artist: "IU", Source: "aaaaaaaaaaa",
+                Artwork: "https://i.ytimg.com/vi/aaaaaaaaaaa/hqdefault.jpg", Duration: 241 },
+            VideoTitle: "IU - You & I (Official Audio)",
+        },
+        {
+            DownloadRequest: DownloadRequest{ Title: "Good Day", Artist: "IU", Source: "bbbbbbbbbbb",
+                Duration: 233 },
+            VideoTitle: "Good Day",
+        },
+        {
+            DownloadRequest: DownloadRequest{ Title: "Track", Artist: "Fake Artist",
+                Source: "https://soundcloud.com/fake/track", Duration: 180 },
+            VideoTitle: "Track",
+        },
+    }
+    for i,entry := range preview.Entries {
+        if entry != expected[i] {
+            t.Errorf("Entry %d: expected %+v, got %+v", i, expected[i], entry)
+        }
+    }
+
+    _, err = PreviewPlaylist(context.Background(), "https://example.com/not-a-playlist")
+    var ytErr *yt_dlp.Error
+    if !errors.As(err, &ytErr) || ytErr.Kind != yt_dlp.ErrorUnsupportedURL {
+        t.Errorf("Expected an unsupported URL error, got %v", err)
+    }
+}
+
+func TestPreviewChapters(t *testing.T) {
+    preview, err := PreviewChapters(context.Background(), "albumLovePm")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if preview.Title != "Love poem" || preview.Uploader != "IU Official" || len(preview.Entries) != 3 {
+        t.Fatalf("Expected the album's 3 chapters, got %+v", preview)
+    }
+    artwork := "https://i.ytimg.com/vi/albumLovePm/maxresdefault.jpg"
+    expected := []PlaylistEntry{
+        {
+            DownloadRequest: DownloadRequest{ Title: "unlucky", Artist: "IU", Album: "Love poem",
+                Artwork: artwork, Source: "albumLovePm", Duration: 200, End: 200.5, Track: 1 },
+            VideoTitle: "01. unlucky",
+        },
+        {
+            DownloadRequest: DownloadRequest{ Title: "The visitor", Artist: "IU", Album: "Love poem",
+                Artwork: artwork, Source: "albumLovePm", Duration: 199, Start: 200.5, End: 400, Track: 2 },
+            VideoTitle: "2 - The visitor",
+        },
+        {
+            DownloadRequest: DownloadRequest{ Title: "7 rings", Artist: "IU & Someone", Album: "Love poem",
+                Artwork: artwork, Source: "albumLovePm", Duration: 200, Start: 400, End: 600, Track: 3 },
+            VideoTitle: "IU & Someone - 7 rings",
+        },
+    }
+    for i,entry := range preview.Entries {
+        if entry != expected[i] {
+            t.Errorf("Entry %d: expected %+v, got %+v", i, expected[i], entry)
+        }
+    }
+
+    _, err = PreviewChapters(context.Background(), "aaaaaaaaaaa")
+    if !errors.Is(err, ErrNoChapters) {
+        t.Errorf("Expected ErrNoChapters for a video without chapters, got %v", err)
+    }
+}
+
+func TestDownloadSection(t *testing.T) {
+    req := DownloadRequest{ Title: "The visitor", Album: "Love poem", Artist: "IU",
+        Source: "sectionTest", Start: 1, End: 2.5, Track: 2 }
+    req.ApplyDefaults(ffmpeg.Options{})
+    var written []Song
+    err := Download(req, func(song Song) error {
+        written = append(written, song)
+        return nil
+    }, nil, nil)
+    if err != nil {
+        t.Fatalf("Download failed: %v", err)
+    }
+    // the fake audio is 3.5 seconds long
+    if len(written) != 1 || written[0].Duration != 1 || written[0].Track != 2 {
+        t.Errorf("Expected the 1.5 seconds of the section as track 2, got %+v", written)
+    }
+
+    for _,section := range [][2]float64{ { -1, 0 }, { 2, 1 }, { 2, 2 } } {
+        req.Start, req.End = section[0], section[1]
+        if req.Validate() == nil {
+            t.Errorf("Expected the section from %v to %v to be invalid", req.Start, req.End)
+        }
+    }
+    // a section that starts after the end of the audio can't be converted
+    req.Start, req.End = 5, 0
+    err = Download(req, func(Song) error { return nil }, nil, nil)
+    if err == nil {
+        t.Errorf("Expected a section outside of the audio to fail")
+    }
+}
+
+func TestResolve(t *testing.T) {
+    tests := []struct{
+        ref string
+        expected DownloadRequest
+    }{
+        { "rsvKskQcFD4", DownloadRequest{ Title: "You & I", Artist: "IU", Source: "rsvKskQcFD4",
+            Artwork: "https://i.ytimg.com/vi/rsvKskQcFD4/hqdefault.jpg", Duration: 241 } },
+        // YouTube knows the track, artist and album of a topic channel's upload
+        { "topicGoodDy", DownloadRequest{ Title: "Good Day", Artist: "IU", Album: "Real",
+            Source: "topicGoodDy", Artwork: "https://i.ytimg.com/vi/topicGoodDy/maxresdefault.jpg",
+            Duration: 233 } },
+    }
+    for _,test := range tests {
+        req, err := Resolve(context.Background(), test.ref)
+        if err != nil {
+            t.Errorf("Resolve %s: %v", test.ref, err)
+        } else if req != test.expected {
+            t.Errorf("Resolve %s: expected %+v, got %+v", test.ref, test.expected, req)
+        }
+    }
+    _, err := Resolve(context.Background(), "unavailable")
+    if Classify(err) != Permanent {
+        t.Errorf("Expected a permanent error for a removed video, got %v", err)
+    }
+}
+
+func TestHTTPSource(t *testing.T) {
+    content := strings.Repeat("audio of song.mp3 ", 1000)
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path != "/music/song.mp3" {
+            http.NotFound(w, r)
+            return
+        }
+        w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+        w.Write([]byte(content))
+    }))
+    defer server.Close()
+    defer EnableSources(SourcesConfig{})
+    if err := EnableSources(SourcesConfig{ Enabled: []string{ "youtube", "http" } }); err != nil {
+        t.Fatal(err)
+    }
+
+    ref := server.URL + "/music/song.mp3?token=abc"
+    if _, ok := mustLookupSource(t, ref).(httpSource); !ok {
+        t.Errorf("Expected the http source to handle %s", ref)
+    }
+    if _, ok := mustLookupSource(t, "https://www.youtube.com/watch?v=rsvKskQcFD4").(youtubeSource); !ok {
+        t.Errorf("Expected the youtube source to handle a YouTube URL")
+    }
+    if _, ok := mustLookupSource(t, "-ZClicWm0zM").(youtubeSource); !ok {
+        t.Errorf("Expected the youtube source to handle an id that starts with -")
+    }
+    for _,ref := range []string{ server.URL + "/watch?v=rsvKskQcFD4", "--exec=touch x",
+    "song", "https://youtube.com.example.com/watch?v=rsvKskQcFD4" } {
+        if _, err := lookupSource(ref); !errors.Is(err, ErrNoSource) {
+            t.Errorf("Expected no source to handle %q, got %v", ref, err)
+        }
+    }
+
+    req, err := Resolve(context.Background(), ref)
+    if err != nil || req.Title != "song" || req.Source != ref {
+        t.Errorf("Expected the file's name as its title, got %+v, %v", req, err)
+    }
+
+    // the test server is on a loopback address, which the source refuses
+    _, err = DownloadAudio(context.Background(), ref, nil)
+    if !errors.Is(err, ErrPrivateAddress) || Classify(err) != Permanent {
+        t.Errorf("Expected a permanent error for a loopback address, got %v", err)
+    }
+    redirect := &http.Request{ URL: &url.URL{ Scheme: "http", Host: "169.254.169.254", Path: "/x.mp3" } }
+    if err := checkRedirect(redirect, nil); !errors.Is(err, ErrPrivateAddress) {
+        t.Errorf("Expected a redirect to a link-local address to be refused, got %v", err)
+    }
+    for _,ip := range []string{ "100.64.0.1", "0.0.0.1", "198.18.0.1", "::ffff:100.64.0.1",
+    "127.0.0.1", "10.1.2.3", "fe80::1" } {
+        if isPublicIP(net.ParseIP(ip)) {
+            t.Errorf("Expected %s to be refused", ip)
+        }
+    }
+    if !isPublicIP(net.ParseIP("93.184.216.34")) || !isPublicIP(net.ParseIP("2606:2800:220:1::1")) {
+        t.Errorf("Expected public addresses to be allowed")
+    }
+    redirect.URL.Host = "100.64.0.1"
+    if err := checkRedirect(redirect, nil); !errors.Is(err, ErrPrivateAddress) {
+        t.Errorf("Expected a redirect to a carrier-grade NAT address to be refused, got %v", err)
+    }
+    redirect.URL.Host = "example.com"
+    if err := checkRedirect(redirect, nil); err != nil {
+        t.Errorf("Expected a redirect to a public name to be followed, got %v", err)
+    }
+
+    source := httpSource{ server.Client() }
+    var progress []uint8
+    file, err := source.Fetch(context.Background(), ref, func(p uint8) {
+        progress = append(progress, p)
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.Remove(file)
+    b, _ := os.ReadFile(file)
+    if filepath.Base(file) != "song.mp3" || string(b) != content {
+        t.Errorf("Expected the file to be downloaded to song.mp3, got %s (%d bytes)", file, len(b))
+    }
+    if len(progress) < 2 || progress[0] != 0 || progress[len(progress) - 1] != 100 {
+        t.Errorf("Expected progress from 0 to 100, got %v", progress)
+    }
+
+    _, err = source.Fetch(context.Background(), server.URL + "/music/gone.mp3", nil)
+    if err == nil || Classify(err) != Permanent {
+        t.Errorf("Expected a permanent error for a missing file, got %v", err)
+    }
+    if _, err := os.Stat("gone.mp3"); !os.IsNotExist(err) {
+        t.Errorf("Expected nothing to be written for a missing file, got %v", err)
+    }
+}
+
+func TestFileSource(t *testing.T) {
+    defer EnableSources(SourcesConfig{})
+    dir := t.TempDir()
+    err := EnableSources(SourcesConfig{ Enabled: []string{ "youtube", "file" }, FileDirectory: dir })
+    if err != nil {
+        t.Fatal(err)
+    }
+    // the sources keep the order that they were registered in
+    if names := EnabledSources(); fmt.Sprint(names) != "[file youtube]" {
+        t.Errorf("Expected the file and youtube sources, got %v", names)
+    }
+
+    song := filepath.Join(dir, "Album", "01 Song.flac")
+    os.MkdirAll(filepath.Dir(song), 0755)
+    os.WriteFile(song, []byte("audio of 01 Song.flac"), 0644)
+    req, err := Resolve(context.Background(), song)
+    if err != nil || req.Title != "01 Song" || req.Duration != 3 {
+        t.Errorf("Expected the file's name and duration, got %+v, %v", req, err)
+    }
+    file, err := DownloadAudio(context.Background(), "file://" + filepath.ToSlash(song), nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.Remove(file)
+    if b, _ := os.ReadFile(file); string(b) != "audio of 01 Song.flac" {
+        t.Errorf("Expected a copy of the file, got %q", b)
+    }
+    if _, err := os.Stat(song); err != nil {
+        t.Errorf("Expected the original file to be kept: %v", err)
+    }
+
+    outside := filepath.Join(t.TempDir(), "secret.mp3")
+    os.WriteFile(outside, []byte("audio of secret.mp3"), 0644)
+    for _,ref := range []string{ outside, filepath.Join(dir, "..", filepath.Base(filepath.Dir(outside)), "secret.mp3"),
+    filepath.Join(dir, "missing.mp3") } {
+        _, err = DownloadAudio(context.Background(), ref, nil)
+        if Classify(err) != Permanent {
+            t.Errorf("Download %s: expected a permanent error, got %v", ref, err)
+        }
+    }
+
+    if EnableSources(SourcesConfig{ Enabled: []string{ "file" } }) == nil {
+        t.Errorf("Expected the file source to require a directory")
+    }
+    if EnableSources(SourcesConfig{ Enabled: []string{ "ftp" } }) == nil {
+        t.Errorf("Expected an error for an unknown source")
+    }
+    if names := EnabledSources(); fmt.Sprint(names) != "[file youtube]" {
+        t.Errorf("Expected a failed EnableSources to change nothing, got %v", names)
+    }
+
+    EnableSources(SourcesConfig{ Enabled: []string{ "file" }, FileDirectory: dir })
+    _, err = DownloadAudio(context.Background(), "rsvKskQcFD4", nil)
+    if !errors.Is(err, ErrNoSource) || Classify(err) != Permanent {
+        t.Errorf("Expected no source to handle a video with youtube disabled, got %v", err)
+    }
+}
+
+func mustLookupSource(t *testing.T, ref string) Source {
+    t.Helper()
+    source, err := lookupSource(ref)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return source
+}
+
+func TestSplitVideoTitle(t *testing.T) {
+    cases := []struct{ videoTitle, artist, title string }{
+        { "IU - You & I", "IU", "You & I" },
+        { "IU - Good Day (Official Music Video) [4K]", "IU", "Good Day" },
+        { "Blueming (feat. Someone) (Lyrics)", "", "Blueming (feat. Someone)" },
+        { "Love wins all (Live)", "", "Love wins all (Live)" },
+        { "IU - Love poem (Full Album)", "IU", "Love poem" },
+    }
+    for _,c := range cases {
+        artist, title := splitVideoTitle(c.videoTitle)
+        if artist != c.artist || title != c.title {
+            t.Errorf("%q: expected %q, %q, got %q, %q", c.videoTitle, c.artist, c.title, artist, title)
+        }
+    }
+}
+
+func TestMatchSpotifyPlaylist(t *testing.T) {
+    newTestAPIServer(t)
+    matches, err := MatchSpotifyPlaylist(context.Background(),
+        "https://open.spotify.com/playlist/PL1?si=abc")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if matches.Title != "IU Mix" || matches.Artwork != "https://i.scdn.co/mix" || len(matches.Tracks) != 3 {
+        t.Fatalf("Expected the playlist's 3 tracks, got %+v", matches)
+    }
+    // the studio version beats the live one and the topic channel beats the
+    // cover, even though they were found second
+    youAndI, goodDay, unsearchable := matches.Tracks[0], matches.Tracks[1], matches.Tracks[2]
+    if youAndI.SpotifyId != "1" || len(youAndI.Candidates) != 2 ||
+    youAndI.Candidates[0].Video.Id != "rsvKskQcFD4" || youAndI.Candidates[0].Confidence < 0.8 {
+        t.Errorf("Expected a confident match for You & I, got %+v", youAndI)
+    }
+    if goodDay.Track.Artwork != "https://i.scdn.co/real" || len(goodDay.Candidates) != 2 ||
+    goodDay.Candidates[0].Video.Id != "goodDay0000" || goodDay.Candidates[0].Confidence < 0.8 ||
+    goodDay.Candidates[1].Confidence > goodDay.Candidates[0].Confidence - 0.15 {
+        t.Errorf("Expected a confident match for Good Day, got %+v", goodDay)
+    }
+    if unsearchable.Error == "" || len(unsearchable.Candidates) != 0 {
+        t.Errorf("Expected the failed search to be reported, got %+v", unsearchable)
+    }
+
+    _, err = MatchSpotifyPlaylist(context.Background(), "https://open.spotify.com/playlist/missing")
+    if !errors.Is(err, spotify.ErrNotFound) {
+        t.Errorf("Expected ErrNotFound for a missing playlist, got %v", err)
+    }
+    _, err = MatchSpotifyPlaylist(context.Background(), "https://example.com/playlist/PL1")
+    if !errors.Is(err, ErrInvalidLink) {
+        t.Errorf("Expected ErrInvalidLink for another site, got %v", err)
+    }
+}
+
+func TestSourceId(t *testing.T) {
+    tests := []struct{ source, id string }{
+        { "dQw4w9WgXcQ", "youtube:dQw4w9WgXcQ" },
+        { "-ZClicWm0zM", "youtube:-ZClicWm0zM" },
+        { " https://www.youtube.com/watch?v=dQw4w9WgXcQ&list=PL1&index=2 ", "youtube:dQw4w9WgXcQ" },
+        { "https://m.youtube.com/watch?v=dQw4w9WgXcQ", "youtube:dQw4w9WgXcQ" },
+        { "https://music.youtube.com/watch?v=dQw4w9WgXcQ&si=abc", "youtube:dQw4w9WgXcQ" },
+        { "https://youtu.be/dQw4w9WgXcQ?si=abc", "youtube:dQw4w9WgXcQ" },
+        { "https://www.youtube.com/shorts/dQw4w9WgXcQ", "youtube:dQw4w9WgXcQ" },
+        { "https://www.youtube.com/embed/dQw4w9WgXcQ", "youtube:dQw4w9WgXcQ" },
+        { "https://soundcloud.com/fake/track#t=1:00", "https://soundcloud.com/fake/track" },
+        { "https://www.youtube.com/playlist?list=PL1", "https://www.youtube.com/playlist?list=PL1" },
+        // only the references of the youtube source are taken for videos
+        { "/music/track_01_ab", "/music/track_01_ab" },
+        { "file:///music/track_01_ab", "file:///music/track_01_ab" },
+        { "https://example.com/track_01_ab", "https://example.com/track_01_ab" },
+    }
+    for _,test := range tests {
+        if id := SourceId(test.source); id != test.id {
+            t.Errorf("SourceId(%q): expected %q, got %q", test.source, test.id, id)
+        }
+    }
+}
+
+func TestSameSong(t *testing.T) {
+    song := Song{ Title: "Save Your Tears", Artist: "The Weeknd", Duration: 215 }
+    tests := []struct{ other Song; same bool }{
+        { Song{ Title: "save your tears", Artist: "The Weeknd", Duration: 217 }, true },
+        { Song{ Title: "Save Your Tears (Official Audio)", Artist: "Ariana Grande,The Weeknd" }, true },
+        { Song{ Title: "Save Your Tears (feat. Ariana Grande)", Artist: "THE WEEKND", Duration: 215 }, true },
+        { Song{ Title: "Save Your Tears - 2021 Remaster", Artist: "The Weeknd", Duration: 215 }, true },
+        { Song{ Title: "Save Your Tears", Duration: 214 }, true },
+        // the title is all there is to go on
+        { Song{ Title: "Save Your Tears" }, false },
+        { Song{ Title: "Save Your Tears", Artist: "The Weeknd", Duration: 240 }, false },
+        { Song{ Title: "Save Your Tears - Live", Artist: "The Weeknd", Duration: 215 }, false },
+        { Song{ Title: "Save Your Tears", Artist: "Someone Else", Duration: 215 }, false },
+        { Song{ Title: "Blinding Lights", Artist: "The Weeknd", Duration: 215 }, false },
+    }
+    for _,test := range tests {
+        if same := SameSong(song, test.other); same != test.same {
+            t.Errorf("SameSong(%+v, %+v): expected %v", song, test.other, test.same)
+        }
+        if same := SameSong(test.other, song); same != test.same {
+            t.Errorf("SameSong(%+v, %+v): expected %v", test.other, song, test.same)
+        }
+    }
+}
+
+func TestApplyDefaults(t *testing.T) {
+    defaults := ffmpeg.Options{ Codec: "opus", Bitrate: "128k", SampleRate: 48000 }
+    cases := []struct {
+        body string
+        want ffmpeg.Options
+    }{
+        { `{}`, defaults },
+        { `{"bitrate":"96k"}`, ffmpeg.Options{ Codec: "opus", Bitrate: "96k", SampleRate: 48000 } },
+        { `{"codec":"mp3","quality":"2"}`, ffmpeg.Options{ Codec: "mp3", Quality: "2", SampleRate: 48000 } },
+        { `{"codec":"flac","sampleRate":44100}`, ffmpeg.Options{ Codec: "flac", SampleRate: 44100 } },
+    }
+    for _,c := range cases {
+        var req DownloadRequest
+        err := json.Unmarshal([]byte(c.body), &req)
+        if err != nil {
+            t.Fatal(err)
+        }
+        req.ApplyDefaults(defaults)
+        if req.Options != c.want {
+            t.Errorf("%s: expected %+v, got %+v", c.body, c.want, req.Options)
+        }
+    }
+
+    var req DownloadRequest
+    req.ApplyDefaults(ffmpeg.Options{})
+    if req.Codec != "mp3" {
+        t.Errorf("Expected the codec to default to mp3, got \"%s\"", req.Codec)
+    }
+}
+
+func TestClassify(t *testing.T) {
+    tests := []struct{
+        err error
+        expected ErrorClass
+    }{
+        { errors.New("ERROR: [youtube] abc: HTTP Error 429: Too Many Requests"), Retryable },
+        { errors.New("ERROR: unable to download video data: HTTP Error 403: Forbidden"), Retryable },
+        { errors.New("something nobody has seen before"), Retryable },
+        { errors.New("ERROR: [youtube] abc: Video unavailable"), Permanent },
+        { errors.New("ERROR: [youtube] abc: Private video. Sign in if you've been granted access"), Permanent },
+        { fmt.Errorf("Failed to convert audio: %w", errors.New("abc.webm: Invalid data found when processing input")), BadDownload },
+        { PermanentError(errors.New("Unsupported codec \"wav\"")), Permanent },
+        { fmt.Errorf("Failed to download video: %w", context.Canceled), Permanent },
+        { &yt_dlp.Error{ Kind: yt_dlp.ErrorThrottled, Err: errors.New("exit status 1") }, Retryable },
+        { &yt_dlp.Error{ Kind: yt_dlp.ErrorSignIn, Err: errors.New("exit status 1") }, Permanent },
+        { fmt.Errorf("Failed to convert audio: %w", &ffmpeg.Error{ Kind: ffmpeg.ErrorMissingInput }), BadDownload },
+        { &ffmpeg.Error{ Kind: ffmpeg.ErrorUnsupported, Err: errors.New("exit status 1") }, Permanent },
+    }
+    for _,test := range tests {
+        if class := Classify(test.err); class != test.expected {
+            t.Errorf("Classify(%q): expected %v, got %v", test.err, test.expected, class)
+        }
+    }
 }
@@ -0,0 +1,115 @@
+package download
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var youtubeVideoId = regexp.MustCompile(`^[A-Za-z0-9_-]{11}$`)
+
+// The prefix of the keys of the songs that were downloaded from YouTube
+const YouTubeSourcePrefix = "youtube:"
+
+/* Returns the key that a song's source is stored and compared by. Every form
+ * of a YouTube video's URL, ex. "https://youtu.be/<id>?si=..." or
+ * "https://www.youtube.com/watch?v=<id>&list=...", is "youtube:<id>", any
+ * other URL is kept without its fragment and anything else as it is. Only
+ * the references that the "youtube" source handles are taken for videos, so
+ * a file or URL can't have the same key as one. */
+func SourceId(source string) string {
+    source = strings.TrimSpace(source)
+    if !(youtubeSource{}).Handles(source) {
+        if u, err := url.Parse(source); err == nil && isHTTPURL(source) {
+            u.Fragment = ""
+            return u.String()
+        }
+        return source
+    }
+    if youtubeVideoId.MatchString(source) {
+        return YouTubeSourcePrefix + source
+    }
+    u, _ := url.Parse(source)
+    host := strings.ToLower(u.Hostname())
+    host = strings.TrimPrefix(strings.TrimPrefix(host, "www."), "m.")
+    switch host {
+    case "youtube.com", "music.youtube.com":
+        if id := u.Query().Get("v"); youtubeVideoId.MatchString(id) {
+            return YouTubeSourcePrefix + id
+        }
+        for _,prefix := range []string{ "/shorts/", "/embed/", "/live/", "/v/" } {
+            if id, ok := strings.CutPrefix(u.Path, prefix); ok && youtubeVideoId.MatchString(id) {
+                return YouTubeSourcePrefix + id
+            }
+        }
+    case "youtu.be":
+        if id := strings.TrimPrefix(u.Path, "/"); youtubeVideoId.MatchString(id) {
+            return YouTubeSourcePrefix + id
+        }
+    }
+    u.Fragment = ""
+    return u.String()
+}
+
+/* Reports whether two songs are probably the same recording. Their titles
+ * must be the same once featured artists and noise like "(Official Audio)"
+ * are left out, they must share an artist and, if both durations are known,
+ * be within a few seconds of each other. */
+func SameSong(a, b Song) bool {
+    if a.Duration > 0 && b.Duration > 0 && abs(a.Duration - b.Duration) > 3 {
+        return false
+    }
+    titleA, titleB := songTitleKey(a.Title), songTitleKey(b.Title)
+    if titleA == "" || titleA != titleB {
+        return false
+    }
+    if a.Artist == "" || b.Artist == "" {
+        // only the duration is left to tell them apart
+        return a.Duration > 0 && b.Duration > 0
+    }
+    for _,artistA := range strings.Split(a.Artist, ",") {
+        for _,artistB := range strings.Split(b.Artist, ",") {
+            nameA := strings.Join(matchWords(artistA), "")
+            if nameA != "" && nameA == strings.Join(matchWords(artistB), "") {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// The words of a title without its featured artists or a remaster note
+func songTitleKey(title string) string {
+    title = strings.ToLower(title)
+    for _,sep := range []string{ "(feat", "[feat", " feat.", "(ft.", " ft." } {
+        title, _, _ = strings.Cut(title, sep)
+    }
+    if t, note, ok := strings.Cut(title, " - "); ok && strings.Contains(note, "remaster") {
+        title = t
+    }
+    return strings.Join(matchWords(title), " ")
+}
+
+/* Returns path, or if a file already exists there, ex. the song of a previous
+ * download of the same video, the first of "<name>-2<ext>", "<name>-3<ext>",
+ * ... that does not exist */
+func uniquePath(path string) (string,error) {
+    ext := filepath.Ext(path)
+    name := strings.TrimSuffix(path, ext)
+    for n := 1; ; n++ {
+        candidate := path
+        if n > 1 {
+            candidate = fmt.Sprintf("%s-%d%s", name, n, ext)
+        }
+        _, err := os.Stat(candidate)
+        if os.IsNotExist(err) {
+            return candidate, nil
+        }
+        if err != nil {
+            return "", err
+        }
+    }
+}
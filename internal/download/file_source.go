@@ -0,0 +1,106 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/* The "file" source copies audio files from a directory on the server, ex. a
+ * music collection that is being moved into the library. A reference is an
+ * absolute path or a file:// URL, a file outside of the directory is an
+ * error. It can't search. */
+type fileSource struct {
+    dir string
+}
+
+func newFileSource(config SourcesConfig) (Source,error) {
+    if config.FileDirectory == "" {
+        return nil, errors.New("FileDirectory is required")
+    }
+    dir, err := filepath.Abs(config.FileDirectory)
+    if err != nil {
+        return nil, err
+    }
+    return fileSource{ dir }, nil
+}
+
+func (fileSource) Handles(ref string) bool {
+    return strings.HasPrefix(ref, "file://") || filepath.IsAbs(ref)
+}
+
+func (fileSource) Search(ctx context.Context, query string) ([]searchResultsVideo,error) {
+    return nil, nil
+}
+
+func (s fileSource) Resolve(ctx context.Context, ref string) (DownloadRequest,error) {
+    file, err := s.path(ref)
+    if err != nil {
+        return DownloadRequest{}, err
+    }
+    return resolveAudioFile(file, filepath.Base(file)), nil
+}
+
+// Copies the file, the job that converts it removes its input
+func (s fileSource) Fetch(ctx context.Context, ref string, onProgressUpdate func(uint8)) (string,error) {
+    file, err := s.path(ref)
+    if err != nil {
+        return "", err
+    }
+    in, err := os.Open(file)
+    if err != nil {
+        return "", PermanentError(err)
+    }
+    defer in.Close()
+    info, err := in.Stat()
+    if err != nil {
+        return "", err
+    }
+    name, err := fetchPath(file)
+    if err != nil {
+        return "", err
+    }
+    out, err := os.Create(name)
+    if err != nil {
+        return "", err
+    }
+    w := &progressWriter{ w: out, total: info.Size(), onProgressUpdate: onProgressUpdate }
+    w.report()
+    _, err = io.Copy(w, in)
+    if e := out.Close(); err == nil {
+        err = e
+    }
+    if err != nil {
+        os.Remove(name)
+        return "", fmt.Errorf("Failed to copy %s: %w", file, err)
+    }
+    return name, nil
+}
+
+/* returns the path of the file that ref refers to, which must be a regular
+ * file inside of the source's directory */
+func (s fileSource) path(ref string) (string,error) {
+    file := filepath.Clean(filepath.FromSlash(strings.TrimPrefix(ref, "file://")))
+    rel, err := filepath.Rel(s.dir, file)
+    if err != nil || rel == ".." || strings.HasPrefix(rel, ".." + string(filepath.Separator)) {
+        return "", PermanentError(fmt.Errorf("%s is not in %s", file, s.dir))
+    }
+    // a link could lead out of the directory
+    resolved, err := filepath.EvalSymlinks(file)
+    if err != nil {
+        return "", PermanentError(err)
+    }
+    dir, err := filepath.EvalSymlinks(s.dir)
+    if err != nil {
+        return "", err
+    }
+    rel, err = filepath.Rel(dir, resolved)
+    if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".." + string(filepath.Separator)) {
+        return "", PermanentError(fmt.Errorf("%s is not in %s", file, s.dir))
+    }
+    return file, nil
+}
@@ -0,0 +1,216 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The extensions of the URLs that the "http" source downloads
+var audioExtensions = map[string]bool{
+    ".mp3": true, ".m4a": true, ".aac": true, ".flac": true, ".ogg": true,
+    ".oga": true, ".opus": true, ".wav": true,
+}
+
+// Audio files larger than this are not downloaded
+const maxAudioSize = 1 << 30
+
+/* The "http" source downloads audio files from http and https URLs that end
+ * in an audio file's extension, ex. "https://example.com/song.mp3". It can't
+ * search. It only connects to public addresses, so that a song's URL can't
+ * reach the server's own network, ex. a cloud metadata service. */
+type httpSource struct {
+    client *http.Client
+}
+
+// Returned (wrapped) when a URL, or a redirect, is to an address that isn't public
+var ErrPrivateAddress = errors.New("The address is not public")
+
+func newHTTPSource(SourcesConfig) (Source,error) {
+    dialer := &net.Dialer{ Timeout: 30 * time.Second, Control: refusePrivateAddress }
+    transport := http.DefaultTransport.(*http.Transport).Clone()
+    transport.DialContext = dialer.DialContext
+    // a proxy would make the connection on the server's behalf, unchecked
+    transport.Proxy = nil
+    return httpSource{ &http.Client{ Transport: transport, CheckRedirect: checkRedirect } }, nil
+}
+
+// Called before every connection is made, with the address that it is made to
+func refusePrivateAddress(network, address string, _ syscall.RawConn) error {
+    host, _, err := net.SplitHostPort(address)
+    if err != nil {
+        return err
+    }
+    if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+        return fmt.Errorf("%s: %w", host, ErrPrivateAddress)
+    }
+    return nil
+}
+
+/* Checks where a response redirects to before following it. The connection
+ * is checked again when it is made, a name can resolve to anything. */
+func checkRedirect(req *http.Request, via []*http.Request) error {
+    if len(via) >= 10 {
+        return errors.New("stopped after 10 redirects")
+    }
+    if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+        return fmt.Errorf("redirected to %s: %w", req.URL.Scheme, ErrPrivateAddress)
+    }
+    host := req.URL.Hostname()
+    if ip := net.ParseIP(host); strings.EqualFold(host, "localhost") || ip != nil && !isPublicIP(ip) {
+        return fmt.Errorf("redirected to %s: %w", host, ErrPrivateAddress)
+    }
+    return nil
+}
+
+/* The ranges that aren't public besides the ones that net.IP has methods
+ * for, see the IANA special-purpose address registries */
+var deniedPrefixes = []netip.Prefix{
+    // "this network", Linux connects to the local host for these
+    netip.MustParsePrefix("0.0.0.0/8"),
+    // carrier-grade NAT, often a provider's internal network
+    netip.MustParsePrefix("100.64.0.0/10"),
+    netip.MustParsePrefix("192.0.0.0/24"),
+    // benchmarking
+    netip.MustParsePrefix("198.18.0.0/15"),
+    // reserved, and broadcast
+    netip.MustParsePrefix("240.0.0.0/4"),
+    // NAT64, the IPv4 address is embedded in the last 32 bits
+    netip.MustParsePrefix("64:ff9b::/96"),
+    netip.MustParsePrefix("64:ff9b:1::/48"),
+}
+
+func isPublicIP(ip net.IP) bool {
+    if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+    ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+    ip.IsMulticast() || ip.IsUnspecified() {
+        return false
+    }
+    addr, ok := netip.AddrFromSlice(ip)
+    if !ok {
+        return false
+    }
+    addr = addr.Unmap()
+    for _,prefix := range deniedPrefixes {
+        if prefix.Contains(addr) {
+            return false
+        }
+    }
+    return true
+}
+
+func (httpSource) Handles(ref string) bool {
+    if !isHTTPURL(ref) {
+        return false
+    }
+    u, _ := url.Parse(ref)
+    return audioExtensions[strings.ToLower(path.Ext(u.Path))]
+}
+
+func (httpSource) Search(ctx context.Context, query string) ([]searchResultsVideo,error) {
+    return nil, nil
+}
+
+func (httpSource) Resolve(ctx context.Context, ref string) (DownloadRequest,error) {
+    u, err := url.Parse(ref)
+    if err != nil {
+        return DownloadRequest{}, PermanentError(err)
+    }
+    // ffprobe would fetch the URL itself, without the checks of the client,
+    // so the title is the file's name and the tags are read once it is downloaded
+    name := path.Base(u.Path)
+    return DownloadRequest{ Title: strings.TrimSuffix(name, path.Ext(name)) }, nil
+}
+
+func (s httpSource) Fetch(ctx context.Context, ref string, onProgressUpdate func(uint8)) (string,error) {
+    req, err := http.NewRequestWithContext(ctx, "GET", ref, nil)
+    if err != nil {
+        return "", PermanentError(err)
+    }
+    res, err := s.client.Do(req)
+    if errors.Is(err, ErrPrivateAddress) {
+        return "", PermanentError(fmt.Errorf("Failed to download %s: %w", ref, err))
+    }
+    if err != nil {
+        return "", fmt.Errorf("Failed to download %s: %w", ref, err)
+    }
+    defer res.Body.Close()
+    if res.StatusCode != http.StatusOK {
+        err = fmt.Errorf("Failed to download %s: %s", ref, res.Status)
+        // the file is gone or was never there, other errors may pass
+        if res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone ||
+        res.StatusCode == http.StatusForbidden || res.StatusCode == http.StatusUnauthorized {
+            err = PermanentError(err)
+        }
+        return "", err
+    }
+    if res.ContentLength > maxAudioSize {
+        return "", PermanentError(fmt.Errorf("Failed to download %s: larger than %d bytes", ref, maxAudioSize))
+    }
+
+    name, err := fetchPath(path.Base(req.URL.Path))
+    if err != nil {
+        return "", err
+    }
+    f, err := os.Create(name)
+    if err != nil {
+        return "", err
+    }
+    w := &progressWriter{ w: f, total: res.ContentLength, onProgressUpdate: onProgressUpdate }
+    w.report()
+    n, err := io.Copy(w, io.LimitReader(res.Body, maxAudioSize + 1))
+    if e := f.Close(); err == nil {
+        err = e
+    }
+    if err == nil && n > maxAudioSize {
+        err = PermanentError(fmt.Errorf("larger than %d bytes", maxAudioSize))
+    }
+    if err != nil {
+        os.Remove(name)
+        if ctx.Err() != nil {
+            return "", ctx.Err()
+        }
+        return "", fmt.Errorf("Failed to download %s: %w", ref, err)
+    }
+    if onProgressUpdate != nil && w.last != 100 {
+        onProgressUpdate(100)
+    }
+    return name, nil
+}
+
+// Reports the percent of total that has been written, total is -1 if unknown
+type progressWriter struct {
+    w io.Writer
+    written, total int64
+    last int
+    onProgressUpdate func(uint8)
+}
+
+func (p *progressWriter) Write(b []byte) (int,error) {
+    n, err := p.w.Write(b)
+    p.written += int64(n)
+    p.report()
+    return n, err
+}
+
+// calls onProgressUpdate when the percent changes
+func (p *progressWriter) report() {
+    if p.onProgressUpdate == nil || p.total <= 0 {
+        return
+    }
+    percent := int(100 * p.written / p.total)
+    if p.written == 0 || percent != p.last {
+        p.last = percent
+        p.onProgressUpdate(uint8(min(100, percent)))
+    }
+}
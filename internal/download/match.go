@@ -0,0 +1,203 @@
+package download
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+/* How likely it is that a video is a song, and the signals that it was
+ * worked out from. Each signal is from 0 to 1. */
+type MatchScore struct {
+    // The overall score, from 0 to 1
+    Confidence float64 `json:"confidence"`
+    // The fraction of the song's title that is in the video's title
+    Title float64 `json:"title"`
+    // The fraction of the song's first artist that is in the video's title
+    // or channel
+    Artist float64 `json:"artist"`
+    // 1 within a couple of seconds of the song's duration, 0 at 30 seconds
+    // off, 0.5 if either duration is unknown
+    Duration float64 `json:"duration"`
+    // How likely the channel is to post the original recording, ex. the
+    // artist's "- Topic" or VEVO channel, or an "Official Audio" upload
+    Channel float64 `json:"channel"`
+    // Subtracted for a different version of the song, ex. "live", "cover" or
+    // "remix", and for other words that are not in the song's title or artist
+    Penalty float64 `json:"penalty"`
+}
+
+type MatchCandidate struct {
+    Video searchResultsVideo `json:"video"`
+    MatchScore
+}
+
+/* The videos of a search ranked for one of its songs, most likely first. The
+ * ranked videos are referred to by id. */
+type Suggestion struct {
+    // The index of the song in SearchResults.Songs
+    Song int `json:"song"`
+    Videos []RankedVideo `json:"videos"`
+}
+
+type RankedVideo struct {
+    Id string `json:"id"`
+    MatchScore
+}
+
+// Pairs each song with the videos ranked by how likely they are to be it
+func Suggest(songs []searchResultsSong, videos []searchResultsVideo) []Suggestion {
+    suggestions := make([]Suggestion, 0, len(songs))
+    for i,song := range songs {
+        suggestion := Suggestion{ Song: i, Videos: []RankedVideo{} }
+        for _,candidate := range RankVideos(song, videos) {
+            suggestion.Videos = append(suggestion.Videos, RankedVideo{
+                Id: candidate.Video.Id,
+                MatchScore: candidate.MatchScore,
+            })
+        }
+        suggestions = append(suggestions, suggestion)
+    }
+    return suggestions
+}
+
+// Scores each video for the song, most likely first
+func RankVideos(song searchResultsSong, videos []searchResultsVideo) []MatchCandidate {
+    candidates := make([]MatchCandidate, 0, len(videos))
+    for _,video := range videos {
+        candidates = append(candidates, MatchCandidate{
+            Video: video,
+            MatchScore: ScoreMatch(song, video),
+        })
+    }
+    sort.SliceStable(candidates, func(i, j int) bool {
+        return candidates[i].Confidence > candidates[j].Confidence
+    })
+    return candidates
+}
+
+// Words in video titles and channel names that say nothing about the song
+var matchNoise = map[string]bool{
+    "official": true, "audio": true, "video": true, "music": true, "lyric": true,
+    "lyrics": true, "mv": true, "hd": true, "4k": true, "visualizer": true,
+    "topic": true, "vevo": true, "ft": true, "feat": true,
+}
+
+// Words in a video's title that mean it is another version of the song
+var variantWords = map[string]bool{
+    "live": true, "cover": true, "remix": true, "karaoke": true,
+    "instrumental": true, "acoustic": true, "nightcore": true, "sped": true,
+    "slowed": true, "8d": true, "reaction": true, "mashup": true,
+}
+
+/* Scores how likely it is that the video is the song. The video's title must
+ * contain the song's title, its title or channel should name the first
+ * artist and its duration should be within a few seconds of the song's. A
+ * "live", "cover" or "remix" that the song's title doesn't have costs a lot,
+ * any other extra word costs a little. */
+func ScoreMatch(song searchResultsSong, video searchResultsVideo) MatchScore {
+    var score MatchScore
+    // "Song - 2011 Remaster" and "Song (feat. Artist)" are still "Song"
+    title, _, _ := strings.Cut(song.Title, " - ")
+    title, _, _ = strings.Cut(title, "(feat")
+    titleWords := matchWords(title)
+    allTitleWords := matchWords(song.Title)
+    artist, _, _ := strings.Cut(song.Artist, ",")
+    artistWords := matchWords(artist)
+    allArtistWords := matchWords(song.Artist)
+    videoWords := matchWords(video.Title)
+    channelWords := matchWords(video.ChannelTitle)
+
+    score.Title = overlap(titleWords, videoWords)
+    score.Artist = max(overlap(artistWords, videoWords), overlap(artistWords, channelWords))
+
+    score.Duration = 0.5
+    if song.Duration > 0 && video.Duration > 0 {
+        delta := float64(abs(song.Duration - video.Duration))
+        score.Duration = max(0, 1 - max(0, delta - 2) / 28)
+    }
+
+    score.Channel = channelScore(artist, video)
+
+    var variants, extra float64
+    for _,word := range videoWords {
+        if contains(allTitleWords, word) || contains(allArtistWords, word) {
+            continue
+        }
+        if variantWords[word] {
+            variants++
+        } else {
+            extra++
+        }
+    }
+    score.Penalty = min(1, 0.35 * variants + min(0.2, 0.05 * extra))
+
+    // the artist's channel only vouches for the videos that are the song
+    confidence := 0.4 * score.Title + 0.2 * score.Artist + 0.3 * score.Duration +
+        0.1 * score.Channel * score.Title - score.Penalty
+    score.Confidence = max(0, min(1, confidence))
+    return score
+}
+
+/* Returns 1 for the artist's "- Topic" channel, where YouTube posts the
+ * recordings from the artist's label, 0.8 for a VEVO channel or an "Official
+ * Audio" upload, otherwise 0 */
+func channelScore(artist string, video searchResultsVideo) float64 {
+    channel := strings.ToLower(video.ChannelTitle)
+    artistName := strings.Join(matchWords(artist), "")
+    if name, ok := strings.CutSuffix(channel, " - topic"); ok {
+        if artistName == "" || strings.Join(matchWords(name), "") == artistName {
+            return 1
+        }
+        // another artist's topic channel
+        return 0.5
+    }
+    if strings.HasSuffix(channel, "vevo") ||
+    strings.Contains(strings.ToLower(video.Title), "official audio") {
+        return 0.8
+    }
+    return 0
+}
+
+// Returns the fraction of words that are in other, 1 if words is empty
+func overlap(words, other []string) float64 {
+    if len(words) == 0 {
+        return 1
+    }
+    n := 0
+    for _,word := range words {
+        if contains(other, word) {
+            n++
+        }
+    }
+    return float64(n) / float64(len(words))
+}
+
+// Splits s into lowercase words of letters and digits, without matchNoise
+func matchWords(s string) []string {
+    var words []string
+    for _,word := range strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+        return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+    }) {
+        if !matchNoise[word] {
+            words = append(words, word)
+        }
+    }
+    return words
+}
+
+func contains(words []string, word string) bool {
+    for _,w := range words {
+        if w == word {
+            return true
+        }
+    }
+    return false
+}
+
+func abs(x int64) int64 {
+    if x < 0 {
+        return -x
+    }
+    return x
+}
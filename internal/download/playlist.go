@@ -0,0 +1,109 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	yt_dlp "github.com/TSchreiber/melo/internal/yt_dlp"
+)
+
+/* The entries of a playlist or channel, each with metadata guessed from its
+ * title and uploader for the admin to review before it is downloaded */
+type PlaylistPreview struct {
+    Title string `json:"title"`
+    Uploader string `json:"uploader"`
+    URL string `json:"url"`
+    Entries []PlaylistEntry `json:"entries"`
+}
+
+type PlaylistEntry struct {
+    DownloadRequest
+    // The title of the video as it was uploaded
+    VideoTitle string `json:"videoTitle"`
+}
+
+// Lists the entries of a YouTube or SoundCloud playlist or channel URL
+func PreviewPlaylist(ctx context.Context, url string) (PlaylistPreview,error) {
+    var preview PlaylistPreview
+    playlist, err := yt_dlp.ListPlaylist(ctx, url)
+    if err != nil {
+        return preview, fmt.Errorf("Failed to list playlist: %w", err)
+    }
+    preview.Title = playlist.Title
+    preview.Uploader = firstNonEmpty(playlist.Uploader, playlist.Channel)
+    preview.URL = firstNonEmpty(playlist.WebpageURL, url)
+    preview.Entries = make([]PlaylistEntry, 0, len(playlist.Entries))
+    for _,entry := range playlist.Entries {
+        preview.Entries = append(preview.Entries, playlistEntry(entry))
+    }
+    return preview, nil
+}
+
+func playlistEntry(entry yt_dlp.PlaylistEntry) PlaylistEntry {
+    var out PlaylistEntry
+    out.VideoTitle = entry.Title
+    out.Duration = int64(entry.Duration)
+    out.Artwork = entry.Thumbnail()
+    // YouTube videos are downloaded by id like the ones picked from a search,
+    // anything else needs its URL
+    out.Source = entry.URL
+    if entry.IEKey == "Youtube" || out.Source == "" {
+        out.Source = entry.Id
+    }
+    out.Artist, out.Title = splitVideoTitle(entry.Title)
+    if out.Artist == "" {
+        // music uploaded by YouTube on an artist's behalf is on
+        // "<artist> - Topic"
+        out.Artist = strings.TrimSuffix(firstNonEmpty(entry.Channel, entry.Uploader), " - Topic")
+    }
+    return out
+}
+
+// Words in parentheses or brackets that are not part of a song's title
+var videoTitleNoise = []string{
+    "official", "audio", "lyric", "lyrics", "video", "visualizer", "hd", "4k", "mv", "full",
+}
+
+/* Splits "Artist - Title (Official Video)" into the artist and the title,
+ * without the noise. The artist is "" if the title has no " - ". */
+func splitVideoTitle(videoTitle string) (artist, title string) {
+    title = videoTitle
+    if a, t, ok := strings.Cut(videoTitle, " - "); ok {
+        artist, title = strings.TrimSpace(a), t
+    }
+    for _,pair := range []string{ "()", "[]" } {
+        for {
+            open := strings.LastIndexByte(title, pair[0])
+            if open == -1 {
+                break
+            }
+            end := strings.IndexByte(title[open:], pair[1])
+            if end == -1 || !isVideoTitleNoise(title[open+1 : open+end]) {
+                break
+            }
+            title = title[:open] + title[open+end+1:]
+        }
+    }
+    return artist, strings.Join(strings.Fields(title), " ")
+}
+
+func isVideoTitleNoise(s string) bool {
+    for _,word := range strings.Fields(strings.ToLower(s)) {
+        for _,noise := range videoTitleNoise {
+            if word == noise {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+func firstNonEmpty(s ...string) string {
+    for _,x := range s {
+        if x != "" {
+            return x
+        }
+    }
+    return ""
+}
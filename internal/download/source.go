@@ -0,0 +1,204 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/TSchreiber/melo/internal/ffmpeg"
+)
+
+/* A Source is a provider that songs are downloaded from, ex. YouTube. The
+ * Source of a DownloadRequest is a reference, a video id, URL or path, that
+ * one of the enabled sources handles. A new provider is added by registering
+ * it with RegisterSource, it can then be enabled in the server's config. */
+type Source interface {
+    // Reports whether ref is one of this source's songs
+    Handles(ref string) bool
+    // Searches the source for songs, a source that can't search returns nil
+    Search(ctx context.Context, query string) ([]searchResultsVideo,error)
+    // Looks up what the source knows of the song's title, artist, album,
+    // artwork and duration, the rest is left empty
+    Resolve(ctx context.Context, ref string) (DownloadRequest,error)
+    // Writes the song's audio to a new file in the working directory and
+    // returns its path, the file belongs to the caller. Cancelling ctx stops
+    // the download and removes what was written of it.
+    Fetch(ctx context.Context, ref string, onProgressUpdate func(uint8)) (string,error)
+}
+
+type SourcesConfig struct {
+    // The names of the sources that songs may be downloaded from, ex.
+    // ["youtube", "http", "file"]. Defaults to DefaultSources, "http" lets
+    // anyone who can download make the server fetch a URL, so it is opt-in
+    Enabled []string
+    // The directory that the "file" source downloads from, it can't be
+    // enabled without one
+    FileDirectory string
+}
+
+// The sources that are enabled when the config doesn't name any
+var DefaultSources = []string{ "youtube" }
+
+type registeredSource struct {
+    name string
+    newSource func(SourcesConfig) (Source,error)
+}
+
+var (
+    sourcesMu sync.RWMutex
+    // every source that can be enabled, in the order that they were registered
+    registry []registeredSource
+    // the enabled sources, in the same order
+    enabled []registeredSource
+    enabledSources []Source
+)
+
+/* Makes a source available to be enabled by name. The enabled sources are
+ * asked whether they handle a reference in the order that they were
+ * registered, so a source of particular URLs must be registered before one
+ * that handles any URL, like "youtube". */
+func RegisterSource(name string, newSource func(SourcesConfig) (Source,error)) {
+    sourcesMu.Lock()
+    defer sourcesMu.Unlock()
+    registry = append(registry, registeredSource{ name, newSource })
+}
+
+func init() {
+    RegisterSource("file", newFileSource)
+    RegisterSource("http", newHTTPSource)
+    RegisterSource("youtube", newYouTubeSource)
+    err := EnableSources(SourcesConfig{})
+    if err != nil {
+        panic(err)
+    }
+}
+
+/* Enables the sources that config names in place of the ones that were
+ * enabled. Nothing changes if a name is unknown or a source is missing its
+ * settings. */
+func EnableSources(config SourcesConfig) error {
+    names := config.Enabled
+    if len(names) == 0 {
+        names = DefaultSources
+    }
+    sourcesMu.Lock()
+    defer sourcesMu.Unlock()
+    for _,name := range names {
+        found := false
+        for _,r := range registry {
+            found = found || r.name == name
+        }
+        if !found {
+            return fmt.Errorf("Unknown download source, \"%s\"", name)
+        }
+    }
+    var list []registeredSource
+    var sources []Source
+    for _,r := range registry {
+        for _,name := range names {
+            if r.name != name {
+                continue
+            }
+            source, err := r.newSource(config)
+            if err != nil {
+                return fmt.Errorf("Failed to enable the %s source: %w", name, err)
+            }
+            list = append(list, r)
+            sources = append(sources, source)
+            break
+        }
+    }
+    enabled, enabledSources = list, sources
+    return nil
+}
+
+// Returns the names of the enabled sources
+func EnabledSources() []string {
+    sourcesMu.RLock()
+    defer sourcesMu.RUnlock()
+    names := make([]string, len(enabled))
+    for i,r := range enabled {
+        names[i] = r.name
+    }
+    return names
+}
+
+// Returned (wrapped) when none of the enabled sources handles a reference
+var ErrNoSource = errors.New("No enabled source can download it")
+
+// returns the first enabled source that handles ref
+func lookupSource(ref string) (Source,error) {
+    sourcesMu.RLock()
+    defer sourcesMu.RUnlock()
+    for _,source := range enabledSources {
+        if source.Handles(ref) {
+            return source, nil
+        }
+    }
+    return nil, PermanentError(fmt.Errorf("\"%s\": %w", ref, ErrNoSource))
+}
+
+// Searches every enabled source that can search, in order
+func searchSources(ctx context.Context, query string) ([]searchResultsVideo,error) {
+    sourcesMu.RLock()
+    sources := enabledSources
+    sourcesMu.RUnlock()
+    var videos []searchResultsVideo
+    var errs []error
+    for _,source := range sources {
+        results, err := source.Search(ctx, query)
+        if err != nil {
+            errs = append(errs, err)
+        }
+        videos = append(videos, results...)
+    }
+    return videos, errors.Join(errs...)
+}
+
+/* Looks up the metadata of the song that ref refers to with the source that
+ * handles it. The returned request's Source is ref. */
+func Resolve(ctx context.Context, ref string) (DownloadRequest,error) {
+    source, err := lookupSource(ref)
+    if err != nil {
+        return DownloadRequest{}, err
+    }
+    req, err := source.Resolve(ctx, ref)
+    if err != nil {
+        return req, err
+    }
+    req.Source = ref
+    return req, nil
+}
+
+// Reports whether ref is an http or https URL
+func isHTTPURL(ref string) bool {
+    u, err := url.Parse(ref)
+    return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+/* Returns the metadata of an audio file from its tags, falling back
+ * to the file's name for the title. The tags are only read if ffprobe can,
+ * name is used as is otherwise. */
+func resolveAudioFile(file, name string) DownloadRequest {
+    var req DownloadRequest
+    req.Title = strings.TrimSuffix(name, path.Ext(name))
+    info, err := ffmpeg.Probe(file)
+    if err != nil {
+        return req
+    }
+    req.Title = firstNonEmpty(info.Tags["title"], req.Title)
+    req.Artist = firstNonEmpty(info.Tags["artist"], info.Tags["album_artist"])
+    req.Album = info.Tags["album"]
+    req.Duration = int64(info.Duration / 1000)
+    return req
+}
+
+// Returns a path in the working directory, that nothing is at yet, for a file named name
+func fetchPath(name string) (string,error) {
+    return uniquePath("./" + filepath.Base(name))
+}
@@ -0,0 +1,109 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	spotify "github.com/TSchreiber/melo/internal/spotify_api"
+)
+
+// Returned (wrapped) when a link is not one that can be imported
+var ErrInvalidLink = errors.New("invalid link")
+
+/* A Spotify playlist with the YouTube videos that could be each of its
+ * tracks, for the admin to approve before they are downloaded */
+type SpotifyPlaylistMatches struct {
+    Title string `json:"title"`
+    Description string `json:"description"`
+    Artwork string `json:"artwork"`
+    Tracks []TrackMatch `json:"tracks"`
+}
+
+type TrackMatch struct {
+    SpotifyId string `json:"spotifyId"`
+    Track searchResultsSong `json:"track"`
+    // The videos that could be the track, most likely first
+    Candidates []MatchCandidate `json:"candidates"`
+    // Why no videos were found, ex. the search failed
+    Error string `json:"error,omitempty"`
+}
+
+// The most candidates kept for each track
+const maxCandidates = 5
+
+// The number of tracks that are searched for at the same time
+const matchConcurrency = 4
+
+/* Fetches the Spotify playlist at link and searches YouTube for each of its
+ * tracks. Each search uses 100 units of the YouTube Data API quota, which is
+ * 10000 a day by default. A track whose search failed has an Error instead of
+ * candidates, the other tracks are still matched. */
+func MatchSpotifyPlaylist(ctx context.Context, link string) (SpotifyPlaylistMatches,error) {
+    var out SpotifyPlaylistMatches
+    playlistId, err := spotify.ParseId("playlist", link)
+    if err != nil {
+        return out, fmt.Errorf("%w: %v", ErrInvalidLink, err)
+    }
+    token, err := getSpotifyAuthToken()
+    if err != nil {
+        return out, err
+    }
+    playlist, err := spotify.GetPlaylist(token, playlistId)
+    if err != nil {
+        return out, fmt.Errorf("Failed to get Spotify playlist: %w", err)
+    }
+    out.Title = playlist.Name
+    out.Description = playlist.Description
+    if len(playlist.Images) > 0 {
+        out.Artwork = playlist.Images[0].Url
+    }
+
+    out.Tracks = make([]TrackMatch, len(playlist.Tracks))
+    next := make(chan int)
+    var wg sync.WaitGroup
+    for w := 0; w < matchConcurrency; w++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for i := range next {
+                out.Tracks[i] = matchTrack(playlist.Tracks[i])
+            }
+        }()
+    }
+    for i := range playlist.Tracks {
+        if ctx.Err() != nil {
+            break
+        }
+        next <- i
+    }
+    close(next)
+    wg.Wait()
+    if err := ctx.Err(); err != nil {
+        return out, err
+    }
+    return out, nil
+}
+
+// Searches YouTube for the track and ranks the videos that were found
+func matchTrack(track spotify.SpotifyTrack) TrackMatch {
+    var match TrackMatch
+    match.SpotifyId = track.Id
+    match.Track = spotifyTrackToSearchResultsSong(track)
+    match.Candidates = []MatchCandidate{}
+    query := match.Track.Title
+    if len(track.Artists) > 0 {
+        query = track.Artists[0].Name + " - " + query
+    }
+    videos, err := ytSearch(query)
+    if err != nil {
+        match.Error = err.Error()
+        return match
+    }
+    match.Candidates = RankVideos(match.Track, videos)
+    if len(match.Candidates) > maxCandidates {
+        match.Candidates = match.Candidates[:maxCandidates]
+    }
+    return match
+}
@@ -0,0 +1,83 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+
+	yt_dlp "github.com/TSchreiber/melo/internal/yt_dlp"
+)
+
+/* The "youtube" source downloads with yt-dlp. It handles YouTube video ids
+ * and the http and https URLs of the sites in youtubeHosts, nothing else is
+ * passed to yt-dlp. It searches YouTube with the YouTube Data API. */
+type youtubeSource struct{}
+
+/* The sites that the "youtube" source downloads from, and their subdomains.
+ * SoundCloud is downloaded with yt-dlp too, its playlists can be imported. */
+var youtubeHosts = []string{ "youtube.com", "youtu.be", "youtube-nocookie.com", "soundcloud.com" }
+
+func newYouTubeSource(SourcesConfig) (Source,error) {
+    return youtubeSource{}, nil
+}
+
+/* Ids may start with "-", ex. "-ZClicWm0zM", yt-dlp is always given the
+ * reference after "--" so it isn't read as an option. Anything else that
+ * starts with "-" is neither an id nor a URL. */
+func (youtubeSource) Handles(ref string) bool {
+    if youtubeVideoId.MatchString(ref) {
+        return true
+    }
+    if !isHTTPURL(ref) {
+        return false
+    }
+    u, _ := url.Parse(ref)
+    host := strings.ToLower(u.Hostname())
+    for _,h := range youtubeHosts {
+        if host == h || strings.HasSuffix(host, "." + h) {
+            return true
+        }
+    }
+    return false
+}
+
+func (youtubeSource) Search(ctx context.Context, query string) ([]searchResultsVideo,error) {
+    return ytSearch(query)
+}
+
+/* Uses the track and artist that YouTube knows of the song, otherwise they
+ * are guessed from the video's title and channel like a playlist entry's */
+func (youtubeSource) Resolve(ctx context.Context, ref string) (DownloadRequest,error) {
+    var req DownloadRequest
+    video, err := yt_dlp.GetVideo(ctx, ref)
+    if err != nil {
+        return req, fmt.Errorf("Failed to look up the video: %w", err)
+    }
+    req.Title, req.Artist, req.Album = video.Track, video.Artist, video.Album
+    if req.Title == "" {
+        req.Artist, req.Title = splitVideoTitle(video.Title)
+    }
+    if req.Artist == "" {
+        req.Artist = strings.TrimSuffix(firstNonEmpty(video.Channel, video.Uploader), " - Topic")
+    }
+    req.Artwork = video.Thumbnail
+    req.Duration = int64(video.Duration)
+    return req, nil
+}
+
+func (youtubeSource) Fetch(ctx context.Context, ref string, onProgressUpdate func(uint8)) (string,error) {
+    var downloader yt_dlp.Downloader
+    downloader.OnProgressUpdate(onProgressUpdate)
+    downloader.DownloadAudioContext(ctx, ref)
+    downloader.Wait()
+    for _,warning := range downloader.Warnings() {
+        log.Printf("yt-dlp %s: %s\n", ref, warning)
+    }
+    inputFile,err := downloader.GetFilepath()
+    if err != nil {
+        return "", fmt.Errorf("Failed to download video: %w", err)
+    }
+    return inputFile, nil
+}
@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/TSchreiber/melo/internal/download"
+	"github.com/TSchreiber/melo/internal/fingerprint"
+	"github.com/TSchreiber/melo/internal/jobs"
+)
+
+/* A song, or a download in progress, that a new download would duplicate.
+ * It is the body of a 409 from POST /download/song. */
+type duplicate struct {
+    // "source" if the song was downloaded from the same video or URL,
+    // "similar" if it has the same title, artist and duration, or "queued" if
+    // the same video or URL is already being downloaded
+    Reason string `json:"reason"`
+    Song *Song `json:"song,omitempty"`
+    Job *jobs.Job `json:"job,omitempty"`
+}
+
+// Makes the search terms of a title and artist match rather than exclude songs
+var searchTermReplacer = strings.NewReplacer("-", " ", `"`, " ")
+
+/* Returns what req would duplicate, or nil if it is a new song. Songs that
+ * were stored with another form of the source's URL are only found by their
+ * title, artist and duration, as are sections of a video, ex. the tracks of
+ * a full album, which share their source with the album's other tracks. */
+func findDuplicate(meloDB MeloDatabase, queue *jobs.Queue,
+req download.DownloadRequest) (*duplicate,error) {
+    // an upload has no source to compare
+    if req.Source != "" && !req.IsSection() {
+        dup, err := findDuplicateSource(meloDB, queue, req.Source)
+        if dup != nil || err != nil {
+            return dup, err
+        }
+    }
+
+    songs, err := meloDB.SearchForSong(searchTermReplacer.Replace(req.Title + " " + req.Artist))
+    if err != nil {
+        return nil, fmt.Errorf("findDuplicate: %v", err)
+    }
+    want := download.Song{ Title: req.Title, Artist: req.Artist, Duration: req.Duration }
+    for i,song := range songs {
+        got := download.Song{ Title: song.Title, Artist: song.Artist, Duration: song.Duration }
+        if download.SameSong(want, got) {
+            return &duplicate{ Reason: "similar", Song: &songs[i] }, nil
+        }
+    }
+    return nil, nil
+}
+
+// Returns the song or job that was downloaded from the same source, or nil
+func findDuplicateSource(meloDB MeloDatabase, queue *jobs.Queue, source string) (*duplicate,error) {
+    sourceId := download.SourceId(source)
+    sources := []string{ sourceId }
+    if source != sourceId {
+        sources = append(sources, source)
+    }
+    // the songs that were downloaded before the videos' ids were prefixed
+    if id, ok := strings.CutPrefix(sourceId, download.YouTubeSourcePrefix); ok && id != source {
+        sources = append(sources, id)
+    }
+    songs, err := meloDB.GetSongsBySource(sources...)
+    if err != nil {
+        return nil, fmt.Errorf("findDuplicate: %v", err)
+    }
+    if len(songs) > 0 {
+        return &duplicate{ Reason: "source", Song: &songs[0] }, nil
+    }
+
+    pending, err := queue.List(jobs.Queued, jobs.Running)
+    if err != nil {
+        return nil, fmt.Errorf("findDuplicate: %v", err)
+    }
+    for i := range pending {
+        if download.SourceId(pending[i].Request.Source) == sourceId &&
+        !pending[i].Request.IsSection() {
+            return &duplicate{ Reason: "queued", Job: &pending[i] }, nil
+        }
+    }
+    return nil, nil
+}
+
+/* Returns the function that the job queue uses to find the songs in the
+ * library that a downloaded song is the same recording as, by comparing its
+ * fingerprint with every song's */
+func createFindSimilarSongsFunc(meloDB MeloDatabase) func(download.Song) ([]jobs.SimilarSong,error) {
+    return func(song download.Song) ([]jobs.SimilarSong,error) {
+        fps, err := meloDB.GetFingerprints()
+        if err != nil {
+            return nil, fmt.Errorf("findSimilarSongs: %v", err)
+        }
+        ids := make([]string, 0, len(fps))
+        for id := range fps {
+            ids = append(ids, id)
+        }
+        sort.Strings(ids)
+        list := make([]fingerprint.Fingerprint, len(ids))
+        for i,id := range ids {
+            list[i] = fps[id]
+        }
+        var similar []jobs.SimilarSong
+        for _,match := range fingerprint.Search(song.Fingerprint, list, fingerprint.Threshold) {
+            s, err := meloDB.GetSong(ids[match.Index])
+            if errors.Is(err, ErrNotFound) {
+                continue
+            }
+            if err != nil {
+                return nil, fmt.Errorf("findSimilarSongs: %v", err)
+            }
+            similar = append(similar, jobs.SimilarSong{
+                Id: s.Id,
+                Title: s.Title,
+                Artist: s.Artist,
+                Similarity: match.Similarity,
+            })
+        }
+        return similar, nil
+    }
+}
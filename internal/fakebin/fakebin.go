@@ -0,0 +1,79 @@
+/* Package fakebin builds fake yt-dlp, ffmpeg and ffprobe executables so that
+ * the download pipeline can be tested without the real programs or a
+ * network. The fakes are one program, testdata/main.go, that acts like
+ * whichever program it is named after.
+ *
+ * The fake yt-dlp "downloads" <id>.webm and extracts it to <id>.opus, both
+ * text files, printing the same progress and destination lines as yt-dlp and
+ * a warning. Ids that start with one of these fail instead, they are padded
+ * to 11 characters to look like video ids, ex. "throttled01":
+ *     unavailable  ERROR: Video unavailable
+ *     throttled    ERROR: HTTP Error 429
+ *     crash        a traceback without an ERROR: line
+ *     corrupt      succeeds, but ffmpeg and ffprobe reject the file
+ *     slow         takes 10 seconds, for cancelling
+ * With --flat-playlist it lists a playlist of three songs for any URL with a
+ * list= parameter, other URLs are unsupported. With -J alone it prints the
+ * details of a music video, or of a song on a "- Topic" channel for ids that
+ * start with "topic".
+ * The fake ffmpeg copies its first input to its output, or decodes it to 10
+ * seconds of chords that are the same for files with the same content, and
+ * the fake ffprobe reports a 3.5 second file, with the tags that are written
+ * in it as lines like "TITLE=Good Day". */
+package fakebin
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+)
+
+type Paths struct {
+    YtDlp, FFmpeg, FFprobe string
+}
+
+/* Builds the fakes into dir, which must exist. It needs the go command,
+ * which is always around when running tests. */
+func Build(dir string) (Paths,error) {
+    var paths Paths
+    _, file, _, ok := runtime.Caller(0)
+    if !ok {
+        return paths, fmt.Errorf("fakebin.Build Could not find the fakebin source")
+    }
+    exe := ""
+    if runtime.GOOS == "windows" {
+        exe = ".exe"
+    }
+    bin := filepath.Join(dir, "fakebin" + exe)
+    cmd := exec.Command(goCommand(), "build", "-o", bin, "./testdata")
+    cmd.Dir = filepath.Dir(file)
+    out, err := cmd.CombinedOutput()
+    if err != nil {
+        return paths, fmt.Errorf("fakebin.Build go build: %v: %s", err, out)
+    }
+    paths.YtDlp = filepath.Join(dir, "yt-dlp" + exe)
+    paths.FFmpeg = filepath.Join(dir, "ffmpeg" + exe)
+    paths.FFprobe = filepath.Join(dir, "ffprobe" + exe)
+    for _,path := range []string{ paths.YtDlp, paths.FFmpeg, paths.FFprobe } {
+        err = os.Link(bin, path)
+        if err != nil {
+            return paths, fmt.Errorf("fakebin.Build: %w", err)
+        }
+    }
+    return paths, nil
+}
+
+// the go command that is running the tests, or the one in $PATH
+func goCommand() string {
+    exe := ""
+    if runtime.GOOS == "windows" {
+        exe = ".exe"
+    }
+    path := filepath.Join(runtime.GOROOT(), "bin", "go" + exe)
+    if _, err := os.Stat(path); err == nil {
+        return path
+    }
+    return "go"
+}
@@ -0,0 +1,324 @@
+/* A stand-in for yt-dlp, ffmpeg and ffprobe, it acts like whichever one it is
+ * named after. The "audio" files that it writes are text, a file that contains
+ * "corrupt" is treated like a partial download. See package fakebin for how
+ * each fake behaves. */
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func main() {
+    name := strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe")
+    var code int
+    switch name {
+    case "yt-dlp":
+        code = ytDlp(os.Args[1:])
+    case "ffmpeg":
+        code = ffmpeg(os.Args[1:])
+    case "ffprobe":
+        code = ffprobe(os.Args[1:])
+    default:
+        fmt.Fprintf(os.Stderr, "fakebin: unknown program %s\n", name)
+        code = 2
+    }
+    os.Exit(code)
+}
+
+// yt-dlp --newline --extract-audio -o %(id)s.%(ext)s <id>
+// yt-dlp --flat-playlist -J -- <url>
+// yt-dlp -J --no-playlist -- <id>
+func ytDlp(args []string) int {
+    var template, id string
+    flatPlaylist, dump := false, false
+    for i := 0; i < len(args); i++ {
+        switch {
+        case args[i] == "-o":
+            i++
+            template = args[i]
+        case args[i] == "--flat-playlist":
+            flatPlaylist = true
+        case args[i] == "-J":
+            dump = true
+        case args[i] == "--" && i + 1 < len(args):
+            i++
+            id = args[i]
+        case !strings.HasPrefix(args[i], "-"):
+            id = args[i]
+        }
+    }
+    if flatPlaylist {
+        return ytDlpPlaylist(id)
+    }
+    if dump {
+        return ytDlpVideo(id)
+    }
+    output := func(ext string) string {
+        s := strings.ReplaceAll(template, "%(id)s", id)
+        return strings.ReplaceAll(s, "%(ext)s", ext)
+    }
+
+    fmt.Printf("[youtube] Extracting URL: %s\n", id)
+    fmt.Printf("[youtube] %s: Downloading webpage\n", id)
+    switch {
+    case strings.HasPrefix(id, "unavailable"):
+        fmt.Fprintf(os.Stderr, "ERROR: [youtube] %s: Video unavailable. This video has been removed by the uploader\n", id)
+        return 1
+    case strings.HasPrefix(id, "throttled"):
+        fmt.Fprintln(os.Stderr, "ERROR: unable to download video data: HTTP Error 429: Too Many Requests")
+        return 1
+    case strings.HasPrefix(id, "crash"):
+        fmt.Fprintln(os.Stderr, "Traceback (most recent call last):")
+        fmt.Fprintln(os.Stderr, "KeyError: 'formats'")
+        return 1
+    }
+    fmt.Fprintf(os.Stderr, "WARNING: [youtube] %s: nsig extraction failed: Some formats may be missing\n", id)
+
+    webm := output("webm")
+    fmt.Printf("[download] Destination: %s\n", webm)
+    content := "audio of " + id
+    if strings.HasPrefix(id, "corrupt") {
+        content = "corrupt audio"
+    }
+    err := os.WriteFile(webm + ".part", []byte(content), 0644)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+        return 1
+    }
+    for _,percent := range []float64{ 0, 12.5, 37.2, 64.9, 100 } {
+        fmt.Printf("[download] %5.1f%% of    3.21MiB at    1.20MiB/s ETA 00:01\n", percent)
+        if strings.HasPrefix(id, "slow") {
+            // long enough for a test to cancel the download
+            time.Sleep(2 * time.Second)
+        }
+    }
+    os.Rename(webm + ".part", webm)
+
+    opus := output("opus")
+    fmt.Printf("[ExtractAudio] Destination: %s\n", opus)
+    os.WriteFile(opus, []byte(content), 0644)
+    fmt.Printf("Deleting original file %s (pass -k to keep)\n", webm)
+    os.Remove(webm)
+    return 0
+}
+
+/* Prints the details of a music video, or of a song that YouTube knows the
+ * track and artist of if the id starts with "topic" */
+func ytDlpVideo(id string) int {
+    if strings.HasPrefix(id, "unavailable") {
+        fmt.Fprintf(os.Stderr, "ERROR: [youtube] %s: Video unavailable. This video has been removed by the uploader\n", id)
+        return 1
+    }
+    if strings.HasPrefix(id, "album") {
+        fmt.Printf(`{"id": %q, "title": "IU - Love poem (Full Album)", "duration": 600.0,
+"uploader": "IU Official", "channel": "IU Official",
+"thumbnail": "https://i.ytimg.com/vi/%s/maxresdefault.jpg",
+"webpage_url": "https://www.youtube.com/watch?v=%s",
+"chapters": [
+ {"title": "01. unlucky", "start_time": 0.0, "end_time": 200.5},
+ {"title": "2 - The visitor", "start_time": 200.5, "end_time": 400.0},
+ {"title": "IU & Someone - 7 rings", "start_time": 400.0, "end_time": 600.0}
+]}
+`, id, id, id)
+        return 0
+    }
+    if strings.HasPrefix(id, "topic") {
+        fmt.Printf(`{"id": %q, "title": "Good Day", "track": "Good Day", "artist": "IU",
+"album": "Real", "duration": 233.0, "uploader": "IU - Topic", "channel": "IU - Topic",
+"thumbnail": "https://i.ytimg.com/vi/%s/maxresdefault.jpg",
+"webpage_url": "https://www.youtube.com/watch?v=%s"}
+`, id, id, id)
+        return 0
+    }
+    fmt.Printf(`{"id": %q, "title": "IU - You & I (Official Audio)", "duration": 241.0,
+"uploader": "IU Official", "channel": "IU Official",
+"thumbnail": "https://i.ytimg.com/vi/%s/hqdefault.jpg",
+"webpage_url": "https://www.youtube.com/watch?v=%s"}
+`, id, id, id)
+    return 0
+}
+
+/* Prints a playlist of three videos and a channel tab, which yt-dlp lists
+ * when given a channel's URL */
+func ytDlpPlaylist(url string) int {
+    if !strings.Contains(url, "list=") {
+        fmt.Fprintf(os.Stderr, "ERROR: [generic] Unsupported URL: %s\n", url)
+        return 1
+    }
+    fmt.Print(`{"_type": "playlist", "id": "PLfake", "title": "Fake Mix",
+"uploader": "Fake Uploader", "webpage_url": "https://www.youtube.com/playlist?list=PLfake",
+"entries": [
+ {"_type": "url", "ie_key": "Youtube", "id": "aaaaaaaaaaa", "url": "https://www.youtube.com/watch?v=aaaaaaaaaaa",
+  "title": "IU - You & I (Official Audio)", "duration": 241.0, "channel": "IU Official",
+  "thumbnails": [{"url": "https://i.ytimg.com/vi/aaaaaaaaaaa/hqdefault.jpg", "width": 480, "height": 360},
+   {"url": "https://i.ytimg.com/vi/aaaaaaaaaaa/default.jpg", "width": 120, "height": 90}]},
+ {"_type": "url", "ie_key": "Youtube", "id": "bbbbbbbbbbb", "url": "https://www.youtube.com/watch?v=bbbbbbbbbbb",
+  "title": "Good Day", "duration": 233.0, "channel": "IU - Topic", "thumbnails": []},
+ {"_type": "url", "ie_key": "YoutubeTab", "id": "UCfake", "url": "https://www.youtube.com/channel/UCfake/shorts",
+  "title": "Fake Uploader - Shorts"},
+ {"_type": "url", "ie_key": "Soundcloud", "id": "123", "url": "https://soundcloud.com/fake/track",
+  "title": "Track", "duration": 180.5, "uploader": "Fake Artist"}
+]}
+`)
+    return 0
+}
+
+// ffmpeg options that are not followed by a value
+var ffmpegFlags = map[string]bool{
+    "-y": true, "-n": true, "-vn": true, "-hide_banner": true, "-nostats": true,
+}
+
+/* Copies the first input to the output. Supports -progress pipe:1, writing to
+ * pipe:1 or -, the loudnorm filter's print_format=json and decoding to
+ * -f s16le. */
+func ffmpeg(args []string) int {
+    var inputs []string
+    var output, progress, filter, format string
+    sampleRate := 44100
+    for i := 0; i < len(args); i++ {
+        arg := args[i]
+        if !strings.HasPrefix(arg, "-") || arg == "-" {
+            output = arg
+            continue
+        }
+        if ffmpegFlags[arg] || i + 1 == len(args) {
+            continue
+        }
+        i++
+        switch arg {
+        case "-i":
+            inputs = append(inputs, args[i])
+        case "-progress":
+            progress = args[i]
+        case "-af":
+            filter = args[i]
+        case "-f":
+            format = args[i]
+        case "-ar":
+            fmt.Sscan(args[i], &sampleRate)
+        }
+    }
+    if len(inputs) == 0 || output == "" {
+        fmt.Fprintln(os.Stderr, "At least one output file must be specified")
+        return 1
+    }
+    b, err := os.ReadFile(inputs[0])
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "%s: No such file or directory\n", inputs[0])
+        return 1
+    }
+    if strings.Contains(string(b), "corrupt") {
+        fmt.Fprintf(os.Stderr, "%s: Invalid data found when processing input\n", inputs[0])
+        return 1
+    }
+    if progress == "pipe:1" {
+        for _,us := range []string{ "N/A", "0", "1750000", "3500000" } {
+            fmt.Printf("out_time_us=%s\nprogress=continue\n", us)
+        }
+        fmt.Println("progress=end")
+    }
+    if strings.Contains(filter, "print_format=json") {
+        fmt.Fprint(os.Stderr, `[Parsed_loudnorm_0 @ 0x5581]
+{
+	"input_i" : "-11.00",
+	"input_tp" : "-0.50",
+	"input_lra" : "5.20",
+	"input_thresh" : "-21.30",
+	"output_i" : "-18.00",
+	"output_tp" : "-1.00",
+	"output_lra" : "4.80",
+	"output_thresh" : "-28.20",
+	"normalization_type" : "dynamic",
+	"target_offset" : "0.00"
+}
+`)
+    }
+    switch {
+    case format == "null":
+    case format == "s16le":
+        os.Stdout.Write(decode(b, sampleRate))
+    case output == "-" || output == "pipe:1":
+        os.Stdout.Write(b)
+    default:
+        err = os.WriteFile(output, b, 0644)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "%s: %v\n", output, err)
+            return 1
+        }
+    }
+    return 0
+}
+
+/* Returns 10 seconds of mono audio, chords picked at random with the file's
+ * content as the seed, so that copies of a file sound the same and files of
+ * different videos sound different */
+func decode(content []byte, sampleRate int) []byte {
+    h := fnv.New64a()
+    h.Write(content)
+    r := rand.New(rand.NewSource(int64(h.Sum64())))
+    b := make([]byte, 0, 2 * 10 * sampleRate)
+    for i := 0; i < 10 * sampleRate; {
+        length := int((0.15 + 0.35 * r.Float64()) * float64(sampleRate))
+        var notes [4]float64
+        for n := range notes {
+            notes[n] = 110 * math.Pow(2, float64(r.Intn(36)) / 12)
+        }
+        for k := 0; k < length && i < 10 * sampleRate; k, i = k + 1, i + 1 {
+            t := float64(i) / float64(sampleRate)
+            var v float64
+            for _,f := range notes {
+                for h := 1.0; h <= 6; h++ {
+                    v += math.Sin(2 * math.Pi * f * h * t) / h
+                }
+            }
+            v *= 1200 * math.Exp(-2 * float64(k) / float64(length))
+            b = binary.LittleEndian.AppendUint16(b, uint16(int16(v)))
+        }
+    }
+    return b
+}
+
+// Reports a 3.5 second file whose codec is chosen by its extension
+func ffprobe(args []string) int {
+    file := args[len(args) - 1]
+    b, err := os.ReadFile(file)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "%s: No such file or directory\n", file)
+        return 1
+    }
+    if strings.Contains(string(b), "corrupt") {
+        fmt.Fprintf(os.Stderr, "%s: Invalid data found when processing input\n", file)
+        return 1
+    }
+    codec := strings.TrimPrefix(filepath.Ext(file), ".")
+    switch codec {
+    case "m4a", "aac":
+        codec = "aac"
+    case "webm":
+        codec = "opus"
+    }
+    // lines like "TITLE=Good Day" are the file's tags
+    tags := map[string]string{}
+    for _,line := range strings.Split(string(b), "\n") {
+        key, value, ok := strings.Cut(line, "=")
+        if ok && key != "" && key == strings.ToUpper(key) {
+            tags[key] = value
+        }
+    }
+    tagsJson, _ := json.Marshal(tags)
+    fmt.Printf(`{
+    "streams": [ { "codec_type": "audio", "codec_name": %q } ],
+    "format": { "duration": "3.500000", "bit_rate": "128000", "size": "%d", "tags": %s }
+}
+`, codec, len(b), tagsJson)
+    return 0
+}
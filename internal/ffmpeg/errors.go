@@ -0,0 +1,99 @@
+package ffmpeg
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// What went wrong with an ffmpeg or ffprobe run, parsed from its stderr
+type ErrorKind string
+
+const (
+    ErrorUnknown ErrorKind = "unknown"
+    // The input is corrupt or incomplete, ex. a partial download
+    ErrorInvalidInput ErrorKind = "invalid-input"
+    // The input file does not exist
+    ErrorMissingInput ErrorKind = "missing-input"
+    // This build of ffmpeg does not support an encoder, format or option
+    ErrorUnsupported ErrorKind = "unsupported"
+    ErrorNoSpace ErrorKind = "no-space"
+    // The ffmpeg or ffprobe executable could not be found
+    ErrorNotInstalled ErrorKind = "not-installed"
+)
+
+// The kind of error for each message, the first match wins
+var errorPatterns = []struct{
+    substr string
+    kind ErrorKind
+}{
+    { "Invalid data found when processing input", ErrorInvalidInput },
+    { "moov atom not found", ErrorInvalidInput },
+    { "could not find codec parameters", ErrorInvalidInput },
+    { "Error while decoding", ErrorInvalidInput },
+    { "No such file or directory", ErrorMissingInput },
+    { "Unknown encoder", ErrorUnsupported },
+    { "Encoder not found", ErrorUnsupported },
+    { "Unrecognized option", ErrorUnsupported },
+    { "Requested output format", ErrorUnsupported },
+    { "No space left on device", ErrorNoSpace },
+}
+
+// The most lines of stderr kept in an Error
+const maxErrorLines = 5
+
+// A failed ffmpeg or ffprobe run
+type Error struct {
+    // "ffmpeg" or "ffprobe"
+    Program string
+    Kind ErrorKind
+    // The last lines that the program wrote to stderr, which is where it
+    // explains the error
+    Messages []string
+    // The error from running the process, ex. exit status 1
+    Err error
+}
+
+func (e *Error) Error() string {
+    if len(e.Messages) == 0 {
+        return fmt.Sprintf("%s: %v", e.Program, e.Err)
+    }
+    return fmt.Sprintf("%s: %v: %s", e.Program, e.Err, strings.Join(e.Messages, "; "))
+}
+
+func (e *Error) Unwrap() error {
+    return e.Err
+}
+
+// Wraps the error of running program in an *Error, nil stays nil
+func newError(program string, err error, stderr string) error {
+    if err == nil {
+        return nil
+    }
+    var lines []string
+    for _,line := range strings.Split(stderr, "\n") {
+        // progress lines end with a carriage return instead of a newline
+        line = strings.TrimSpace(line[strings.LastIndexByte(line, '\r') + 1:])
+        if line != "" {
+            lines = append(lines, line)
+        }
+    }
+    e := &Error{
+        Program: program,
+        Kind: ErrorUnknown,
+        Messages: lines[max(0, len(lines) - maxErrorLines):],
+        Err: err,
+    }
+    if errors.Is(err, exec.ErrNotFound) {
+        e.Kind = ErrorNotInstalled
+        return e
+    }
+    for _,pattern := range errorPatterns {
+        if strings.Contains(stderr, pattern.substr) {
+            e.Kind = pattern.kind
+            break
+        }
+    }
+    return e
+}
@@ -2,8 +2,11 @@ package ffmpeg
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"fmt"
 	"os"
+	"os/exec"
 	"strconv"
 	"strings"
 	"sync"
@@ -11,11 +14,20 @@ import (
 	ffmpeg "github.com/u2takey/ffmpeg-go"
 )
 
+// The ffmpeg and ffprobe executables, a name without a slash is looked up in $PATH
+var (
+    FFmpegPath = "ffmpeg"
+    FFprobePath = "ffprobe"
+)
+
 type Converter struct {
     onProgressUpdate func(uint8)
+    // the section of the input that is converted, see Cut
+    start, end float64
 
     wg sync.WaitGroup
     filepath string
+    duration uint64
     err error
 }
 
@@ -27,83 +39,200 @@ func (c *Converter) Wait() {
     c.wg.Wait()
 }
 
+/* Only converts the audio from start until end, in seconds, ex. one chapter
+ * of a full album. An end of 0 is the end of the input. Must be called before
+ * the conversion is started. */
+func (c *Converter) Cut(start, end float64) {
+    c.start, c.end = start, end
+}
+
 // returns the first error that occured or nil
 func (c *Converter) Err() error {
     return c.err
 }
 
-// Asynchronously converts the file
+// returns the duration of the converted audio in milliseconds, the input's
+// unless it was Cut, only valid after the conversion has finished
+func (c *Converter) Duration() uint64 {
+    return c.duration
+}
+
+// What ffprobe reports about an audio file
+type FileInfo struct {
+    // Duration in milliseconds
+    Duration uint64
+    // The average bitrate in bits per second, 0 if unknown
+    Bitrate int64
+    // Size in bytes
+    Size int64
+    // The codec of the first audio stream, ex. "mp3" or "opus"
+    Codec string
+    // The file's metadata with lowercase keys, ex. "title" and "artist"
+    Tags map[string]string
+}
+
+/* Runs ffprobe on the file, or an http(s) URL, a failed run returns an
+ * *Error */
+func Probe(fileName string) (FileInfo,error) {
+    var info FileInfo
+    cmd := exec.Command(FFprobePath, "-loglevel", "error",
+        "-show_format", "-show_streams", "-of", "json", fileName)
+    var stdout, stderr strings.Builder
+    cmd.Stdout = &stdout
+    cmd.Stderr = &stderr
+    err := cmd.Run()
+    if err != nil {
+        return info, newError("ffprobe", err, stderr.String())
+    }
+    probeResultJson := stdout.String()
+
+    type ProbeResult struct {
+        Format struct {
+            Duration string `json:"duration"`
+            BitRate string `json:"bit_rate"`
+            Size string `json:"size"`
+            Tags map[string]string `json:"tags"`
+        } `json:"format"`
+        Streams []struct {
+            CodecType string `json:"codec_type"`
+            CodecName string `json:"codec_name"`
+        } `json:"streams"`
+    }
+    var x ProbeResult
+    err = json.Unmarshal([]byte(probeResultJson), &x)
+    if err != nil {
+        return info, err
+    }
+    seconds, err := strconv.ParseFloat(x.Format.Duration, 64)
+    if err != nil {
+        return info, err
+    }
+    info.Duration = uint64(seconds * 1000)
+    // not every format reports these, they are left at 0 when missing
+    info.Bitrate, _ = strconv.ParseInt(x.Format.BitRate, 10, 64)
+    info.Size, _ = strconv.ParseInt(x.Format.Size, 10, 64)
+    info.Tags = make(map[string]string, len(x.Format.Tags))
+    for key, value := range x.Format.Tags {
+        info.Tags[strings.ToLower(key)] = value
+    }
+    for _,stream := range x.Streams {
+        if stream.CodecType == "audio" {
+            info.Codec = stream.CodecName
+            break
+        }
+    }
+    return info, nil
+}
+
+// formats milliseconds as seconds for ffmpeg's time options
+func formatSeconds(ms uint64) string {
+    return strconv.FormatFloat(float64(ms) / 1000, 'f', 3, 64)
+}
+
+// Asynchronously converts the file to an MP3 with ffmpeg's default settings,
+// the input file is removed once it has been converted
 func (c *Converter) ConvertToMP3(inFileName, outFileName string) {
     c.wg.Add(1)
     go func() {
         defer c.wg.Done()
-
-        probeResultJson, err := ffmpeg.Probe(inFileName)
-        if err != nil {
-            c.err = err
+        c.err = c.convert(context.Background(), inFileName, outFileName, Options{ Codec: "mp3" })
+        if c.err != nil {
             return
         }
+        c.err = os.Remove(inFileName)
+    }()
+}
 
-        type ProbeResult struct {
-            Format struct {
-                Duration string `json:"duration"`
-            } `json:"format"`
-        }
-        var x ProbeResult
-        err = json.Unmarshal([]byte(probeResultJson), &x)
-        if err != nil {
-            c.err = err
-            return
+/* Asynchronously converts the file using the codec and quality in opts. The
+ * output format is chosen from the extension of outFileName, which should be
+ * the codec's Extension. The input file is not removed. */
+func (c *Converter) Convert(inFileName, outFileName string, opts Options) {
+    c.ConvertContext(context.Background(), inFileName, outFileName, opts)
+}
+
+/* Like Convert, but cancelling ctx kills ffmpeg and removes the partially
+ * written output file. Err then returns ctx.Err(). */
+func (c *Converter) ConvertContext(ctx context.Context, inFileName, outFileName string, opts Options) {
+    c.wg.Add(1)
+    go func() {
+        defer c.wg.Done()
+        c.err = c.convert(ctx, inFileName, outFileName, opts)
+        if ctx.Err() != nil {
+            os.Remove(outFileName)
+            c.err = ctx.Err()
         }
-        parts := strings.Split(x.Format.Duration, ".")
-        sec,err := strconv.ParseUint(parts[0],10,32)
-        if err != nil {
-            c.err = err
-            return
+    }()
+}
+
+func (c *Converter) convert(ctx context.Context, inFileName, outFileName string, opts Options) error {
+    err := opts.Validate()
+    if err != nil {
+        return err
+    }
+    info, err := Probe(inFileName)
+    if err != nil {
+        return err
+    }
+    duration := info.Duration
+    inputArgs := ffmpeg.KwArgs{}
+    kwargs := opts.kwArgs()
+    // a section is always encoded, a copy could only be cut between frames
+    if opts.copies(info.Codec) && c.start == 0 && c.end == 0 {
+        kwargs["c:a"] = "copy"
+    }
+    if c.start > 0 || c.end > 0 {
+        start := uint64(c.start * 1000)
+        end := duration
+        if c.end > 0 {
+            end = min(uint64(c.end * 1000), duration)
         }
-        us,err := strconv.ParseUint(parts[1],10,32)
-        if err != nil {
-            c.err = err
-            return
+        if start >= end {
+            return fmt.Errorf("The section from %.3fs to %.3fs is not in the %.3fs of audio",
+                c.start, c.end, float64(duration) / 1000)
         }
-        duration := (sec * 1000) + (us / 1000)
+        duration = end - start
+        // seeking the input is fast, and exact since the audio is decoded
+        inputArgs["ss"] = formatSeconds(start)
+        kwargs["t"] = formatSeconds(duration)
+    }
+    c.duration = duration
 
-        cmd := ffmpeg.Input(inFileName).
-            Output(outFileName, ffmpeg.KwArgs{ "progress": "pipe:1" }).
-            OverWriteOutput().
-            Compile()
+    kwargs["progress"] = "pipe:1"
+    args := ffmpeg.Input(inFileName, inputArgs).
+        Output(outFileName, kwargs).
+        GlobalArgs("-hide_banner", "-nostats").
+        OverWriteOutput().
+        GetArgs()
+    cmd := exec.CommandContext(ctx, FFmpegPath, args...)
+    var stderr strings.Builder
+    cmd.Stderr = &stderr
 
-        stdout, err := cmd.StdoutPipe()
-        if err != nil {
-            c.err = err
-            return
-        }
-        if err := cmd.Start(); err != nil {
-            c.err = err
-            return
-        }
+    stdout, err := cmd.StdoutPipe()
+    if err != nil {
+        return err
+    }
+    if err := cmd.Start(); err != nil {
+        return newError("ffmpeg", err, "")
+    }
 
-        scanner := bufio.NewScanner(stdout)
-        for scanner.Scan() {
-            line := scanner.Text()
-            if strings.HasPrefix(line, "out_time_us=") {
-                time,err := strconv.ParseUint(strings.Split(line, "=")[1],10,64)
-                if err != nil {
-                    c.err = err
-                    return
-                }
-                time = time / 1000
-                time = min(time, duration)
-                percent := uint8((time * 100) / duration)
+    scanner := bufio.NewScanner(stdout)
+    for scanner.Scan() {
+        line := scanner.Text()
+        if strings.HasPrefix(line, "out_time_us=") && duration > 0 {
+            time,err := strconv.ParseUint(strings.Split(line, "=")[1],10,64)
+            if err != nil {
+                // ffmpeg reports N/A before the first frame
+                continue
+            }
+            time = time / 1000
+            time = min(time, duration)
+            percent := uint8((time * 100) / duration)
+            if c.onProgressUpdate != nil {
                 c.onProgressUpdate(percent)
             }
         }
+    }
 
-        err = os.Remove(inFileName)
-        if err != nil {
-            c.err = err
-            return
-        }
-    }()
+    // the output file is only complete once ffmpeg has exited
+    return newError("ffmpeg", cmd.Wait(), stderr.String())
 }
-
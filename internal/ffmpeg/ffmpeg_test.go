@@ -1,6 +1,16 @@
 package ffmpeg
 
-import "testing"
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
 
 func TestConvertToMP3(t *testing.T) {
     var converter Converter
@@ -16,3 +26,200 @@ func TestConvertToMP3(t *testing.T) {
     }
 }
 
+
+func TestWriteHLSMasterPlaylist(t *testing.T) {
+    var b strings.Builder
+    err := WriteHLSMasterPlaylist(&b, []HLSRendition{
+        { Name: "48k", Bitrate: "48k", Bandwidth: 56000 },
+        { Name: "160k", Bitrate: "160k", Bandwidth: 180000 },
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    expected := "#EXTM3U\n#EXT-X-VERSION:3\n" +
+        "#EXT-X-STREAM-INF:BANDWIDTH=56000,CODECS=\"mp4a.40.2\"\n48k/index.m3u8\n" +
+        "#EXT-X-STREAM-INF:BANDWIDTH=180000,CODECS=\"mp4a.40.2\"\n160k/index.m3u8\n"
+    if b.String() != expected {
+        t.Errorf("Expected:\n%s\nGot:\n%s", expected, b.String())
+    }
+}
+
+func TestOptionsValidate(t *testing.T) {
+    valid := []Options{
+        { Codec: "mp3" },
+        { Codec: "mp3", Quality: "2" },
+        { Codec: "aac", Quality: "0.75" },
+        { Codec: "opus", Bitrate: "128k", SampleRate: 48000 },
+        { Codec: "flac" },
+    }
+    for _,opts := range valid {
+        if err := opts.Validate(); err != nil {
+            t.Errorf("%+v: expected no error, got %v", opts, err)
+        }
+    }
+    invalid := []Options{
+        {},
+        { Codec: "wav" },
+        { Codec: "mp3", Bitrate: "128" },
+        { Codec: "mp3", Bitrate: "128k", Quality: "2" },
+        { Codec: "mp3", Quality: "-1" },
+        { Codec: "opus", Quality: "5" },
+        { Codec: "flac", Quality: "5" },
+        { Codec: "aac", SampleRate: -1 },
+    }
+    for _,opts := range invalid {
+        if err := opts.Validate(); err == nil {
+            t.Errorf("%+v: expected an error", opts)
+        }
+    }
+}
+
+func TestOptionsCopies(t *testing.T) {
+    tests := []struct{ opts Options; input string; copies bool }{
+        { Options{ Codec: "flac" }, "flac", true },
+        { Options{ Codec: "flac" }, "opus", false },
+        { Options{ Codec: "flac", SampleRate: 44100 }, "flac", false },
+        { Options{ Codec: "mp3" }, "mp3", false },
+    }
+    for _,test := range tests {
+        if got := test.opts.copies(test.input); got != test.copies {
+            t.Errorf("%+v copies %s: expected %v, got %v", test.opts, test.input, test.copies, got)
+        }
+    }
+}
+
+func TestTagArgs(t *testing.T) {
+    args := strings.Join(tagArgs("in.mp3", "in.mp3.tmp", "tags.txt", Codecs["mp3"], "cover.jpg"), " ")
+    expected := "-loglevel error -i in.mp3 -f ffmetadata -i tags.txt -i cover.jpg " +
+        "-map 0:a -map_metadata 1 -map_metadata:s:a -1 -map 2:v -disposition:v attached_pic " +
+        "-metadata:s:v title=Album cover -metadata:s:v comment=Cover (front) " +
+        "-c copy -id3v2_version 3 -f mp3 -y in.mp3.tmp"
+    if args != expected {
+        t.Errorf("mp3: expected\n%s\ngot\n%s", expected, args)
+    }
+    // opus gets its cover through the metadata file instead
+    args = strings.Join(tagArgs("in.opus", "in.opus.tmp", "tags.txt", Codecs["opus"], "cover.jpg"), " ")
+    if strings.Contains(args, "cover.jpg") {
+        t.Errorf("opus: expected no picture stream, got\n%s", args)
+    }
+}
+
+func TestEscapeFFMetadata(t *testing.T) {
+    got := escapeFFMetadata("AC=DC; #1 \\ hits\n")
+    expected := "AC\\=DC\\; \\#1 \\\\ hits\\\n"
+    if got != expected {
+        t.Errorf("Expected %q, got %q", expected, got)
+    }
+}
+
+func TestFlacPictureBlock(t *testing.T) {
+    var img bytes.Buffer
+    png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 3, 2)))
+    block, err := flacPictureBlock(img.Bytes())
+    if err != nil {
+        t.Fatal(err)
+    }
+    r := bytes.NewReader(block)
+    readString := func() string {
+        var n uint32
+        binary.Read(r, binary.BigEndian, &n)
+        b := make([]byte, n)
+        r.Read(b)
+        return string(b)
+    }
+    var pictureType, width, height uint32
+    binary.Read(r, binary.BigEndian, &pictureType)
+    mimeType := readString()
+    readString()
+    binary.Read(r, binary.BigEndian, &width)
+    binary.Read(r, binary.BigEndian, &height)
+    if pictureType != 3 || mimeType != "image/png" || width != 3 || height != 2 {
+        t.Errorf("Unexpected picture header, type %d %s %dx%d", pictureType, mimeType, width, height)
+    }
+    r.Seek(8, io.SeekCurrent)
+    if data := readString(); data != img.String() {
+        t.Error("Expected the block to end with the image")
+    }
+
+    if _,err := flacPictureBlock([]byte("GIF89a")); err == nil {
+        t.Error("Expected an error for a GIF")
+    }
+}
+
+func TestParseLoudnorm(t *testing.T) {
+    output := `[Parsed_loudnorm_0 @ 0x5581c0c0] 
+{
+	"input_i" : "-13.48",
+	"input_tp" : "-0.10",
+	"input_lra" : "5.30",
+	"input_thresh" : "-23.61",
+	"output_i" : "-18.02",
+	"output_tp" : "-4.59",
+	"output_lra" : "5.10",
+	"output_thresh" : "-28.13",
+	"normalization_type" : "dynamic",
+	"target_offset" : "0.02"
+}
+`
+    loudness, err := parseLoudnorm(output)
+    if err != nil {
+        t.Fatal(err)
+    }
+    expected := Loudness{ Integrated: -13.48, TruePeak: -0.1, Range: 5.3, Threshold: -23.61 }
+    if loudness != expected {
+        t.Errorf("Expected %+v, got %+v", expected, loudness)
+    }
+    if gain := loudness.TrackGain(); gain < -4.53 || gain > -4.51 {
+        t.Errorf("Expected a track gain of -4.52, got %f", gain)
+    }
+    if peak := loudness.TrackPeak(); peak < 0.988 || peak > 0.989 {
+        t.Errorf("Expected a track peak of 0.9886, got %f", peak)
+    }
+
+    silent := strings.Replace(output, `"-13.48"`, `"-inf"`, 1)
+    if _,err := parseLoudnorm(silent); err == nil {
+        t.Error("Expected an error for silent audio")
+    }
+    if _,err := parseLoudnorm("ffmpeg version 6.1"); err == nil {
+        t.Error("Expected an error for output without measurements")
+    }
+}
+
+func TestWriteFFMetadata(t *testing.T) {
+    f, err := os.CreateTemp(t.TempDir(), "*.ffmetadata")
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = writeFFMetadata(f, Tags{ Title: "You & I", Artist: "IU", Track: 3, Gain: -4.52, Peak: 0.988553 },
+        Codecs["mp3"], nil)
+    f.Close()
+    if err != nil {
+        t.Fatal(err)
+    }
+    b, _ := os.ReadFile(f.Name())
+    expected := ";FFMETADATA1\ntitle=You & I\nartist=IU\ntrack=3\n" +
+        "REPLAYGAIN_TRACK_GAIN=-4.52 dB\nREPLAYGAIN_TRACK_PEAK=0.988553\n"
+    if string(b) != expected {
+        t.Errorf("Expected:\n%s\nGot:\n%s", expected, b)
+    }
+}
+
+func TestNewError(t *testing.T) {
+    exitErr := errors.New("exit status 1")
+    stderr := "[mov,mp4,m4a,3gp,3g2,mj2 @ 0x55d] moov atom not found\n" +
+        "abc.m4a: Invalid data found when processing input\n"
+    e := newError("ffmpeg", exitErr, stderr).(*Error)
+    if e.Kind != ErrorInvalidInput || len(e.Messages) != 2 || !errors.Is(e, exitErr) {
+        t.Errorf("Expected an invalid input error, got %+v", e)
+    }
+    // only the last lines are kept, progress updates are cut at the carriage return
+    stderr = "1\n2\n3\n4\nsize=1kB time=00:00:01\rsize=2kB time=00:00:02\nUnknown encoder 'libfoo'\n"
+    e = newError("ffmpeg", exitErr, stderr).(*Error)
+    if e.Kind != ErrorUnsupported || len(e.Messages) != 5 || e.Messages[0] != "2" ||
+    e.Messages[3] != "size=2kB time=00:00:02" {
+        t.Errorf("Expected the last 5 lines and an unsupported error, got %+v", e)
+    }
+    if newError("ffmpeg", nil, stderr) != nil {
+        t.Error("Expected no error for a successful run")
+    }
+}
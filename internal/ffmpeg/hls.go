@@ -0,0 +1,116 @@
+package ffmpeg
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+// One of the bitrates that a song is segmented into for HLS streaming
+type HLSRendition struct {
+    // The name of the rendition's directory, ex. "96k"
+    Name string
+    // The AAC bitrate passed to ffmpeg, ex. "96k"
+    Bitrate string
+    // The peak bitrate in bits per second, advertised in the master playlist
+    Bandwidth int
+}
+
+var DefaultHLSRenditions = []HLSRendition{
+    { Name: "48k", Bitrate: "48k", Bandwidth: 56000 },
+    { Name: "96k", Bitrate: "96k", Bandwidth: 110000 },
+    { Name: "160k", Bitrate: "160k", Bandwidth: 180000 },
+}
+
+// The length of each HLS segment in seconds
+const hlsSegmentDuration = 6
+
+/* Synchronously segments the audio file into AAC renditions for HTTP Live
+ * Streaming. Each rendition is written to outDir/<rendition name>/ as an
+ * index.m3u8 media playlist with segment_000.ts, segment_001.ts, ... and the
+ * master playlist listing every rendition is written to outDir/master.m3u8.
+ * The output is written to a temporary directory first so that outDir only
+ * ever contains a complete set of playlists. The input file is not removed. */
+func SegmentHLS(inFileName, outDir string, renditions []HLSRendition) error {
+    if len(renditions) == 0 {
+        return fmt.Errorf("SegmentHLS: at least one rendition is required")
+    }
+    err := os.MkdirAll(filepath.Dir(outDir), 0755)
+    if err != nil {
+        return err
+    }
+    tmpDir, err := os.MkdirTemp(filepath.Dir(outDir), filepath.Base(outDir) + ".tmp-")
+    if err != nil {
+        return err
+    }
+    defer os.RemoveAll(tmpDir)
+
+    for _,rendition := range renditions {
+        dir := filepath.Join(tmpDir, rendition.Name)
+        err = os.Mkdir(dir, 0755)
+        if err != nil {
+            return err
+        }
+        args := ffmpeg.Input(inFileName).
+            Output(filepath.Join(dir, "index.m3u8"), ffmpeg.KwArgs{
+                "vn": "",
+                "c:a": "aac",
+                "b:a": rendition.Bitrate,
+                "ac": 2,
+                "f": "hls",
+                "hls_time": hlsSegmentDuration,
+                "hls_playlist_type": "vod",
+                "hls_segment_filename": filepath.Join(dir, "segment_%03d.ts"),
+            }).
+            GlobalArgs("-loglevel", "error").
+            OverWriteOutput().
+            GetArgs()
+        cmd := exec.Command(FFmpegPath, args...)
+        var stderr strings.Builder
+        cmd.Stderr = &stderr
+        err = newError("ffmpeg", cmd.Run(), stderr.String())
+        if err != nil {
+            return fmt.Errorf("SegmentHLS Failed to create the %s rendition: %w",
+                rendition.Name, err)
+        }
+    }
+
+    master, err := os.Create(filepath.Join(tmpDir, "master.m3u8"))
+    if err != nil {
+        return err
+    }
+    err = WriteHLSMasterPlaylist(master, renditions)
+    if e := master.Close(); err == nil {
+        err = e
+    }
+    if err != nil {
+        return err
+    }
+
+    err = os.RemoveAll(outDir)
+    if err != nil {
+        return err
+    }
+    return os.Rename(tmpDir, outDir)
+}
+
+// Writes a master playlist that lists the index.m3u8 of each rendition
+func WriteHLSMasterPlaylist(w io.Writer, renditions []HLSRendition) error {
+    _, err := fmt.Fprint(w, "#EXTM3U\n#EXT-X-VERSION:3\n")
+    if err != nil {
+        return err
+    }
+    for _,r := range renditions {
+        _, err = fmt.Fprintf(w, "#EXT-X-STREAM-INF:BANDWIDTH=%d,CODECS=\"mp4a.40.2\"\n%s/index.m3u8\n",
+            r.Bandwidth, r.Name)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
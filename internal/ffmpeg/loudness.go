@@ -0,0 +1,116 @@
+package ffmpeg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+// The loudness that track gains are relative to in LUFS, the same reference
+// as ReplayGain 2.0
+const ReferenceLoudness = -18.0
+
+// The loudness of an audio file as measured by EBU R128
+type Loudness struct {
+    // Integrated loudness in LUFS
+    Integrated float64
+    // True peak in dBTP
+    TruePeak float64
+    // Loudness range in LU
+    Range float64
+    // The gating threshold in LUFS
+    Threshold float64
+}
+
+// The gain in dB that brings the audio to ReferenceLoudness
+func (l Loudness) TrackGain() float64 {
+    return ReferenceLoudness - l.Integrated
+}
+
+// The true peak as a linear amplitude, where 1 is full scale
+func (l Loudness) TrackPeak() float64 {
+    return math.Pow(10, l.TruePeak / 20)
+}
+
+// The loudnorm filter only used to measure, the targets do not matter
+const loudnormAnalysisFilter = "loudnorm=I=-18:TP=-1:LRA=11:print_format=json"
+
+/* Synchronously measures the loudness of the audio file with the first pass
+ * of ffmpeg's loudnorm filter. The audio is decoded but nothing is written.
+ * Cancelling ctx kills ffmpeg. */
+func AnalyzeLoudness(ctx context.Context, fileName string) (Loudness,error) {
+    args := ffmpeg.Input(fileName).
+        Output("-", ffmpeg.KwArgs{
+            "vn": "",
+            "af": loudnormAnalysisFilter,
+            "f": "null",
+        }).
+        GlobalArgs("-hide_banner", "-nostats").
+        GetArgs()
+    cmd := exec.CommandContext(ctx, FFmpegPath, args...)
+    var stderr strings.Builder
+    cmd.Stderr = &stderr
+    err := cmd.Run()
+    if ctx.Err() != nil {
+        return Loudness{}, ctx.Err()
+    }
+    if err != nil {
+        return Loudness{}, fmt.Errorf("AnalyzeLoudness %s: %w", fileName,
+            newError("ffmpeg", err, stderr.String()))
+    }
+    loudness, err := parseLoudnorm(stderr.String())
+    if err != nil {
+        return loudness, fmt.Errorf("AnalyzeLoudness %s: %w", fileName, err)
+    }
+    return loudness, nil
+}
+
+/* Parses the JSON that the loudnorm filter prints at the end of ffmpeg's
+ * output, ex.
+ *     {
+ *         "input_i" : "-27.61",
+ *         "input_tp" : "-4.47",
+ *         "input_lra" : "18.06",
+ *         "input_thresh" : "-39.20",
+ *         ...
+ *     } */
+func parseLoudnorm(output string) (Loudness,error) {
+    var loudness Loudness
+    start := strings.LastIndex(output, "{")
+    end := strings.LastIndex(output, "}")
+    if start == -1 || end < start {
+        return loudness, fmt.Errorf("No loudnorm measurements in the ffmpeg output")
+    }
+    var x struct {
+        InputI string `json:"input_i"`
+        InputTP string `json:"input_tp"`
+        InputLRA string `json:"input_lra"`
+        InputThresh string `json:"input_thresh"`
+    }
+    err := json.Unmarshal([]byte(output[start:end+1]), &x)
+    if err != nil {
+        return loudness, err
+    }
+    for _,v := range []struct{ s string; f *float64 }{
+        { x.InputI, &loudness.Integrated },
+        { x.InputTP, &loudness.TruePeak },
+        { x.InputLRA, &loudness.Range },
+        { x.InputThresh, &loudness.Threshold },
+    } {
+        *v.f, err = strconv.ParseFloat(v.s, 64)
+        if err != nil {
+            return loudness, err
+        }
+    }
+    // silence has no loudness, a gain would be meaningless
+    if math.IsInf(loudness.Integrated, 0) || math.IsInf(loudness.TruePeak, 0) {
+        return loudness, fmt.Errorf("The audio is silent")
+    }
+    return loudness, nil
+}
@@ -0,0 +1,193 @@
+package ffmpeg
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The metadata written into audio files
+type Tags struct {
+    Title string
+    Artist string
+    Album string
+    // The song's track number on its album, not written when 0
+    Track int
+    // ReplayGain track gain in dB and peak as a linear amplitude, not written
+    // when Peak is 0
+    Gain float64
+    Peak float64
+}
+
+/* Synchronously writes the tags into the audio file, replacing any tags it
+ * already has. If artworkFile is not "" the JPEG or PNG image is embedded as
+ * the front cover, as an attached picture in MP3 and FLAC files and as a
+ * METADATA_BLOCK_PICTURE comment in Opus files. AAC files only get ID3 tags,
+ * ADTS has nowhere to put a picture. The audio itself is copied, not
+ * re-encoded, and the file is only replaced once ffmpeg has succeeded. */
+func WriteTags(fileName string, tags Tags, artworkFile string) error {
+    codec, err := codecForFile(fileName)
+    if err != nil {
+        return err
+    }
+    var artwork []byte
+    if artworkFile != "" {
+        artwork, err = os.ReadFile(artworkFile)
+        if err != nil {
+            return err
+        }
+    }
+
+    metadata, err := os.CreateTemp("", "melo-*.ffmetadata")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(metadata.Name())
+    err = writeFFMetadata(metadata, tags, codec, artwork)
+    if e := metadata.Close(); err == nil {
+        err = e
+    }
+    if err != nil {
+        return err
+    }
+
+    tmpFile := fileName + ".tmp"
+    defer os.Remove(tmpFile)
+    cmd := exec.Command(FFmpegPath,
+        tagArgs(fileName, tmpFile, metadata.Name(), codec, artworkFile)...)
+    var stderr strings.Builder
+    cmd.Stderr = &stderr
+    err = cmd.Run()
+    if err != nil {
+        return fmt.Errorf("WriteTags Failed to tag %s: %w", fileName,
+            newError("ffmpeg", err, stderr.String()))
+    }
+    return os.Rename(tmpFile, fileName)
+}
+
+// returns the Codecs entry whose extension matches the file
+func codecForFile(fileName string) (Codec,error) {
+    ext := strings.TrimPrefix(filepath.Ext(fileName), ".")
+    for _,codec := range Codecs {
+        if codec.Extension == ext {
+            return codec, nil
+        }
+    }
+    return Codec{}, fmt.Errorf("Unsupported file type, \"%s\"", fileName)
+}
+
+// whether the format stores cover art as an attached picture stream
+func supportsAttachedPicture(codec Codec) bool {
+    return codec.Format == "mp3" || codec.Format == "flac"
+}
+
+/* Returns the ffmpeg arguments that copy inFileName to outFileName with the
+ * global metadata taken from the ffmetadata file. The arguments are built by
+ * hand since ffmpeg-go can not take metadata from an input without streams. */
+func tagArgs(inFileName, outFileName, metadataFile string, codec Codec,
+artworkFile string) []string {
+    args := []string{ "-loglevel", "error", "-i", inFileName,
+        "-f", "ffmetadata", "-i", metadataFile }
+    // the stream metadata is dropped as well, Ogg keeps its comments there and
+    // old tags would otherwise win over the new ones
+    maps := []string{ "-map", "0:a", "-map_metadata", "1", "-map_metadata:s:a", "-1" }
+    if artworkFile != "" && supportsAttachedPicture(codec) {
+        args = append(args, "-i", artworkFile)
+        maps = append(maps, "-map", "2:v",
+            "-disposition:v", "attached_pic",
+            "-metadata:s:v", "title=Album cover",
+            "-metadata:s:v", "comment=Cover (front)")
+    }
+    args = append(args, maps...)
+    args = append(args, "-c", "copy")
+    switch codec.Format {
+    case "mp3":
+        // ID3v2.4 is not understood by some players, notably Windows
+        args = append(args, "-id3v2_version", "3")
+    case "adts":
+        args = append(args, "-write_id3v2", "1")
+    }
+    return append(args, "-f", codec.Format, "-y", outFileName)
+}
+
+/* Writes the tags in ffmpeg's metadata file format. Using a file rather than
+ * -metadata arguments keeps large pictures off of the command line, which
+ * has a limit on the length of each argument. */
+func writeFFMetadata(w *os.File, tags Tags, codec Codec, artwork []byte) error {
+    var b strings.Builder
+    b.WriteString(";FFMETADATA1\n")
+    writeTag := func(key, value string) {
+        if value != "" {
+            b.WriteString(key + "=" + escapeFFMetadata(value) + "\n")
+        }
+    }
+    writeTag("title", tags.Title)
+    writeTag("artist", tags.Artist)
+    writeTag("album", tags.Album)
+    if tags.Track > 0 {
+        writeTag("track", strconv.Itoa(tags.Track))
+    }
+    if tags.Peak != 0 {
+        writeTag("REPLAYGAIN_TRACK_GAIN", fmt.Sprintf("%.2f dB", tags.Gain))
+        writeTag("REPLAYGAIN_TRACK_PEAK", fmt.Sprintf("%.6f", tags.Peak))
+    }
+    if len(artwork) > 0 && codec.Format == "ogg" {
+        block, err := flacPictureBlock(artwork)
+        if err != nil {
+            return err
+        }
+        writeTag("METADATA_BLOCK_PICTURE", base64.StdEncoding.EncodeToString(block))
+    }
+    _, err := w.WriteString(b.String())
+    return err
+}
+
+// escapes the characters that have a meaning in ffmetadata files
+func escapeFFMetadata(s string) string {
+    var b strings.Builder
+    for _,r := range s {
+        switch r {
+        case '=', ';', '#', '\\', '\n':
+            b.WriteRune('\\')
+        }
+        b.WriteRune(r)
+    }
+    return b.String()
+}
+
+/* Encodes the image as a FLAC METADATA_BLOCK_PICTURE, which is how Vorbis
+ * comments embed cover art */
+func flacPictureBlock(img []byte) ([]byte,error) {
+    mimeType := http.DetectContentType(img)
+    if mimeType != "image/jpeg" && mimeType != "image/png" {
+        return nil, fmt.Errorf("Unsupported artwork type, \"%s\"", mimeType)
+    }
+    config, _, err := image.DecodeConfig(bytes.NewReader(img))
+    if err != nil {
+        return nil, err
+    }
+    description := "Album cover"
+    var b bytes.Buffer
+    for _,v := range []interface{}{
+        uint32(3), // front cover
+        uint32(len(mimeType)), []byte(mimeType),
+        uint32(len(description)), []byte(description),
+        uint32(config.Width), uint32(config.Height),
+        uint32(24), // color depth
+        uint32(0), // not an indexed image
+        uint32(len(img)), img,
+    } {
+        binary.Write(&b, binary.BigEndian, v)
+    }
+    return b.Bytes(), nil
+}
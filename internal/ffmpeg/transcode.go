@@ -0,0 +1,167 @@
+package ffmpeg
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+// An output format that songs can be converted to
+type Codec struct {
+    // The ffmpeg encoder, ex. "libmp3lame"
+    Encoder string
+    // The ffmpeg muxer used when streaming, ex. "mp3"
+    Format string
+    // The file extension without the dot, ex. "mp3"
+    Extension string
+    ContentType string
+    // The input codec that is copied rather than encoded again, ex. a FLAC
+    // file is already what the flac codec would make of it
+    Passthrough string
+}
+
+var Codecs = map[string]Codec{
+    "mp3": { Encoder: "libmp3lame", Format: "mp3", Extension: "mp3", ContentType: "audio/mpeg" },
+    "aac": { Encoder: "aac", Format: "adts", Extension: "aac", ContentType: "audio/aac" },
+    "opus": { Encoder: "libopus", Format: "ogg", Extension: "opus", ContentType: "audio/ogg" },
+    // FLAC input passes through untouched, anything else is encoded
+    "flac": { Encoder: "flac", Format: "flac", Extension: "flac", ContentType: "audio/flac",
+        Passthrough: "flac" },
+}
+
+// How audio should be encoded, zero values leave the choice to ffmpeg
+type Options struct {
+    // One of the keys of Codecs
+    Codec string `json:"codec,omitempty"`
+    // The target bitrate, ex. "96k"
+    Bitrate string `json:"bitrate,omitempty"`
+    // The variable bitrate quality passed to -q:a instead of a bitrate, ex.
+    // "2". Only mp3 (0 is best, 9 is worst) and aac (0.1 to 2) support it
+    Quality string `json:"quality,omitempty"`
+    // The sample rate in Hz, ex. 44100
+    SampleRate int `json:"sampleRate,omitempty"`
+}
+
+var bitratePattern = regexp.MustCompile(`^[0-9]{1,3}k$`)
+var qualityPattern = regexp.MustCompile(`^[0-9](\.[0-9]{1,2})?$`)
+
+// Returns an error if ffmpeg would not understand the options
+func (opts Options) Validate() error {
+    if _,ok := Codecs[opts.Codec]; !ok {
+        return fmt.Errorf("Unsupported codec, \"%s\"", opts.Codec)
+    }
+    if opts.Bitrate != "" && !bitratePattern.MatchString(opts.Bitrate) {
+        return fmt.Errorf("Invalid bitrate, \"%s\"", opts.Bitrate)
+    }
+    if opts.Quality != "" {
+        if opts.Codec != "mp3" && opts.Codec != "aac" {
+            return fmt.Errorf("The %s codec does not support a quality", opts.Codec)
+        }
+        if opts.Bitrate != "" {
+            return fmt.Errorf("Only one of bitrate and quality can be set")
+        }
+        if !qualityPattern.MatchString(opts.Quality) {
+            return fmt.Errorf("Invalid quality, \"%s\"", opts.Quality)
+        }
+    }
+    if opts.SampleRate < 0 || opts.SampleRate > 192000 {
+        return fmt.Errorf("Invalid sample rate, %d", opts.SampleRate)
+    }
+    return nil
+}
+
+/* Reports whether audio in the input codec can be copied as it is, which
+ * needs the codec's passthrough and no sample rate to convert to */
+func (opts Options) copies(inputCodec string) bool {
+    passthrough := Codecs[opts.Codec].Passthrough
+    return passthrough != "" && passthrough == inputCodec && opts.SampleRate == 0
+}
+
+// returns the ffmpeg output arguments for the options
+func (opts Options) kwArgs() ffmpeg.KwArgs {
+    codec := Codecs[opts.Codec]
+    args := ffmpeg.KwArgs{
+        "vn": "",
+        "c:a": codec.Encoder,
+    }
+    // flac is lossless, there is no bitrate to choose
+    if opts.Bitrate != "" && opts.Codec != "flac" {
+        args["b:a"] = opts.Bitrate
+    }
+    if opts.Quality != "" {
+        args["q:a"] = opts.Quality
+    }
+    if opts.SampleRate != 0 {
+        args["ar"] = opts.SampleRate
+    }
+    return args
+}
+
+/* Synchronously converts the audio file and writes the result to w as it is
+ * produced, so that it can be streamed to a client before the conversion has
+ * finished. Cancelling ctx kills ffmpeg. */
+func Transcode(ctx context.Context, inFileName string, w io.Writer, opts Options) error {
+    err := opts.Validate()
+    if err != nil {
+        return err
+    }
+    kwargs := opts.kwArgs()
+    kwargs["f"] = Codecs[opts.Codec].Format
+    args := ffmpeg.Input(inFileName).
+        Output("pipe:1", kwargs).
+        GlobalArgs("-loglevel", "error").
+        GetArgs()
+    cmd := exec.CommandContext(ctx, FFmpegPath, args...)
+    var stderr strings.Builder
+    cmd.Stdout = w
+    cmd.Stderr = &stderr
+    err = cmd.Run()
+    if ctx.Err() != nil {
+        return ctx.Err()
+    }
+    if err != nil {
+        return fmt.Errorf("Transcode %s: %w", inFileName,
+            newError("ffmpeg", err, stderr.String()))
+    }
+    return nil
+}
+
+/* Synchronously decodes the audio file to signed 16 bit mono samples at the
+ * sample rate, ex. for fingerprinting. Cancelling ctx kills ffmpeg. */
+func DecodePCM(ctx context.Context, fileName string, sampleRate int) ([]int16,error) {
+    args := ffmpeg.Input(fileName).
+        Output("pipe:1", ffmpeg.KwArgs{
+            "vn": "",
+            "ac": 1,
+            "ar": sampleRate,
+            "f": "s16le",
+        }).
+        GlobalArgs("-loglevel", "error").
+        GetArgs()
+    cmd := exec.CommandContext(ctx, FFmpegPath, args...)
+    var stdout bytes.Buffer
+    var stderr strings.Builder
+    cmd.Stdout = &stdout
+    cmd.Stderr = &stderr
+    err := cmd.Run()
+    if ctx.Err() != nil {
+        return nil, ctx.Err()
+    }
+    if err != nil {
+        return nil, fmt.Errorf("DecodePCM %s: %w", fileName,
+            newError("ffmpeg", err, stderr.String()))
+    }
+    b := stdout.Bytes()
+    samples := make([]int16, len(b) / 2)
+    for i := range samples {
+        samples[i] = int16(binary.LittleEndian.Uint16(b[2 * i:]))
+    }
+    return samples, nil
+}
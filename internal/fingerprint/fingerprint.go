@@ -0,0 +1,249 @@
+/* Package fingerprint computes acoustic fingerprints, which tell whether two
+ * audio files are the same recording even when they were encoded, trimmed or
+ * normalized differently.
+ *
+ * It is the robust hash of Haitsma and Kalker, "A Highly Robust Audio
+ * Fingerprinting System" (2002). The audio is split into overlapping frames
+ * and each frame's spectrum into 33 bands between 300 and 2000 Hz. Each frame
+ * gives 32 bits, one for each pair of neighbouring bands, that are set when
+ * the difference between the two bands' energy grew since the previous
+ * frame. A change in volume or encoding flips a few of the bits, different
+ * audio flips about half of them. */
+package fingerprint
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/bits"
+
+	"github.com/TSchreiber/melo/internal/ffmpeg"
+)
+
+// The sample rate that audio is decoded at before it is fingerprinted
+const SampleRate = 11025
+
+const (
+    frameSize = 2048
+    hopSize = 1024
+    bands = 33
+    minFrequency = 300.0
+    maxFrequency = 2000.0
+)
+
+// The number of values in a fingerprint for each second of audio
+const FrameRate = float64(SampleRate) / hopSize
+
+/* The fingerprint of some audio, a 32 bit value for each frame. It is
+ * encoded as base64 in JSON. */
+type Fingerprint []uint32
+
+// The length of the fingerprinted audio in seconds
+func (fp Fingerprint) Duration() float64 {
+    return float64(len(fp)) / FrameRate
+}
+
+/* Decodes the audio file with ffmpeg and fingerprints it. Cancelling ctx
+ * kills ffmpeg. */
+func FromFile(ctx context.Context, fileName string) (Fingerprint,error) {
+    samples, err := ffmpeg.DecodePCM(ctx, fileName, SampleRate)
+    if err != nil {
+        return nil, err
+    }
+    fp := Compute(samples)
+    if len(fp) == 0 {
+        return nil, fmt.Errorf("fingerprint.FromFile %s is too short to fingerprint", fileName)
+    }
+    return fp, nil
+}
+
+/* Fingerprints mono audio sampled at SampleRate. Audio shorter than a frame,
+ * about 0.2 seconds, has an empty fingerprint. */
+func Compute(samples []int16) Fingerprint {
+    if len(samples) < frameSize {
+        return Fingerprint{}
+    }
+    window := make([]float64, frameSize)
+    for i := range window {
+        window[i] = 0.5 - 0.5 * math.Cos(2 * math.Pi * float64(i) / frameSize)
+    }
+    // the first FFT bin of each band, and the end of the last one
+    var edges [bands + 1]int
+    for i := range edges {
+        f := minFrequency * math.Pow(maxFrequency / minFrequency, float64(i) / bands)
+        edges[i] = int(math.Round(f * frameSize / SampleRate))
+    }
+
+    frameCount := 1 + (len(samples) - frameSize) / hopSize
+    fp := make(Fingerprint, 0, frameCount - 1)
+    re := make([]float64, frameSize)
+    im := make([]float64, frameSize)
+    var energy, prev [bands]float64
+    for n := 0; n < frameCount; n++ {
+        for i := range re {
+            re[i] = float64(samples[n * hopSize + i]) * window[i]
+            im[i] = 0
+        }
+        fft(re, im)
+        for b := 0; b < bands; b++ {
+            energy[b] = 0
+            for k := edges[b]; k < edges[b + 1]; k++ {
+                energy[b] += re[k] * re[k] + im[k] * im[k]
+            }
+        }
+        if n > 0 {
+            var value uint32
+            for m := 0; m < bands - 1; m++ {
+                if energy[m] - energy[m + 1] - (prev[m] - prev[m + 1]) > 0 {
+                    value |= 1 << m
+                }
+            }
+            fp = append(fp, value)
+        }
+        prev = energy
+    }
+    return fp
+}
+
+// An in-place radix-2 FFT, len(re) must be a power of two
+func fft(re, im []float64) {
+    n := len(re)
+    for i, j := 1, 0; i < n; i++ {
+        bit := n >> 1
+        for ; j & bit != 0; bit >>= 1 {
+            j ^= bit
+        }
+        j ^= bit
+        if i < j {
+            re[i], re[j] = re[j], re[i]
+            im[i], im[j] = im[j], im[i]
+        }
+    }
+    for size := 2; size <= n; size <<= 1 {
+        angle := -2 * math.Pi / float64(size)
+        wRe, wIm := math.Cos(angle), math.Sin(angle)
+        for start := 0; start < n; start += size {
+            uRe, uIm := 1.0, 0.0
+            for k := 0; k < size / 2; k++ {
+                a, b := start + k, start + k + size / 2
+                tRe := re[b] * uRe - im[b] * uIm
+                tIm := re[b] * uIm + im[b] * uRe
+                re[b], im[b] = re[a] - tRe, im[a] - tIm
+                re[a], im[a] = re[a] + tRe, im[a] + tIm
+                uRe, uIm = uRe * wRe - uIm * wIm, uRe * wIm + uIm * wRe
+            }
+        }
+    }
+}
+
+// The values as little endian bytes, how fingerprints are stored
+func (fp Fingerprint) Bytes() []byte {
+    b := make([]byte, 4 * len(fp))
+    for i,value := range fp {
+        binary.LittleEndian.PutUint32(b[4 * i:], value)
+    }
+    return b
+}
+
+// The inverse of Bytes
+func FromBytes(b []byte) (Fingerprint,error) {
+    if len(b) % 4 != 0 {
+        return nil, fmt.Errorf("fingerprint.FromBytes %d bytes is not a whole number of values", len(b))
+    }
+    fp := make(Fingerprint, len(b) / 4)
+    for i := range fp {
+        fp[i] = binary.LittleEndian.Uint32(b[4 * i:])
+    }
+    return fp, nil
+}
+
+func (fp Fingerprint) MarshalJSON() ([]byte,error) {
+    return json.Marshal(base64.StdEncoding.EncodeToString(fp.Bytes()))
+}
+
+func (fp *Fingerprint) UnmarshalJSON(data []byte) error {
+    var s string
+    err := json.Unmarshal(data, &s)
+    if err != nil {
+        return err
+    }
+    b, err := base64.StdEncoding.DecodeString(s)
+    if err != nil {
+        return fmt.Errorf("Fingerprint.UnmarshalJSON: %v", err)
+    }
+    *fp, err = FromBytes(b)
+    return err
+}
+
+/* How far apart the audio of two fingerprints is searched for, in seconds,
+ * beyond the difference in their lengths. A video often has a second or two
+ * of silence that the album version doesn't. */
+const maxOffset = 5
+
+/* Compares every 4th value while searching for the offset where the
+ * fingerprints line up, then every value at the best one */
+const coarseStep = 4
+
+// Fingerprints must overlap by at least this many seconds to be compared
+const minOverlap = 5
+
+/* Returns how alike the audio of two fingerprints is, from 0 for unrelated
+ * audio to 1 for the same. The audio of one may start a few seconds after
+ * the other's. It is 1 - 2 * the fraction of bits that differ where the
+ * fingerprints line up best, unrelated audio differs in about half. */
+func Compare(a, b Fingerprint) float64 {
+    if len(a) == 0 || len(b) == 0 {
+        return 0
+    }
+    overlap := max(frames(minOverlap), min(len(a), len(b)) / 2)
+    shift := abs(len(a) - len(b)) + frames(maxOffset)
+    best, bestOffset := 1.0, 0
+    for offset := -shift; offset <= shift; offset++ {
+        ber, n := bitErrorRate(a, b, offset, coarseStep)
+        if n >= overlap && ber < best {
+            best, bestOffset = ber, offset
+        }
+    }
+    if best == 1 {
+        return 0
+    }
+    best = 1
+    for offset := bestOffset - 1; offset <= bestOffset + 1; offset++ {
+        ber, n := bitErrorRate(a, b, offset, 1)
+        if n >= overlap {
+            best = min(best, ber)
+        }
+    }
+    return max(0, 1 - 2 * best)
+}
+
+/* The fraction of bits that differ between b[i] and a[i+offset] for every
+ * step'th i where both exist, and the number of values that overlap */
+func bitErrorRate(a, b Fingerprint, offset, step int) (float64,int) {
+    start := max(0, -offset)
+    end := min(len(b), len(a) - offset)
+    if end <= start {
+        return 1, 0
+    }
+    errors, n := 0, 0
+    for i := start; i < end; i += step {
+        errors += bits.OnesCount32(a[i + offset] ^ b[i])
+        n++
+    }
+    return float64(errors) / float64(32 * n), end - start
+}
+
+// The number of values in a fingerprint of that many seconds of audio
+func frames(seconds float64) int {
+    return int(seconds * FrameRate)
+}
+
+func abs(x int) int {
+    if x < 0 {
+        return -x
+    }
+    return x
+}
@@ -0,0 +1,142 @@
+package fingerprint
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+/* Synthesizes a minute of "music", chords of four notes with their
+ * harmonics and a drum hit on every other one, picked at random from seed */
+func synthesize(seed int64) []float64 {
+    r := rand.New(rand.NewSource(seed))
+    audio := make([]float64, 60 * SampleRate)
+    for i := 0; i < len(audio); {
+        length := int((0.15 + 0.35 * r.Float64()) * SampleRate)
+        var notes [4]float64
+        for n := range notes {
+            notes[n] = 110 * math.Pow(2, float64(r.Intn(36)) / 12)
+        }
+        drum := r.Intn(2) == 0
+        for k := 0; k < length && i < len(audio); k, i = k + 1, i + 1 {
+            t := float64(i) / SampleRate
+            var v float64
+            for _,f := range notes {
+                for h := 1.0; h <= 6; h++ {
+                    v += math.Sin(2 * math.Pi * f * h * t) / h
+                }
+            }
+            v *= 0.1 * math.Exp(-2 * float64(k) / float64(length))
+            if drum && k < SampleRate / 20 {
+                v += 0.3 * r.NormFloat64() * math.Exp(-60 * float64(k) / SampleRate)
+            }
+            audio[i] = v
+        }
+    }
+    return audio
+}
+
+// Scales the audio by gain, adds white noise and converts it to samples
+func pcm(audio []float64, gain, noise float64) []int16 {
+    r := rand.New(rand.NewSource(1))
+    samples := make([]int16, len(audio))
+    for i,v := range audio {
+        v = 12000 * (gain * v + noise * r.NormFloat64())
+        samples[i] = int16(max(-32768, min(32767, v)))
+    }
+    return samples
+}
+
+func TestCompare(t *testing.T) {
+    song := synthesize(1)
+    fp := Compute(pcm(song, 1, 0))
+    if d := fp.Duration(); math.Abs(d - 60) > 0.5 {
+        t.Errorf("Duration() = %.2f, want 60", d)
+    }
+
+    delayed := append(make([]float64, 2 * SampleRate + 300), song...)
+    same := map[string][]int16{
+        "quieter": pcm(song, 0.4, 0),
+        "noisy": pcm(song, 1, 0.01),
+        // half a frame off, the worst an offset can line up
+        "shifted": pcm(append(make([]float64, hopSize / 2), song...), 1, 0),
+        "delayed": pcm(delayed, 1, 0.005),
+        "cut short": pcm(song[:50 * SampleRate], 1, 0.005),
+    }
+    for name,samples := range same {
+        if similarity := Compare(fp, Compute(samples)); similarity < Threshold {
+            t.Errorf("%s: Compare() = %.3f, want >= %v", name, similarity, Threshold)
+        }
+    }
+
+    if similarity := Compare(fp, fp); similarity != 1 {
+        t.Errorf("Compare() of the same fingerprint = %.3f, want 1", similarity)
+    }
+    for seed := int64(2); seed <= 4; seed++ {
+        if similarity := Compare(fp, Compute(pcm(synthesize(seed), 1, 0))); similarity > 0.15 {
+            t.Errorf("other song %d: Compare() = %.3f, want about 0", seed, similarity)
+        }
+    }
+    if similarity := Compare(fp, Compute(make([]int16, len(song)))); similarity > 0.15 {
+        t.Errorf("silence: Compare() = %.3f, want about 0", similarity)
+    }
+    if similarity := Compare(fp, nil); similarity != 0 {
+        t.Errorf("Compare() with an empty fingerprint = %.3f, want 0", similarity)
+    }
+}
+
+func TestCompute(t *testing.T) {
+    if fp := Compute(make([]int16, frameSize - 1)); len(fp) != 0 {
+        t.Errorf("Compute() of less than a frame has %d values, want 0", len(fp))
+    }
+    if fp := Compute(make([]int16, frameSize + 3 * hopSize)); len(fp) != 3 {
+        t.Errorf("Compute() of 4 frames has %d values, want 3", len(fp))
+    }
+}
+
+func TestEncoding(t *testing.T) {
+    fp := Fingerprint{ 0, 1, 0xdeadbeef, math.MaxUint32 }
+    decoded, err := FromBytes(fp.Bytes())
+    if err != nil || !reflect.DeepEqual(decoded, fp) {
+        t.Errorf("FromBytes(Bytes()) = %v, %v, want %v", decoded, err, fp)
+    }
+    if _, err := FromBytes([]byte{ 1, 2, 3 }); err == nil {
+        t.Error("FromBytes() of 3 bytes did not fail")
+    }
+
+    body, err := json.Marshal(struct{ Fingerprint Fingerprint }{ fp })
+    if err != nil {
+        t.Fatal(err)
+    }
+    var value struct{ Fingerprint Fingerprint }
+    err = json.Unmarshal(body, &value)
+    if err != nil || !reflect.DeepEqual(value.Fingerprint, fp) {
+        t.Errorf("json round trip of %s = %v, %v, want %v", body, value.Fingerprint, err, fp)
+    }
+}
+
+func TestSearch(t *testing.T) {
+    a, b := synthesize(1), synthesize(2)
+    fps := []Fingerprint{
+        Compute(pcm(b, 1, 0)),
+        Compute(pcm(a, 0.5, 0.005)),
+        Compute(pcm(a[:30 * SampleRate], 1, 0)),
+        Compute(pcm(append(make([]float64, SampleRate), a...), 1, 0)),
+        nil,
+    }
+    matches := Search(Compute(pcm(a, 1, 0)), fps, Threshold)
+    if len(matches) != 2 || !(matches[0].Index == 1 && matches[1].Index == 3 ||
+    matches[0].Index == 3 && matches[1].Index == 1) {
+        t.Errorf("Search() = %v, want indices 1 and 3", matches)
+    } else if matches[0].Similarity < matches[1].Similarity {
+        t.Errorf("Search() = %v, want the most similar first", matches)
+    }
+
+    pairs := Pairs(append(fps, Compute(pcm(b, 0.8, 0))), Threshold)
+    if len(pairs) != 2 || pairs[0].A != 0 || pairs[0].B != 5 ||
+    pairs[1].A != 1 || pairs[1].B != 3 {
+        t.Errorf("Pairs() = %v, want (0, 5) and (1, 3)", pairs)
+    }
+}
@@ -0,0 +1,102 @@
+package fingerprint
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+)
+
+/* Audio at least this similar, see Compare, is counted as the same
+ * recording. Re-encodings of the same audio score well above it and
+ * different recordings, even of the same song, well below. It is about the
+ * bit error rate of 0.35 that Haitsma and Kalker suggest. */
+const Threshold = 0.35
+
+/* Fingerprints whose lengths differ by more than this many seconds are not
+ * compared by Search and Pairs */
+const maxLengthDifference = 10
+
+type Match struct {
+    // The index of the fingerprint in the list that was searched
+    Index int
+    Similarity float64
+}
+
+/* Returns the fingerprints in fps that are at least threshold similar to fp,
+ * most similar first */
+func Search(fp Fingerprint, fps []Fingerprint, threshold float64) []Match {
+    window := frames(maxLengthDifference)
+    var matches []Match
+    for i,other := range fps {
+        if abs(len(fp) - len(other)) > window {
+            continue
+        }
+        if similarity := Compare(fp, other); similarity >= threshold {
+            matches = append(matches, Match{ i, similarity })
+        }
+    }
+    sort.SliceStable(matches, func(i, j int) bool {
+        return matches[i].Similarity > matches[j].Similarity
+    })
+    return matches
+}
+
+// Two fingerprints of the same audio, by their index, A < B
+type Pair struct {
+    A, B int
+    Similarity float64
+}
+
+/* Compares every two fingerprints in fps that are about as long and returns
+ * the pairs that are at least threshold similar, ordered by A then B. The
+ * comparisons are spread over every CPU, a library of a few thousand songs
+ * takes seconds. */
+func Pairs(fps []Fingerprint, threshold float64) []Pair {
+    order := make([]int, len(fps))
+    for i := range order {
+        order[i] = i
+    }
+    sort.Slice(order, func(i, j int) bool {
+        return len(fps[order[i]]) < len(fps[order[j]])
+    })
+    window := frames(maxLengthDifference)
+
+    var pairs []Pair
+    var mu sync.Mutex
+    next := make(chan int)
+    var wg sync.WaitGroup
+    for w := 0; w < runtime.NumCPU(); w++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for i := range next {
+                a := fps[order[i]]
+                if len(a) == 0 {
+                    continue
+                }
+                for j := i + 1; j < len(order) && len(fps[order[j]]) - len(a) <= window; j++ {
+                    similarity := Compare(a, fps[order[j]])
+                    if similarity < threshold {
+                        continue
+                    }
+                    pair := Pair{ min(order[i], order[j]), max(order[i], order[j]), similarity }
+                    mu.Lock()
+                    pairs = append(pairs, pair)
+                    mu.Unlock()
+                }
+            }
+        }()
+    }
+    for i := range order {
+        next <- i
+    }
+    close(next)
+    wg.Wait()
+    sort.Slice(pairs, func(i, j int) bool {
+        if pairs[i].A != pairs[j].A {
+            return pairs[i].A < pairs[j].A
+        }
+        return pairs[i].B < pairs[j].B
+    })
+    return pairs
+}
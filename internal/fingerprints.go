@@ -0,0 +1,211 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/TSchreiber/melo/internal/fingerprint"
+)
+
+// Songs whose audio is the same recording, see duplicateRecordings
+type duplicateGroup struct {
+    // The least similar of the pairs of songs that put the group together
+    Similarity float64 `json:"similarity"`
+    Songs []Song `json:"songs"`
+}
+
+type duplicateReport struct {
+    Groups []duplicateGroup `json:"groups"`
+    // The number of songs without a fingerprint, which can't be checked. They
+    // are fingerprinted by "melo fingerprint".
+    Unfingerprinted int `json:"unfingerprinted"`
+}
+
+/* Groups the songs in the library whose fingerprints match, ex. the same
+ * recording downloaded from YouTube and from SoundCloud. A song that matches
+ * any song of a group is in the group. The groups are ordered most similar
+ * first, their songs by id. */
+func duplicateRecordings(db MigratableDatabase) (duplicateReport,error) {
+    report := duplicateReport{ Groups: []duplicateGroup{} }
+    fps, err := db.GetFingerprints()
+    if err != nil {
+        return report, fmt.Errorf("duplicateRecordings: %v", err)
+    }
+    var songs []Song
+    var list []fingerprint.Fingerprint
+    err = db.EachSong(func(song Song) error {
+        fp, ok := fps[song.Id]
+        if !ok {
+            report.Unfingerprinted++
+            return nil
+        }
+        songs = append(songs, song)
+        list = append(list, fp)
+        return nil
+    })
+    if err != nil {
+        return report, fmt.Errorf("duplicateRecordings: %v", err)
+    }
+
+    // union-find over the matching pairs
+    parent := make([]int, len(songs))
+    for i := range parent {
+        parent[i] = i
+    }
+    var root func(i int) int
+    root = func(i int) int {
+        if parent[i] != i {
+            parent[i] = root(parent[i])
+        }
+        return parent[i]
+    }
+    similarity := make(map[int]float64)
+    for _,pair := range fingerprint.Pairs(list, fingerprint.Threshold) {
+        a, b := root(pair.A), root(pair.B)
+        s := pair.Similarity
+        for _,r := range []int{ a, b } {
+            if prev, ok := similarity[r]; ok {
+                s = min(s, prev)
+            }
+        }
+        parent[b] = a
+        delete(similarity, b)
+        similarity[a] = s
+    }
+
+    members := make(map[int][]Song)
+    for i,song := range songs {
+        r := root(i)
+        if _,ok := similarity[r]; ok {
+            members[r] = append(members[r], song)
+        }
+    }
+    for r,group := range members {
+        sort.Slice(group, func(i, j int) bool { return group[i].Id < group[j].Id })
+        report.Groups = append(report.Groups, duplicateGroup{ similarity[r], group })
+    }
+    sort.Slice(report.Groups, func(i, j int) bool {
+        a, b := report.Groups[i], report.Groups[j]
+        if a.Similarity != b.Similarity {
+            return a.Similarity > b.Similarity
+        }
+        return a.Songs[0].Id < b.Songs[0].Id
+    })
+    return report, nil
+}
+
+/* Responds with the songs in the library that are the same recording, see
+ * duplicateRecordings. Comparing a large library takes a while. */
+func createDuplicateReportHandler(meloDB MeloDatabase) http.HandlerFunc {
+    return http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+        db, ok := meloDB.(MigratableDatabase)
+        if !ok {
+            w.WriteHeader(http.StatusNotImplemented)
+            fmt.Fprint(w, "501 - The database can't list its songs")
+            return
+        }
+        disableWriteTimeout(w)
+        report, err := duplicateRecordings(db)
+        if err != nil {
+            log.Printf("\"GET /download/duplicates\": %v\n", err)
+            w.WriteHeader(http.StatusInternalServerError)
+            return
+        }
+        b, err := json.Marshal(report)
+        if err != nil {
+            fmt.Println(err)
+            w.WriteHeader(http.StatusInternalServerError)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        w.Write(b)
+    })
+}
+
+/* Fingerprints the songs that don't have a fingerprint yet, ex. the ones
+ * downloaded before songs were fingerprinted. A song whose file can't be
+ * fingerprinted is logged and skipped. Returns the number of songs that
+ * were fingerprinted. */
+func backfillFingerprints(ctx context.Context, db MigratableDatabase) (int,error) {
+    fps, err := db.GetFingerprints()
+    if err != nil {
+        return 0, fmt.Errorf("backfillFingerprints: %v", err)
+    }
+    // the songs are listed first, SQLite can't write while EachSong reads
+    var missing []Song
+    err = db.EachSong(func(song Song) error {
+        if _,ok := fps[song.Id]; !ok {
+            missing = append(missing, song)
+        }
+        return nil
+    })
+    if err != nil {
+        return 0, fmt.Errorf("backfillFingerprints: %v", err)
+    }
+    n := 0
+    for i,song := range missing {
+        path, err := songFilePath(song)
+        if err != nil {
+            log.Println(err)
+            continue
+        }
+        fp, err := fingerprint.FromFile(ctx, path)
+        if ctx.Err() != nil {
+            return n, ctx.Err()
+        }
+        if err != nil {
+            log.Printf("Failed to fingerprint song %s: %v\n", song.Id, err)
+            continue
+        }
+        err = db.PutFingerprint(song.Id, fp)
+        if err != nil {
+            return n, fmt.Errorf("backfillFingerprints: %v", err)
+        }
+        n++
+        log.Printf("Fingerprinted %d of %d: \"%s\" by %s\n", i + 1, len(missing), song.Title, song.Artist)
+    }
+    return n, nil
+}
+
+/* Fingerprints the songs in the library that don't have a fingerprint and
+ * then logs the songs that are the same recording */
+func LaunchFingerprint(config DatabaseConfig) {
+    meloDB, err := NewMeloDatabase(config)
+    if err != nil {
+        log.Fatalln(err)
+    }
+    defer meloDB.Disconnect()
+    db, ok := meloDB.(MigratableDatabase)
+    if !ok {
+        log.Fatalf("The \"%s\" database can't list its songs\n", config.Type)
+    }
+
+    n, err := backfillFingerprints(context.Background(), db)
+    if err != nil {
+        log.Fatalln(err)
+    }
+    log.Printf("Fingerprinted %d songs\n", n)
+
+    report, err := duplicateRecordings(db)
+    if err != nil {
+        log.Fatalln(err)
+    }
+    if report.Unfingerprinted > 0 {
+        log.Printf("%d songs could not be fingerprinted\n", report.Unfingerprinted)
+    }
+    if len(report.Groups) == 0 {
+        log.Println("No duplicate recordings found")
+        return
+    }
+    log.Printf("Found %d groups of duplicate recordings:\n", len(report.Groups))
+    for _,group := range report.Groups {
+        fmt.Printf("%.0f%% similar\n", 100 * group.Similarity)
+        for _,song := range group.Songs {
+            fmt.Printf("    %s  \"%s\" by %s  (%s)\n", song.Id, song.Title, song.Artist, song.Source)
+        }
+    }
+}
@@ -0,0 +1,193 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	"github.com/TSchreiber/melo/internal/ffmpeg"
+	"github.com/gorilla/mux"
+)
+
+// The directory that the HLS renditions of each song are saved to
+const hlsDirectory = "static/hls"
+
+type HLSConfig struct {
+    // Segment songs as soon as they are downloaded instead of on first play
+    GenerateAtIngest bool
+    // Defaults to ffmpeg.DefaultHLSRenditions
+    Renditions []ffmpeg.HLSRendition
+}
+
+/* hlsLibrary creates the HLS renditions of songs, making sure that each song
+ * is only segmented once even if it is requested by several clients at the
+ * same time. */
+type hlsLibrary struct {
+    renditions []ffmpeg.HLSRendition
+    mu *sync.Mutex
+    inProgress map[string]*hlsJob
+}
+
+type hlsJob struct {
+    done chan struct{}
+    err error
+}
+
+func newHLSLibrary(config HLSConfig) *hlsLibrary {
+    renditions := config.Renditions
+    if len(renditions) == 0 {
+        renditions = ffmpeg.DefaultHLSRenditions
+    }
+    return &hlsLibrary{
+        renditions: renditions,
+        mu: &sync.Mutex{},
+        inProgress: make(map[string]*hlsJob),
+    }
+}
+
+/* Returns the directory containing the master playlist of the song's audio
+ * file as it is now. It is named after the file's size and modification time,
+ * like the transcode cache's keys, so the renditions of a file that has been
+ * replaced, ex. by UpdateSongAudio or a library scan, are never served. */
+func (lib *hlsLibrary) songDir(song Song) (string,error) {
+    audioFile, err := songFilePath(song)
+    if err != nil {
+        return "", err
+    }
+    info, err := os.Stat(audioFile)
+    if err != nil {
+        return "", err
+    }
+    version := fmt.Sprintf("%x-%x", info.Size(), info.ModTime().UnixNano())
+    return filepath.Join(hlsDirectory, song.Id, version), nil
+}
+
+/* Creates the song's renditions if they do not exist yet and waits for them
+ * to be ready, returns their directory. Concurrent calls for the same song
+ * share the same ffmpeg run. */
+func (lib *hlsLibrary) ensure(song Song) (string,error) {
+    dir, err := lib.songDir(song)
+    if err != nil {
+        return "", fmt.Errorf("Failed to create the HLS renditions of song %s: %w", song.Id, err)
+    }
+    if _,err := os.Stat(filepath.Join(dir, "master.m3u8")); err == nil {
+        return dir, nil
+    }
+
+    lib.mu.Lock()
+    job, ok := lib.inProgress[dir]
+    if !ok {
+        job = &hlsJob{done: make(chan struct{})}
+        lib.inProgress[dir] = job
+        go func() {
+            job.err = lib.segment(song, dir)
+            lib.mu.Lock()
+            delete(lib.inProgress, dir)
+            lib.mu.Unlock()
+            close(job.done)
+        }()
+    }
+    lib.mu.Unlock()
+    <-job.done
+    return dir, job.err
+}
+
+/* Segments the song's audio file into dir, then removes the renditions of
+ * the song's earlier files */
+func (lib *hlsLibrary) segment(song Song, dir string) error {
+    audioFile, err := songFilePath(song)
+    if err != nil {
+        return err
+    }
+    log.Printf("Creating the HLS renditions of song %s\n", song.Id)
+    err = ffmpeg.SegmentHLS(audioFile, dir, lib.renditions)
+    if err != nil {
+        return fmt.Errorf("Failed to create the HLS renditions of song %s: %w", song.Id, err)
+    }
+    entries, _ := os.ReadDir(filepath.Dir(dir))
+    for _,entry := range entries {
+        if entry.Name() != filepath.Base(dir) {
+            os.RemoveAll(filepath.Join(filepath.Dir(dir), entry.Name()))
+        }
+    }
+    return nil
+}
+
+// Creates the song's renditions in the background
+func (lib *hlsLibrary) ensureAsync(song Song) {
+    go func() {
+        if _,err := lib.ensure(song); err != nil {
+            log.Println(err)
+        }
+    }()
+}
+
+func (lib *hlsLibrary) hasRendition(name string) bool {
+    for _,r := range lib.renditions {
+        if r.Name == name {
+            return true
+        }
+    }
+    return false
+}
+
+var hlsFilePattern = regexp.MustCompile(`^(index\.m3u8|segment_[0-9]+\.ts)$`)
+
+/* Serves /song/{id}/master.m3u8 and the media playlists and segments that it
+ * refers to, /song/{id}/{rendition}/{file}. The renditions are created the
+ * first time a song's master playlist is requested. */
+func createHLSHandler(meloDB MeloDatabase, lib *hlsLibrary) http.HandlerFunc {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        vars := mux.Vars(r)
+        songId := vars["id"]
+        rendition, file := vars["rendition"], vars["file"]
+        if file == "" {
+            file = "master.m3u8"
+        } else if !lib.hasRendition(rendition) || !hlsFilePattern.MatchString(file) {
+            w.WriteHeader(http.StatusNotFound)
+            return
+        }
+
+        song, err := meloDB.GetSong(songId)
+        if errors.Is(err, ErrInvalidId) {
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprintf(w, "400 - Invalid song id, \"%s\"", songId)
+            return
+        }
+        if errors.Is(err, ErrNotFound) {
+            w.WriteHeader(http.StatusNotFound)
+            return
+        }
+        if err != nil {
+            log.Printf("\"GET %s\": %v\n", r.URL.Path, err)
+            w.WriteHeader(http.StatusInternalServerError)
+            return
+        }
+
+        // segmenting a long song can take longer than the write timeout
+        disableWriteTimeout(w)
+        dir, err := lib.ensure(song)
+        if err != nil {
+            log.Printf("\"GET %s\": %v\n", r.URL.Path, err)
+            w.WriteHeader(http.StatusInternalServerError)
+            return
+        }
+
+        path := filepath.Join(dir, rendition, file)
+        if filepath.Ext(file) == ".m3u8" {
+            w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+            w.Header().Set("Cache-Control", "no-cache")
+        } else {
+            // the segments' URLs stay the same when the song's file is
+            // replaced, so they are revalidated rather than immutable
+            w.Header().Set("Content-Type", "video/mp2t")
+            w.Header().Set("Cache-Control", "private, no-cache")
+        }
+        http.ServeFile(w, r, path)
+    })
+}
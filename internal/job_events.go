@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/TSchreiber/melo/internal/jobs"
+	"github.com/gorilla/mux"
+)
+
+// How often a comment is sent to keep idle event streams open through proxies
+const jobEventsKeepAlive = 15 * time.Second
+
+/* An event sent by createJobEventsHandler, one of
+ *     step-start {"step"}
+ *     progress   {"step","progress"}
+ *     warning    {"message"}
+ *     done       {"songId"}
+ *     error      {"step","state","message","kind"}, state is failed or
+ *                cancelled, kind is the job's ErrorKind
+ * Only warnings have an id, it is the number of warnings sent so far. */
+type jobEvent struct {
+    Event string
+    Id string
+    Data interface{}
+}
+
+type jobStepData struct {
+    Step jobs.Step `json:"step"`
+}
+
+type jobProgressData struct {
+    Step jobs.Step `json:"step"`
+    Progress uint8 `json:"progress"`
+}
+
+type jobWarningData struct {
+    Message string `json:"message"`
+}
+
+type jobDoneData struct {
+    SongId string `json:"songId"`
+}
+
+type jobErrorData struct {
+    Step jobs.Step `json:"step,omitempty"`
+    State jobs.State `json:"state"`
+    Message string `json:"message"`
+    Kind string `json:"kind,omitempty"`
+}
+
+/* Streams the progress of a download job as Server-Sent Events, see jobEvent.
+ * A client that connects, or reconnects, to a running job is first sent the
+ * step that it is on. Warnings up to the Last-Event-ID are not sent again. The
+ * stream ends with a done or error event. */
+func createJobEventsHandler(queue *jobs.Queue) http.HandlerFunc {
+    return http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+        jobId := mux.Vars(r)["id"]
+        updates, unsubscribe, err := queue.Subscribe(jobId)
+        if writeJobError(w, jobId, err) {
+            return
+        }
+        defer unsubscribe()
+        sentWarnings, _ := strconv.Atoi(r.Header.Get("Last-Event-ID"))
+
+        // a download can take much longer than the write timeout
+        disableWriteTimeout(w)
+        w.Header().Set("Content-Type", "text/event-stream")
+        w.Header().Set("Cache-Control", "no-cache")
+        w.WriteHeader(http.StatusOK)
+        w.(http.Flusher).Flush()
+
+        keepAlive := time.NewTicker(jobEventsKeepAlive)
+        defer keepAlive.Stop()
+        var last jobs.Job
+        for {
+            select {
+            case job, ok := <-updates:
+                if !ok {
+                    return
+                }
+                for _,event := range jobEvents(last, job, &sentWarnings) {
+                    writeJobEvent(w, event)
+                }
+                w.(http.Flusher).Flush()
+                last = job
+            case <-keepAlive.C:
+                fmt.Fprint(w, ": keep-alive\n\n")
+                w.(http.Flusher).Flush()
+            case <-r.Context().Done():
+                return
+            }
+        }
+    })
+}
+
+/* Returns the events for the changes from prev to job. prev is the zero Job
+ * for the first update. sentWarnings is the number of the job's warnings that
+ * the client already has, it is updated. */
+func jobEvents(prev, job jobs.Job, sentWarnings *int) []jobEvent {
+    var events []jobEvent
+    stepChanged := job.Step != prev.Step
+    if job.Step != "" && stepChanged {
+        events = append(events, jobEvent{ Event: "step-start", Data: jobStepData{ job.Step } })
+    }
+    if job.Step != "" && !job.State.Finished() && job.Progress != 0 &&
+    (stepChanged || job.Progress != prev.Progress) {
+        events = append(events, jobEvent{
+            Event: "progress",
+            Data: jobProgressData{ job.Step, job.Progress },
+        })
+    }
+    for ; *sentWarnings < len(job.Warnings); *sentWarnings++ {
+        events = append(events, jobEvent{
+            Event: "warning",
+            Id: strconv.Itoa(*sentWarnings + 1),
+            Data: jobWarningData{ job.Warnings[*sentWarnings] },
+        })
+    }
+    switch job.State {
+    case jobs.Done:
+        events = append(events, jobEvent{ Event: "done", Data: jobDoneData{ job.SongId } })
+    case jobs.Failed, jobs.Cancelled:
+        events = append(events, jobEvent{
+            Event: "error",
+            Data: jobErrorData{ job.Step, job.State, job.Error, job.ErrorKind },
+        })
+    }
+    return events
+}
+
+func writeJobEvent(w http.ResponseWriter, event jobEvent) {
+    b, _ := json.Marshal(event.Data)
+    fmt.Fprintf(w, "event: %s\n", event.Event)
+    if event.Id != "" {
+        fmt.Fprintf(w, "id: %s\n", event.Id)
+    }
+    fmt.Fprintf(w, "data: %s\n\n", b)
+}
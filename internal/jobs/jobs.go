@@ -0,0 +1,994 @@
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TSchreiber/melo/internal/download"
+)
+
+type State string
+
+const (
+    Queued State = "queued"
+    // Waiting for another job of its group to download the same source, see
+    // EnqueueGroup
+    Waiting State = "waiting"
+    Running State = "running"
+    Done State = "done"
+    Failed State = "failed"
+    Cancelled State = "cancelled"
+)
+
+// Reports whether a job in this state will never run again
+func (s State) Finished() bool {
+    return s == Done || s == Failed || s == Cancelled
+}
+
+// Returned by Cancel when the job had already finished
+var ErrFinished = errors.New("The job has already finished")
+
+type Step string
+
+const (
+    StepDownload Step = "Download"
+    StepExtract Step = "Extract"
+    StepSave Step = "Save"
+)
+
+// The steps of a download job, in the order that they are run
+var Steps = []Step{ StepDownload, StepExtract, StepSave }
+
+// The steps of a job for a file that is already on the server, see EnqueueFile
+var FileSteps = []Step{ StepExtract, StepSave }
+
+/* A song download. The results of each finished step are stored on the job
+ * so that a job that was interrupted, ex. by a restart, can resume from the
+ * step that it was on. */
+type Job struct {
+    Id string `json:"id" bson:"_id"`
+    Request download.DownloadRequest `json:"request"`
+    // The email of the user that requested the download
+    CreatedBy string `json:"createdBy"`
+    CreatedAt time.Time `json:"createdAt"`
+    UpdatedAt time.Time `json:"updatedAt"`
+    State State `json:"state"`
+    // The step being run, or the last step that was run once the job has finished
+    Step Step `json:"step,omitempty"`
+    // The progress of the step in percent. It is only kept in memory, the
+    // stored progress is the progress at the start of the step
+    Progress uint8 `json:"progress"`
+
+    // The file written by the download step, removed by the extract step
+    DownloadedFile string `json:"downloadedFile,omitempty"`
+    // The song created by the extract step
+    Song *download.Song `json:"song,omitempty"`
+    // The id of the song written by the save step
+    SongId string `json:"songId,omitempty"`
+    // Why the job failed
+    Error string `json:"error,omitempty"`
+    // The kind of yt-dlp or ffmpeg error that the job failed with, ex.
+    // "unavailable", and the lines of their output that explain it
+    ErrorKind string `json:"errorKind,omitempty"`
+    Diagnostics []string `json:"diagnostics,omitempty"`
+    // Problems that did not stop the job, ex. a song that could not be tagged
+    Warnings []string `json:"warnings,omitempty"`
+    // The songs in the library whose audio the extracted song's is nearly
+    // identical to, each is also a warning
+    Similar []SimilarSong `json:"similar,omitempty"`
+    // Every attempt at a step, oldest first
+    History []Attempt `json:"history,omitempty"`
+
+    // The jobs created together by EnqueueGroup share a Group, Position is
+    // the job's place in it
+    Group string `json:"group,omitempty"`
+    Position int `json:"position,omitempty"`
+    // The playlist that the group's songs are added to once every job in the
+    // group has finished, "" for none
+    Playlist string `json:"playlist,omitempty"`
+    // The job of the group that downloads the source for this one while it
+    // is Waiting
+    WaitingFor string `json:"waitingFor,omitempty"`
+}
+
+/* A song in the library that sounds like a job's, found by comparing their
+ * acoustic fingerprints */
+type SimilarSong struct {
+    Id string `json:"id"`
+    Title string `json:"title"`
+    Artist string `json:"artist"`
+    // See fingerprint.Compare
+    Similarity float64 `json:"similarity"`
+}
+
+// A single run of one of a job's steps
+type Attempt struct {
+    Step Step `json:"step"`
+    StartedAt time.Time `json:"startedAt"`
+    FinishedAt time.Time `json:"finishedAt"`
+    // Why the attempt failed, empty if it succeeded
+    Error string `json:"error,omitempty"`
+    // How the error was classified, see download.ErrorClass
+    Class string `json:"class,omitempty"`
+    // See Job.ErrorKind and Job.Diagnostics
+    ErrorKind string `json:"errorKind,omitempty"`
+    Diagnostics []string `json:"diagnostics,omitempty"`
+    // When the step will be tried again, nil if it will not be
+    RetryAt *time.Time `json:"retryAt,omitempty"`
+}
+
+// the number of failed attempts at the step
+func (job Job) failures(step Step) int {
+    n := 0
+    for _,attempt := range job.History {
+        if attempt.Step == step && attempt.Error != "" {
+            n++
+        }
+    }
+    return n
+}
+
+/* Store persists jobs, the MeloDatabase implementations are Stores. Each
+ * method must be safe to call from several goroutines. */
+type Store interface {
+    // Stores a new job and returns the id given to it, the job's Id is ignored
+    CreateJob(job Job) (string,error)
+    UpdateJob(job Job) error
+    GetJob(jobId string) (Job,error)
+    // Returns the jobs in any of the states, or every job if no state is
+    // given, oldest first
+    ListJobs(states ...State) ([]Job,error)
+}
+
+type Config struct {
+    // The number of jobs that are run at the same time, defaults to 2
+    Concurrency int
+    // How each step is retried, steps that are left out use DefaultRetry
+    Retry map[Step]RetryPolicy
+}
+
+/* How a step that failed with a retryable error is tried again. The delay
+ * doubles after each attempt, ex. 5s, 10s, 20s. */
+type RetryPolicy struct {
+    // The most times the step is run, 1 means that it is not retried
+    Attempts int
+    // The delay before the first retry
+    InitialDelaySeconds float64
+    // The longest delay between attempts
+    MaxDelaySeconds float64
+}
+
+// Returns how long to wait after the given number of failed attempts
+func (p RetryPolicy) delay(failures int) time.Duration {
+    seconds := p.InitialDelaySeconds
+    for i := 1; i < failures && seconds < p.MaxDelaySeconds; i++ {
+        seconds *= 2
+    }
+    seconds = min(seconds, p.MaxDelaySeconds)
+    return time.Duration(seconds * float64(time.Second))
+}
+
+/* yt-dlp is often throttled for a while, so downloads are retried for the
+ * longest. A conversion only fails transiently on a bad download. */
+var DefaultRetry = map[Step]RetryPolicy{
+    StepDownload: { Attempts: 4, InitialDelaySeconds: 5, MaxDelaySeconds: 60 },
+    StepExtract: { Attempts: 3, InitialDelaySeconds: 2, MaxDelaySeconds: 30 },
+    StepSave: { Attempts: 3, InitialDelaySeconds: 1, MaxDelaySeconds: 10 },
+}
+
+// Returned by a step when the queue is stopped while it waits to retry
+var errStopped = errors.New("The queue was stopped")
+
+/* Queue runs the stored jobs with a fixed number of workers. Jobs are run in
+ * the order that they were created. */
+type Queue struct {
+    store Store
+    concurrency int
+    retry map[Step]RetryPolicy
+    // writes the song created by a job to the library and returns its id
+    saveSong func(Job) (string,error)
+    // the steps, replaced in tests
+    download func(ctx context.Context, source string, onProgressUpdate func(uint8)) (string,error)
+    convert func(ctx context.Context, inputFile string, req download.DownloadRequest,
+        onProgressUpdate func(uint8), onWarning func(error)) (download.Song,error)
+    // removes the audio file of a song that was never saved
+    removeSong func(download.Song)
+    onGroupFinished func([]Job)
+    findSimilarSongs func(download.Song) ([]SimilarSong,error)
+
+    // claimMu makes finding and claiming the next job atomic
+    claimMu sync.Mutex
+    // groupMu makes storing the last job of a group and finding that the
+    // group has finished atomic, so that only one job finishes the group
+    groupMu sync.Mutex
+    mu sync.Mutex
+    // the latest state of each running job
+    active map[string]Job
+    // how to stop each running job
+    running map[string]runningJob
+    subscribers map[string][]chan Job
+    wake chan struct{}
+    stop chan struct{}
+    wg sync.WaitGroup
+}
+
+func NewQueue(store Store, config Config, saveSong func(Job) (string,error)) *Queue {
+    concurrency := config.Concurrency
+    if concurrency <= 0 {
+        concurrency = 2
+    }
+    retry := make(map[Step]RetryPolicy)
+    for _,step := range Steps {
+        policy, ok := config.Retry[step]
+        if !ok || policy.Attempts <= 0 {
+            policy = DefaultRetry[step]
+        }
+        retry[step] = policy
+    }
+    return &Queue{
+        store: store,
+        concurrency: concurrency,
+        retry: retry,
+        saveSong: saveSong,
+        download: download.DownloadAudio,
+        convert: download.ConvertAudio,
+        removeSong: func(song download.Song) {
+            os.Remove(download.SongFile(song))
+        },
+        active: make(map[string]Job),
+        running: make(map[string]runningJob),
+        subscribers: make(map[string][]chan Job),
+        wake: make(chan struct{}, 1),
+        stop: make(chan struct{}),
+    }
+}
+
+/* Starts the workers. Jobs that were running when the server last stopped
+ * are queued again, they resume from the step that they were on. */
+func (q *Queue) Start() error {
+    interrupted, err := q.store.ListJobs(Running)
+    if err != nil {
+        return fmt.Errorf("Queue.Start: %w", err)
+    }
+    for _,job := range interrupted {
+        log.Printf("Resuming job %s from the %s step\n", job.Id, job.Step)
+        job.State = Queued
+        err = q.store.UpdateJob(job)
+        if err != nil {
+            return fmt.Errorf("Queue.Start: %w", err)
+        }
+    }
+    // the jobs that were waiting for a job that finished without sharing its
+    // download, ex. one that was cancelled right before the server stopped
+    waiting, err := q.store.ListJobs(Waiting)
+    if err != nil {
+        return fmt.Errorf("Queue.Start: %w", err)
+    }
+    released := make(map[string]bool)
+    for _,job := range waiting {
+        if released[job.WaitingFor] {
+            continue
+        }
+        downloader, err := q.store.GetJob(job.WaitingFor)
+        if err == nil && !downloader.State.Finished() {
+            continue
+        }
+        released[job.WaitingFor] = true
+        err = q.releaseWaiting(job.WaitingFor)
+        if err != nil {
+            return fmt.Errorf("Queue.Start: %w", err)
+        }
+    }
+    for i := 0; i < q.concurrency; i++ {
+        q.wg.Add(1)
+        go q.work()
+    }
+    q.signal()
+    return nil
+}
+
+// Stops the workers once they have finished the jobs that they are running
+func (q *Queue) Stop() {
+    close(q.stop)
+    q.wg.Wait()
+}
+
+// Stores a new job for the request, it is run once a worker is free
+func (q *Queue) Enqueue(req download.DownloadRequest, createdBy string) (Job,error) {
+    now := time.Now()
+    job := Job{
+        Request: req,
+        CreatedBy: createdBy,
+        CreatedAt: now,
+        UpdatedAt: now,
+        State: Queued,
+    }
+    id, err := q.store.CreateJob(job)
+    if err != nil {
+        return job, fmt.Errorf("Queue.Enqueue: %w", err)
+    }
+    job.Id = id
+    q.signal()
+    return job, nil
+}
+
+/* Stores a job for a file that is already on the server, ex. an upload. The
+ * job starts at the extract step, which removes the file once it has been
+ * converted. If the file is gone before then, the job downloads req.Source
+ * instead. */
+func (q *Queue) EnqueueFile(req download.DownloadRequest, file string, createdBy string) (Job,error) {
+    now := time.Now()
+    job := Job{
+        Request: req,
+        CreatedBy: createdBy,
+        CreatedAt: now,
+        UpdatedAt: now,
+        State: Queued,
+        DownloadedFile: file,
+    }
+    id, err := q.store.CreateJob(job)
+    if err != nil {
+        return job, fmt.Errorf("Queue.EnqueueFile: %w", err)
+    }
+    job.Id = id
+    q.signal()
+    return job, nil
+}
+
+/* Stores a job for each request, in order, as one group. The playlist is
+ * passed on to the OnGroupFinished handler. Jobs with the same source, ex. the
+ * chapters of a full album, share a single download: only the first is
+ * queued, the others wait until it has downloaded the source and then start
+ * from the extract step with a link to its file. If the first job stops
+ * before then, ex. it is cancelled, the next one downloads the source. */
+func (q *Queue) EnqueueGroup(reqs []download.DownloadRequest, createdBy string,
+playlist string) ([]Job,error) {
+    group, err := newGroupId()
+    if err != nil {
+        return nil, fmt.Errorf("Queue.EnqueueGroup: %w", err)
+    }
+    var list []Job
+    // the job that downloads each source
+    downloaders := make(map[string]string)
+    for i,req := range reqs {
+        now := time.Now()
+        job := Job{
+            Request: req,
+            CreatedBy: createdBy,
+            CreatedAt: now,
+            UpdatedAt: now,
+            State: Queued,
+            Group: group,
+            Position: i,
+            Playlist: playlist,
+        }
+        downloader, shared := downloaders[req.Source]
+        if shared {
+            job.State = Waiting
+            job.WaitingFor = downloader
+        }
+        job.Id, err = q.store.CreateJob(job)
+        if err != nil {
+            // the jobs that were stored are run anyway, they are still a
+            // group, only a smaller one
+            q.signal()
+            return list, fmt.Errorf("Queue.EnqueueGroup: %w", err)
+        }
+        if !shared {
+            downloaders[req.Source] = job.Id
+        }
+        list = append(list, job)
+    }
+    q.signal()
+    return list, nil
+}
+
+/* Sets the function that is called, once, when every job in a group has
+ * finished, with the group's jobs in order. */
+func (q *Queue) OnGroupFinished(onGroupFinished func([]Job)) {
+    q.onGroupFinished = onGroupFinished
+}
+
+/* Sets the function that looks for songs in the library that sound like the
+ * song that a job extracted. The song is saved either way, the similar songs
+ * are reported on the job as warnings so that a duplicate can be removed. */
+func (q *Queue) FindSimilarSongs(findSimilarSongs func(download.Song) ([]SimilarSong,error)) {
+    q.findSimilarSongs = findSimilarSongs
+}
+
+// Returns the jobs in the group, in order
+func (q *Queue) ListGroup(group string) ([]Job,error) {
+    all, err := q.List()
+    if err != nil {
+        return nil, err
+    }
+    var list []Job
+    for _,job := range all {
+        if job.Group == group {
+            list = append(list, job)
+        }
+    }
+    sort.SliceStable(list, func(i, j int) bool {
+        return list[i].Position < list[j].Position
+    })
+    return list, nil
+}
+
+func newGroupId() (string,error) {
+    b := make([]byte, 12)
+    _, err := rand.Read(b)
+    return hex.EncodeToString(b), err
+}
+
+/* Returns the job, with the current progress if it is running */
+func (q *Queue) Get(jobId string) (Job,error) {
+    q.mu.Lock()
+    job, ok := q.active[jobId]
+    q.mu.Unlock()
+    if ok {
+        return job, nil
+    }
+    return q.store.GetJob(jobId)
+}
+
+/* Returns the jobs in any of the states, or every job if no state is given,
+ * oldest first. Running jobs have their current progress. */
+func (q *Queue) List(states ...State) ([]Job,error) {
+    list, err := q.store.ListJobs(states...)
+    if err != nil {
+        return nil, fmt.Errorf("Queue.List: %w", err)
+    }
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    for i,job := range list {
+        if active, ok := q.active[job.Id]; ok && active.State == job.State {
+            list[i] = active
+        }
+    }
+    return list, nil
+}
+
+/* Stops the job and removes the files that it had written. A running job's
+ * yt-dlp or ffmpeg process is killed and Cancel waits for it to exit. The
+ * cancelled job is returned, or ErrFinished along with the job if it had
+ * already finished. */
+func (q *Queue) Cancel(jobId string) (Job,error) {
+    q.claimMu.Lock()
+    q.mu.Lock()
+    r, ok := q.running[jobId]
+    q.mu.Unlock()
+    if ok {
+        q.claimMu.Unlock()
+        r.cancel()
+        <-r.done
+        job, err := q.store.GetJob(jobId)
+        if err != nil {
+            return job, err
+        }
+        if job.State != Cancelled {
+            // it finished before it could be stopped
+            return job, ErrFinished
+        }
+        return job, nil
+    }
+    // holding claimMu keeps a worker from claiming the job in the meantime
+    defer q.claimMu.Unlock()
+    job, err := q.store.GetJob(jobId)
+    if err != nil {
+        return job, err
+    }
+    if job.State.Finished() {
+        return job, ErrFinished
+    }
+    q.cancelled(&job)
+    err = q.save(job)
+    if err != nil {
+        return job, fmt.Errorf("Queue.Cancel: %w", err)
+    }
+    err = q.releaseWaiting(job.Id)
+    if err != nil {
+        return job, fmt.Errorf("Queue.Cancel: %w", err)
+    }
+    return job, nil
+}
+
+/* Returns a channel that receives the job each time it changes. Updates that
+ * are not received in time are replaced by newer ones, so the channel always
+ * holds the latest state. The channel is closed once the job has finished,
+ * the last value is the finished job. unsubscribe must be called if the
+ * channel is abandoned before then. */
+func (q *Queue) Subscribe(jobId string) (updates <-chan Job, unsubscribe func(), err error) {
+    ch := make(chan Job, 1)
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    job, ok := q.active[jobId]
+    if !ok {
+        job, err = q.store.GetJob(jobId)
+        if err != nil {
+            return nil, nil, err
+        }
+    }
+    ch <- job
+    if job.State.Finished() {
+        close(ch)
+        return ch, func() {}, nil
+    }
+    q.subscribers[jobId] = append(q.subscribers[jobId], ch)
+    unsubscribe = func() {
+        q.mu.Lock()
+        defer q.mu.Unlock()
+        subs := q.subscribers[jobId]
+        for i,sub := range subs {
+            if sub == ch {
+                q.subscribers[jobId] = append(subs[:i:i], subs[i+1:]...)
+                break
+            }
+        }
+        if len(q.subscribers[jobId]) == 0 {
+            delete(q.subscribers, jobId)
+        }
+    }
+    return ch, unsubscribe, nil
+}
+
+// wakes an idle worker, if there is one
+func (q *Queue) signal() {
+    select {
+    case q.wake <- struct{}{}:
+    default:
+    }
+}
+
+func (q *Queue) work() {
+    defer q.wg.Done()
+    for {
+        select {
+        case <-q.stop:
+            return
+        default:
+        }
+        job, ok, err := q.claim()
+        if err != nil {
+            log.Println(err)
+        }
+        if !ok {
+            select {
+            case <-q.wake:
+                continue
+            case <-q.stop:
+                return
+            }
+        }
+        // there may be more jobs waiting for another worker
+        q.signal()
+        q.run(job)
+    }
+}
+
+// marks the oldest queued job as running and returns it
+func (q *Queue) claim() (Job,bool,error) {
+    q.claimMu.Lock()
+    defer q.claimMu.Unlock()
+    queued, err := q.store.ListJobs(Queued)
+    if err != nil {
+        return Job{}, false, fmt.Errorf("Queue.claim: %w", err)
+    }
+    if len(queued) == 0 {
+        return Job{}, false, nil
+    }
+    job := queued[0]
+    job.State = Running
+    err = q.save(job)
+    if err != nil {
+        return job, false, fmt.Errorf("Queue.claim: %w", err)
+    }
+    // registered before claimMu is released so that Cancel can find it
+    ctx, cancel := context.WithCancel(context.Background())
+    q.mu.Lock()
+    q.running[job.Id] = runningJob{ ctx, cancel, make(chan struct{}) }
+    q.mu.Unlock()
+    return job, true, nil
+}
+
+type runningJob struct {
+    ctx context.Context
+    cancel context.CancelFunc
+    // closed once the job has stopped
+    done chan struct{}
+}
+
+func (q *Queue) run(job Job) {
+    q.mu.Lock()
+    r := q.running[job.Id]
+    q.mu.Unlock()
+    defer func() {
+        q.mu.Lock()
+        delete(q.running, job.Id)
+        q.mu.Unlock()
+        r.cancel()
+        close(r.done)
+    }()
+
+    err := q.runSteps(r.ctx, &job)
+    if errors.Is(err, errStopped) {
+        // it is still running as far as the store knows, so it is resumed
+        // by the next Start
+        log.Printf("Job %s was stopped while waiting to retry\n", job.Id)
+        return
+    }
+    if err != nil && r.ctx.Err() != nil {
+        log.Printf("Job %s was cancelled\n", job.Id)
+        q.cancelled(&job)
+    } else if err != nil {
+        log.Printf("Job %s failed: %v\n", job.Id, err)
+        job.State = Failed
+        job.Error = err.Error()
+        job.ErrorKind, job.Diagnostics = download.ErrorDetails(err)
+    } else {
+        job.State = Done
+        job.Progress = 100
+    }
+    err = q.save(job)
+    if err != nil {
+        log.Printf("Failed to save job %s: %v\n", job.Id, err)
+    }
+    q.claimMu.Lock()
+    defer q.claimMu.Unlock()
+    err = q.releaseWaiting(job.Id)
+    if err != nil {
+        log.Printf("Failed to queue the jobs waiting for job %s: %v\n", job.Id, err)
+    }
+}
+
+// marks the job as cancelled and removes the files that its steps wrote
+func (q *Queue) cancelled(job *Job) {
+    job.State = Cancelled
+    job.Error = "The download was cancelled"
+    if job.DownloadedFile != "" {
+        os.Remove(job.DownloadedFile)
+        job.DownloadedFile = ""
+    }
+    if job.Song != nil && job.SongId == "" {
+        q.removeSong(*job.Song)
+        job.Song = nil
+    }
+}
+
+/* runs the steps that the job has not finished yet. A step that fails is
+ * tried again as its RetryPolicy allows, unless the error is Permanent. */
+func (q *Queue) runSteps(ctx context.Context, job *Job) error {
+    for {
+        step := nextStep(*job)
+        if step == "" {
+            return nil
+        }
+        err := q.startStep(ctx, job, step)
+        if err != nil {
+            return err
+        }
+        attempt := Attempt{ Step: step, StartedAt: time.Now() }
+        err = q.runStep(ctx, job, step)
+        attempt.FinishedAt = time.Now()
+        if err == nil {
+            job.History = append(job.History, attempt)
+            continue
+        }
+        if ctx.Err() != nil {
+            return err
+        }
+        class := download.Classify(err)
+        attempt.Error = err.Error()
+        attempt.Class = class.String()
+        attempt.ErrorKind, attempt.Diagnostics = download.ErrorDetails(err)
+        failures := job.failures(step) + 1
+        policy := q.retry[step]
+        if class == download.Permanent || failures >= policy.Attempts {
+            job.History = append(job.History, attempt)
+            return err
+        }
+        delay := policy.delay(failures)
+        retryAt := attempt.FinishedAt.Add(delay)
+        attempt.RetryAt = &retryAt
+        job.History = append(job.History, attempt)
+        if class == download.BadDownload && job.DownloadedFile != "" {
+            os.Remove(job.DownloadedFile)
+            job.DownloadedFile = ""
+        }
+        log.Printf("Job %s: %s failed, retrying in %v: %v\n", job.Id, step, delay, err)
+        job.Warnings = append(job.Warnings,
+            fmt.Sprintf("%s failed, trying again in %v: %v", step, delay, err))
+        err = q.save(*job)
+        if err != nil {
+            return err
+        }
+        err = q.wait(ctx, delay)
+        if err != nil {
+            return err
+        }
+    }
+}
+
+// the step that the job should run next, or "" if it has finished
+func nextStep(job Job) Step {
+    if job.SongId != "" {
+        return ""
+    }
+    if job.Song != nil {
+        return StepSave
+    }
+    if job.DownloadedFile != "" && fileExists(job.DownloadedFile) {
+        return StepExtract
+    }
+    return StepDownload
+}
+
+// runs a single step and stores its result on the job
+func (q *Queue) runStep(ctx context.Context, job *Job, step Step) error {
+    onProgressUpdate := func(progress uint8) {
+        job.Progress = progress
+        q.publish(*job)
+    }
+    onWarning := func(err error) {
+        job.Warnings = append(job.Warnings, err.Error())
+        q.publish(*job)
+    }
+    switch step {
+    case StepDownload:
+        file, err := q.download(ctx, job.Request.Source, onProgressUpdate)
+        if err != nil {
+            return err
+        }
+        job.DownloadedFile = file
+        q.shareDownload(*job)
+    case StepExtract:
+        song, err := q.convert(ctx, job.DownloadedFile, job.Request, onProgressUpdate, onWarning)
+        if err != nil {
+            return err
+        }
+        job.Song = &song
+        job.DownloadedFile = ""
+        q.checkSimilar(job, onWarning)
+    case StepSave:
+        songId, err := q.saveSong(*job)
+        if err != nil {
+            return fmt.Errorf("Failed to write song to database: %w", err)
+        }
+        job.SongId = songId
+        // the fingerprint is stored with the song, the job has no more use
+        // for it
+        song := *job.Song
+        song.Fingerprint = nil
+        job.Song = &song
+    }
+    return nil
+}
+
+/* stores the songs that sound like the job's song on the job, a failed
+ * search is only logged since the song can be saved without it */
+func (q *Queue) checkSimilar(job *Job, onWarning func(error)) {
+    if q.findSimilarSongs == nil || len(job.Song.Fingerprint) == 0 {
+        return
+    }
+    similar, err := q.findSimilarSongs(*job.Song)
+    if err != nil {
+        log.Printf("Job %s: Failed to look for similar songs: %v\n", job.Id, err)
+        return
+    }
+    job.Similar = similar
+    for _,song := range similar {
+        name := fmt.Sprintf("\"%s\"", song.Title)
+        if song.Artist != "" {
+            name += " by " + song.Artist
+        }
+        onWarning(fmt.Errorf("The audio is nearly identical to %s, which is already in the library", name))
+    }
+}
+
+/* gives each job that is waiting for the job's download a link to the file
+ * and queues it, so that it is converted without downloading the source
+ * again. A job that can't be given the file downloads the source itself. */
+func (q *Queue) shareDownload(job Job) {
+    q.claimMu.Lock()
+    defer q.claimMu.Unlock()
+    waiting, err := q.waitingFor(job.Id)
+    if err != nil {
+        log.Printf("Job %s: Failed to share the download: %v\n", job.Id, err)
+        return
+    }
+    for _,w := range waiting {
+        w.DownloadedFile, err = linkFile(job.DownloadedFile, w.Id)
+        if err != nil {
+            log.Printf("Job %s: Failed to share the download with job %s: %v\n", job.Id, w.Id, err)
+        }
+        w.State = Queued
+        w.WaitingFor = ""
+        err = q.save(w)
+        if err != nil {
+            log.Printf("Job %s: Failed to share the download with job %s: %v\n", job.Id, w.Id, err)
+        }
+    }
+    if len(waiting) > 0 {
+        q.signal()
+    }
+}
+
+/* queues the first of the jobs that were waiting for the job's download to
+ * download the source instead, the others wait for it. claimMu must be held.
+ * A job that shared its download has no jobs waiting for it. */
+func (q *Queue) releaseWaiting(jobId string) error {
+    waiting, err := q.waitingFor(jobId)
+    if err != nil || len(waiting) == 0 {
+        return err
+    }
+    next := waiting[0]
+    next.State = Queued
+    next.WaitingFor = ""
+    err = q.save(next)
+    if err != nil {
+        return err
+    }
+    for _,w := range waiting[1:] {
+        w.WaitingFor = next.Id
+        err = q.save(w)
+        if err != nil {
+            return err
+        }
+    }
+    q.signal()
+    return nil
+}
+
+// the jobs that are waiting for the job's download, in order
+func (q *Queue) waitingFor(jobId string) ([]Job,error) {
+    list, err := q.store.ListJobs(Waiting)
+    if err != nil {
+        return nil, err
+    }
+    var waiting []Job
+    for _,job := range list {
+        if job.WaitingFor == jobId {
+            waiting = append(waiting, job)
+        }
+    }
+    sort.SliceStable(waiting, func(i, j int) bool {
+        return waiting[i].Position < waiting[j].Position
+    })
+    return waiting, nil
+}
+
+/* Links the file to a new name ending in suffix, or copies it if it can't be
+ * linked, ex. on a filesystem without hard links. Each job removes its own
+ * name once it has converted the file. */
+func linkFile(file, suffix string) (string,error) {
+    ext := filepath.Ext(file)
+    name := strings.TrimSuffix(file, ext) + "-" + suffix + ext
+    err := os.Link(file, name)
+    if err == nil {
+        return name, nil
+    }
+    in, err := os.Open(file)
+    if err != nil {
+        return "", err
+    }
+    defer in.Close()
+    out, err := os.Create(name)
+    if err != nil {
+        return "", err
+    }
+    _, err = io.Copy(out, in)
+    if e := out.Close(); err == nil {
+        err = e
+    }
+    if err != nil {
+        os.Remove(name)
+        return "", err
+    }
+    return name, nil
+}
+
+// waits before a retry, returns early if the job is cancelled or the queue stopped
+func (q *Queue) wait(ctx context.Context, delay time.Duration) error {
+    timer := time.NewTimer(delay)
+    defer timer.Stop()
+    select {
+    case <-timer.C:
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    case <-q.stop:
+        return errStopped
+    }
+}
+
+/* stores the results of the previous step along with the start of the next,
+ * a cancelled job stops here */
+func (q *Queue) startStep(ctx context.Context, job *Job, step Step) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    job.Step = step
+    job.Progress = 0
+    return q.save(*job)
+}
+
+/* stores the job and sends it to its subscribers. Storing the last job of a
+ * group to finish calls the OnGroupFinished handler. */
+func (q *Queue) save(job Job) error {
+    groupJob := job.Group != "" && job.State.Finished()
+    if groupJob {
+        q.groupMu.Lock()
+        defer q.groupMu.Unlock()
+    }
+    job.UpdatedAt = time.Now()
+    err := q.store.UpdateJob(job)
+    q.publish(job)
+    if groupJob && err == nil {
+        q.finishGroup(job.Group)
+    }
+    return err
+}
+
+// calls the OnGroupFinished handler if every job in the group has finished
+func (q *Queue) finishGroup(group string) {
+    list, err := q.store.ListJobs()
+    if err != nil {
+        log.Printf("Failed to check if group %s has finished: %v\n", group, err)
+        return
+    }
+    var jobs []Job
+    for _,job := range list {
+        if job.Group != group {
+            continue
+        }
+        if !job.State.Finished() {
+            return
+        }
+        jobs = append(jobs, job)
+    }
+    sort.SliceStable(jobs, func(i, j int) bool {
+        return jobs[i].Position < jobs[j].Position
+    })
+    if q.onGroupFinished != nil {
+        q.onGroupFinished(jobs)
+    }
+}
+
+func (q *Queue) publish(job Job) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    if job.State.Finished() {
+        delete(q.active, job.Id)
+    } else {
+        q.active[job.Id] = job
+    }
+    for _,ch := range q.subscribers[job.Id] {
+        // replace the update that has not been received yet, if there is one
+        select {
+        case <-ch:
+        default:
+        }
+        ch <- job
+        if job.State.Finished() {
+            close(ch)
+        }
+    }
+    if job.State.Finished() {
+        delete(q.subscribers, job.Id)
+    }
+}
+
+func fileExists(name string) bool {
+    _, err := os.Stat(name)
+    return err == nil
+}
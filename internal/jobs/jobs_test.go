@@ -0,0 +1,631 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TSchreiber/melo/internal/download"
+	"github.com/TSchreiber/melo/internal/fingerprint"
+	yt_dlp "github.com/TSchreiber/melo/internal/yt_dlp"
+)
+
+// a Store that keeps the jobs in a map
+type memoryStore struct {
+    mu sync.Mutex
+    next int
+    jobs map[string]Job
+}
+
+func newMemoryStore() *memoryStore {
+    return &memoryStore{ jobs: make(map[string]Job) }
+}
+
+func (s *memoryStore) CreateJob(job Job) (string,error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.next++
+    job.Id = fmt.Sprintf("%03d", s.next)
+    s.jobs[job.Id] = job
+    return job.Id, nil
+}
+
+func (s *memoryStore) UpdateJob(job Job) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.jobs[job.Id] = job
+    return nil
+}
+
+func (s *memoryStore) GetJob(jobId string) (Job,error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    job, ok := s.jobs[jobId]
+    if !ok {
+        return job, errors.New("not found")
+    }
+    return job, nil
+}
+
+func (s *memoryStore) ListJobs(states ...State) ([]Job,error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    var list []Job
+    for _,job := range s.jobs {
+        if len(states) == 0 {
+            list = append(list, job)
+        }
+        for _,state := range states {
+            if job.State == state {
+                list = append(list, job)
+            }
+        }
+    }
+    sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+    return list, nil
+}
+
+/* A queue whose steps only pretend to download and convert. release must
+ * receive once for each download before it finishes. */
+type testQueue struct {
+    *Queue
+    store *memoryStore
+    release chan struct{}
+
+    mu sync.Mutex
+    running, maxRunning int
+    downloads, saved []string
+}
+
+func newTestQueue(t *testing.T, concurrency int) *testQueue {
+    tq := &testQueue{
+        store: newMemoryStore(),
+        release: make(chan struct{}),
+    }
+    tq.Queue = NewQueue(tq.store, Config{ Concurrency: concurrency }, func(job Job) (string,error) {
+        tq.mu.Lock()
+        defer tq.mu.Unlock()
+        tq.saved = append(tq.saved, job.Song.Title)
+        return "song-" + job.Id, nil
+    })
+    // retries are quick, a download that fails with "unavailable" is not retried
+    for step := range tq.retry {
+        tq.retry[step] = RetryPolicy{ Attempts: 3, InitialDelaySeconds: 0.001, MaxDelaySeconds: 0.01 }
+    }
+    dir := t.TempDir()
+    tq.download = func(ctx context.Context, source string, onProgressUpdate func(uint8)) (string,error) {
+        tq.mu.Lock()
+        tq.running++
+        tq.maxRunning = max(tq.maxRunning, tq.running)
+        tq.downloads = append(tq.downloads, source)
+        tq.mu.Unlock()
+        defer func() {
+            tq.mu.Lock()
+            tq.running--
+            tq.mu.Unlock()
+        }()
+        onProgressUpdate(50)
+        select {
+        case <-tq.release:
+        case <-ctx.Done():
+            return "", ctx.Err()
+        }
+        if source == "fail" {
+            return "", &yt_dlp.Error{
+                Kind: yt_dlp.ErrorUnavailable,
+                Messages: []string{ "[youtube] fail: Video unavailable" },
+                Err: errors.New("exit status 1"),
+            }
+        }
+        name := filepath.Join(dir, source + ".webm")
+        return name, os.WriteFile(name, []byte(source), 0644)
+    }
+    tq.convert = func(ctx context.Context, inputFile string, req download.DownloadRequest,
+    onProgressUpdate func(uint8), onWarning func(error)) (download.Song,error) {
+        os.Remove(inputFile)
+        if req.Artwork == "missing" {
+            onWarning(errors.New("Failed to fetch artwork"))
+        }
+        return download.Song{
+            Title: req.Title,
+            AudioUrl: "/song/" + req.Source + ".mp3",
+            Fingerprint: fingerprint.Fingerprint{ 1, 2, 3 },
+        }, nil
+    }
+    return tq
+}
+
+// waits for the job to finish and returns it
+func waitForJob(t *testing.T, q *Queue, jobId string) Job {
+    updates, unsubscribe, err := q.Subscribe(jobId)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer unsubscribe()
+    var job Job
+    timeout := time.After(5 * time.Second)
+    for {
+        select {
+        case update, ok := <-updates:
+            if !ok {
+                return job
+            }
+            job = update
+        case <-timeout:
+            t.Fatalf("Timed out waiting for job %s", jobId)
+        }
+    }
+}
+
+func TestQueue(t *testing.T) {
+    tq := newTestQueue(t, 2)
+    if err := tq.Start(); err != nil {
+        t.Fatal(err)
+    }
+    var ids []string
+    for _,source := range []string{ "a", "b", "fail", "c" } {
+        job, err := tq.Enqueue(download.DownloadRequest{ Title: source, Source: source }, "admin@example.com")
+        if err != nil {
+            t.Fatal(err)
+        }
+        ids = append(ids, job.Id)
+    }
+    go func() {
+        // let both workers start before any download finishes
+        for {
+            tq.mu.Lock()
+            running := tq.running
+            tq.mu.Unlock()
+            if running == 2 {
+                break
+            }
+            time.Sleep(time.Millisecond)
+        }
+        for i := 0; i < 4; i++ {
+            tq.release <- struct{}{}
+        }
+    }()
+    finished := make([]Job, len(ids))
+    for i,id := range ids {
+        finished[i] = waitForJob(t, tq.Queue, id)
+    }
+    tq.Stop()
+
+    if tq.maxRunning != 2 {
+        t.Errorf("Expected 2 downloads at a time, got %d", tq.maxRunning)
+    }
+    for i,job := range finished {
+        if i == 2 {
+            if job.State != Failed || job.Step != StepDownload || job.ErrorKind != "unavailable" ||
+            len(job.Diagnostics) != 1 || len(job.History) != 1 {
+                t.Errorf("Expected job %s to fail while downloading, got %+v", job.Id, job)
+            }
+            continue
+        }
+        if job.State != Done || job.SongId != "song-" + job.Id || job.Step != StepSave {
+            t.Errorf("Expected job %s to be done, got %+v", job.Id, job)
+        }
+        stored, _ := tq.store.GetJob(job.Id)
+        if stored.State != Done || stored.Song == nil || stored.DownloadedFile != "" {
+            t.Errorf("Expected the finished job %s to be stored, got %+v", job.Id, stored)
+        }
+    }
+    // the first two jobs start together, so only the later ones are ordered
+    if len(tq.downloads) != 4 || tq.downloads[3] != "c" {
+        t.Errorf("Expected the jobs to start in order, got %v", tq.downloads)
+    }
+}
+
+func TestQueueResume(t *testing.T) {
+    tq := newTestQueue(t, 1)
+    now := time.Now()
+    // interrupted after the download and after the conversion
+    downloaded := filepath.Join(t.TempDir(), "a.webm")
+    os.WriteFile(downloaded, []byte("a"), 0644)
+    a, _ := tq.store.CreateJob(Job{
+        Request: download.DownloadRequest{ Title: "a", Source: "a" },
+        CreatedAt: now, State: Running, Step: StepExtract, DownloadedFile: downloaded,
+    })
+    b, _ := tq.store.CreateJob(Job{
+        Request: download.DownloadRequest{ Title: "b", Source: "b" },
+        CreatedAt: now, State: Running, Step: StepSave,
+        Song: &download.Song{ Title: "b", AudioUrl: "/song/b.mp3" },
+    })
+    // the file of an interrupted download is gone, it is downloaded again
+    c, _ := tq.store.CreateJob(Job{
+        Request: download.DownloadRequest{ Title: "c", Source: "c" },
+        CreatedAt: now, State: Running, Step: StepExtract, DownloadedFile: "missing.webm",
+    })
+    if err := tq.Start(); err != nil {
+        t.Fatal(err)
+    }
+    go func() { tq.release <- struct{}{} }()
+    for _,id := range []string{ a, b, c } {
+        if job := waitForJob(t, tq.Queue, id); job.State != Done {
+            t.Errorf("Expected job %s to be done, got %+v", id, job)
+        }
+    }
+    tq.Stop()
+    if len(tq.downloads) != 1 || tq.downloads[0] != "c" {
+        t.Errorf("Expected only \"c\" to be downloaded, got %v", tq.downloads)
+    }
+    if len(tq.saved) != 3 {
+        t.Errorf("Expected 3 songs to be saved, got %v", tq.saved)
+    }
+}
+
+func TestEnqueueFile(t *testing.T) {
+    tq := newTestQueue(t, 1)
+    if err := tq.Start(); err != nil {
+        t.Fatal(err)
+    }
+    defer tq.Stop()
+    uploaded := filepath.Join(t.TempDir(), "upload.flac")
+    os.WriteFile(uploaded, []byte("upload"), 0644)
+    job, err := tq.EnqueueFile(download.DownloadRequest{ Title: "Upload" }, uploaded, "admin@example.com")
+    if err != nil {
+        t.Fatal(err)
+    }
+    job = waitForJob(t, tq.Queue, job.Id)
+    if job.State != Done || job.SongId == "" || len(job.History) != 2 || job.History[0].Step != StepExtract {
+        t.Errorf("Expected the job to start at the extract step, got %+v", job)
+    }
+    if len(tq.downloads) != 0 {
+        t.Errorf("Expected nothing to be downloaded, got %v", tq.downloads)
+    }
+    if _, err := os.Stat(uploaded); !os.IsNotExist(err) {
+        t.Errorf("Expected the file to be removed once it was converted, got %v", err)
+    }
+}
+
+func TestSubscribe(t *testing.T) {
+    tq := newTestQueue(t, 1)
+    job, _ := tq.Enqueue(download.DownloadRequest{ Title: "a", Source: "a", Artwork: "missing" }, "")
+    updates, unsubscribe, err := tq.Subscribe(job.Id)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer unsubscribe()
+    if first := <-updates; first.State != Queued {
+        t.Errorf("Expected the first update to be the queued job, got %+v", first)
+    }
+    tq.Start()
+    defer tq.Stop()
+    if update := <-updates; update.State != Running {
+        t.Errorf("Expected the job to be running, got %+v", update)
+    }
+    tq.release <- struct{}{}
+    var last Job
+    for update := range updates {
+        last = update
+    }
+    if last.State != Done || last.Progress != 100 || len(last.Warnings) != 1 {
+        t.Errorf("Expected the last update to be the finished job, got %+v", last)
+    }
+
+    // subscribing to a finished job only returns the job
+    updates, _, err = tq.Subscribe(job.Id)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if first, ok := <-updates; !ok || first.State != Done {
+        t.Errorf("Expected the finished job, got %+v", first)
+    }
+    if _, ok := <-updates; ok {
+        t.Error("Expected the channel of a finished job to be closed")
+    }
+}
+
+func TestFindSimilarSongs(t *testing.T) {
+    tq := newTestQueue(t, 1)
+    var searched []download.Song
+    tq.FindSimilarSongs(func(song download.Song) ([]SimilarSong,error) {
+        searched = append(searched, song)
+        switch song.Title {
+        case "dup":
+            return []SimilarSong{
+                { Id: "1", Title: "Good Day", Artist: "IU", Similarity: 0.9 },
+                { Id: "2", Title: "Good Day (Live)", Similarity: 0.4 },
+            }, nil
+        case "broken":
+            return nil, errors.New("the database is down")
+        }
+        return nil, nil
+    })
+    tq.Start()
+    defer tq.Stop()
+    go func() {
+        for i := 0; i < 3; i++ {
+            tq.release <- struct{}{}
+        }
+    }()
+    var finished []Job
+    for _,title := range []string{ "dup", "broken", "new" } {
+        job, _ := tq.Enqueue(download.DownloadRequest{ Title: title, Source: title }, "")
+        finished = append(finished, waitForJob(t, tq.Queue, job.Id))
+    }
+
+    dup := finished[0]
+    if dup.State != Done || len(dup.Similar) != 2 || dup.Similar[0].Id != "1" {
+        t.Errorf("Expected the similar songs to be stored on the job, got %+v", dup)
+    }
+    if len(dup.Warnings) != 2 || dup.Warnings[0] != `The audio is nearly identical to "Good Day" by IU, which is already in the library` ||
+    dup.Warnings[1] != `The audio is nearly identical to "Good Day (Live)", which is already in the library` {
+        t.Errorf("Expected a warning for each similar song, got %q", dup.Warnings)
+    }
+    for _,job := range finished[1:] {
+        if job.State != Done || len(job.Similar) != 0 || len(job.Warnings) != 0 {
+            t.Errorf("Expected job %s to be done without similar songs, got %+v", job.Id, job)
+        }
+    }
+    if len(searched) != 3 || len(searched[0].Fingerprint) != 3 {
+        t.Errorf("Expected each fingerprinted song to be searched for, got %+v", searched)
+    }
+    if len(tq.saved) != 3 {
+        t.Errorf("Expected every song to be saved, got %v", tq.saved)
+    }
+    // the fingerprint was saved with the song
+    if stored, _ := tq.store.GetJob(dup.Id); stored.Song == nil || stored.Song.Fingerprint != nil {
+        t.Errorf("Expected the stored job to keep the song without its fingerprint, got %+v", stored.Song)
+    }
+}
+
+func TestCancel(t *testing.T) {
+    tq := newTestQueue(t, 1)
+    running, _ := tq.Enqueue(download.DownloadRequest{ Title: "a", Source: "a" }, "")
+    queued, _ := tq.Enqueue(download.DownloadRequest{ Title: "b", Source: "b" }, "")
+    // cancelled while it waits for a worker, it is never run
+    if job, err := tq.Cancel(queued.Id); err != nil || job.State != Cancelled {
+        t.Fatalf("Expected the queued job to be cancelled, got %+v, %v", job, err)
+    }
+    updates, unsubscribe, _ := tq.Subscribe(running.Id)
+    defer unsubscribe()
+    tq.Start()
+    defer tq.Stop()
+    // wait for the download to start
+    for update := range updates {
+        if update.Progress == 50 {
+            break
+        }
+    }
+    job, err := tq.Cancel(running.Id)
+    if err != nil || job.State != Cancelled || job.Step != StepDownload {
+        t.Errorf("Expected the running job to be cancelled, got %+v, %v", job, err)
+    }
+    if _, err := tq.Cancel(running.Id); !errors.Is(err, ErrFinished) {
+        t.Errorf("Expected ErrFinished for a cancelled job, got %v", err)
+    }
+    if len(tq.downloads) != 1 || len(tq.saved) != 0 {
+        t.Errorf("Expected only \"a\" to start and nothing to be saved, got %v, %v",
+            tq.downloads, tq.saved)
+    }
+
+    // the converted song of a job cancelled before it was saved is removed
+    var removed []string
+    tq.removeSong = func(song download.Song) {
+        removed = append(removed, song.AudioUrl)
+    }
+    id, _ := tq.store.CreateJob(Job{
+        Request: download.DownloadRequest{ Title: "c", Source: "c" },
+        State: Running, Step: StepSave,
+        Song: &download.Song{ Title: "c", AudioUrl: "/song/c.mp3" },
+    })
+    job, err = tq.Cancel(id)
+    if err != nil || job.Song != nil || len(removed) != 1 || removed[0] != "/song/c.mp3" {
+        t.Errorf("Expected the song file to be removed, got %+v, %v, %v", job, removed, err)
+    }
+}
+
+func TestEnqueueGroup(t *testing.T) {
+    tq := newTestQueue(t, 2)
+    finished := make(chan []Job, 2)
+    tq.OnGroupFinished(func(group []Job) {
+        finished <- group
+    })
+    group, err := tq.EnqueueGroup([]download.DownloadRequest{
+        { Title: "a", Source: "a" },
+        { Title: "b", Source: "fail" },
+        { Title: "c", Source: "c" },
+    }, "admin@example.com", "playlist-1")
+    if err != nil || len(group) != 3 {
+        t.Fatalf("Expected 3 jobs, got %v, %v", group, err)
+    }
+    tq.Start()
+    defer tq.Stop()
+    for range group {
+        tq.release <- struct{}{}
+    }
+
+    select {
+    case jobs := <-finished:
+        if len(jobs) != 3 {
+            t.Fatalf("Expected the 3 jobs of the group, got %+v", jobs)
+        }
+        for i,job := range jobs {
+            if job.Position != i || job.Group != group[0].Group || job.Playlist != "playlist-1" {
+                t.Errorf("Expected job %d of the group, got %+v", i, job)
+            }
+        }
+        if jobs[0].State != Done || jobs[1].State != Failed || jobs[2].State != Done {
+            t.Errorf("Expected done, failed, done, got %s, %s, %s",
+                jobs[0].State, jobs[1].State, jobs[2].State)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("Timed out waiting for the group to finish")
+    }
+    // a job outside of the group does not finish it again
+    job, _ := tq.Enqueue(download.DownloadRequest{ Title: "d", Source: "d" }, "")
+    tq.release <- struct{}{}
+    waitForJob(t, tq.Queue, job.Id)
+    select {
+    case jobs := <-finished:
+        t.Errorf("Expected the group to finish once, finished again with %+v", jobs)
+    default:
+    }
+    list, err := tq.ListGroup(group[0].Group)
+    if err != nil || len(list) != 3 || list[2].Id != group[2].Id {
+        t.Errorf("Expected the group's jobs, got %+v, %v", list, err)
+    }
+}
+
+func TestEnqueueGroupSharedDownload(t *testing.T) {
+    tq := newTestQueue(t, 2)
+    group, err := tq.EnqueueGroup([]download.DownloadRequest{
+        { Title: "unlucky", Source: "album", End: 200, Track: 1 },
+        { Title: "The visitor", Source: "album", Start: 200, End: 400, Track: 2 },
+        { Title: "Good Day", Source: "other" },
+        { Title: "7 rings", Source: "album", Start: 400, Track: 3 },
+    }, "admin@example.com", "")
+    if err != nil || len(group) != 4 {
+        t.Fatalf("Expected 4 jobs, got %v, %v", group, err)
+    }
+    for i,want := range []State{ Queued, Waiting, Queued, Waiting } {
+        if group[i].State != want || (want == Waiting) != (group[i].WaitingFor == group[0].Id) {
+            t.Errorf("Job %d: expected to be %s, got %s waiting for %q", i, want,
+                group[i].State, group[i].WaitingFor)
+        }
+    }
+    tq.Start()
+    defer tq.Stop()
+    tq.release <- struct{}{}
+    tq.release <- struct{}{}
+    for i,job := range group {
+        job = waitForJob(t, tq.Queue, job.Id)
+        if job.State != Done {
+            t.Errorf("Job %d: expected to be done, got %+v", i, job)
+        }
+        if i == 1 || i == 3 {
+            if len(job.History) != 2 || job.History[0].Step != StepExtract {
+                t.Errorf("Job %d: expected to start at the extract step, got %+v", i, job.History)
+            }
+        }
+    }
+    if len(tq.downloads) != 2 {
+        t.Errorf("Expected each source to be downloaded once, got %v", tq.downloads)
+    }
+}
+
+func TestWaitingJobsTakeOver(t *testing.T) {
+    tq := newTestQueue(t, 1)
+    group, _ := tq.EnqueueGroup([]download.DownloadRequest{
+        { Title: "a1", Source: "a", End: 1 },
+        { Title: "a2", Source: "a", Start: 1, End: 2 },
+        { Title: "a3", Source: "a", Start: 2 },
+        { Title: "f1", Source: "fail", End: 1 },
+        { Title: "f2", Source: "fail", Start: 1 },
+    }, "admin@example.com", "")
+    // the next job downloads the source instead of the cancelled one
+    if _, err := tq.Cancel(group[0].Id); err != nil {
+        t.Fatal(err)
+    }
+    a2, _ := tq.store.GetJob(group[1].Id)
+    a3, _ := tq.store.GetJob(group[2].Id)
+    if a2.State != Queued || a2.WaitingFor != "" || a3.State != Waiting || a3.WaitingFor != a2.Id {
+        t.Errorf("Expected a3 to wait for a2, got %+v and %+v", a2, a3)
+    }
+    // a job left waiting for a job that has finished is queued by Start
+    orphan, _ := tq.store.CreateJob(Job{
+        Request: download.DownloadRequest{ Title: "o", Source: "o" },
+        CreatedAt: time.Now(), State: Waiting, WaitingFor: group[0].Id,
+    })
+
+    tq.Start()
+    defer tq.Stop()
+    go func() {
+        // a, both attempts at fail, and o
+        for i := 0; i < 4; i++ {
+            tq.release <- struct{}{}
+        }
+    }()
+    for i,want := range []State{ Cancelled, Done, Done, Failed, Failed } {
+        if job := waitForJob(t, tq.Queue, group[i].Id); job.State != want {
+            t.Errorf("Job %d: expected to be %s, got %+v", i, want, job)
+        }
+    }
+    if job := waitForJob(t, tq.Queue, orphan); job.State != Done {
+        t.Errorf("Expected the orphaned job to be done, got %+v", job)
+    }
+    if fmt.Sprint(tq.downloads) != "[a fail fail o]" {
+        t.Errorf("Expected a to be downloaded once and fail twice, got %v", tq.downloads)
+    }
+}
+
+func TestRetry(t *testing.T) {
+    tq := newTestQueue(t, 1)
+    dir := t.TempDir()
+    downloads := 0
+    tq.download = func(ctx context.Context, source string, onProgressUpdate func(uint8)) (string,error) {
+        downloads++
+        switch {
+        case downloads == 1:
+            return "", errors.New("ERROR: unable to download video data: HTTP Error 403: Forbidden")
+        case source == "throttled":
+            return "", errors.New("ERROR: [youtube] throttled: HTTP Error 429: Too Many Requests")
+        }
+        name := filepath.Join(dir, fmt.Sprintf("%s-%d.webm", source, downloads))
+        return name, os.WriteFile(name, []byte(source), 0644)
+    }
+    converts := 0
+    tq.convert = func(ctx context.Context, inputFile string, req download.DownloadRequest,
+    onProgressUpdate func(uint8), onWarning func(error)) (download.Song,error) {
+        converts++
+        if converts == 1 {
+            return download.Song{}, fmt.Errorf("Failed to convert audio: %s: %w", inputFile,
+                errors.New("Invalid data found when processing input"))
+        }
+        os.Remove(inputFile)
+        return download.Song{ Title: req.Title, AudioUrl: "/song/" + req.Source + ".mp3" }, nil
+    }
+    tq.Start()
+    defer tq.Stop()
+
+    // 403, then a partial download that is downloaded again
+    job, _ := tq.Enqueue(download.DownloadRequest{ Title: "a", Source: "a" }, "")
+    job = waitForJob(t, tq.Queue, job.Id)
+    if job.State != Done || downloads != 3 || converts != 2 {
+        t.Errorf("Expected the job to be done after 3 downloads and 2 conversions, got %d, %d, %+v",
+            downloads, converts, job)
+    }
+    var classes []string
+    for _,attempt := range job.History {
+        classes = append(classes, string(attempt.Step) + ":" + attempt.Class)
+        if (attempt.Error != "") != (attempt.RetryAt != nil) {
+            t.Errorf("Expected only the failed attempts to be retried, got %+v", attempt)
+        }
+    }
+    expected := "[Download:retryable Download: Extract:bad-download Download: Extract: Save:]"
+    if fmt.Sprint(classes) != expected {
+        t.Errorf("Expected the history %s, got %v", expected, classes)
+    }
+    if len(job.Warnings) != 2 {
+        t.Errorf("Expected a warning for each retry, got %v", job.Warnings)
+    }
+    entries, _ := os.ReadDir(dir)
+    if len(entries) != 0 {
+        t.Errorf("Expected the partial download to be removed, found %d files", len(entries))
+    }
+
+    // the download is given up on after 3 attempts
+    job, _ = tq.Enqueue(download.DownloadRequest{ Title: "b", Source: "throttled" }, "")
+    job = waitForJob(t, tq.Queue, job.Id)
+    if job.State != Failed || len(job.History) != 3 || job.History[2].RetryAt != nil {
+        t.Errorf("Expected the job to fail after 3 attempts, got %+v", job)
+    }
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+    policy := RetryPolicy{ Attempts: 5, InitialDelaySeconds: 5, MaxDelaySeconds: 30 }
+    var delays []time.Duration
+    for failures := 1; failures <= 4; failures++ {
+        delays = append(delays, policy.delay(failures))
+    }
+    if fmt.Sprint(delays) != "[5s 10s 20s 30s]" {
+        t.Errorf("Expected the delay to double up to 30s, got %v", delays)
+    }
+}
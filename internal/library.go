@@ -0,0 +1,450 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TSchreiber/melo/internal/ffmpeg"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type LibraryConfig struct {
+    // Directories of music that Melo serves from where it is, ex. a NAS
+    // share, without copying it into static/song
+    Directories []string
+    // How often the directories are scanned for changes, in minutes.
+    // Defaults to 60, a negative interval only scans with `melo scan`
+    ScanIntervalMinutes int
+}
+
+/* A file in one of the library directories and the song that plays it. The
+ * size and modification time tell a scan whether the file has changed since
+ * the last one, the hash whether a new file is one that moved. */
+type LibraryFile struct {
+    // The absolute path of the file
+    Path string `json:"path" bson:"_id"`
+    SongId string `json:"songId" bson:"songId"`
+    Size int64 `json:"size" bson:"size"`
+    // The modification time in Unix nanoseconds
+    ModTime int64 `json:"modTime" bson:"modTime"`
+    // See quickHash
+    Hash string `json:"hash" bson:"hash"`
+}
+
+const defaultLibraryScanInterval = 60 * time.Minute
+
+// The files that a scan reads, anything else in the directories is ignored
+var libraryExtensions = map[string]bool{
+    ".mp3": true, ".flac": true, ".ogg": true, ".oga": true, ".opus": true, ".m4a": true,
+}
+
+// The audio URLs of library songs are their files' paths with this prefix
+const libraryURLPrefix = "file://"
+
+var (
+    libraryMu sync.RWMutex
+    // the absolute paths of the library directories, songFilePath only
+    // serves library files inside of them
+    libraryDirectories []string
+)
+
+// Sets the library directories, they are made absolute
+func setLibraryDirectories(dirs []string) error {
+    abs := make([]string, len(dirs))
+    for i,dir := range dirs {
+        var err error
+        abs[i], err = filepath.Abs(dir)
+        if err != nil {
+            return fmt.Errorf("Invalid library directory, \"%s\": %v", dir, err)
+        }
+    }
+    libraryMu.Lock()
+    defer libraryMu.Unlock()
+    libraryDirectories = abs
+    return nil
+}
+
+// Reports whether the song plays a file of the music library
+func isLibrarySong(song Song) bool {
+    return strings.HasPrefix(song.AudioURL, libraryURLPrefix)
+}
+
+/* Returns the path of a library song's file, which must be inside of one of
+ * the library directories */
+func libraryFilePath(song Song) (string,error) {
+    path := filepath.Clean(filepath.FromSlash(strings.TrimPrefix(song.AudioURL, libraryURLPrefix)))
+    libraryMu.RLock()
+    defer libraryMu.RUnlock()
+    if !filepath.IsAbs(path) || !isInside(libraryDirectories, path) {
+        return "", fmt.Errorf("Song %s has an audio file outside of the library directories, \"%s\"",
+            song.Id, song.AudioURL)
+    }
+    return path, nil
+}
+
+// Reports whether path is inside of any of the directories
+func isInside(dirs []string, path string) bool {
+    for _,dir := range dirs {
+        rel, err := filepath.Rel(dir, path)
+        if err == nil && rel != "." && rel != ".." &&
+        !strings.HasPrefix(rel, ".." + string(filepath.Separator)) {
+            return true
+        }
+    }
+    return false
+}
+
+// Returned by scanLibrary while another scan, ex. of `melo scan`, is running
+var ErrScanRunning = errors.New("Another library scan is running")
+
+// the name of the lock that a scan holds in the database
+const libraryScanLock = "library-scan"
+
+// how long the lock is held for without being renewed, a scan renews it
+// every third of this
+var libraryScanLockTTL = 5 * time.Minute
+
+type ScanReport struct {
+    Added, Updated, Moved, Removed, Unchanged int
+    // The files that could not be read, and the directories that could not
+    // be listed
+    Errors []string
+}
+
+/* Brings the songs of the library directories up to date with the files in
+ * them. A new file is added as a song that plays it where it is. A file that
+ * changed, ex. was retagged, updates its song with its tags, which replace
+ * any edits that were made in Melo. A file that is gone is removed along with
+ * its song, unless a new file has the same content, then the file moved and
+ * its song, with its place in playlists, plays the new file instead.
+ *
+ * Files that have not changed since the last scan are not read. Files and
+ * directories starting with "." are skipped. A directory that can't be
+ * listed, ex. a NAS share that isn't mounted, is left out, the songs of its
+ * files are kept until it can be scanned again.
+ *
+ * Only one scan runs at a time, even in different processes, one that starts
+ * while another is running returns ErrScanRunning. Both would add a new file
+ * otherwise. A scan that loses its lock, ex. because the database was
+ * unreachable until it expired, stops and returns ErrScanRunning too. */
+func scanLibrary(ctx context.Context, db MeloDatabase, dirs []string) (ScanReport,error) {
+    var report ScanReport
+    holder := primitive.NewObjectID().Hex()
+    ttl := libraryScanLockTTL
+    ok, err := db.TryLock(libraryScanLock, holder, time.Now().Add(ttl))
+    if err != nil {
+        return report, fmt.Errorf("scanLibrary: %v", err)
+    }
+    if !ok {
+        return report, ErrScanRunning
+    }
+    defer db.Unlock(libraryScanLock, holder)
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+    // closed before the scan is cancelled once another scan may have the lock
+    lost := make(chan struct{})
+    stopped := func(err error) error {
+        select {
+        case <-lost:
+            return ErrScanRunning
+        default:
+            return err
+        }
+    }
+    stop := make(chan struct{})
+    defer close(stop)
+    go func() {
+        ticker := time.NewTicker(ttl / 3)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-stop:
+                return
+            case <-ticker.C:
+                ok, err := db.TryLock(libraryScanLock, holder, time.Now().Add(ttl))
+                if err != nil {
+                    log.Printf("Failed to renew the library scan lock: %v\n", err)
+                } else if !ok {
+                    close(lost)
+                    cancel()
+                    return
+                }
+            }
+        }
+    }()
+
+    known, err := db.GetLibraryFiles()
+    if err != nil {
+        return report, fmt.Errorf("scanLibrary: %v", err)
+    }
+    byPath := make(map[string]LibraryFile, len(known))
+    for _,file := range known {
+        byPath[file.Path] = file
+    }
+
+    type foundFile struct {
+        path string
+        info fs.FileInfo
+    }
+    var found []foundFile
+    var scanned, skipped []string
+    seen := make(map[string]bool)
+    for _,dir := range dirs {
+        dir, err := filepath.Abs(dir)
+        if err != nil {
+            report.Errors = append(report.Errors, err.Error())
+            continue
+        }
+        err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+            if ctx.Err() != nil {
+                return ctx.Err()
+            }
+            if err != nil {
+                // the files under it are neither added nor removed
+                report.Errors = append(report.Errors, err.Error())
+                skipped = append(skipped, path)
+                return nil
+            }
+            if path != dir && strings.HasPrefix(d.Name(), ".") {
+                if d.IsDir() {
+                    return filepath.SkipDir
+                }
+                return nil
+            }
+            if !d.Type().IsRegular() || !libraryExtensions[strings.ToLower(filepath.Ext(path))] {
+                return nil
+            }
+            info, err := d.Info()
+            if err != nil {
+                report.Errors = append(report.Errors, err.Error())
+                skipped = append(skipped, path)
+                return nil
+            }
+            seen[path] = true
+            if file, ok := byPath[path]; ok && file.Size == info.Size() &&
+            file.ModTime == info.ModTime().UnixNano() {
+                report.Unchanged++
+                return nil
+            }
+            found = append(found, foundFile{ path, info })
+            return nil
+        })
+        if err != nil {
+            return report, stopped(err)
+        }
+        scanned = append(scanned, dir)
+    }
+
+    // the files that are gone, by hash, to match them with new files
+    gone := make(map[string][]LibraryFile)
+    for _,file := range known {
+        if seen[file.Path] || !isInside(scanned, file.Path) ||
+        isInside(skipped, file.Path) || containsString(skipped, file.Path) {
+            continue
+        }
+        gone[file.Hash] = append(gone[file.Hash], file)
+    }
+
+    for _,f := range found {
+        if ctx.Err() != nil {
+            return report, stopped(ctx.Err())
+        }
+        file, song, err := readLibraryFile(f.path, f.info)
+        if err != nil {
+            report.Errors = append(report.Errors, err.Error())
+            continue
+        }
+        if old, ok := byPath[f.path]; ok {
+            file.SongId, err = updateLibrarySong(db, old.SongId, song)
+            report.Updated++
+        } else if moved := gone[file.Hash]; len(moved) > 0 {
+            old := moved[0]
+            gone[file.Hash] = moved[1:]
+            file.SongId = old.SongId
+            err = db.UpdateSongAudio(old.SongId, song)
+            if errors.Is(err, ErrNotFound) {
+                file.SongId, err = postLibrarySong(db, song)
+            }
+            if err == nil {
+                err = db.DeleteLibraryFile(old.Path)
+            }
+            report.Moved++
+        } else {
+            file.SongId, err = postLibrarySong(db, song)
+            report.Added++
+        }
+        if err == nil {
+            err = db.PutLibraryFile(file)
+        }
+        if err != nil {
+            return report, fmt.Errorf("scanLibrary %s: %v", f.path, err)
+        }
+    }
+
+    for _,files := range gone {
+        for _,file := range files {
+            err := db.DeleteSong(file.SongId)
+            if err != nil && !errors.Is(err, ErrNotFound) {
+                return report, fmt.Errorf("scanLibrary %s: %v", file.Path, err)
+            }
+            err = db.DeleteLibraryFile(file.Path)
+            if err != nil {
+                return report, fmt.Errorf("scanLibrary %s: %v", file.Path, err)
+            }
+            report.Removed++
+        }
+    }
+    return report, nil
+}
+
+/* Reads the tags and audio details of a library file, the title defaults to
+ * the file's name */
+func readLibraryFile(path string, info fs.FileInfo) (LibraryFile,Song,error) {
+    file := LibraryFile{ Path: path, Size: info.Size(), ModTime: info.ModTime().UnixNano() }
+    var song Song
+    var err error
+    file.Hash, err = quickHash(path, info.Size())
+    if err != nil {
+        return file, song, err
+    }
+    probe, err := ffmpeg.Probe(path)
+    if err != nil {
+        return file, song, fmt.Errorf("%s: %v", path, err)
+    }
+    if probe.Codec == "" {
+        return file, song, fmt.Errorf("%s: The file has no audio", path)
+    }
+    song.AudioURL = libraryURLPrefix + filepath.ToSlash(path)
+    song.Source = song.AudioURL
+    song.Title = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+    if probe.Tags["title"] != "" {
+        song.Title = probe.Tags["title"]
+    }
+    song.Artist = probe.Tags["artist"]
+    if song.Artist == "" {
+        song.Artist = probe.Tags["album_artist"]
+    }
+    song.Album = probe.Tags["album"]
+    song.Duration = int64(probe.Duration / 1000)
+    song.Codec = probe.Codec
+    song.Bitrate = probe.Bitrate
+    song.Size = info.Size()
+    return file, song, nil
+}
+
+// The number of bytes at each end of a file that quickHash reads
+const quickHashSize = 64 << 10
+
+/* Hashes the size and the first and last 64 KiB of a file. It tells a moved
+ * file from another without reading all of either, which is slow on a NAS. */
+func quickHash(path string, size int64) (string,error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return "", err
+    }
+    defer f.Close()
+    h := sha256.New()
+    binary.Write(h, binary.LittleEndian, size)
+    _, err = io.CopyN(h, f, quickHashSize)
+    if err != nil && err != io.EOF {
+        return "", err
+    }
+    if size > 2 * quickHashSize {
+        _, err = f.Seek(-quickHashSize, io.SeekEnd)
+        if err == nil {
+            _, err = io.Copy(h, f)
+        }
+        if err != nil {
+            return "", err
+        }
+    }
+    return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func postLibrarySong(db MeloDatabase, song Song) (string,error) {
+    id, err := db.PostSong(song)
+    if err != nil {
+        return "", err
+    }
+    return id.Hex(), nil
+}
+
+/* Updates the song of a changed file, keeping its artwork. A song that was
+ * deleted is added again. Returns the song's id. */
+func updateLibrarySong(db MeloDatabase, songId string, song Song) (string,error) {
+    old, err := db.GetSong(songId)
+    if errors.Is(err, ErrNotFound) || errors.Is(err, ErrInvalidId) {
+        return postLibrarySong(db, song)
+    }
+    if err != nil {
+        return songId, err
+    }
+    song.Artwork = old.Artwork
+    err = db.UpdateSong(songId, song)
+    if err == nil {
+        err = db.UpdateSongAudio(songId, song)
+    }
+    return songId, err
+}
+
+func containsString(list []string, s string) bool {
+    for _,v := range list {
+        if v == s {
+            return true
+        }
+    }
+    return false
+}
+
+// Scans the library directories now and then every interval, forever
+func scanLibraryEvery(db MeloDatabase, dirs []string, interval time.Duration) {
+    for {
+        report, err := scanLibrary(context.Background(), db, dirs)
+        if err != nil {
+            log.Printf("Failed to scan the library: %v\n", err)
+        } else {
+            logScanReport(report)
+        }
+        time.Sleep(interval)
+    }
+}
+
+func logScanReport(report ScanReport) {
+    for _,e := range report.Errors {
+        log.Printf("Library scan: %s\n", e)
+    }
+    log.Printf("Library scan: %d added, %d updated, %d moved, %d removed, %d unchanged\n",
+        report.Added, report.Updated, report.Moved, report.Removed, report.Unchanged)
+}
+
+// Scans the library directories of the config once
+func LaunchScan(config MeloConfig) {
+    if len(config.Library.Directories) == 0 {
+        log.Fatalln("The config has no Library.Directories to scan")
+    }
+    if config.Download.FFprobePath != "" {
+        ffmpeg.FFprobePath = config.Download.FFprobePath
+    }
+    db, err := NewMeloDatabase(config.Database)
+    if err != nil {
+        log.Fatalln(err)
+    }
+    defer db.Disconnect()
+    report, err := scanLibrary(context.Background(), db, config.Library.Directories)
+    if err != nil {
+        log.Fatalln(err)
+    }
+    logScanReport(report)
+}
@@ -0,0 +1,604 @@
+package internal
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/TSchreiber/melo/internal/fingerprint"
+	"github.com/TSchreiber/melo/internal/jobs"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/* MemoryDatabase is a MeloDatabase that keeps everything in memory. It is
+ * meant for tests and local development, nothing is persisted once the server
+ * stops. It mirrors the behavior of MongoDatabase as closely as possible,
+ * including silently ignoring playlist updates from users that do not own the
+ * playlist. */
+type MemoryDatabase struct {
+    mu *sync.RWMutex
+    songs map[string]Song
+    fingerprints map[string]fingerprint.Fingerprint
+    playlists map[string]NormalizedPlaylist
+    permissions map[string][]string
+    downloadJobs map[string]jobs.Job
+    libraryFiles map[string]LibraryFile
+    locks map[string]memoryLock
+}
+
+type memoryLock struct {
+    holder string
+    expires time.Time
+}
+
+type MemoryDBConfig struct {
+    // Permissions to grant to users by email, ex. {"me@example.com":["admin"]}
+    Permissions map[string][]string
+}
+
+func NewMemoryDB(config MemoryDBConfig) (MeloDatabase, error) {
+    db := MemoryDatabase{
+        mu: &sync.RWMutex{},
+        songs: make(map[string]Song),
+        fingerprints: make(map[string]fingerprint.Fingerprint),
+        playlists: make(map[string]NormalizedPlaylist),
+        permissions: make(map[string][]string),
+        downloadJobs: make(map[string]jobs.Job),
+        libraryFiles: make(map[string]LibraryFile),
+        locks: make(map[string]memoryLock),
+    }
+    for email, permissions := range config.Permissions {
+        db.SetUserPermissions(email, permissions)
+    }
+    return db, nil
+}
+
+func (db MemoryDatabase) Disconnect() {}
+
+// Replaces the permissions of the user with the given email
+func (db MemoryDatabase) SetUserPermissions(email string, permissions []string) error {
+    db.mu.Lock()
+    defer db.mu.Unlock()
+    db.permissions[email] = append([]string{}, permissions...)
+    return nil
+}
+
+func (db MemoryDatabase) GetSong(songId string) (Song,error) {
+    if _,err := primitive.ObjectIDFromHex(songId); err != nil {
+        return Song{}, fmt.Errorf(
+            "MemoryDatabase.GetSong Invalid ObjectID %s: %w", songId, ErrInvalidId)
+    }
+    db.mu.RLock()
+    defer db.mu.RUnlock()
+    song, ok := db.songs[songId]
+    if !ok {
+        return Song{}, fmt.Errorf(
+            "MemoryDatabase.GetSong Song %s: %w", songId, ErrNotFound)
+    }
+    return song, nil
+}
+
+func (db MemoryDatabase) UpdateSong(songId string, data Song) error {
+    if _,err := primitive.ObjectIDFromHex(songId); err != nil {
+        return fmt.Errorf(
+            "MemoryDatabase.UpdateSong Invalid ObjectID %s: %w", songId, ErrInvalidId)
+    }
+    db.mu.Lock()
+    defer db.mu.Unlock()
+    song, ok := db.songs[songId]
+    if !ok {
+        return fmt.Errorf(
+            "MemoryDatabase.UpdateSong Song %s: %w", songId, ErrNotFound)
+    }
+    song.Title = data.Title
+    song.Artist = data.Artist
+    song.Album = data.Album
+    song.Artwork = data.Artwork
+    db.songs[songId] = song
+    return nil
+}
+
+func (db MemoryDatabase) UpdateSongAudio(songId string, data Song) error {
+    if _,err := primitive.ObjectIDFromHex(songId); err != nil {
+        return fmt.Errorf(
+            "MemoryDatabase.UpdateSongAudio Invalid ObjectID %s: %w", songId, ErrInvalidId)
+    }
+    db.mu.Lock()
+    defer db.mu.Unlock()
+    song, ok := db.songs[songId]
+    if !ok {
+        return fmt.Errorf(
+            "MemoryDatabase.UpdateSongAudio Song %s: %w", songId, ErrNotFound)
+    }
+    song.AudioURL = data.AudioURL
+    song.Source = data.Source
+    song.Duration = data.Duration
+    song.Codec = data.Codec
+    song.Bitrate = data.Bitrate
+    song.Size = data.Size
+    song.Gain = data.Gain
+    song.Peak = data.Peak
+    db.songs[songId] = song
+    return nil
+}
+
+func (db MemoryDatabase) DeleteSong(songId string) error {
+    sid, err := primitive.ObjectIDFromHex(songId)
+    if err != nil {
+        return fmt.Errorf(
+            "MemoryDatabase.DeleteSong Invalid ObjectID %s: %w", songId, ErrInvalidId)
+    }
+    db.mu.Lock()
+    defer db.mu.Unlock()
+    if _,ok := db.songs[songId]; !ok {
+        return fmt.Errorf("MemoryDatabase.DeleteSong Song %s: %w", songId, ErrNotFound)
+    }
+    delete(db.songs, songId)
+    delete(db.fingerprints, songId)
+    for id, p := range db.playlists {
+        songs := make([]primitive.ObjectID, 0, len(p.Songs))
+        for _,s := range p.Songs {
+            if s != sid {
+                songs = append(songs, s)
+            }
+        }
+        p.Songs = songs
+        db.playlists[id] = p
+    }
+    return nil
+}
+
+func (db MemoryDatabase) PostSong(song Song) (primitive.ObjectID,error) {
+    id := primitive.NewObjectID()
+    song.Id = id.Hex()
+    db.mu.Lock()
+    defer db.mu.Unlock()
+    db.songs[song.Id] = song
+    return id, nil
+}
+
+func (db MemoryDatabase) SampleSongs() ([]Song,error) {
+    db.mu.RLock()
+    defer db.mu.RUnlock()
+    ids := db.songIds()
+    var list []Song
+    for _,i := range rand.Perm(len(ids)) {
+        if len(list) == 100 {
+            break
+        }
+        list = append(list, db.songs[ids[i]])
+    }
+    return list, nil
+}
+
+func (db MemoryDatabase) PutFingerprint(songId string, fp fingerprint.Fingerprint) error {
+    db.mu.Lock()
+    defer db.mu.Unlock()
+    db.fingerprints[songId] = append(fingerprint.Fingerprint{}, fp...)
+    return nil
+}
+
+func (db MemoryDatabase) GetFingerprints() (map[string]fingerprint.Fingerprint,error) {
+    db.mu.RLock()
+    defer db.mu.RUnlock()
+    fps := make(map[string]fingerprint.Fingerprint, len(db.fingerprints))
+    for id, fp := range db.fingerprints {
+        fps[id] = fp
+    }
+    return fps, nil
+}
+
+func (db MemoryDatabase) GetLibraryFiles() ([]LibraryFile,error) {
+    db.mu.RLock()
+    defer db.mu.RUnlock()
+    list := make([]LibraryFile, 0, len(db.libraryFiles))
+    for _,f := range db.libraryFiles {
+        list = append(list, f)
+    }
+    sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+    return list, nil
+}
+
+func (db MemoryDatabase) PutLibraryFile(file LibraryFile) error {
+    db.mu.Lock()
+    defer db.mu.Unlock()
+    db.libraryFiles[file.Path] = file
+    return nil
+}
+
+func (db MemoryDatabase) DeleteLibraryFile(path string) error {
+    db.mu.Lock()
+    defer db.mu.Unlock()
+    delete(db.libraryFiles, path)
+    return nil
+}
+
+func (db MemoryDatabase) TryLock(name, holder string, expires time.Time) (bool,error) {
+    db.mu.Lock()
+    defer db.mu.Unlock()
+    if lock, ok := db.locks[name]; ok && lock.holder != holder && time.Now().Before(lock.expires) {
+        return false, nil
+    }
+    db.locks[name] = memoryLock{ holder, expires }
+    return true, nil
+}
+
+func (db MemoryDatabase) Unlock(name, holder string) error {
+    db.mu.Lock()
+    defer db.mu.Unlock()
+    if db.locks[name].holder == holder {
+        delete(db.locks, name)
+    }
+    return nil
+}
+
+// returns the ids of all songs in a stable order, the caller must hold db.mu
+func (db MemoryDatabase) songIds() []string {
+    ids := make([]string, 0, len(db.songs))
+    for id := range db.songs {
+        ids = append(ids, id)
+    }
+    sort.Strings(ids)
+    return ids
+}
+
+func (db MemoryDatabase) GetSongsBySource(sources ...string) ([]Song,error) {
+    db.mu.RLock()
+    defer db.mu.RUnlock()
+    list := []Song{}
+    for _,id := range db.songIds() {
+        song := db.songs[id]
+        for _,source := range sources {
+            if song.Source == source {
+                list = append(list, song)
+                break
+            }
+        }
+    }
+    return list, nil
+}
+
+func (db MemoryDatabase) GetSongByAudioURL(audioURL string) (Song,error) {
+    db.mu.RLock()
+    defer db.mu.RUnlock()
+    for _,id := range db.songIds() {
+        if db.songs[id].AudioURL == audioURL {
+            return db.songs[id], nil
+        }
+    }
+    return Song{}, fmt.Errorf("MemoryDatabase.GetSongByAudioURL %s: %w", audioURL, ErrNotFound)
+}
+
+/* Approximates a MongoDB $text search: the search string is split into terms
+ * and a song matches if its title, artist, or album contains any of the terms.
+ * Terms starting with "-" exclude songs containing them. Results are ordered
+ * by the number of matching terms. */
+func (db MemoryDatabase) SearchForSong(search string) ([]Song,error) {
+    var include, exclude []string
+    for _,term := range strings.Fields(strings.ToLower(search)) {
+        if t,ok := strings.CutPrefix(term, "-"); ok {
+            exclude = append(exclude, tokenize(t)...)
+        } else {
+            include = append(include, tokenize(term)...)
+        }
+    }
+
+    db.mu.RLock()
+    defer db.mu.RUnlock()
+    type match struct {
+        song Song
+        score int
+    }
+    var matches []match
+    for _,id := range db.songIds() {
+        song := db.songs[id]
+        words := make(map[string]bool)
+        for _,w := range tokenize(song.Title + " " + song.Artist + " " + song.Album) {
+            words[w] = true
+        }
+        excluded := false
+        for _,t := range exclude {
+            if words[t] {
+                excluded = true
+                break
+            }
+        }
+        if excluded {
+            continue
+        }
+        score := 0
+        for _,t := range include {
+            if words[t] {
+                score++
+            }
+        }
+        if score > 0 {
+            matches = append(matches, match{song, score})
+        }
+    }
+    sort.SliceStable(matches, func(i, j int) bool {
+        return matches[i].score > matches[j].score
+    })
+    list := make([]Song, 0, len(matches))
+    for _,m := range matches {
+        list = append(list, m.song)
+    }
+    return list, nil
+}
+
+// splits s into lowercase words made up of letters and digits
+func tokenize(s string) []string {
+    return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+        return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+    })
+}
+
+func (db MemoryDatabase) GetUserPermissions(email string) ([]string,error) {
+    db.mu.RLock()
+    defer db.mu.RUnlock()
+    permissions, ok := db.permissions[email]
+    if !ok {
+        return []string{}, nil
+    }
+    return append([]string{}, permissions...), nil
+}
+
+// expands the song ids of the playlist, the caller must hold db.mu
+func (db MemoryDatabase) expandPlaylist(p NormalizedPlaylist) Playlist {
+    playlist := Playlist{
+        Id: p.Id,
+        Artwork: p.Artwork,
+        Title: p.Title,
+        Description: p.Description,
+        Songs: []Song{},
+        Owner: p.Owner,
+    }
+    for _,sid := range p.Songs {
+        if song, ok := db.songs[sid.Hex()]; ok {
+            playlist.Songs = append(playlist.Songs, song)
+        }
+    }
+    return playlist
+}
+
+func (db MemoryDatabase) GetPlaylist(playlistId string) (Playlist,error) {
+    if _,err := primitive.ObjectIDFromHex(playlistId); err != nil {
+        return Playlist{}, fmt.Errorf(
+            "MemoryDatabase.GetPlaylist Invalid ObjectID %s: %w", playlistId, ErrInvalidId)
+    }
+    db.mu.RLock()
+    defer db.mu.RUnlock()
+    p, ok := db.playlists[playlistId]
+    if !ok {
+        return Playlist{}, fmt.Errorf(
+            "MemoryDatabase.GetPlaylist Playlist %s: %w", playlistId, ErrNotFound)
+    }
+    return db.expandPlaylist(p), nil
+}
+
+func (db MemoryDatabase) GetPersonalPlaylists(uid string) ([]Playlist,error) {
+    db.mu.RLock()
+    defer db.mu.RUnlock()
+    playlists := make([]Playlist, 0)
+    for _,id := range db.playlistIds() {
+        p := db.playlists[id]
+        if p.Owner == uid {
+            playlists = append(playlists, db.expandPlaylist(p))
+        }
+    }
+    return playlists, nil
+}
+
+// returns the ids of all playlists in a stable order, the caller must hold db.mu
+func (db MemoryDatabase) playlistIds() []string {
+    ids := make([]string, 0, len(db.playlists))
+    for id := range db.playlists {
+        ids = append(ids, id)
+    }
+    sort.Strings(ids)
+    return ids
+}
+
+func (db MemoryDatabase) PostPlaylist(playlist NormalizedPlaylist) (primitive.ObjectID,error) {
+    id := primitive.NewObjectID()
+    playlist.Id = id.Hex()
+    playlist.Songs = append([]primitive.ObjectID{}, playlist.Songs...)
+    db.mu.Lock()
+    defer db.mu.Unlock()
+    db.playlists[playlist.Id] = playlist
+    return id, nil
+}
+
+func (db MemoryDatabase) SamplePlaylists() ([]Playlist, error) {
+    db.mu.RLock()
+    defer db.mu.RUnlock()
+    ids := db.playlistIds()
+    var list []Playlist
+    for _,i := range rand.Perm(len(ids)) {
+        if len(list) == 25 {
+            break
+        }
+        list = append(list, db.expandPlaylist(db.playlists[ids[i]]))
+    }
+    return list, nil
+}
+
+// calls update on the playlist if it exists and is owned by uid
+func (db MemoryDatabase) updateOwnedPlaylist(uid string, playlistId string,
+update func(*NormalizedPlaylist)) {
+    db.mu.Lock()
+    defer db.mu.Unlock()
+    p, ok := db.playlists[playlistId]
+    if !ok || p.Owner != uid {
+        return
+    }
+    update(&p)
+    db.playlists[playlistId] = p
+}
+
+func (db MemoryDatabase) UpdatePlaylist(uid string, playlistId string, data Playlist) error {
+    db.updateOwnedPlaylist(uid, playlistId, func(p *NormalizedPlaylist) {
+        p.Title = data.Title
+        p.Description = data.Description
+        p.Artwork = data.Artwork
+    })
+    return nil
+}
+
+func (db MemoryDatabase) AddSongToPlaylist(uid string, playlistId string, songId string) error {
+    sid,_ := primitive.ObjectIDFromHex(songId)
+    db.updateOwnedPlaylist(uid, playlistId, func(p *NormalizedPlaylist) {
+        p.Songs = append(p.Songs, sid)
+    })
+    return nil
+}
+
+func (db MemoryDatabase) RemoveSongFromPlaylist(uid string, playlistId string, songId string) error {
+    sid,_ := primitive.ObjectIDFromHex(songId)
+    db.updateOwnedPlaylist(uid, playlistId, func(p *NormalizedPlaylist) {
+        songs := make([]primitive.ObjectID, 0, len(p.Songs))
+        for _,s := range p.Songs {
+            if s != sid {
+                songs = append(songs, s)
+            }
+        }
+        p.Songs = songs
+    })
+    return nil
+}
+
+func (db MemoryDatabase) EachSong(fn func(Song) error) error {
+    db.mu.RLock()
+    songs := make([]Song, 0, len(db.songs))
+    for _,id := range db.songIds() {
+        songs = append(songs, db.songs[id])
+    }
+    db.mu.RUnlock()
+    for _,song := range songs {
+        if err := fn(song); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (db MemoryDatabase) EachPlaylist(fn func(NormalizedPlaylist) error) error {
+    db.mu.RLock()
+    playlists := make([]NormalizedPlaylist, 0, len(db.playlists))
+    for _,id := range db.playlistIds() {
+        p := db.playlists[id]
+        p.Songs = append([]primitive.ObjectID{}, p.Songs...)
+        playlists = append(playlists, p)
+    }
+    db.mu.RUnlock()
+    for _,playlist := range playlists {
+        if err := fn(playlist); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (db MemoryDatabase) EachUserPermissions(fn func(string, []string) error) error {
+    db.mu.RLock()
+    permissions := make(map[string][]string, len(db.permissions))
+    emails := make([]string, 0, len(db.permissions))
+    for email, p := range db.permissions {
+        permissions[email] = append([]string{}, p...)
+        emails = append(emails, email)
+    }
+    db.mu.RUnlock()
+    sort.Strings(emails)
+    for _,email := range emails {
+        if err := fn(email, permissions[email]); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (db MemoryDatabase) ImportSong(song Song) error {
+    if _,err := primitive.ObjectIDFromHex(song.Id); err != nil {
+        return fmt.Errorf(
+            "MemoryDatabase.ImportSong Invalid ObjectID %s: %w", song.Id, ErrInvalidId)
+    }
+    db.mu.Lock()
+    defer db.mu.Unlock()
+    db.songs[song.Id] = song
+    return nil
+}
+
+func (db MemoryDatabase) ImportPlaylist(playlist NormalizedPlaylist) error {
+    if _,err := primitive.ObjectIDFromHex(playlist.Id); err != nil {
+        return fmt.Errorf(
+            "MemoryDatabase.ImportPlaylist Invalid ObjectID %s: %w", playlist.Id, ErrInvalidId)
+    }
+    playlist.Songs = append([]primitive.ObjectID{}, playlist.Songs...)
+    db.mu.Lock()
+    defer db.mu.Unlock()
+    db.playlists[playlist.Id] = playlist
+    return nil
+}
+
+func (db MemoryDatabase) CreateJob(job jobs.Job) (string,error) {
+    job.Id = primitive.NewObjectID().Hex()
+    db.mu.Lock()
+    defer db.mu.Unlock()
+    db.downloadJobs[job.Id] = job
+    return job.Id, nil
+}
+
+func (db MemoryDatabase) UpdateJob(job jobs.Job) error {
+    db.mu.Lock()
+    defer db.mu.Unlock()
+    if _,ok := db.downloadJobs[job.Id]; !ok {
+        return fmt.Errorf("MemoryDatabase.UpdateJob Job %s: %w", job.Id, ErrNotFound)
+    }
+    db.downloadJobs[job.Id] = job
+    return nil
+}
+
+func (db MemoryDatabase) GetJob(jobId string) (jobs.Job,error) {
+    if _,err := primitive.ObjectIDFromHex(jobId); err != nil {
+        return jobs.Job{}, fmt.Errorf(
+            "MemoryDatabase.GetJob Invalid ObjectID %s: %w", jobId, ErrInvalidId)
+    }
+    db.mu.RLock()
+    defer db.mu.RUnlock()
+    job, ok := db.downloadJobs[jobId]
+    if !ok {
+        return job, fmt.Errorf("MemoryDatabase.GetJob Job %s: %w", jobId, ErrNotFound)
+    }
+    return job, nil
+}
+
+func (db MemoryDatabase) ListJobs(states ...jobs.State) ([]jobs.Job,error) {
+    db.mu.RLock()
+    defer db.mu.RUnlock()
+    list := []jobs.Job{}
+    for _,job := range db.downloadJobs {
+        if len(states) == 0 || containsState(states, job.State) {
+            list = append(list, job)
+        }
+    }
+    sort.Slice(list, func(i, j int) bool {
+        if !list[i].CreatedAt.Equal(list[j].CreatedAt) {
+            return list[i].CreatedAt.Before(list[j].CreatedAt)
+        }
+        return list[i].Id < list[j].Id
+    })
+    return list, nil
+}
+
+func containsState(states []jobs.State, state jobs.State) bool {
+    for _,s := range states {
+        if s == state {
+            return true
+        }
+    }
+    return false
+}
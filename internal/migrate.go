@@ -0,0 +1,235 @@
+package internal
+
+import (
+	"fmt"
+	"log"
+	"sort"
+)
+
+/* MigratableDatabase is implemented by MeloDatabases that can be used as the
+ * source or the destination of a library migration. The Each functions stream
+ * every record to fn and stop at the first error fn returns. The Import
+ * functions keep the ids of the records so that playlists and bookmarks keep
+ * working after a migration, and they overwrite records that already exist
+ * so that an interrupted migration can simply be run again. */
+type MigratableDatabase interface {
+    MeloDatabase
+    EachSong(fn func(Song) error) error
+    EachPlaylist(fn func(NormalizedPlaylist) error) error
+    EachUserPermissions(fn func(email string, permissions []string) error) error
+    ImportSong(song Song) error
+    ImportPlaylist(playlist NormalizedPlaylist) error
+    SetUserPermissions(email string, permissions []string) error
+}
+
+type MigrationReport struct {
+    Songs, Playlists, Users, Fingerprints, LibraryFiles int
+}
+
+/* Copies every song, playlist, user's permissions, song fingerprint and
+ * library file from one database to the other. When dryRun is true nothing
+ * is written and the report contains the number of records that would have
+ * been copied. */
+func Migrate(from, to MigratableDatabase, dryRun bool) (MigrationReport,error) {
+    var report MigrationReport
+    err := from.EachSong(func(song Song) error {
+        report.Songs++
+        if dryRun {
+            return nil
+        }
+        if err := to.ImportSong(song); err != nil {
+            return fmt.Errorf("Failed to import song %s: %w", song.Id, err)
+        }
+        return nil
+    })
+    if err != nil {
+        return report, err
+    }
+    err = from.EachPlaylist(func(playlist NormalizedPlaylist) error {
+        report.Playlists++
+        if dryRun {
+            return nil
+        }
+        if err := to.ImportPlaylist(playlist); err != nil {
+            return fmt.Errorf("Failed to import playlist %s: %w", playlist.Id, err)
+        }
+        return nil
+    })
+    if err != nil {
+        return report, err
+    }
+    err = from.EachUserPermissions(func(email string, permissions []string) error {
+        report.Users++
+        if dryRun {
+            return nil
+        }
+        if err := to.SetUserPermissions(email, permissions); err != nil {
+            return fmt.Errorf("Failed to import permissions for %s: %w", email, err)
+        }
+        return nil
+    })
+    if err != nil {
+        return report, err
+    }
+    fps, err := from.GetFingerprints()
+    if err != nil {
+        return report, err
+    }
+    report.Fingerprints = len(fps)
+    files, err := from.GetLibraryFiles()
+    if err != nil {
+        return report, err
+    }
+    report.LibraryFiles = len(files)
+    if dryRun {
+        return report, nil
+    }
+    for songId, fp := range fps {
+        if err := to.PutFingerprint(songId, fp); err != nil {
+            return report, fmt.Errorf("Failed to import the fingerprint of song %s: %w", songId, err)
+        }
+    }
+    for _,file := range files {
+        if err := to.PutLibraryFile(file); err != nil {
+            return report, fmt.Errorf("Failed to import library file %s: %w", file.Path, err)
+        }
+    }
+    return report, nil
+}
+
+/* Checks that every song, playlist and user in the source database exists in
+ * the destination with the same id, and that the playlists have the same songs
+ * in the same order. The destination may contain records that are not in the
+ * source. */
+func VerifyMigration(from, to MigratableDatabase) error {
+    fromSongs, err := songIds(from)
+    if err != nil {
+        return err
+    }
+    toSongs, err := songIds(to)
+    if err != nil {
+        return err
+    }
+    if missing := missingKeys(fromSongs, toSongs); len(missing) > 0 {
+        return fmt.Errorf("%d of %d songs are missing from the destination: %v",
+            len(missing), len(fromSongs), missing)
+    }
+
+    fromPlaylists, err := playlistSongs(from)
+    if err != nil {
+        return err
+    }
+    toPlaylists, err := playlistSongs(to)
+    if err != nil {
+        return err
+    }
+    if missing := missingKeys(fromPlaylists, toPlaylists); len(missing) > 0 {
+        return fmt.Errorf("%d of %d playlists are missing from the destination: %v",
+            len(missing), len(fromPlaylists), missing)
+    }
+    for id, songs := range fromPlaylists {
+        if toPlaylists[id] != songs {
+            return fmt.Errorf("The songs of playlist %s do not match, expected %s, got %s",
+                id, songs, toPlaylists[id])
+        }
+    }
+
+    fromUsers, err := userPermissions(from)
+    if err != nil {
+        return err
+    }
+    toUsers, err := userPermissions(to)
+    if err != nil {
+        return err
+    }
+    if missing := missingKeys(fromUsers, toUsers); len(missing) > 0 {
+        return fmt.Errorf("%d of %d users are missing from the destination: %v",
+            len(missing), len(fromUsers), missing)
+    }
+    for email, permissions := range fromUsers {
+        if toUsers[email] != permissions {
+            return fmt.Errorf("The permissions of %s do not match, expected %s, got %s",
+                email, permissions, toUsers[email])
+        }
+    }
+    return nil
+}
+
+func songIds(db MigratableDatabase) (map[string]string,error) {
+    ids := make(map[string]string)
+    err := db.EachSong(func(song Song) error {
+        ids[song.Id] = song.Id
+        return nil
+    })
+    return ids, err
+}
+
+// returns the song ids of each playlist as a string, keyed by playlist id
+func playlistSongs(db MigratableDatabase) (map[string]string,error) {
+    playlists := make(map[string]string)
+    err := db.EachPlaylist(func(playlist NormalizedPlaylist) error {
+        playlists[playlist.Id] = fmt.Sprint(playlist.Songs)
+        return nil
+    })
+    return playlists, err
+}
+
+// returns the sorted permissions of each user as a string, keyed by email
+func userPermissions(db MigratableDatabase) (map[string]string,error) {
+    users := make(map[string]string)
+    err := db.EachUserPermissions(func(email string, permissions []string) error {
+        p := append([]string{}, permissions...)
+        sort.Strings(p)
+        users[email] = fmt.Sprint(p)
+        return nil
+    })
+    return users, err
+}
+
+// returns the keys of from that are not in to, sorted
+func missingKeys(from, to map[string]string) []string {
+    var missing []string
+    for k := range from {
+        if _,ok := to[k]; !ok {
+            missing = append(missing, k)
+        }
+    }
+    sort.Strings(missing)
+    return missing
+}
+
+// Opens both databases, migrates the library and then verifies the result
+func LaunchMigration(from, to DatabaseConfig, dryRun bool) {
+    open := func(config DatabaseConfig) MigratableDatabase {
+        db, err := NewMeloDatabase(config)
+        if err != nil {
+            log.Fatalln(err)
+        }
+        mdb, ok := db.(MigratableDatabase)
+        if !ok {
+            log.Fatalf("The \"%s\" database does not support migrations\n", config.Type)
+        }
+        return mdb
+    }
+    fromDB := open(from)
+    defer fromDB.Disconnect()
+    toDB := open(to)
+    defer toDB.Disconnect()
+
+    report, err := Migrate(fromDB, toDB, dryRun)
+    if err != nil {
+        log.Fatalln(err)
+    }
+    if dryRun {
+        log.Printf("Dry run: would migrate %d songs, %d playlists, %d users, %d fingerprints and %d library files\n",
+            report.Songs, report.Playlists, report.Users, report.Fingerprints, report.LibraryFiles)
+        return
+    }
+    log.Printf("Migrated %d songs, %d playlists, %d users, %d fingerprints and %d library files, verifying...\n",
+        report.Songs, report.Playlists, report.Users, report.Fingerprints, report.LibraryFiles)
+    err = VerifyMigration(fromDB, toDB)
+    if err != nil {
+        log.Fatalf("Verification failed: %v\n", err)
+    }
+    log.Println("Verification passed")
+}
@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/TSchreiber/melo/internal/fingerprint"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMigrate(t *testing.T) {
+    memory, _ := NewMemoryDB(MemoryDBConfig{
+        Permissions: map[string][]string{testAdmin: {"admin", "upload"}},
+    })
+    from := memory.(MigratableDatabase)
+    song1, _ := from.PostSong(Song{Title: "Sand In My Boots", Artist: "Morgan Wallen", Duration: 202})
+    song2, _ := from.PostSong(Song{Title: "You & I", Artist: "IU"})
+    from.PutFingerprint(song1.Hex(), fingerprint.Fingerprint{ 1, 2, 3 })
+    from.PutLibraryFile(LibraryFile{ Path: "/music/boots.mp3", SongId: song1.Hex(), Size: 10, ModTime: 1, Hash: "ab" })
+    plid, _ := from.PostPlaylist(NormalizedPlaylist{
+        Title: "Mix",
+        Owner: testUser,
+        Songs: []primitive.ObjectID{song2, song1, song2},
+    })
+
+    sqlite, err := NewSQLiteDB(SQLiteDBConfig{
+        SQLitePath: filepath.Join(t.TempDir(), "melo.db"),
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer sqlite.Disconnect()
+    to := sqlite.(MigratableDatabase)
+
+    report, err := Migrate(from, to, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if report != (MigrationReport{Songs: 2, Playlists: 1, Users: 1, Fingerprints: 1, LibraryFiles: 1}) {
+        t.Errorf("Dry run: unexpected report %+v", report)
+    }
+    if songs, _ := to.SampleSongs(); len(songs) != 0 {
+        t.Fatalf("Dry run: expected nothing to be written, found %d songs", len(songs))
+    }
+    if VerifyMigration(from, to) == nil {
+        t.Errorf("VerifyMigration: expected an error before migrating")
+    }
+
+    // running the migration twice must not duplicate anything
+    for i := 0; i < 2; i++ {
+        _, err = Migrate(from, to, false)
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+    err = VerifyMigration(from, to)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    song, err := to.GetSong(song1.Hex())
+    if err != nil || song.Title != "Sand In My Boots" || song.Duration != 202 {
+        t.Errorf("GetSong after migrating: unexpected song %+v %v", song, err)
+    }
+    if fps, _ := to.GetFingerprints(); len(fps[song1.Hex()]) != 3 {
+        t.Errorf("GetFingerprints after migrating: unexpected fingerprints %v", fps)
+    }
+    if files, _ := to.GetLibraryFiles(); len(files) != 1 || files[0].SongId != song1.Hex() {
+        t.Errorf("GetLibraryFiles after migrating: unexpected files %+v", files)
+    }
+    if songs, _ := to.SearchForSong("boots"); len(songs) != 1 {
+        t.Errorf("SearchForSong after migrating twice: expected 1 song, got %+v", songs)
+    }
+    playlist, err := to.GetPlaylist(plid.Hex())
+    if err != nil || playlist.Owner != testUser || len(playlist.Songs) != 3 ||
+    playlist.Songs[0].Id != song2.Hex() || playlist.Songs[1].Id != song1.Hex() {
+        t.Errorf("GetPlaylist after migrating: unexpected playlist %+v %v", playlist, err)
+    }
+
+    // and back again
+    back, _ := NewMemoryDB(MemoryDBConfig{})
+    _, err = Migrate(to, back.(MigratableDatabase), false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = VerifyMigration(to, back.(MigratableDatabase))
+    if err != nil {
+        t.Fatal(err)
+    }
+}
@@ -0,0 +1,265 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/TSchreiber/melo/internal/download"
+	"github.com/TSchreiber/melo/internal/ffmpeg"
+	"github.com/TSchreiber/melo/internal/jobs"
+	spotify "github.com/TSchreiber/melo/internal/spotify_api"
+	yt_dlp "github.com/TSchreiber/melo/internal/yt_dlp"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/* The body of POST /download/playlist, the entries of a playlist preview
+ * that were selected, in order, with their metadata corrected. If Playlist
+ * has a title the songs are added to a new Melo playlist once they have all
+ * been downloaded. */
+type playlistImportRequest struct {
+    Entries []download.DownloadRequest `json:"entries"`
+    Playlist *struct {
+        Title string `json:"title"`
+        Description string `json:"description"`
+        Artwork string `json:"artwork"`
+    } `json:"playlist"`
+}
+
+// An entry of a playlistImportRequest that is already in the library
+type playlistDuplicate struct {
+    // The index of the entry
+    Entry int `json:"entry"`
+    duplicate
+}
+
+type playlistImportResponse struct {
+    Group string `json:"group"`
+    // The id of the Melo playlist that the songs are added to, if any
+    PlaylistId string `json:"playlistId,omitempty"`
+    // The job of each entry, in order
+    JobIds []string `json:"jobIds"`
+    Steps []jobs.Step `json:"steps"`
+}
+
+/* Lists the entries of the YouTube or SoundCloud playlist or channel at ?url=
+ * with pre-filled metadata, see download.PlaylistPreview. Nothing is
+ * downloaded until the entries are posted to /download/playlist. */
+func createPlaylistPreviewHandler() http.HandlerFunc {
+    return http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+        url := r.URL.Query().Get("url")
+        if url == "" {
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprintf(w, "Query string parameter, \"url\" is required")
+            return
+        }
+        preview, err := download.PreviewPlaylist(r.Context(), url)
+        var ytErr *yt_dlp.Error
+        if errors.As(err, &ytErr) && (ytErr.Kind == yt_dlp.ErrorUnsupportedURL ||
+        ytErr.Kind == yt_dlp.ErrorUnavailable || ytErr.Kind == yt_dlp.ErrorSignIn) {
+            // the URL is not a playlist that yt-dlp can list
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprintf(w, "400 - %v", err)
+            return
+        }
+        if err != nil {
+            log.Printf("\"GET /download/playlist\": %v\n", err)
+            w.WriteHeader(http.StatusInternalServerError)
+            return
+        }
+        b, _ := json.Marshal(preview)
+        w.Header().Set("Content-Type", "application/json")
+        w.Write(b)
+    })
+}
+
+/* Lists the chapters of the video at ?url=, ex. a full album, as a playlist
+ * of its tracks, see download.PreviewChapters. The tracks are posted to
+ * /download/playlist like a playlist's entries. */
+func createChapterPreviewHandler() http.HandlerFunc {
+    return http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+        url := r.URL.Query().Get("url")
+        if url == "" {
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprintf(w, "Query string parameter, \"url\" is required")
+            return
+        }
+        preview, err := download.PreviewChapters(r.Context(), url)
+        var ytErr *yt_dlp.Error
+        if errors.Is(err, download.ErrNoChapters) || errors.As(err, &ytErr) &&
+        (ytErr.Kind == yt_dlp.ErrorUnsupportedURL || ytErr.Kind == yt_dlp.ErrorUnavailable ||
+        ytErr.Kind == yt_dlp.ErrorSignIn) {
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprintf(w, "400 - %v", err)
+            return
+        }
+        if err != nil {
+            log.Printf("\"GET /download/chapters\": %v\n", err)
+            w.WriteHeader(http.StatusInternalServerError)
+            return
+        }
+        b, _ := json.Marshal(preview)
+        w.Header().Set("Content-Type", "application/json")
+        w.Write(b)
+    })
+}
+
+/* Fetches the Spotify playlist at ?url= and searches YouTube for each of its
+ * tracks, see download.SpotifyPlaylistMatches. The matches that the admin
+ * approves are posted to /download/playlist. */
+func createSpotifyPlaylistMatchHandler() http.HandlerFunc {
+    return http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+        url := r.URL.Query().Get("url")
+        if url == "" {
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprintf(w, "Query string parameter, \"url\" is required")
+            return
+        }
+        // matching a long playlist can take much longer than the write timeout
+        disableWriteTimeout(w)
+        matches, err := download.MatchSpotifyPlaylist(r.Context(), url)
+        if errors.Is(err, download.ErrInvalidLink) {
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprintf(w, "400 - %v", err)
+            return
+        }
+        if errors.Is(err, spotify.ErrNotFound) {
+            // private playlists can not be seen either
+            w.WriteHeader(http.StatusNotFound)
+            fmt.Fprint(w, "404 - The playlist does not exist or is private")
+            return
+        }
+        if err != nil {
+            log.Printf("\"GET /download/spotify/playlist\": %v\n", err)
+            w.WriteHeader(http.StatusInternalServerError)
+            return
+        }
+        b, _ := json.Marshal(matches)
+        w.Header().Set("Content-Type", "application/json")
+        w.Write(b)
+    })
+}
+
+/* Queues a download for each entry of a playlistImportRequest as one group
+ * of jobs and responds with 202 and a playlistImportResponse. The jobs are
+ * listed by /download/jobs?group=. If any of the entries are already in the
+ * library nothing is queued, it responds with 409 and the list of
+ * playlistDuplicates instead, unless ?force=true. */
+func createPostPlaylistImportHandler(queue *jobs.Queue, meloDB MeloDatabase,
+defaults ffmpeg.Options) http.HandlerFunc {
+    return http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+        b, err := io.ReadAll(r.Body)
+        if err != nil {
+            fmt.Printf("Failed to read body,\n%s\n", err)
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprint(w, "400 - Missing request body")
+            return
+        }
+        var req playlistImportRequest
+        err = json.Unmarshal(b, &req)
+        if err != nil {
+            fmt.Printf("Failed to parse body,\n\t%s\n\t%s\n", err, string(b))
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprint(w, "400 - Malformed form data")
+            return
+        }
+        if len(req.Entries) == 0 {
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprint(w, "400 - No entries were selected")
+            return
+        }
+        for i := range req.Entries {
+            entry := &req.Entries[i]
+            if entry.Title == "" || entry.Source == "" {
+                w.WriteHeader(http.StatusBadRequest)
+                fmt.Fprintf(w, "400 - Entry %d is missing its title or source", i)
+                return
+            }
+            entry.ApplyDefaults(defaults)
+            if err := entry.Validate(); err != nil {
+                w.WriteHeader(http.StatusBadRequest)
+                fmt.Fprintf(w, "400 - Entry %d: %v", i, err)
+                return
+            }
+        }
+        if r.URL.Query().Get("force") != "true" {
+            var duplicates []playlistDuplicate
+            for i,entry := range req.Entries {
+                dup, err := findDuplicate(meloDB, queue, entry)
+                if err != nil {
+                    log.Printf("\"POST /download/playlist\": %v\n", err)
+                    w.WriteHeader(http.StatusInternalServerError)
+                    return
+                }
+                if dup != nil {
+                    duplicates = append(duplicates, playlistDuplicate{ i, *dup })
+                }
+            }
+            if len(duplicates) > 0 {
+                bytes,_ := json.Marshal(map[string]interface{}{ "duplicates": duplicates })
+                w.Header().Set("Content-Type", "application/json")
+                w.WriteHeader(http.StatusConflict)
+                w.Write(bytes)
+                return
+            }
+        }
+        claims := r.Context().Value("user_claims").(map[string]interface{})
+        uid,_ := claims["email"].(string)
+
+        var res playlistImportResponse
+        if req.Playlist != nil && req.Playlist.Title != "" {
+            id, err := meloDB.PostPlaylist(NormalizedPlaylist{
+                Title: req.Playlist.Title,
+                Description: req.Playlist.Description,
+                Artwork: req.Playlist.Artwork,
+                Owner: uid,
+                Songs: []primitive.ObjectID{},
+            })
+            if err != nil {
+                log.Printf("\"POST /download/playlist\": %v\n", err)
+                w.WriteHeader(http.StatusInternalServerError)
+                return
+            }
+            res.PlaylistId = id.Hex()
+        }
+        group, err := queue.EnqueueGroup(req.Entries, uid, res.PlaylistId)
+        if err != nil {
+            log.Printf("\"POST /download/playlist\": %v\n", err)
+            if len(group) == 0 {
+                w.WriteHeader(http.StatusInternalServerError)
+                return
+            }
+        }
+        res.Group = group[0].Group
+        for _,job := range group {
+            res.JobIds = append(res.JobIds, job.Id)
+        }
+        res.Steps = jobs.Steps
+        bytes,_ := json.Marshal(res)
+        w.Header().Set("Content-Type", "application/json")
+        w.Header().Set("Location", "/download/jobs?group=" + res.Group)
+        w.WriteHeader(http.StatusAccepted)
+        w.Write(bytes)
+    })
+}
+
+/* Returns the function that adds the songs of a finished group of jobs to
+ * their playlist, in the group's order. The songs that failed to download
+ * are left out. */
+func createFinishPlaylistImportFunc(meloDB MeloDatabase) func([]jobs.Job) {
+    return func(group []jobs.Job) {
+        for _,job := range group {
+            if job.Playlist == "" || job.State != jobs.Done || job.SongId == "" {
+                continue
+            }
+            err := meloDB.AddSongToPlaylist(job.CreatedBy, job.Playlist, job.SongId)
+            if err != nil {
+                log.Printf("Failed to add song %s to playlist %s: %v\n",
+                    job.SongId, job.Playlist, err)
+            }
+        }
+    }
+}
@@ -3,22 +3,35 @@ package internal
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
+	"slices"
+	"strconv"
+	"sync"
 	"time"
 
 	keywe "github.com/TSchreiber/keywe-go"
 	"github.com/gorilla/mux"
+    "github.com/TSchreiber/melo/internal/cache"
     "github.com/TSchreiber/melo/internal/download"
+    "github.com/TSchreiber/melo/internal/ffmpeg"
+    "github.com/TSchreiber/melo/internal/jobs"
+    yt_dlp "github.com/TSchreiber/melo/internal/yt_dlp"
 )
 
 type MeloConfig struct {
     Server ServerConfig
-    Database MongoDBConfig
+    Database DatabaseConfig
     Keywe KeyweConfig
+    HLS HLSConfig
+    Transcode TranscodeConfig
+    Download DownloadConfig
+    Jobs jobs.Config
+    Library LibraryConfig
 }
 
 type ServerConfig struct {
@@ -27,6 +40,19 @@ type ServerConfig struct {
 	CertFile, KeyFile string
 }
 
+type DownloadConfig struct {
+    // How downloaded songs are encoded unless the request says otherwise,
+    // ex. {"Codec": "opus", "Bitrate": "128k"}. Defaults to mp3
+    ffmpeg.Options
+    // The executables that are run, found in $PATH when left out
+    YtDlpPath, FFmpegPath, FFprobePath string
+    // Which providers songs are downloaded from, see download.SourcesConfig
+    Sources download.SourcesConfig
+    // The largest audio file that can be uploaded to /download/upload in
+    // bytes. Defaults to 512 MiB
+    MaxUploadSize int64
+}
+
 type KeyweConfig struct {
     URL string
     RedirectURL string
@@ -39,6 +65,14 @@ type MeloServer struct {
     useTLS bool
     tlsCertFile, tlsKeyFile string
     meloDB MeloDatabase
+    hls *hlsLibrary
+    hlsAtIngest bool
+    transcodes *cache.DiskCache
+    downloadOptions ffmpeg.Options
+    maxUploadSize int64
+    jobs *jobs.Queue
+    libraryDirs []string
+    libraryScanInterval time.Duration
 
     tokenVerifier *keywe.Verifier
     keyweURL, keyweRedirectTarget string
@@ -56,11 +90,64 @@ func NewMeloServer(config MeloConfig) (MeloServer,error) {
     server.tlsKeyFile = config.Server.KeyFile
 
     var err error
-    server.meloDB, err = NewMongoDB(config.Database)
+    server.meloDB, err = NewMeloDatabase(config.Database)
+    if err != nil {
+        return server, err
+    }
+
+    server.hls = newHLSLibrary(config.HLS)
+    server.hlsAtIngest = config.HLS.GenerateAtIngest
+    server.transcodes, err = newTranscodeCache(config.Transcode)
     if err != nil {
         return server, err
     }
 
+    if config.Download.YtDlpPath != "" {
+        yt_dlp.Path = config.Download.YtDlpPath
+    }
+    if config.Download.FFmpegPath != "" {
+        ffmpeg.FFmpegPath = config.Download.FFmpegPath
+    }
+    if config.Download.FFprobePath != "" {
+        ffmpeg.FFprobePath = config.Download.FFprobePath
+    }
+    err = download.EnableSources(config.Download.Sources)
+    if err != nil {
+        return server, err
+    }
+    server.downloadOptions = config.Download.Options
+    if server.downloadOptions.Codec == "" {
+        server.downloadOptions.Codec = "mp3"
+    }
+    err = server.downloadOptions.Validate()
+    if err != nil {
+        return server, fmt.Errorf("Invalid download options: %w", err)
+    }
+
+    server.maxUploadSize = config.Download.MaxUploadSize
+    if server.maxUploadSize <= 0 {
+        server.maxUploadSize = defaultMaxUploadSize
+    }
+
+    err = setLibraryDirectories(config.Library.Directories)
+    if err != nil {
+        return server, err
+    }
+    server.libraryDirs = config.Library.Directories
+    server.libraryScanInterval = time.Duration(config.Library.ScanIntervalMinutes) * time.Minute
+    if config.Library.ScanIntervalMinutes == 0 {
+        server.libraryScanInterval = defaultLibraryScanInterval
+    }
+
+    onSongCreated := func(Song) {}
+    if server.hlsAtIngest {
+        onSongCreated = server.hls.ensureAsync
+    }
+    server.jobs = jobs.NewQueue(server.meloDB, config.Jobs,
+        createSaveSongFunc(server.meloDB, onSongCreated))
+    server.jobs.OnGroupFinished(createFinishPlaylistImportFunc(server.meloDB))
+    server.jobs.FindSimilarSongs(createFindSimilarSongsFunc(server.meloDB))
+
     server.router = createRouterForServer(server)
 
     server.server = &http.Server{
@@ -74,6 +161,13 @@ func NewMeloServer(config MeloConfig) (MeloServer,error) {
 }
 
 func (server *MeloServer) Start() error {
+    err := server.jobs.Start()
+    if err != nil {
+        return err
+    }
+    if len(server.libraryDirs) > 0 && server.libraryScanInterval > 0 {
+        go scanLibraryEvery(server.meloDB, server.libraryDirs, server.libraryScanInterval)
+    }
     log.Printf("Serving at %s...\n", server.server.Addr)
     if server.useTLS {
         return server.server.ListenAndServeTLS(server.tlsCertFile, server.tlsKeyFile)
@@ -106,6 +200,16 @@ func createRouterForServer(server MeloServer) *mux.Router {
     songApiRouter.Path("/metadata").Handler(createSongMetadataHandler(server.meloDB))
     songApiRouter.Path("/search").Handler(createSearchForSongHandler(server.meloDB))
 
+    adminAuthorizor := createAuthorizorMiddleware(server.meloDB, []string{"admin"})
+    songEditRouter :=
+        router.PathPrefix("/api/song").
+        Methods("POST").
+        Subrouter()
+    songEditRouter.Use(authenticator)
+    songEditRouter.Use(adminAuthorizor)
+    songEditRouter.Path("/metadata").Handler(
+        createUpdateSongMetadataHandler(server.meloDB, retagSongFile))
+
     playlistApiRouter := router.PathPrefix("/api/playlist").Subrouter()
     playlistApiRouter.Use(authenticator)
     playlistApiRouter.Methods("GET").Path("/metadata").Handler(createPlaylistMetadataHandler(server.meloDB))
@@ -117,20 +221,58 @@ func createRouterForServer(server MeloServer) *mux.Router {
     playlistApiRouter.Methods("POST").Path("/addSong").Handler(createAddSongToPlaylistHandler(server.meloDB))
     playlistApiRouter.Methods("POST").Path("/removeSong").Handler(createRemoveSongFromPlaylistHandler(server.meloDB))
 
-    adminAuthorizor := createAuthorizorMiddleware(server.meloDB, []string{"admin"})
     downloadRouter := router.PathPrefix("/download").Subrouter()
     downloadRouter.Use(authenticator)
     downloadRouter.Use(adminAuthorizor)
     downloadRouter.Path("/search").
         Methods("GET").
         HandlerFunc(downloadSearchHandler)
+    downloadRouter.Path("/sources").
+        Methods("GET").
+        HandlerFunc(listSourcesHandler)
+    downloadRouter.Path("/resolve").
+        Methods("GET").
+        Handler(createResolveSourceHandler())
     downloadRouter.Path("/song").
         Methods("POST").
-        Handler(createPostSongHandler(server.meloDB))
+        Handler(createPostSongHandler(server.jobs, server.meloDB, server.downloadOptions))
+    downloadRouter.Path("/upload").
+        Methods("POST").
+        Handler(createUploadSongHandler(server.jobs, server.meloDB, server.downloadOptions,
+            server.maxUploadSize))
+    downloadRouter.Path("/playlist").
+        Methods("GET").
+        Handler(createPlaylistPreviewHandler())
+    downloadRouter.Path("/playlist").
+        Methods("POST").
+        Handler(createPostPlaylistImportHandler(server.jobs, server.meloDB, server.downloadOptions))
+    downloadRouter.Path("/chapters").
+        Methods("GET").
+        Handler(createChapterPreviewHandler())
+    downloadRouter.Path("/spotify/playlist").
+        Methods("GET").
+        Handler(createSpotifyPlaylistMatchHandler())
+    downloadRouter.Path("/duplicates").
+        Methods("GET").
+        Handler(createDuplicateReportHandler(server.meloDB))
+    downloadRouter.Path("/jobs").
+        Methods("GET").
+        Handler(createListJobsHandler(server.jobs))
+    downloadRouter.Path("/jobs/{id}").
+        Methods("GET").
+        Handler(createGetJobHandler(server.jobs))
+    downloadRouter.Path("/jobs/{id}").
+        Methods("DELETE").
+        Handler(createCancelJobHandler(server.jobs))
+    downloadRouter.Path("/jobs/{id}/events").
+        Methods("GET").
+        Handler(createJobEventsHandler(server.jobs))
 
-    songRouter := router.PathPrefix("/song").Methods("GET").Subrouter()
+    songRouter := router.PathPrefix("/song").Methods("GET", "HEAD").Subrouter()
     songRouter.Use(authenticator)
-    songRouter.PathPrefix("/").HandlerFunc(serveSong)
+    songRouter.Path("/{id}").Handler(createStreamSongHandler(server.meloDB, server.transcodes))
+    songRouter.Path("/{id}/master.m3u8").Handler(createHLSHandler(server.meloDB, server.hls))
+    songRouter.Path("/{id}/{rendition}/{file}").Handler(createHLSHandler(server.meloDB, server.hls))
 
     publicRoutes := []string {
         "/modules",
@@ -212,13 +354,6 @@ func serveHomePage(w http.ResponseWriter, r *http.Request) {
     http.ServeFile(w, r, "./static/index.html")
 }
 
-/* This function is needed because the static file server does not serve files
- * that begin with a number and some of the song files start with numbers */
-func serveSong(w http.ResponseWriter, r *http.Request) {
-    path := "static/" + r.URL.Path
-    http.ServeFile(w, r, path)
-}
-
 func createSampleSongsHandler(meloDB MeloDatabase) http.HandlerFunc {
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
         songs, err := meloDB.SampleSongs()
@@ -245,6 +380,15 @@ func createSongMetadataHandler(meloDB MeloDatabase) http.HandlerFunc {
             return
         }
         song, err := meloDB.GetSong(songId)
+        if errors.Is(err, ErrInvalidId) {
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprintf(w, "400 - Invalid song id, \"%s\"", songId)
+            return
+        }
+        if errors.Is(err, ErrNotFound) {
+            w.WriteHeader(http.StatusNotFound)
+            return
+        }
         if err != nil {
             fmt.Println(err)
             w.WriteHeader(http.StatusInternalServerError)
@@ -254,7 +398,9 @@ func createSongMetadataHandler(meloDB MeloDatabase) http.HandlerFunc {
         if err != nil {
             fmt.Println(err)
             w.WriteHeader(http.StatusInternalServerError)
+            return
         }
+        w.Header().Set("Content-Type", "application/json")
         w.Write(b)
     })
 }
@@ -317,7 +463,13 @@ func createPlaylistMetadataHandler(meloDB MeloDatabase) http.HandlerFunc {
     })
 }
 
-func createPostSongHandler(meloDB MeloDatabase) http.HandlerFunc {
+/* Queues a download and responds with 202 and the job's id along with the
+ * names of its steps. The progress of the job is streamed by
+ * /download/jobs/{id}/events. If the song is already in the library, or is
+ * being downloaded, it responds with 409 and the duplicate instead, unless
+ * ?force=true. */
+func createPostSongHandler(queue *jobs.Queue, meloDB MeloDatabase,
+defaults ffmpeg.Options) http.HandlerFunc {
     return http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
         b, err := io.ReadAll(r.Body)
         if err != nil {
@@ -326,7 +478,6 @@ func createPostSongHandler(meloDB MeloDatabase) http.HandlerFunc {
             fmt.Fprint(w, "400 - Missing request body")
             return
         }
-        fmt.Println(string(b))
         var songRequest download.DownloadRequest
         err = json.Unmarshal(b,&songRequest)
         if err != nil {
@@ -339,64 +490,209 @@ func createPostSongHandler(meloDB MeloDatabase) http.HandlerFunc {
             w.WriteHeader(http.StatusBadRequest)
             return
         }
-
-        var steps struct {
-            Steps []string `json:"steps"`
+        songRequest.ApplyDefaults(defaults)
+        if err := songRequest.Validate(); err != nil {
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprintf(w, "400 - %v", err)
+            return
         }
-        steps.Steps = []string{"Download","Extract"}
-        bytes,_ := json.Marshal(steps)
-        w.Write(bytes)
-        w.(http.Flusher).Flush()
-
-        writeSong := func(song download.Song) error {
-            s := make(map[string]string)
-            s["title"] = song.Title
-            s["album"] = song.Album
-            s["artist"] = song.Artist
-            s["artwork"] = song.Artwork
-            s["audioUrl"] = song.AudioUrl
-            _,err := meloDB.PostSong(s)
+        if r.URL.Query().Get("force") != "true" {
+            dup, err := findDuplicate(meloDB, queue, songRequest)
             if err != nil {
-                return err
+                log.Printf("\"POST /download/song\": %v\n", err)
+                w.WriteHeader(http.StatusInternalServerError)
+                return
+            }
+            if dup != nil {
+                bytes,_ := json.Marshal(dup)
+                w.Header().Set("Content-Type", "application/json")
+                w.WriteHeader(http.StatusConflict)
+                w.Write(bytes)
+                return
             }
-            return nil
         }
+        claims := r.Context().Value("user_claims").(map[string]interface{})
+        uid,_ := claims["email"].(string)
 
-        type ProgressUpdate struct {
-            Step string `json:"step"`
-            Progress uint8 `json:"progress"`
-            Done bool `json:"done"`
+        job, err := queue.Enqueue(songRequest, uid)
+        if err != nil {
+            log.Printf("\"POST /download/song\": %v\n", err)
+            w.WriteHeader(http.StatusInternalServerError)
+            return
         }
-
-        downloadProgressHandler := func(progress uint8) {
-            var update ProgressUpdate
-            update.Step = "Download"
-            update.Progress = progress
-            update.Done = false
-            bytes,_ := json.Marshal(update)
-            w.Write(bytes)
-            w.(http.Flusher).Flush()
+        var res struct {
+            JobId string `json:"jobId"`
+            Steps []jobs.Step `json:"steps"`
         }
+        res.JobId = job.Id
+        res.Steps = jobs.Steps
+        bytes,_ := json.Marshal(res)
+        w.Header().Set("Content-Type", "application/json")
+        w.Header().Set("Location", "/download/jobs/" + job.Id)
+        w.WriteHeader(http.StatusAccepted)
+        w.Write(bytes)
+    })
+}
 
-        convertProgressHandler := func(progress uint8) {
-            var update ProgressUpdate
-            update.Step = "Extract"
-            update.Progress = progress
-            update.Done = false
-            bytes,_ := json.Marshal(update)
-            w.Write(bytes)
-            w.(http.Flusher).Flush()
+/* Lists the download jobs, newest first. ?state= limits the list to the jobs
+ * in that state and may be repeated, ?limit= is the most jobs returned and
+ * defaults to 100. ?group= lists the jobs of a playlist import instead, in
+ * the playlist's order, ?state= filters them the same way. */
+func createListJobsHandler(queue *jobs.Queue) http.HandlerFunc {
+    return http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+        var states []jobs.State
+        for _,state := range r.URL.Query()["state"] {
+            states = append(states, jobs.State(state))
+        }
+        limit := 100
+        if s := r.URL.Query().Get("limit"); s != "" {
+            var err error
+            limit, err = strconv.Atoi(s)
+            if err != nil || limit <= 0 {
+                w.WriteHeader(http.StatusBadRequest)
+                fmt.Fprintf(w, "400 - Invalid limit, \"%s\"", s)
+                return
+            }
         }
-
-        err = download.Download(songRequest, writeSong, downloadProgressHandler, convertProgressHandler)
+        var list []jobs.Job
+        var err error
+        if group := r.URL.Query().Get("group"); group != "" {
+            list, err = queue.ListGroup(group)
+            if len(states) > 0 {
+                list = slices.DeleteFunc(list, func(job jobs.Job) bool {
+                    return !slices.Contains(states, job.State)
+                })
+            }
+        } else {
+            list, err = queue.List(states...)
+            slices.Reverse(list)
+        }
+        if err != nil {
+            log.Printf("\"GET /download/jobs\": %v\n", err)
+            w.WriteHeader(http.StatusInternalServerError)
+            return
+        }
+        if len(list) > limit {
+            list = list[:limit]
+        }
+        if list == nil {
+            list = []jobs.Job{}
+        }
+        b, err := json.Marshal(list)
         if err != nil {
-            fmt.Printf("Failed to download song: %v", err)
+            fmt.Println(err)
             w.WriteHeader(http.StatusInternalServerError)
             return
         }
+        w.Header().Set("Content-Type", "application/json")
+        w.Write(b)
     })
 }
 
+func createGetJobHandler(queue *jobs.Queue) http.HandlerFunc {
+    return http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+        jobId := mux.Vars(r)["id"]
+        job, err := queue.Get(jobId)
+        if writeJobError(w, jobId, err) {
+            return
+        }
+        writeJob(w, job)
+    })
+}
+
+/* Cancels the download job, killing its yt-dlp or ffmpeg process if it is
+ * running. Responds with the cancelled job, or 409 if it had already
+ * finished. */
+func createCancelJobHandler(queue *jobs.Queue) http.HandlerFunc {
+    return http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+        jobId := mux.Vars(r)["id"]
+        job, err := queue.Cancel(jobId)
+        if errors.Is(err, jobs.ErrFinished) {
+            w.WriteHeader(http.StatusConflict)
+            fmt.Fprintf(w, "409 - The job has already %s", job.State)
+            return
+        }
+        if writeJobError(w, jobId, err) {
+            return
+        }
+        writeJob(w, job)
+    })
+}
+
+// writes the response for a failed job lookup, reports whether there was an error
+func writeJobError(w http.ResponseWriter, jobId string, err error) bool {
+    if err == nil {
+        return false
+    }
+    if errors.Is(err, ErrInvalidId) {
+        w.WriteHeader(http.StatusBadRequest)
+        fmt.Fprintf(w, "400 - Invalid job id, \"%s\"", jobId)
+    } else if errors.Is(err, ErrNotFound) {
+        w.WriteHeader(http.StatusNotFound)
+    } else {
+        fmt.Println(err)
+        w.WriteHeader(http.StatusInternalServerError)
+    }
+    return true
+}
+
+func writeJob(w http.ResponseWriter, job jobs.Job) {
+    b, err := json.Marshal(job)
+    if err != nil {
+        fmt.Println(err)
+        w.WriteHeader(http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.Write(b)
+}
+
+/* Returns the function that the job queue uses to add a downloaded song to
+ * the library. Every converted file has its own audio URL, so a job that is
+ * resumed after its song was added, but before the job recorded it, finds
+ * the song rather than adding it again. */
+func createSaveSongFunc(meloDB MeloDatabase, onSongCreated func(Song)) func(jobs.Job) (string,error) {
+    return func(job jobs.Job) (string,error) {
+        song := job.Song
+        var s Song
+        s.Title = song.Title
+        s.Album = song.Album
+        s.Artist = song.Artist
+        s.Artwork = song.Artwork
+        s.AudioURL = song.AudioUrl
+        s.Duration = song.Duration
+        s.Source = song.Source
+        s.AddedBy = job.CreatedBy
+        s.Codec = song.Codec
+        s.Bitrate = song.Bitrate
+        s.Size = song.Size
+        s.Gain = song.Gain
+        s.Peak = song.Peak
+        s.Track = song.Track
+        existing, err := meloDB.GetSongByAudioURL(s.AudioURL)
+        if err == nil {
+            s = existing
+        } else if errors.Is(err, ErrNotFound) {
+            id,err := meloDB.PostSong(s)
+            if err != nil {
+                return "", err
+            }
+            s.Id = id.Hex()
+        } else {
+            return "", err
+        }
+        if len(song.Fingerprint) > 0 {
+            // the song is only left out of duplicate checks without it
+            err = meloDB.PutFingerprint(s.Id, song.Fingerprint)
+            if err != nil {
+                log.Printf("Failed to store the fingerprint of song %s: %v\n", s.Id, err)
+            }
+        }
+        onSongCreated(s)
+        return s.Id, nil
+    }
+}
+
 
 func createPlaylistPersonalHandler(meloDB MeloDatabase) http.HandlerFunc {
     return http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
@@ -471,6 +767,90 @@ func createPostPlaylistHandler(meloDB MeloDatabase) http.HandlerFunc {
     })
 }
 
+/* Changes a song's metadata. onSongUpdated is called with the updated song so
+ * that the tags in its audio file can be rewritten. */
+func createUpdateSongMetadataHandler(meloDB MeloDatabase, onSongUpdated func(Song)) http.HandlerFunc {
+    return http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+        b, err := io.ReadAll(r.Body)
+        if err != nil {
+            fmt.Printf("Failed to read body,\n%v\n", err)
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprint(w, "400 - Missing request body")
+            return
+        }
+        type T struct {
+            SongId, Title, Artist, Album, Artwork string
+        }
+        var temp T
+        err = json.Unmarshal(b,&temp)
+        if err != nil || temp.Title == "" {
+            fmt.Printf("Failed to parse body,\n\t%v\n\t%s\n", err, string(b))
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprint(w, "400 - Malformed form data")
+            return
+        }
+        var song Song
+        song.Title = temp.Title
+        song.Artist = temp.Artist
+        song.Album = temp.Album
+        song.Artwork = temp.Artwork
+        err = meloDB.UpdateSong(temp.SongId, song)
+        if errors.Is(err, ErrInvalidId) {
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprintf(w, "400 - Invalid song id, \"%s\"", temp.SongId)
+            return
+        }
+        if errors.Is(err, ErrNotFound) {
+            w.WriteHeader(http.StatusNotFound)
+            return
+        }
+        if err != nil {
+            w.WriteHeader(http.StatusInternalServerError)
+            fmt.Printf("Post /api/song/metadata: %v", err)
+            return
+        }
+        song, err = meloDB.GetSong(temp.SongId)
+        if err != nil {
+            fmt.Printf("Post /api/song/metadata: %v", err)
+            return
+        }
+        onSongUpdated(song)
+    })
+}
+
+// Only one song file is re-tagged at a time, which also keeps two quick
+// edits of the same song from writing the file at once
+var retagMutex sync.Mutex
+
+/* Rewrites the tags of the song's audio file in the background. The files of
+ * library songs are left as they are, they belong to the collection that
+ * Melo serves, not to Melo. */
+func retagSongFile(song Song) {
+    if isLibrarySong(song) {
+        return
+    }
+    go func() {
+        retagMutex.Lock()
+        defer retagMutex.Unlock()
+        path, err := songFilePath(song)
+        if err != nil {
+            log.Printf("Failed to re-tag song %s: %v\n", song.Id, err)
+            return
+        }
+        err = download.TagFile(path, ffmpeg.Tags{
+            Title: song.Title,
+            Artist: song.Artist,
+            Album: song.Album,
+            Track: song.Track,
+            Gain: song.Gain,
+            Peak: song.Peak,
+        }, song.Artwork)
+        if err != nil {
+            log.Printf("Failed to re-tag song %s: %v\n", song.Id, err)
+        }
+    }()
+}
+
 func createUpdatePlaylistMetadataHandler(meloDB MeloDatabase) http.HandlerFunc {
     return http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
         b, err := io.ReadAll(r.Body)
@@ -0,0 +1,1260 @@
+package internal
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TSchreiber/melo/internal/download"
+	"github.com/TSchreiber/melo/internal/fakebin"
+	"github.com/TSchreiber/melo/internal/ffmpeg"
+	"github.com/TSchreiber/melo/internal/fingerprint"
+	"github.com/TSchreiber/melo/internal/jobs"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+    testUser = "user@example.com"
+    testAdmin = "admin@example.com"
+)
+
+var (
+    testKey *rsa.PrivateKey
+    testKeywe *httptest.Server
+)
+
+func TestMain(m *testing.M) {
+    // the handlers serve files relative to the repository root
+    if err := os.Chdir(".."); err != nil {
+        panic(err)
+    }
+    var err error
+    testKey, err = rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        panic(err)
+    }
+    testKeywe = newTestKeywe(&testKey.PublicKey)
+    code := m.Run()
+    testKeywe.Close()
+    os.Exit(code)
+}
+
+// Creates a stand-in for the KeyWe service that serves the public key used to
+// verify the tokens created by signToken
+func newTestKeywe(key *rsa.PublicKey) *httptest.Server {
+    der, err := x509.MarshalPKIXPublicKey(key)
+    if err != nil {
+        panic(err)
+    }
+    keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+    return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path != "/public_key" {
+            w.WriteHeader(http.StatusNotFound)
+            return
+        }
+        w.Write(keyPEM)
+    }))
+}
+
+// Creates an RS256 id token for the given email signed with testKey
+func signToken(t *testing.T, email string) string {
+    /* The KeyWe verifier decodes the header with padded standard base64, so
+     * the header is padded with spaces until its encoding needs no padding and
+     * is identical in the standard and url-safe alphabets */
+    header := `{"alg":"RS256","kid":"test","typ":"JWT"}`
+    for len(header) % 3 != 0 ||
+    strings.ContainsAny(base64.StdEncoding.EncodeToString([]byte(header)), "+/") {
+        header = header[:len(header)-1] + " }"
+    }
+    claims, _ := json.Marshal(map[string]interface{}{
+        "email": email,
+        "exp": time.Now().Add(time.Hour).Unix(),
+    })
+    signingInput := base64.RawURLEncoding.EncodeToString([]byte(header)) + "." +
+        base64.RawURLEncoding.EncodeToString(claims)
+    digest := sha256.Sum256([]byte(signingInput))
+    sig, err := rsa.SignPKCS1v15(rand.Reader, testKey, crypto.SHA256, digest[:])
+    if err != nil {
+        t.Fatal(err)
+    }
+    return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func newTestServer(t *testing.T) (MeloServer, MeloDatabase) {
+    server, err := NewMeloServer(newTestConfig(t))
+    if err != nil {
+        t.Fatal(err)
+    }
+    return server, server.meloDB
+}
+
+// The config of a server with an in-memory database and the test Keywe
+func newTestConfig(t *testing.T) MeloConfig {
+    var config MeloConfig
+    config.Database.Type = "memory"
+    config.Database.Permissions = map[string][]string{testAdmin: {"admin"}}
+    config.Keywe.URL = testKeywe.URL
+    config.Keywe.RedirectURL = "https://melo.example.com/keywe_redirect_target.html"
+    config.Transcode.CacheDirectory = t.TempDir()
+    return config
+}
+
+// Sends the request to the server's router as the given user, an empty email
+// sends the request without an Authorization header
+func doRequest(t *testing.T, server MeloServer, method, target, email string,
+body string) *httptest.ResponseRecorder {
+    var reader io.Reader
+    if body != "" {
+        reader = strings.NewReader(body)
+    }
+    req := httptest.NewRequest(method, target, reader)
+    if email != "" {
+        req.Header.Set("Authorization", signToken(t, email))
+    }
+    w := httptest.NewRecorder()
+    server.router.ServeHTTP(w, req)
+    return w
+}
+
+func postTestSong(t *testing.T, db MeloDatabase, title, artist string) string {
+    id, err := db.PostSong(Song{
+        Title: title,
+        Artist: artist,
+        Album: title + " - Single",
+        AudioURL: "/song/" + title + ".mp3",
+        Duration: 180,
+        Source: "youtube:dQw4w9WgXcQ",
+        AddedBy: testAdmin,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    return id.Hex()
+}
+
+func TestPublicRoutes(t *testing.T) {
+    server, _ := newTestServer(t)
+
+    w := doRequest(t, server, "GET", "/", "", "")
+    if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<html") {
+        t.Errorf("GET /: expected the home page, got %d", w.Code)
+    }
+
+    w = doRequest(t, server, "GET", "/modules/melo_api.mjs", "", "")
+    if w.Code != http.StatusOK {
+        t.Errorf("GET /modules/melo_api.mjs: expected 200, got %d", w.Code)
+    }
+
+    w = doRequest(t, server, "GET", "/login", "", "")
+    if w.Code != http.StatusTemporaryRedirect {
+        t.Errorf("GET /login: expected 307, got %d", w.Code)
+    }
+    if loc := w.Header().Get("Location"); !strings.HasPrefix(loc, testKeywe.URL + "/login?redirect_url=") {
+        t.Errorf("GET /login: unexpected redirect, \"%s\"", loc)
+    }
+
+    w = doRequest(t, server, "GET", "/auth/refresh_url", "", "")
+    if w.Body.String() != testKeywe.URL + "/token" {
+        t.Errorf("GET /auth/refresh_url: unexpected body, \"%s\"", w.Body.String())
+    }
+}
+
+func TestAuthentication(t *testing.T) {
+    server, _ := newTestServer(t)
+    routes := []string{
+        "/api/song/sample",
+        "/api/playlist/personal",
+        "/download/search?q=test",
+        "/song/" + primitive.NewObjectID().Hex(),
+    }
+    for _,route := range routes {
+        w := doRequest(t, server, "GET", route, "", "")
+        if w.Code != http.StatusUnauthorized {
+            t.Errorf("GET %s without a token: expected 401, got %d", route, w.Code)
+        }
+        req := httptest.NewRequest("GET", route, nil)
+        req.Header.Set("Authorization", "not.a.token")
+        w = httptest.NewRecorder()
+        server.router.ServeHTTP(w, req)
+        if w.Code != http.StatusForbidden {
+            t.Errorf("GET %s with an invalid token: expected 403, got %d", route, w.Code)
+        }
+    }
+}
+
+func TestSongApi(t *testing.T) {
+    server, db := newTestServer(t)
+    id := postTestSong(t, db, "Sand In My Boots", "Morgan Wallen")
+    postTestSong(t, db, "You & I", "IU")
+
+    w := doRequest(t, server, "GET", "/api/song/sample", testUser, "")
+    var songs []Song
+    if err := json.Unmarshal(w.Body.Bytes(), &songs); err != nil || len(songs) != 2 {
+        t.Errorf("GET /api/song/sample: expected 2 songs, got %s", w.Body.String())
+    }
+
+    w = doRequest(t, server, "GET", "/api/song/search?q=boots", testUser, "")
+    songs = nil
+    if err := json.Unmarshal(w.Body.Bytes(), &songs); err != nil ||
+    len(songs) != 1 || songs[0].Id != id {
+        t.Errorf("GET /api/song/search: expected song %s, got %s", id, w.Body.String())
+    }
+
+    w = doRequest(t, server, "GET", "/api/song/metadata?id=" + id, testUser, "")
+    var song Song
+    if err := json.Unmarshal(w.Body.Bytes(), &song); err != nil {
+        t.Fatalf("GET /api/song/metadata: %v", err)
+    }
+    if song.Title != "Sand In My Boots" || song.Duration != 180 ||
+    song.Source != "youtube:dQw4w9WgXcQ" || song.AddedBy != testAdmin {
+        t.Errorf("GET /api/song/metadata: unexpected song %+v", song)
+    }
+
+    statusTests := map[string]int{
+        "/api/song/metadata": http.StatusBadRequest,
+        "/api/song/metadata?id=not-an-id": http.StatusBadRequest,
+        "/api/song/metadata?id=" + primitive.NewObjectID().Hex(): http.StatusNotFound,
+    }
+    for target, status := range statusTests {
+        w = doRequest(t, server, "GET", target, testUser, "")
+        if w.Code != status {
+            t.Errorf("GET %s: expected %d, got %d", target, status, w.Code)
+        }
+    }
+
+    body := `{"songId":"` + id + `","title":"Sand in My Boots","artist":"Morgan Wallen","album":"Dangerous"}`
+    w = doRequest(t, server, "POST", "/api/song/metadata", testUser, body)
+    if w.Code != http.StatusForbidden {
+        t.Errorf("POST /api/song/metadata as a user: expected 403, got %d", w.Code)
+    }
+    w = doRequest(t, server, "POST", "/api/song/metadata", testAdmin, body)
+    if w.Code != http.StatusOK {
+        t.Errorf("POST /api/song/metadata: expected 200, got %d", w.Code)
+    }
+    if song, _ := db.GetSong(id); song.Title != "Sand in My Boots" || song.Album != "Dangerous" {
+        t.Errorf("POST /api/song/metadata: song was not updated, %+v", song)
+    }
+    postTests := map[string]int{
+        `{`: http.StatusBadRequest,
+        `{"songId":"` + id + `"}`: http.StatusBadRequest,
+        `{"songId":"not-an-id","title":"Test"}`: http.StatusBadRequest,
+        `{"songId":"` + primitive.NewObjectID().Hex() + `","title":"Test"}`: http.StatusNotFound,
+    }
+    for body, status := range postTests {
+        w = doRequest(t, server, "POST", "/api/song/metadata", testAdmin, body)
+        if w.Code != status {
+            t.Errorf("POST /api/song/metadata %s: expected %d, got %d", body, status, w.Code)
+        }
+    }
+}
+
+func TestPlaylistApi(t *testing.T) {
+    server, db := newTestServer(t)
+    song1 := postTestSong(t, db, "Sand In My Boots", "Morgan Wallen")
+    song2 := postTestSong(t, db, "You & I", "IU")
+
+    w := doRequest(t, server, "POST", "/api/playlist", testUser,
+        `{"title":"Road Trip","description":"Songs for the car"}`)
+    if w.Code != http.StatusOK {
+        t.Fatalf("POST /api/playlist: expected 200, got %d", w.Code)
+    }
+
+    w = doRequest(t, server, "GET", "/api/playlist/personal", testUser, "")
+    var playlists []Playlist
+    if err := json.Unmarshal(w.Body.Bytes(), &playlists); err != nil || len(playlists) != 1 {
+        t.Fatalf("GET /api/playlist/personal: expected 1 playlist, got %s", w.Body.String())
+    }
+    playlistId := playlists[0].Id
+
+    for _,songId := range []string{song1, song2, song1} {
+        body := fmt.Sprintf(`{"playlistId":"%s","songId":"%s"}`, playlistId, songId)
+        w = doRequest(t, server, "POST", "/api/playlist/addSong", testUser, body)
+        if w.Code != http.StatusOK {
+            t.Errorf("POST /api/playlist/addSong: expected 200, got %d", w.Code)
+        }
+    }
+    body := fmt.Sprintf(`{"playlistId":"%s","songId":"%s"}`, playlistId, song1)
+    doRequest(t, server, "POST", "/api/playlist/removeSong", testUser, body)
+
+    body = fmt.Sprintf(`{"playlistId":"%s","title":"Road Trip 2","description":"","artwork":""}`,
+        playlistId)
+    doRequest(t, server, "POST", "/api/playlist/metadata", testUser, body)
+
+    // changes from users that do not own the playlist are ignored
+    body = fmt.Sprintf(`{"playlistId":"%s","title":"Hijacked"}`, playlistId)
+    doRequest(t, server, "POST", "/api/playlist/metadata", testAdmin, body)
+
+    w = doRequest(t, server, "GET", "/api/playlist/metadata?id=" + playlistId, testUser, "")
+    var playlist Playlist
+    if err := json.Unmarshal(w.Body.Bytes(), &playlist); err != nil {
+        t.Fatalf("GET /api/playlist/metadata: %v", err)
+    }
+    if playlist.Title != "Road Trip 2" {
+        t.Errorf("GET /api/playlist/metadata: expected title \"Road Trip 2\", got \"%s\"",
+            playlist.Title)
+    }
+    if len(playlist.Songs) != 1 || playlist.Songs[0].Id != song2 {
+        t.Errorf("GET /api/playlist/metadata: expected only song %s, got %+v",
+            song2, playlist.Songs)
+    }
+
+    w = doRequest(t, server, "GET", "/api/playlist/sample", testUser, "")
+    playlists = nil
+    if err := json.Unmarshal(w.Body.Bytes(), &playlists); err != nil || len(playlists) != 1 {
+        t.Errorf("GET /api/playlist/sample: expected 1 playlist, got %s", w.Body.String())
+    }
+
+    w = doRequest(t, server, "GET", "/api/playlist/metadata", testUser, "")
+    if w.Code != http.StatusBadRequest {
+        t.Errorf("GET /api/playlist/metadata without an id: expected 400, got %d", w.Code)
+    }
+    w = doRequest(t, server, "POST", "/api/playlist/addSong", testUser, "{")
+    if w.Code != http.StatusBadRequest {
+        t.Errorf("POST /api/playlist/addSong with a malformed body: expected 400, got %d", w.Code)
+    }
+}
+
+func TestDownloadApi(t *testing.T) {
+    server, db := newTestServer(t)
+
+    w := doRequest(t, server, "GET", "/download/search?q=test", testUser, "")
+    if w.Code != http.StatusForbidden {
+        t.Errorf("GET /download/search as a user: expected 403, got %d", w.Code)
+    }
+    w = doRequest(t, server, "GET", "/download/search", testAdmin, "")
+    if w.Code != http.StatusBadRequest {
+        t.Errorf("GET /download/search without a query: expected 400, got %d", w.Code)
+    }
+    w = doRequest(t, server, "POST", "/download/song", testUser, `{}`)
+    if w.Code != http.StatusForbidden {
+        t.Errorf("POST /download/song as a user: expected 403, got %d", w.Code)
+    }
+    w = doRequest(t, server, "POST", "/download/song", testAdmin, `{"source":"dQw4w9WgXcQ"}`)
+    if w.Code != http.StatusBadRequest {
+        t.Errorf("POST /download/song without a title: expected 400, got %d", w.Code)
+    }
+    w = doRequest(t, server, "POST", "/download/song", testAdmin,
+        `{"title":"Test","source":"dQw4w9WgXcQ","codec":"wav"}`)
+    if w.Code != http.StatusBadRequest {
+        t.Errorf("POST /download/song with an unsupported codec: expected 400, got %d", w.Code)
+    }
+    w = doRequest(t, server, "POST", "/download/song", testAdmin,
+        `{"title":"Test","source":"dQw4w9WgXcQ","codec":"opus","quality":"5"}`)
+    if w.Code != http.StatusBadRequest {
+        t.Errorf("POST /download/song with a quality for opus: expected 400, got %d", w.Code)
+    }
+    // no worker is running so the job stays queued
+    w = doRequest(t, server, "POST", "/download/song", testAdmin,
+        `{"title":"Test","source":"dQw4w9WgXcQ"}`)
+    var first struct {
+        JobId string `json:"jobId"`
+        Steps []string `json:"steps"`
+    }
+    if err := json.Unmarshal(w.Body.Bytes(), &first); err != nil || w.Code != http.StatusAccepted ||
+    first.JobId == "" || len(first.Steps) != 3 {
+        t.Errorf("POST /download/song: expected 202 with a job id and its steps, got %d %s",
+            w.Code, w.Body.String())
+    }
+    if loc := w.Header().Get("Location"); loc != "/download/jobs/" + first.JobId {
+        t.Errorf("POST /download/song: expected the job's location, got %s", loc)
+    }
+    queued, _ := db.ListJobs(jobs.Queued)
+    if len(queued) != 1 || queued[0].Id != first.JobId || queued[0].CreatedBy != testAdmin ||
+    queued[0].Request.Codec != "mp3" {
+        t.Errorf("POST /download/song: expected a queued job, got %+v", queued)
+    }
+
+    w = doRequest(t, server, "POST", "/download/song", testAdmin, `{`)
+    if w.Code != http.StatusBadRequest {
+        t.Errorf("POST /download/song with a malformed body: expected 400, got %d", w.Code)
+    }
+
+    // the queued job can be listed, looked up and cancelled
+    second, _ := server.jobs.Enqueue(download.DownloadRequest{ Title: "Second", Source: "x" }, testAdmin)
+    w = doRequest(t, server, "GET", "/download/jobs", testUser, "")
+    if w.Code != http.StatusForbidden {
+        t.Errorf("GET /download/jobs as a user: expected 403, got %d", w.Code)
+    }
+    w = doRequest(t, server, "GET", "/download/jobs?state=queued&limit=1", testAdmin, "")
+    var list []jobs.Job
+    if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list) != 1 ||
+    list[0].Id != second.Id {
+        t.Errorf("GET /download/jobs: expected the newest job, got %d %s", w.Code, w.Body.String())
+    }
+    w = doRequest(t, server, "GET", "/download/jobs?limit=0", testAdmin, "")
+    if w.Code != http.StatusBadRequest {
+        t.Errorf("GET /download/jobs with a limit of 0: expected 400, got %d", w.Code)
+    }
+    target := "/download/jobs/" + first.JobId
+    w = doRequest(t, server, "GET", target, testAdmin, "")
+    var job jobs.Job
+    if err := json.Unmarshal(w.Body.Bytes(), &job); err != nil || job.State != jobs.Queued ||
+    job.CreatedBy != testAdmin {
+        t.Errorf("GET %s: expected the queued job, got %d %s", target, w.Code, w.Body.String())
+    }
+    w = doRequest(t, server, "DELETE", target, testAdmin, "")
+    if err := json.Unmarshal(w.Body.Bytes(), &job); err != nil || job.State != jobs.Cancelled {
+        t.Errorf("DELETE %s: expected the cancelled job, got %d %s", target, w.Code, w.Body.String())
+    }
+    w = doRequest(t, server, "DELETE", target, testAdmin, "")
+    if w.Code != http.StatusConflict {
+        t.Errorf("DELETE %s twice: expected 409, got %d", target, w.Code)
+    }
+    w = doRequest(t, server, "GET", "/download/jobs?state=cancelled", testAdmin, "")
+    if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list) != 1 ||
+    list[0].Id != first.JobId {
+        t.Errorf("GET /download/jobs?state=cancelled: expected the cancelled job, got %s", w.Body.String())
+    }
+    w = doRequest(t, server, "GET", "/download/jobs/" + primitive.NewObjectID().Hex(), testAdmin, "")
+    if w.Code != http.StatusNotFound {
+        t.Errorf("GET an unknown job: expected 404, got %d", w.Code)
+    }
+    w = doRequest(t, server, "DELETE", "/download/jobs/not-an-id", testAdmin, "")
+    if w.Code != http.StatusBadRequest {
+        t.Errorf("DELETE a job with an invalid id: expected 400, got %d", w.Code)
+    }
+}
+
+func TestDownloadSources(t *testing.T) {
+    server, _ := newTestServer(t)
+    w := doRequest(t, server, "GET", "/download/sources", testAdmin, "")
+    if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `["youtube"]` {
+        t.Errorf("GET /download/sources: expected the default sources, got %d %s", w.Code, w.Body.String())
+    }
+    w = doRequest(t, server, "GET", "/download/resolve", testAdmin, "")
+    if w.Code != http.StatusBadRequest {
+        t.Errorf("GET /download/resolve without a source: expected 400, got %d", w.Code)
+    }
+    // the file source is not enabled
+    w = doRequest(t, server, "GET", "/download/resolve?source=%2Fmusic%2Fsong.mp3", testAdmin, "")
+    if w.Code != http.StatusBadRequest {
+        t.Errorf("GET /download/resolve of a path: expected 400, got %d", w.Code)
+    }
+
+    config := newTestConfig(t)
+    config.Download.Sources.Enabled = []string{ "file" }
+    if _, err := NewMeloServer(config); err == nil {
+        t.Errorf("Expected an error for the file source without a directory")
+    }
+}
+
+// Uploads a file, and the other fields, to /download/upload as the given user
+func uploadFile(t *testing.T, server MeloServer, target, email, fileName, content string,
+fields map[string]string) *httptest.ResponseRecorder {
+    var body strings.Builder
+    mw := multipart.NewWriter(&body)
+    for key, value := range fields {
+        mw.WriteField(key, value)
+    }
+    if fileName != "" {
+        fw, _ := mw.CreateFormFile("file", fileName)
+        io.WriteString(fw, content)
+    }
+    mw.Close()
+    req := httptest.NewRequest("POST", target, strings.NewReader(body.String()))
+    req.Header.Set("Content-Type", mw.FormDataContentType())
+    req.Header.Set("Authorization", signToken(t, email))
+    w := httptest.NewRecorder()
+    server.router.ServeHTTP(w, req)
+    return w
+}
+
+func TestUploadSong(t *testing.T) {
+    // the uploads are probed with the fake ffprobe
+    paths, err := fakebin.Build(t.TempDir())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer func(path string) { ffmpeg.FFprobePath = path }(ffmpeg.FFprobePath)
+    ffmpeg.FFprobePath = paths.FFprobe
+    // no worker is running, so the uploads stay in the working directory
+    defer func() {
+        uploads, _ := filepath.Glob("upload-*")
+        for _,name := range uploads {
+            os.Remove(name)
+        }
+    }()
+    countUploads := func() int {
+        uploads, _ := filepath.Glob("upload-*")
+        return len(uploads)
+    }
+
+    config := newTestConfig(t)
+    config.Download.MaxUploadSize = 1024
+    server, err := NewMeloServer(config)
+    if err != nil {
+        t.Fatal(err)
+    }
+    flac := "fLaC\nTITLE=Blueming\nARTIST=IU\n"
+
+    w := uploadFile(t, server, "/download/upload", testUser, "blueming.flac", flac, nil)
+    if w.Code != http.StatusForbidden {
+        t.Errorf("POST /download/upload as a user: expected 403, got %d", w.Code)
+    }
+    statusTests := []struct{
+        name, fileName, content string
+        status int
+    }{
+        { "without a file", "", "", http.StatusBadRequest },
+        { "of a text file", "notes.mp3", "not audio", http.StatusUnsupportedMediaType },
+        { "of a file ffprobe can't read", "broken.flac", "fLaC corrupt", http.StatusUnsupportedMediaType },
+        { "of a file that is too large", "long.flac", "fLaC" + strings.Repeat("-", 2048),
+            http.StatusRequestEntityTooLarge },
+    }
+    for _,test := range statusTests {
+        w = uploadFile(t, server, "/download/upload", testAdmin, test.fileName, test.content, nil)
+        if w.Code != test.status {
+            t.Errorf("POST /download/upload %s: expected %d, got %d %s", test.name, test.status,
+                w.Code, w.Body.String())
+        }
+    }
+    if n := countUploads(); n != 0 {
+        t.Errorf("Expected the refused uploads to be removed, found %d", n)
+    }
+
+    // the tags are the defaults of the fields that were left out
+    w = uploadFile(t, server, "/download/upload", testAdmin, "blueming.flac", flac,
+        map[string]string{ "album": "Love poem", "codec": "opus" })
+    var res struct {
+        JobId string `json:"jobId"`
+        Steps []jobs.Step `json:"steps"`
+        Request download.DownloadRequest `json:"request"`
+    }
+    json.Unmarshal(w.Body.Bytes(), &res)
+    expected := download.DownloadRequest{ Title: "Blueming", Artist: "IU", Album: "Love poem", Duration: 3,
+        Options: ffmpeg.Options{ Codec: "opus" } }
+    if w.Code != http.StatusAccepted || res.Request != expected ||
+    fmt.Sprint(res.Steps) != "[Extract Save]" {
+        t.Fatalf("POST /download/upload: expected 202 %+v, got %d %s", expected, w.Code, w.Body.String())
+    }
+    job, err := server.jobs.Get(res.JobId)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if b, _ := os.ReadFile(job.DownloadedFile); string(b) != flac || job.CreatedBy != testAdmin {
+        t.Errorf("Expected the job to convert the uploaded file, got %+v", job)
+    }
+
+    db := server.meloDB
+    db.PostSong(Song{ Title: "Blueming", Artist: "IU", Duration: 3 })
+    w = uploadFile(t, server, "/download/upload", testAdmin, "blueming.flac", flac, nil)
+    if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), `"reason":"similar"`) {
+        t.Errorf("POST /download/upload of a song in the library: expected 409, got %d %s",
+            w.Code, w.Body.String())
+    }
+    w = uploadFile(t, server, "/download/upload?force=true", testAdmin, "blueming.flac", flac, nil)
+    if w.Code != http.StatusAccepted {
+        t.Errorf("POST /download/upload?force=true: expected 202, got %d %s", w.Code, w.Body.String())
+    }
+    if n := countUploads(); n != 2 {
+        t.Errorf("Expected the two queued uploads to be kept, found %d", n)
+    }
+}
+
+func TestSniffAudio(t *testing.T) {
+    tests := map[string]string{
+        "ID3\x04\x00": ".mp3",
+        "\xFF\xFB\x90\x00": ".mp3",
+        "\xFF\xF1\x50\x80": ".aac",
+        "fLaC\x00\x00\x00\x22": ".flac",
+        "OggS\x00\x02": ".ogg",
+        "RIFF\x24\x08\x00\x00WAVEfmt ": ".wav",
+        "FORM\x00\x00\x00\x00AIFF": ".aiff",
+        "\x00\x00\x00\x20ftypM4A ": ".m4a",
+        "\x1A\x45\xDF\xA3\x01": ".webm",
+        "<!DOCTYPE html>": "",
+        "RIFF\x24\x08\x00\x00AVI ": "",
+        "": "",
+    }
+    for head, ext := range tests {
+        if got := sniffAudio([]byte(head)); got != ext {
+            t.Errorf("sniffAudio(%q): expected %q, got %q", head, ext, got)
+        }
+    }
+}
+
+func TestDownloadDuplicates(t *testing.T) {
+    server, db := newTestServer(t)
+    songId := postTestSong(t, db, "Sand In My Boots", "Morgan Wallen")
+
+    tests := []struct{ name, body, reason string }{
+        { "the same video", `{"title":"Other","source":"dQw4w9WgXcQ"}`, "source" },
+        { "the same video's URL",
+            `{"title":"Other","source":"https://www.youtube.com/watch?v=dQw4w9WgXcQ&list=PL1"}`, "source" },
+        { "a similar song", `{"title":"Sand in My Boots (Official Audio)","artist":"Morgan Wallen",
+            "source":"aaaaaaaaaaa","duration":181}`, "similar" },
+    }
+    for _,test := range tests {
+        w := doRequest(t, server, "POST", "/download/song", testAdmin, test.body)
+        var dup duplicate
+        if err := json.Unmarshal(w.Body.Bytes(), &dup); err != nil || w.Code != http.StatusConflict ||
+        dup.Reason != test.reason || dup.Song == nil || dup.Song.Id != songId {
+            t.Errorf("POST /download/song with %s: expected 409 with the song, got %d %s",
+                test.name, w.Code, w.Body.String())
+        }
+    }
+    // songs that were downloaded before the videos' ids were prefixed
+    legacy, _ := db.PostSong(Song{ Title: "Legacy", AudioURL: "/song/legacy.mp3", Source: "eeeeeeeeeee" })
+    w := doRequest(t, server, "POST", "/download/song", testAdmin,
+        `{"title":"Other","source":"https://youtu.be/eeeeeeeeeee"}`)
+    var legacyDup duplicate
+    if err := json.Unmarshal(w.Body.Bytes(), &legacyDup); err != nil || w.Code != http.StatusConflict ||
+    legacyDup.Reason != "source" || legacyDup.Song == nil || legacyDup.Song.Id != legacy.Hex() {
+        t.Errorf("POST /download/song of an unprefixed source: expected 409 with the song, got %d %s",
+            w.Code, w.Body.String())
+    }
+    w = doRequest(t, server, "POST", "/download/song", testAdmin,
+        `{"title":"Sand In My Boots","artist":"Morgan Wallen","source":"bbbbbbbbbbb","duration":240}`)
+    if w.Code != http.StatusAccepted {
+        t.Errorf("POST /download/song with a longer version: expected 202, got %d %s", w.Code, w.Body.String())
+    }
+    queued, _ := db.ListJobs(jobs.Queued)
+    w = doRequest(t, server, "POST", "/download/song", testAdmin,
+        `{"title":"Other","source":"https://youtu.be/bbbbbbbbbbb"}`)
+    var dup duplicate
+    if err := json.Unmarshal(w.Body.Bytes(), &dup); err != nil || w.Code != http.StatusConflict ||
+    dup.Reason != "queued" || dup.Job == nil || len(queued) != 1 || dup.Job.Id != queued[0].Id {
+        t.Errorf("POST /download/song while it is queued: expected 409 with the job, got %d %s",
+            w.Code, w.Body.String())
+    }
+    w = doRequest(t, server, "POST", "/download/song?force=true", testAdmin,
+        `{"title":"Other","source":"dQw4w9WgXcQ"}`)
+    if w.Code != http.StatusAccepted {
+        t.Errorf("POST /download/song?force=true: expected 202, got %d %s", w.Code, w.Body.String())
+    }
+
+    body := `{"entries":[{"title":"New","source":"ccccccccccc"},{"title":"Old","source":"dQw4w9WgXcQ"}]}`
+    w = doRequest(t, server, "POST", "/download/playlist", testAdmin, body)
+    var res struct{ Duplicates []playlistDuplicate `json:"duplicates"` }
+    if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || w.Code != http.StatusConflict ||
+    len(res.Duplicates) != 1 || res.Duplicates[0].Entry != 1 || res.Duplicates[0].Reason != "source" ||
+    res.Duplicates[0].Song == nil || res.Duplicates[0].Song.Id != songId {
+        t.Errorf("POST /download/playlist with a duplicate: expected 409 with the entry, got %d %s",
+            w.Code, w.Body.String())
+    }
+    queued, _ = db.ListJobs(jobs.Queued)
+    if len(queued) != 2 {
+        t.Errorf("POST /download/playlist with a duplicate: expected nothing to be queued, got %+v", queued)
+    }
+    w = doRequest(t, server, "POST", "/download/playlist?force=true", testAdmin, body)
+    if w.Code != http.StatusAccepted {
+        t.Errorf("POST /download/playlist?force=true: expected 202, got %d %s", w.Code, w.Body.String())
+    }
+}
+
+// A minute long fingerprint, 646 random values,, the same for the same seed
+func testFingerprint(seed uint32) fingerprint.Fingerprint {
+    fp := make(fingerprint.Fingerprint, 646)
+    for i := range fp {
+        // xorshift
+        seed ^= seed << 13
+        seed ^= seed >> 17
+        seed ^= seed << 5
+        fp[i] = seed
+    }
+    return fp
+}
+
+func TestDuplicateRecordings(t *testing.T) {
+    server, db := newTestServer(t)
+    boots := postTestSong(t, db, "Sand In My Boots", "Morgan Wallen")
+    renamed := postTestSong(t, db, "Boots (Lyrics)", "morganwallenfan")
+    iu := postTestSong(t, db, "You & I", "IU")
+    postTestSong(t, db, "Good Day", "IU")
+
+    fp := testFingerprint(1)
+    // a re-encoding flips a few bits
+    reencoded := append(fingerprint.Fingerprint{}, fp...)
+    for i := range reencoded {
+        reencoded[i] ^= 1 << (i % 32)
+    }
+    db.PutFingerprint(boots, fp)
+    db.PutFingerprint(renamed, reencoded)
+    db.PutFingerprint(iu, testFingerprint(2))
+
+    w := doRequest(t, server, "GET", "/download/duplicates", testUser, "")
+    if w.Code != http.StatusForbidden {
+        t.Errorf("GET /download/duplicates as a user: expected 403, got %d", w.Code)
+    }
+    w = doRequest(t, server, "GET", "/download/duplicates", testAdmin, "")
+    var report duplicateReport
+    if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil || w.Code != http.StatusOK {
+        t.Fatalf("GET /download/duplicates: expected the report, got %d %s", w.Code, w.Body.String())
+    }
+    if len(report.Groups) != 1 || len(report.Groups[0].Songs) != 2 || report.Unfingerprinted != 1 ||
+    report.Groups[0].Similarity < 0.9 || report.Groups[0].Similarity >= 1 {
+        t.Fatalf("GET /download/duplicates: expected the two Boots in a group, got %+v", report)
+    }
+    ids := []string{ report.Groups[0].Songs[0].Id, report.Groups[0].Songs[1].Id }
+    if !(ids[0] == boots && ids[1] == renamed || ids[0] == renamed && ids[1] == boots) {
+        t.Errorf("GET /download/duplicates: expected songs %s and %s, got %v", boots, renamed, ids)
+    }
+
+    findSimilarSongs := createFindSimilarSongsFunc(db)
+    similar, err := findSimilarSongs(download.Song{ Fingerprint: fp })
+    if err != nil || len(similar) != 2 || similar[0].Id != boots || similar[0].Similarity != 1 ||
+    similar[1].Id != renamed || similar[1].Title != "Boots (Lyrics)" {
+        t.Errorf("findSimilarSongs: expected both Boots, most similar first, got %+v %v", similar, err)
+    }
+    similar, err = findSimilarSongs(download.Song{ Fingerprint: testFingerprint(3) })
+    if err != nil || len(similar) != 0 {
+        t.Errorf("findSimilarSongs of another song: expected none, got %+v %v", similar, err)
+    }
+}
+
+func TestPlaylistImport(t *testing.T) {
+    server, db := newTestServer(t)
+
+    w := doRequest(t, server, "GET", "/download/playlist?url=x", testUser, "")
+    if w.Code != http.StatusForbidden {
+        t.Errorf("GET /download/playlist as a user: expected 403, got %d", w.Code)
+    }
+    w = doRequest(t, server, "GET", "/download/playlist", testAdmin, "")
+    if w.Code != http.StatusBadRequest {
+        t.Errorf("GET /download/playlist without a url: expected 400, got %d", w.Code)
+    }
+    w = doRequest(t, server, "GET", "/download/chapters", testAdmin, "")
+    if w.Code != http.StatusBadRequest {
+        t.Errorf("GET /download/chapters without a url: expected 400, got %d", w.Code)
+    }
+    w = doRequest(t, server, "GET", "/download/spotify/playlist", testAdmin, "")
+    if w.Code != http.StatusBadRequest {
+        t.Errorf("GET /download/spotify/playlist without a url: expected 400, got %d", w.Code)
+    }
+    w = doRequest(t, server, "GET", "/download/spotify/playlist?url=" +
+        url.QueryEscape("https://open.spotify.com/track/abc"), testAdmin, "")
+    if w.Code != http.StatusBadRequest {
+        t.Errorf("GET /download/spotify/playlist with a track link: expected 400, got %d", w.Code)
+    }
+    w = doRequest(t, server, "POST", "/download/playlist", testAdmin, `{"entries":[]}`)
+    if w.Code != http.StatusBadRequest {
+        t.Errorf("POST /download/playlist without entries: expected 400, got %d", w.Code)
+    }
+    w = doRequest(t, server, "POST", "/download/playlist", testAdmin,
+        `{"entries":[{"title":"A","source":"a"},{"source":"b"}]}`)
+    if w.Code != http.StatusBadRequest {
+        t.Errorf("POST /download/playlist with an untitled entry: expected 400, got %d", w.Code)
+    }
+
+    // no worker is running so the jobs stay queued
+    w = doRequest(t, server, "POST", "/download/playlist", testAdmin, `{
+        "entries": [{"title":"A","source":"a"},{"title":"B","source":"b","codec":"opus"}],
+        "playlist": {"title":"Imported"}
+    }`)
+    var res playlistImportResponse
+    if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || w.Code != http.StatusAccepted ||
+    res.Group == "" || res.PlaylistId == "" || len(res.JobIds) != 2 || len(res.Steps) != 3 {
+        t.Fatalf("POST /download/playlist: expected 202 with the group's jobs, got %d %s",
+            w.Code, w.Body.String())
+    }
+    if loc := w.Header().Get("Location"); loc != "/download/jobs?group=" + res.Group {
+        t.Errorf("POST /download/playlist: expected the group's location, got %s", loc)
+    }
+    playlist, err := db.GetPlaylist(res.PlaylistId)
+    if err != nil || playlist.Title != "Imported" || playlist.Owner != testAdmin || len(playlist.Songs) != 0 {
+        t.Errorf("POST /download/playlist: expected an empty playlist, got %+v, %v", playlist, err)
+    }
+    w = doRequest(t, server, "GET", "/download/jobs?group=" + res.Group, testAdmin, "")
+    var list []jobs.Job
+    if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list) != 2 ||
+    list[0].Id != res.JobIds[0] || list[1].Request.Title != "B" || list[1].Request.Codec != "opus" ||
+    list[0].Request.Codec != "mp3" {
+        t.Errorf("GET /download/jobs?group=: expected the group's jobs in order, got %s", w.Body.String())
+    }
+
+    // once the last job finishes the downloaded songs are added to the playlist
+    songId := postTestSong(t, db, "A", "Artist")
+    first, _ := db.GetJob(res.JobIds[0])
+    first.State = jobs.Done
+    first.SongId = songId
+    db.UpdateJob(first)
+    w = doRequest(t, server, "GET", "/download/jobs?group=" + res.Group + "&state=queued", testAdmin, "")
+    list = nil
+    if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list) != 1 ||
+    list[0].Id != res.JobIds[1] {
+        t.Errorf("GET /download/jobs?group=&state=: expected the group's queued job, got %s", w.Body.String())
+    }
+    w = doRequest(t, server, "DELETE", "/download/jobs/" + res.JobIds[1], testAdmin, "")
+    if w.Code != http.StatusOK {
+        t.Errorf("DELETE the group's last job: expected 200, got %d", w.Code)
+    }
+    playlist, err = db.GetPlaylist(res.PlaylistId)
+    if err != nil || len(playlist.Songs) != 1 || playlist.Songs[0].Id != songId {
+        t.Errorf("Expected the downloaded song to be added to the playlist, got %+v, %v", playlist, err)
+    }
+
+    // the tracks of a full album video are not duplicates of each other, the
+    // later ones wait for the first to download the video
+    w = doRequest(t, server, "POST", "/download/playlist", testAdmin, `{"entries": [
+        {"title":"One","source":"album","start":0,"end":200,"track":1},
+        {"title":"Two","source":"album","start":200,"end":400,"track":2}
+    ]}`)
+    res = playlistImportResponse{}
+    if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || w.Code != http.StatusAccepted ||
+    len(res.JobIds) != 2 {
+        t.Fatalf("POST /download/playlist with tracks: expected 202, got %d %s", w.Code, w.Body.String())
+    }
+    second, _ := db.GetJob(res.JobIds[1])
+    if second.State != jobs.Waiting || second.WaitingFor != res.JobIds[0] ||
+    second.Request.Start != 200 || second.Request.Track != 2 {
+        t.Errorf("Expected the second track to wait for the first, got %+v", second)
+    }
+    w = doRequest(t, server, "POST", "/download/playlist", testAdmin,
+        `{"entries":[{"title":"One","source":"album","start":200,"end":100}]}`)
+    if w.Code != http.StatusBadRequest {
+        t.Errorf("POST /download/playlist with an empty section: expected 400, got %d", w.Code)
+    }
+}
+
+func TestSaveSongIsIdempotent(t *testing.T) {
+    _, db := newTestServer(t)
+    created := 0
+    saveSong := createSaveSongFunc(db, func(Song) { created++ })
+    job := jobs.Job{ CreatedBy: testAdmin, Song: &download.Song{
+        Title: "Good Day", Artist: "IU", AudioUrl: "/song/topicGoodDy.mp3", Track: 2 } }
+    first, err := saveSong(job)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // the job is saved again as if it was resumed before recording the song
+    second, err := saveSong(job)
+    if err != nil || second != first {
+        t.Errorf("Expected the song to be found again, got %s, %v", second, err)
+    }
+    songs, _ := db.SearchForSong("Good Day")
+    if len(songs) != 1 || songs[0].Track != 2 || songs[0].AddedBy != testAdmin || created != 2 {
+        t.Errorf("Expected a single song, got %+v", songs)
+    }
+}
+
+func TestJobEvents(t *testing.T) {
+    server, db := newTestServer(t)
+    now := time.Now()
+    done, _ := db.CreateJob(jobs.Job{
+        CreatedAt: now, State: jobs.Done, Step: jobs.StepSave, Progress: 100,
+        SongId: "song-id", Warnings: []string{ "Failed to tag the song" },
+    })
+    target := "/download/jobs/" + done + "/events"
+    w := doRequest(t, server, "GET", target, testAdmin, "")
+    expected := "event: step-start\ndata: {\"step\":\"Save\"}\n\n" +
+        "event: warning\nid: 1\ndata: {\"message\":\"Failed to tag the song\"}\n\n" +
+        "event: done\ndata: {\"songId\":\"song-id\"}\n\n"
+    if w.Code != http.StatusOK || w.Body.String() != expected {
+        t.Errorf("GET %s: expected\n%s\ngot %d\n%s", target, expected, w.Code, w.Body.String())
+    }
+    if ct := w.Header().Get("Content-Type"); ct != "text/event-stream" {
+        t.Errorf("GET %s: expected Content-Type text/event-stream, got %s", target, ct)
+    }
+    // a client that reconnects is not sent the warnings that it already has
+    req := httptest.NewRequest("GET", target, nil)
+    req.Header.Set("Authorization", signToken(t, testAdmin))
+    req.Header.Set("Last-Event-ID", "1")
+    w = httptest.NewRecorder()
+    server.router.ServeHTTP(w, req)
+    if strings.Contains(w.Body.String(), "event: warning") {
+        t.Errorf("GET %s after the first warning: expected no warnings, got\n%s", target, w.Body.String())
+    }
+
+    // the stream of a running job ends once the job has been cancelled
+    queued, _ := server.jobs.Enqueue(download.DownloadRequest{ Title: "Test", Source: "x" }, testAdmin)
+    go func() {
+        time.Sleep(50 * time.Millisecond)
+        server.jobs.Cancel(queued.Id)
+    }()
+    target = "/download/jobs/" + queued.Id + "/events"
+    w = doRequest(t, server, "GET", target, testAdmin, "")
+    if !strings.HasSuffix(w.Body.String(), "event: error\ndata: " +
+    "{\"state\":\"cancelled\",\"message\":\"The download was cancelled\"}\n\n") {
+        t.Errorf("GET %s: expected the stream to end with the cancellation, got\n%s",
+            target, w.Body.String())
+    }
+
+    w = doRequest(t, server, "GET", "/download/jobs/" + primitive.NewObjectID().Hex() + "/events",
+        testAdmin, "")
+    if w.Code != http.StatusNotFound {
+        t.Errorf("GET the events of an unknown job: expected 404, got %d", w.Code)
+    }
+}
+
+func TestAcceptsMediaType(t *testing.T) {
+    tests := []struct{ accept string; accepted bool }{
+        { "", true },
+        { "*/*", true },
+        { "audio/*", true },
+        { "text/html", false },
+        { "text/html, audio/*;q=0", false },
+        { "audio/*, audio/mpeg;q=0", false },
+        { "audio/mpeg;q=0, audio/*", false },
+        { "audio/*;q=0, audio/mpeg;q=0.5", true },
+        { "*/*;q=0.1, audio/*;q=0", false },
+        { "audio/mpeg;q=abc", false },
+    }
+    for _,test := range tests {
+        if got := acceptsMediaType(test.accept, "audio/mpeg"); got != test.accepted {
+            t.Errorf("acceptsMediaType(%q, audio/mpeg): expected %v, got %v", test.accept, test.accepted, got)
+        }
+    }
+}
+
+func TestStreamSong(t *testing.T) {
+    server, db := newTestServer(t)
+    if err := os.MkdirAll(songDirectory, 0755); err != nil {
+        t.Fatal(err)
+    }
+    f, err := os.CreateTemp(songDirectory, "test-*.mp3")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.Remove(f.Name())
+    content := "ID3 not really an mp3"
+    f.WriteString(content)
+    f.Close()
+
+    songId, _ := db.PostSong(Song{Title: "Test", AudioURL: "/song/" + filepath.Base(f.Name())})
+    target := "/song/" + songId.Hex()
+    w := doRequest(t, server, "GET", target, testUser, "")
+    if w.Code != http.StatusOK || w.Body.String() != content {
+        t.Fatalf("GET %s: expected the file contents, got %d %s", target, w.Code, w.Body.String())
+    }
+    if ct := w.Header().Get("Content-Type"); ct != "audio/mpeg" {
+        t.Errorf("GET %s: expected Content-Type audio/mpeg, got %s", target, ct)
+    }
+    etag := w.Header().Get("ETag")
+
+    req := httptest.NewRequest("GET", target, nil)
+    req.Header.Set("Authorization", signToken(t, testUser))
+    req.Header.Set("Range", "bytes=4-")
+    w = httptest.NewRecorder()
+    server.router.ServeHTTP(w, req)
+    if w.Code != http.StatusPartialContent || w.Body.String() != content[4:] {
+        t.Errorf("GET %s with a Range: expected 206 %q, got %d %q",
+            target, content[4:], w.Code, w.Body.String())
+    }
+
+    req = httptest.NewRequest("GET", target, nil)
+    req.Header.Set("Authorization", signToken(t, testUser))
+    req.Header.Set("If-None-Match", etag)
+    w = httptest.NewRecorder()
+    server.router.ServeHTTP(w, req)
+    if w.Code != http.StatusNotModified {
+        t.Errorf("GET %s with a matching ETag: expected 304, got %d", target, w.Code)
+    }
+
+    req = httptest.NewRequest("GET", target, nil)
+    req.Header.Set("Authorization", signToken(t, testUser))
+    req.Header.Set("Accept", "text/html, audio/*;q=0")
+    w = httptest.NewRecorder()
+    server.router.ServeHTTP(w, req)
+    if w.Code != http.StatusNotAcceptable {
+        t.Errorf("GET %s accepting only html: expected 406, got %d", target, w.Code)
+    }
+
+    req = httptest.NewRequest("GET", target, nil)
+    req.Header.Set("Authorization", signToken(t, testUser))
+    req.Header.Set("Accept", "audio/*, audio/mpeg;q=0")
+    w = httptest.NewRecorder()
+    server.router.ServeHTTP(w, req)
+    if w.Code != http.StatusNotAcceptable {
+        t.Errorf("GET %s refusing audio/mpeg: expected 406, got %d", target, w.Code)
+    }
+
+    // a conversion that is already in the cache can be served without ffmpeg
+    info, _ := os.Stat(f.Name())
+    opts := ffmpeg.Options{Codec: "aac", Bitrate: "96k"}
+    cw, err := server.transcodes.Create(transcodeCacheKey(Song{Id: songId.Hex()}, info, opts))
+    if err != nil {
+        t.Fatal(err)
+    }
+    cw.WriteString("not really aac")
+    cw.Commit()
+    req = httptest.NewRequest("GET", target + "?format=aac&bitrate=96k", nil)
+    req.Header.Set("Authorization", signToken(t, testUser))
+    req.Header.Set("Range", "bytes=11-")
+    w = httptest.NewRecorder()
+    server.router.ServeHTTP(w, req)
+    if w.Code != http.StatusPartialContent || w.Body.String() != "aac" ||
+    w.Header().Get("Content-Type") != "audio/aac" {
+        t.Errorf("GET %s?format=aac&bitrate=96k: expected 206 \"aac\", got %d %q %s",
+            target, w.Code, w.Body.String(), w.Header().Get("Content-Type"))
+    }
+
+    escapeId, _ := db.PostSong(Song{Title: "Escape", AudioURL: "/song/../index.html"})
+    statusTests := map[string]int{
+        "/song/" + escapeId.Hex(): http.StatusNotFound,
+        "/song/" + primitive.NewObjectID().Hex(): http.StatusNotFound,
+        "/song/test.mp3": http.StatusBadRequest,
+        target + "?format=wav": http.StatusBadRequest,
+        target + "?format=mp3&bitrate=lots": http.StatusBadRequest,
+    }
+    for target, status := range statusTests {
+        w = doRequest(t, server, "GET", target, testUser, "")
+        if w.Code != status {
+            t.Errorf("GET %s: expected %d, got %d", target, status, w.Code)
+        }
+    }
+}
+
+func TestHLS(t *testing.T) {
+    server, db := newTestServer(t)
+    if err := os.MkdirAll(songDirectory, 0755); err != nil {
+        t.Fatal(err)
+    }
+    audioFile := filepath.Join(songDirectory, "hls-test.mp3")
+    if err := os.WriteFile(audioFile, []byte("ID3 not really an mp3"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    defer os.Remove(audioFile)
+    song := Song{Title: "Test", AudioURL: "/song/hls-test.mp3"}
+    songId, _ := db.PostSong(song)
+    id := songId.Hex()
+    song.Id = id
+
+    // pretend that the song has already been segmented so ffmpeg is not needed
+    dir, err := server.hls.songDir(song)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(filepath.Join(hlsDirectory, id))
+    if err := os.MkdirAll(filepath.Join(dir, "96k"), 0755); err != nil {
+        t.Fatal(err)
+    }
+    files := map[string]string{
+        "master.m3u8": "#EXTM3U\n",
+        "96k/index.m3u8": "#EXTM3U\nsegment_000.ts\n",
+        "96k/segment_000.ts": "not really a segment",
+    }
+    for name, content := range files {
+        if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    for name, content := range files {
+        target := "/song/" + id + "/" + name
+        w := doRequest(t, server, "GET", target, testUser, "")
+        if w.Code != http.StatusOK || w.Body.String() != content {
+            t.Errorf("GET %s: expected %q, got %d %q", target, content, w.Code, w.Body.String())
+        }
+    }
+    w := doRequest(t, server, "GET", "/song/" + id + "/master.m3u8", testUser, "")
+    if ct := w.Header().Get("Content-Type"); ct != "application/vnd.apple.mpegurl" {
+        t.Errorf("GET master.m3u8: unexpected Content-Type %s", ct)
+    }
+
+    statusTests := map[string]int{
+        "/song/" + id + "/master.m3u8": http.StatusUnauthorized,
+        "/song/" + id + "/1000k/index.m3u8": http.StatusNotFound,
+        "/song/" + id + "/96k/secrets.txt": http.StatusNotFound,
+        "/song/" + primitive.NewObjectID().Hex() + "/master.m3u8": http.StatusNotFound,
+    }
+    for target, status := range statusTests {
+        email := testUser
+        if status == http.StatusUnauthorized {
+            email = ""
+        }
+        w = doRequest(t, server, "GET", target, email, "")
+        if w.Code != status {
+            t.Errorf("GET %s: expected %d, got %d", target, status, w.Code)
+        }
+    }
+
+    // once the song's file is replaced its old renditions are not served
+    later := time.Now().Add(time.Hour)
+    if err := os.Chtimes(audioFile, later, later); err != nil {
+        t.Fatal(err)
+    }
+    if newDir, err := server.hls.songDir(song); err != nil || newDir == dir {
+        t.Errorf("Expected a new directory for the replaced file, got %s, %v", newDir, err)
+    }
+}
+
+// Gives the scan lock to another scan once the scan tries to renew it
+type lockStealer struct {
+    MeloDatabase
+    locked bool
+    stolen chan struct{}
+}
+
+func (db *lockStealer) TryLock(name, holder string, expires time.Time) (bool,error) {
+    if !db.locked {
+        db.locked = true
+        return db.MeloDatabase.TryLock(name, holder, expires)
+    }
+    close(db.stolen)
+    return false, nil
+}
+
+// holds the scan until its lock is stolen
+func (db *lockStealer) GetLibraryFiles() ([]LibraryFile,error) {
+    select {
+    case <-db.stolen:
+    case <-time.After(5 * time.Second):
+    }
+    return db.MeloDatabase.GetLibraryFiles()
+}
+
+func TestScanLibrary(t *testing.T) {
+    // the library files are probed with the fake ffprobe
+    paths, err := fakebin.Build(t.TempDir())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer func(path string) { ffmpeg.FFprobePath = path }(ffmpeg.FFprobePath)
+    ffmpeg.FFprobePath = paths.FFprobe
+
+    dir := filepath.Join(t.TempDir(), "music")
+    write := func(name, content string, modTime time.Time) string {
+        path := filepath.Join(dir, filepath.FromSlash(name))
+        if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+            t.Fatal(err)
+        }
+        if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+            t.Fatal(err)
+        }
+        if err := os.Chtimes(path, modTime, modTime); err != nil {
+            t.Fatal(err)
+        }
+        return path
+    }
+    start := time.Now().Add(-time.Hour)
+    blueming := write("IU/blueming.flac", "fLaC\nTITLE=Blueming\nARTIST=IU\nALBUM=Love poem\n", start)
+    goodDay := write("good day.mp3", "ID3 no tags", start)
+    write("cover.jpg", "not audio", start)
+    write(".trash/deleted.mp3", "ID3\nTITLE=Deleted\n", start)
+    write("broken.ogg", "OggS corrupt", start)
+
+    config := newTestConfig(t)
+    config.Library.Directories = []string{ dir }
+    config.Library.ScanIntervalMinutes = -1
+    server, err := NewMeloServer(config)
+    if err != nil {
+        t.Fatal(err)
+    }
+    db := server.meloDB
+    scan := func(name string, want ScanReport) {
+        t.Helper()
+        report, err := scanLibrary(context.Background(), db, config.Library.Directories)
+        if err != nil {
+            t.Fatalf("%s: %v", name, err)
+        }
+        errs := len(report.Errors)
+        report.Errors = nil
+        if !reflect.DeepEqual(report, want) || errs != 1 {
+            t.Errorf("%s: expected %+v and 1 error, got %+v and %d errors", name, want, report, errs)
+        }
+    }
+    songOf := func(path string) Song {
+        t.Helper()
+        files, _ := db.GetLibraryFiles()
+        for _,file := range files {
+            if file.Path == path {
+                song, err := db.GetSong(file.SongId)
+                if err != nil {
+                    t.Fatalf("GetSong of %s: %v", path, err)
+                }
+                return song
+            }
+        }
+        t.Fatalf("GetLibraryFiles: %s is missing from %+v", path, files)
+        return Song{}
+    }
+
+    // the broken file is an error every time
+    scan("The first scan", ScanReport{ Added: 2 })
+    song := songOf(blueming)
+    if song.Title != "Blueming" || song.Artist != "IU" || song.Album != "Love poem" ||
+    song.Codec != "flac" || song.Duration != 3 || song.AudioURL != "file://" + filepath.ToSlash(blueming) {
+        t.Errorf("The first scan: unexpected song %+v", song)
+    }
+    bluemingId := song.Id
+    if song := songOf(goodDay); song.Title != "good day" || song.Codec != "mp3" {
+        t.Errorf("The first scan: expected the title to be the file's name, got %+v", song)
+    }
+    scan("Scanning again", ScanReport{ Unchanged: 2 })
+
+    // a scan in another process, ex. `melo scan`, keeps this one from running
+    db.TryLock(libraryScanLock, "melo scan", time.Now().Add(time.Minute))
+    if _, err := scanLibrary(context.Background(), db, config.Library.Directories); err != ErrScanRunning {
+        t.Errorf("Expected ErrScanRunning while another scan holds the lock, got %v", err)
+    }
+    db.Unlock(libraryScanLock, "melo scan")
+
+    // a scan that loses its lock stops, the other scan has it now
+    defer func(ttl time.Duration) { libraryScanLockTTL = ttl }(libraryScanLockTTL)
+    libraryScanLockTTL = 30 * time.Millisecond
+    stealer := lockStealer{ MeloDatabase: db, stolen: make(chan struct{}) }
+    if _, err := scanLibrary(context.Background(), &stealer, config.Library.Directories); err != ErrScanRunning {
+        t.Errorf("Expected ErrScanRunning after the lock was lost, got %v", err)
+    }
+
+    target := "/song/" + bluemingId
+    w := doRequest(t, server, "GET", target, testUser, "")
+    if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "TITLE=Blueming") {
+        t.Errorf("GET %s: expected the library file, got %d %s", target, w.Code, w.Body.String())
+    }
+    outside, _ := db.PostSong(Song{ Title: "Outside", AudioURL: "file://" + filepath.ToSlash(paths.FFprobe) })
+    w = doRequest(t, server, "GET", "/song/" + outside.Hex(), testUser, "")
+    if w.Code != http.StatusNotFound {
+        t.Errorf("GET a song outside of the library directories: expected 404, got %d", w.Code)
+    }
+
+    goodDayId, _ := primitive.ObjectIDFromHex(songOf(goodDay).Id)
+    bluemingOID, _ := primitive.ObjectIDFromHex(bluemingId)
+    plid, _ := db.PostPlaylist(NormalizedPlaylist{ Title: "Mix", Owner: testUser,
+        Songs: []primitive.ObjectID{ goodDayId, bluemingOID }})
+    // a retagged file and a moved one
+    write("good day.mp3", "ID3\nTITLE=Good Day\nARTIST=IU\n", start.Add(time.Minute))
+    moved := filepath.Join(dir, "Love poem", "blueming.flac")
+    os.MkdirAll(filepath.Dir(moved), 0755)
+    if err := os.Rename(blueming, moved); err != nil {
+        t.Fatal(err)
+    }
+    scan("Scanning after changes", ScanReport{ Updated: 1, Moved: 1 })
+    if song := songOf(goodDay); song.Title != "Good Day" || song.Artist != "IU" {
+        t.Errorf("Scanning after changes: expected the new tags, got %+v", song)
+    }
+    if song := songOf(moved); song.Id != bluemingId || song.AudioURL != "file://" + filepath.ToSlash(moved) {
+        t.Errorf("Scanning after changes: expected song %s to play the moved file, got %+v", bluemingId, song)
+    }
+    if playlist, _ := db.GetPlaylist(plid.Hex()); len(playlist.Songs) != 2 {
+        t.Errorf("Scanning after changes: expected the playlist to keep both songs, got %+v", playlist.Songs)
+    }
+
+    // an unmounted share removes nothing
+    away := dir + ".away"
+    if err := os.Rename(dir, away); err != nil {
+        t.Fatal(err)
+    }
+    scan("Scanning a missing directory", ScanReport{})
+    if err := os.Rename(away, dir); err != nil {
+        t.Fatal(err)
+    }
+
+    os.Remove(goodDay)
+    scan("Scanning after a delete", ScanReport{ Removed: 1, Unchanged: 1 })
+    if _, err := db.GetSong(goodDayId.Hex()); !errors.Is(err, ErrNotFound) {
+        t.Errorf("Scanning after a delete: expected the song to be removed, got %v", err)
+    }
+    if playlist, _ := db.GetPlaylist(plid.Hex()); len(playlist.Songs) != 1 {
+        t.Errorf("Scanning after a delete: expected the playlist to lose the song, got %+v", playlist.Songs)
+    }
+}
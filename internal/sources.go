@@ -0,0 +1,47 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/TSchreiber/melo/internal/download"
+)
+
+/* Looks up the title, artist, album and artwork of ?source=, a video id, URL
+ * or path, with the download source that handles it. The admin corrects them
+ * before posting the request to /download/song. */
+func createResolveSourceHandler() http.HandlerFunc {
+    return http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+        source := r.URL.Query().Get("source")
+        if source == "" {
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprintf(w, "Query string parameter, \"source\" is required")
+            return
+        }
+        req, err := download.Resolve(r.Context(), source)
+        if errors.Is(err, download.ErrNoSource) || download.Classify(err) == download.Permanent {
+            // nothing can be downloaded from the source
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprintf(w, "400 - %v", err)
+            return
+        }
+        if err != nil {
+            log.Printf("\"GET /download/resolve\": %v\n", err)
+            w.WriteHeader(http.StatusBadGateway)
+            return
+        }
+        b, _ := json.Marshal(req)
+        w.Header().Set("Content-Type", "application/json")
+        w.Write(b)
+    })
+}
+
+// Lists the names of the enabled download sources, ex. ["http", "youtube"]
+func listSourcesHandler(w http.ResponseWriter, r *http.Request) {
+    b, _ := json.Marshal(download.EnabledSources())
+    w.Header().Set("Content-Type", "application/json")
+    w.Write(b)
+}
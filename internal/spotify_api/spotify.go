@@ -2,6 +2,7 @@ package spotify
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -10,6 +11,12 @@ import (
 	"time"
 )
 
+// The Spotify accounts service and Web API, replaced in tests
+var (
+    AccountsURL = "https://accounts.spotify.com"
+    BaseURL = "https://api.spotify.com/v1"
+)
+
 type AuthToken struct {
     Token string `json:"token"`
     Type string `json:"type"`
@@ -30,7 +37,7 @@ func FetchAuthToken() (AuthToken,error){
     data.Set("grant_type","client_credentials")
     data.Set("client_id",clientId)
     data.Set("client_secret",clientSecret)
-    req,err := http.NewRequest("POST", "https://accounts.spotify.com/api/token", strings.NewReader(data.Encode()))
+    req,err := http.NewRequest("POST", AccountsURL + "/api/token", strings.NewReader(data.Encode()))
     if err != nil {
         return AuthToken{}, err
     }
@@ -87,7 +94,7 @@ type SpotifyTrack struct {
 }
 
 func Search(token string, searchInput string) ([]SpotifyTrack,error){
-    req,err := http.NewRequest("GET", "https://api.spotify.com/v1/search", nil)
+    req,err := http.NewRequest("GET", BaseURL + "/search", nil)
     if err != nil {
         return []SpotifyTrack{}, err
     }
@@ -120,3 +127,130 @@ func Search(token string, searchInput string) ([]SpotifyTrack,error){
     }
     return searchResults.Tracks.Items, nil
 }
+
+// Returned (wrapped) when Spotify has no playlist or track with the id, which
+// includes private playlists
+var ErrNotFound = errors.New("not found")
+
+type SpotifyPlaylist struct {
+    Id string `json:"id"`
+    Name string `json:"name"`
+    Description string `json:"description"`
+    Images []struct {
+        Url string `json:"url"`
+        Height int `json:"height"`
+        Width int `json:"width"`
+    } `json:"images"`
+    Owner struct {
+        DisplayName string `json:"display_name"`
+    } `json:"owner"`
+    // Every track of the playlist, in order. Local files and podcast
+    // episodes are left out
+    Tracks []SpotifyTrack `json:"-"`
+}
+
+/* Returns the id in a playlist or track link, ex.
+ * https://open.spotify.com/playlist/37i9dQZF1DXcBWIGoYBM5M?si=abc, or URI, ex.
+ * spotify:playlist:37i9dQZF1DXcBWIGoYBM5M. kind is "playlist" or "track". A
+ * bare id is returned as it is. */
+func ParseId(kind string, link string) (string,error) {
+    link = strings.TrimSpace(link)
+    if id,ok := strings.CutPrefix(link, "spotify:" + kind + ":"); ok {
+        link = id
+    } else if u,err := url.Parse(link); err == nil && u.Host != "" {
+        if u.Host != "open.spotify.com" {
+            return "", fmt.Errorf("Not a Spotify link, \"%s\"", link)
+        }
+        // links can have a locale before the kind, ex. /intl-de/playlist/<id>
+        parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+        if len(parts) < 2 || parts[len(parts)-2] != kind {
+            return "", fmt.Errorf("Not a Spotify %s link, \"%s\"", kind, link)
+        }
+        link = parts[len(parts)-1]
+    }
+    if link == "" || strings.Trim(link, "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+        return "", fmt.Errorf("Invalid Spotify %s id, \"%s\"", kind, link)
+    }
+    return link, nil
+}
+
+// Fetches the playlist along with all of its tracks
+func GetPlaylist(token string, playlistId string) (SpotifyPlaylist,error) {
+    var playlist struct {
+        SpotifyPlaylist
+        Tracks spotifyPlaylistTracks `json:"tracks"`
+    }
+    err := get(token, BaseURL + "/playlists/" + url.PathEscape(playlistId), "GET /playlists", &playlist)
+    if err != nil {
+        return SpotifyPlaylist{}, err
+    }
+    out := playlist.SpotifyPlaylist
+    page := playlist.Tracks
+    for {
+        for _,item := range page.Items {
+            if item.Track == nil || item.IsLocal || item.Track.Type != "track" {
+                continue
+            }
+            out.Tracks = append(out.Tracks, item.Track.SpotifyTrack)
+        }
+        if page.Next == "" {
+            return out, nil
+        }
+        next := page.Next
+        page = spotifyPlaylistTracks{}
+        err = get(token, next, "GET /playlists/tracks", &page)
+        if err != nil {
+            return SpotifyPlaylist{}, err
+        }
+    }
+}
+
+// A page of a playlist's tracks
+type spotifyPlaylistTracks struct {
+    Items []struct {
+        IsLocal bool `json:"is_local"`
+        // null for tracks that are no longer available
+        Track *struct {
+            SpotifyTrack
+            // "track" or "episode"
+            Type string `json:"type"`
+        } `json:"track"`
+    } `json:"items"`
+    // The URL of the next page, "" on the last page
+    Next string `json:"next"`
+}
+
+func GetTrack(token string, trackId string) (SpotifyTrack,error) {
+    var track SpotifyTrack
+    err := get(token, BaseURL + "/tracks/" + url.PathEscape(trackId), "GET /tracks", &track)
+    return track, err
+}
+
+// Sends a GET request to the Web API and decodes the response into v
+func get(token string, reqURL string, endpoint string, v interface{}) error {
+    req,err := http.NewRequest("GET", reqURL, nil)
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Authorization",fmt.Sprintf("Bearer %s", token))
+
+    client := &http.Client{}
+    res, err := client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer res.Body.Close()
+    if res.StatusCode == http.StatusNotFound {
+        return fmt.Errorf("Request to the Spotify API \"%s\" endpoint: %w", endpoint, ErrNotFound)
+    }
+    if res.StatusCode != 200 {
+        return fmt.Errorf(
+            "Request to the Spotify API \"%s\" endpoint returned with status code, \"%s\"",
+            endpoint, res.Status)
+    }
+    err = json.NewDecoder(res.Body).Decode(v)
+    if err != nil {
+        return fmt.Errorf("Could not unmarshal response: %w", err)
+    }
+    return nil
+}
@@ -28,3 +28,30 @@ func TestSearch(t *testing.T) {
     t.Log(string(bytes))
 }
 
+
+func TestParseId(t *testing.T) {
+    valid := []string{
+        "https://open.spotify.com/playlist/37i9dQZF1DXcBWIGoYBM5M?si=abc",
+        "https://open.spotify.com/intl-de/playlist/37i9dQZF1DXcBWIGoYBM5M",
+        "spotify:playlist:37i9dQZF1DXcBWIGoYBM5M",
+        "37i9dQZF1DXcBWIGoYBM5M",
+    }
+    for _,link := range valid {
+        id, err := ParseId("playlist", link)
+        if err != nil || id != "37i9dQZF1DXcBWIGoYBM5M" {
+            t.Errorf("%s: expected the playlist id, got %q, %v", link, id, err)
+        }
+    }
+    invalid := []string{
+        "https://open.spotify.com/track/37i9dQZF1DXcBWIGoYBM5M",
+        "https://example.com/playlist/37i9dQZF1DXcBWIGoYBM5M",
+        "spotify:track:37i9dQZF1DXcBWIGoYBM5M",
+        "../me",
+        "",
+    }
+    for _,link := range invalid {
+        if id, err := ParseId("playlist", link); err == nil {
+            t.Errorf("%s: expected an error, got %q", link, id)
+        }
+    }
+}
@@ -0,0 +1,893 @@
+package internal
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/TSchreiber/melo/internal/fingerprint"
+	"github.com/TSchreiber/melo/internal/jobs"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	_ "modernc.org/sqlite"
+)
+
+/* SQLiteDatabase is a MeloDatabase stored in a single SQLite file, for
+ * deployments that do not want to run a MongoDB server. Ids are generated as
+ * ObjectIDs so that they look the same as the ids from MongoDatabase and a
+ * library can be moved between the two. */
+type SQLiteDatabase struct {
+    db *sql.DB
+}
+
+type SQLiteDBConfig struct {
+    // The path to the database file, it is created if it does not exist
+    SQLitePath string
+}
+
+/* The schema migrations, in order. A migration must never be changed once it
+ * has been released, add a new one instead. The number of migrations that have
+ * been applied is stored in the database's user_version. */
+var sqliteMigrations = []string{
+    `CREATE TABLE song (
+        id TEXT PRIMARY KEY,
+        audio_url TEXT NOT NULL DEFAULT '',
+        artwork TEXT NOT NULL DEFAULT '',
+        title TEXT NOT NULL DEFAULT '',
+        artist TEXT NOT NULL DEFAULT '',
+        album TEXT NOT NULL DEFAULT '',
+        duration INTEGER NOT NULL DEFAULT 0,
+        source TEXT NOT NULL DEFAULT '',
+        added_by TEXT NOT NULL DEFAULT ''
+    );
+    CREATE VIRTUAL TABLE song_fts USING fts5(
+        title, artist, album,
+        content='song', content_rowid='rowid'
+    );
+    CREATE TRIGGER song_fts_insert AFTER INSERT ON song BEGIN
+        INSERT INTO song_fts(rowid, title, artist, album)
+        VALUES (new.rowid, new.title, new.artist, new.album);
+    END;
+    CREATE TRIGGER song_fts_delete AFTER DELETE ON song BEGIN
+        INSERT INTO song_fts(song_fts, rowid, title, artist, album)
+        VALUES ('delete', old.rowid, old.title, old.artist, old.album);
+    END;
+    CREATE TRIGGER song_fts_update AFTER UPDATE ON song BEGIN
+        INSERT INTO song_fts(song_fts, rowid, title, artist, album)
+        VALUES ('delete', old.rowid, old.title, old.artist, old.album);
+        INSERT INTO song_fts(rowid, title, artist, album)
+        VALUES (new.rowid, new.title, new.artist, new.album);
+    END;
+    CREATE TABLE playlist (
+        id TEXT PRIMARY KEY,
+        artwork TEXT NOT NULL DEFAULT '',
+        title TEXT NOT NULL DEFAULT '',
+        description TEXT NOT NULL DEFAULT '',
+        owner TEXT NOT NULL DEFAULT ''
+    );
+    CREATE INDEX playlist_owner ON playlist(owner);
+    CREATE TABLE playlist_song (
+        playlist_id TEXT NOT NULL REFERENCES playlist(id) ON DELETE CASCADE,
+        position INTEGER NOT NULL,
+        song_id TEXT NOT NULL,
+        PRIMARY KEY (playlist_id, position)
+    );
+    CREATE TABLE user_permission (
+        email TEXT NOT NULL,
+        permission TEXT NOT NULL,
+        PRIMARY KEY (email, permission)
+    );`,
+    `ALTER TABLE song ADD COLUMN codec TEXT NOT NULL DEFAULT '';
+    ALTER TABLE song ADD COLUMN bitrate INTEGER NOT NULL DEFAULT 0;
+    ALTER TABLE song ADD COLUMN size INTEGER NOT NULL DEFAULT 0;`,
+    `ALTER TABLE song ADD COLUMN gain REAL NOT NULL DEFAULT 0;
+    ALTER TABLE song ADD COLUMN peak REAL NOT NULL DEFAULT 0;`,
+    // jobs are stored as JSON, only the columns that are queried are split out
+    `CREATE TABLE job (
+        id TEXT PRIMARY KEY,
+        state TEXT NOT NULL,
+        created_at INTEGER NOT NULL,
+        data TEXT NOT NULL
+    );
+    CREATE INDEX job_state ON job(state, created_at);`,
+    `CREATE INDEX song_source ON song(source);`,
+    // the little endian values of fingerprint.Fingerprint.Bytes
+    `CREATE TABLE song_fingerprint (
+        song_id TEXT PRIMARY KEY,
+        data BLOB NOT NULL
+    );`,
+    `CREATE TABLE library_file (
+        path TEXT PRIMARY KEY,
+        song_id TEXT NOT NULL,
+        size INTEGER NOT NULL,
+        mod_time INTEGER NOT NULL,
+        hash TEXT NOT NULL
+    );`,
+    `ALTER TABLE song ADD COLUMN track INTEGER NOT NULL DEFAULT 0;`,
+    `CREATE INDEX song_audio_url ON song(audio_url);`,
+    // expires is in Unix nanoseconds
+    `CREATE TABLE db_lock (
+        name TEXT PRIMARY KEY,
+        holder TEXT NOT NULL,
+        expires INTEGER NOT NULL
+    );`,
+}
+
+func NewSQLiteDB(config SQLiteDBConfig) (MeloDatabase, error) {
+    if config.SQLitePath == "" {
+        return nil, errors.New("NewSQLiteDB SQLitePath is required")
+    }
+    dsn := "file:" + config.SQLitePath +
+        "?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+    db, err := sql.Open("sqlite", dsn)
+    if err != nil {
+        return nil, err
+    }
+    // SQLite only allows one writer at a time, sharing a single connection
+    // avoids "database is locked" errors
+    db.SetMaxOpenConns(1)
+    err = migrateSQLite(db)
+    if err != nil {
+        db.Close()
+        return nil, err
+    }
+    return SQLiteDatabase{db}, nil
+}
+
+// Applies the migrations that have not been applied to the database yet
+func migrateSQLite(db *sql.DB) error {
+    var version int
+    err := db.QueryRow("PRAGMA user_version").Scan(&version)
+    if err != nil {
+        return fmt.Errorf("migrateSQLite Failed to read user_version: %v", err)
+    }
+    if version > len(sqliteMigrations) {
+        return fmt.Errorf(
+            "migrateSQLite The database schema (version %d) is newer than this version of Melo (version %d)",
+            version, len(sqliteMigrations))
+    }
+    for ; version < len(sqliteMigrations); version++ {
+        tx, err := db.Begin()
+        if err != nil {
+            return err
+        }
+        _, err = tx.Exec(sqliteMigrations[version])
+        if err == nil {
+            // PRAGMA does not support bound parameters
+            _, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version + 1))
+        }
+        if err != nil {
+            tx.Rollback()
+            return fmt.Errorf("migrateSQLite Migration %d failed: %v", version + 1, err)
+        }
+        err = tx.Commit()
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (db SQLiteDatabase) Disconnect() {
+    if err := db.db.Close(); err != nil {
+        log.Fatal("Failed to close the SQLite database, panicing")
+    }
+}
+
+const sqliteSongColumns =
+    "song.id, song.audio_url, song.artwork, song.title, song.artist, " +
+    "song.album, song.duration, song.source, song.added_by, song.codec, " +
+    "song.bitrate, song.size, song.gain, song.peak, song.track"
+
+type sqliteScanner interface {
+    Scan(dest ...interface{}) error
+}
+
+func scanSQLiteSong(row sqliteScanner) (Song,error) {
+    var s Song
+    err := row.Scan(&s.Id, &s.AudioURL, &s.Artwork, &s.Title, &s.Artist,
+        &s.Album, &s.Duration, &s.Source, &s.AddedBy, &s.Codec, &s.Bitrate, &s.Size,
+        &s.Gain, &s.Peak, &s.Track)
+    return s, err
+}
+
+func querySQLiteSongs(db *sql.DB, query string, args ...interface{}) ([]Song,error) {
+    rows, err := db.Query(query, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    var list []Song
+    for rows.Next() {
+        song, err := scanSQLiteSong(rows)
+        if err != nil {
+            return nil, err
+        }
+        list = append(list, song)
+    }
+    return list, rows.Err()
+}
+
+func (db SQLiteDatabase) GetSong(songId string) (Song,error) {
+    if _,err := primitive.ObjectIDFromHex(songId); err != nil {
+        return Song{}, fmt.Errorf(
+            "SQLiteDatabase.GetSong Invalid ObjectID %s: %w", songId, ErrInvalidId)
+    }
+    row := db.db.QueryRow("SELECT " + sqliteSongColumns + " FROM song WHERE id = ?",
+        songId)
+    song, err := scanSQLiteSong(row)
+    if err == sql.ErrNoRows {
+        return song, fmt.Errorf(
+            "SQLiteDatabase.GetSong Song %s: %w", songId, ErrNotFound)
+    }
+    if err != nil {
+        return song, fmt.Errorf("SQLiteDatabase.GetSong: %v", err)
+    }
+    return song, nil
+}
+
+func (db SQLiteDatabase) UpdateSong(songId string, data Song) error {
+    if _,err := primitive.ObjectIDFromHex(songId); err != nil {
+        return fmt.Errorf(
+            "SQLiteDatabase.UpdateSong Invalid ObjectID %s: %w", songId, ErrInvalidId)
+    }
+    res, err := db.db.Exec(`UPDATE song SET title = ?, artist = ?, album = ?, artwork = ?
+        WHERE id = ?`,
+        data.Title, data.Artist, data.Album, data.Artwork, songId)
+    if err != nil {
+        return fmt.Errorf("SQLiteDatabase.UpdateSong: %v", err)
+    }
+    if n, err := res.RowsAffected(); err == nil && n == 0 {
+        return fmt.Errorf("SQLiteDatabase.UpdateSong Song %s: %w", songId, ErrNotFound)
+    }
+    return nil
+}
+
+func (db SQLiteDatabase) UpdateSongAudio(songId string, data Song) error {
+    if _,err := primitive.ObjectIDFromHex(songId); err != nil {
+        return fmt.Errorf(
+            "SQLiteDatabase.UpdateSongAudio Invalid ObjectID %s: %w", songId, ErrInvalidId)
+    }
+    res, err := db.db.Exec(`UPDATE song SET audio_url = ?, source = ?, duration = ?,
+        codec = ?, bitrate = ?, size = ?, gain = ?, peak = ?
+        WHERE id = ?`,
+        data.AudioURL, data.Source, data.Duration, data.Codec, data.Bitrate,
+        data.Size, data.Gain, data.Peak, songId)
+    if err != nil {
+        return fmt.Errorf("SQLiteDatabase.UpdateSongAudio: %v", err)
+    }
+    if n, err := res.RowsAffected(); err == nil && n == 0 {
+        return fmt.Errorf("SQLiteDatabase.UpdateSongAudio Song %s: %w", songId, ErrNotFound)
+    }
+    return nil
+}
+
+func (db SQLiteDatabase) DeleteSong(songId string) error {
+    if _,err := primitive.ObjectIDFromHex(songId); err != nil {
+        return fmt.Errorf(
+            "SQLiteDatabase.DeleteSong Invalid ObjectID %s: %w", songId, ErrInvalidId)
+    }
+    tx, err := db.db.Begin()
+    if err != nil {
+        return fmt.Errorf("SQLiteDatabase.DeleteSong: %v", err)
+    }
+    defer tx.Rollback()
+    res, err := tx.Exec("DELETE FROM song WHERE id = ?", songId)
+    if err != nil {
+        return fmt.Errorf("SQLiteDatabase.DeleteSong: %v", err)
+    }
+    if n, err := res.RowsAffected(); err == nil && n == 0 {
+        return fmt.Errorf("SQLiteDatabase.DeleteSong Song %s: %w", songId, ErrNotFound)
+    }
+    _, err = tx.Exec("DELETE FROM song_fingerprint WHERE song_id = ?", songId)
+    if err == nil {
+        _, err = tx.Exec("DELETE FROM playlist_song WHERE song_id = ?", songId)
+    }
+    if err != nil {
+        return fmt.Errorf("SQLiteDatabase.DeleteSong: %v", err)
+    }
+    return tx.Commit()
+}
+
+func (db SQLiteDatabase) PostSong(song Song) (primitive.ObjectID,error) {
+    id := primitive.NewObjectID()
+    _, err := db.db.Exec(`INSERT INTO song
+        (id, audio_url, artwork, title, artist, album, duration, source, added_by,
+            codec, bitrate, size, gain, peak, track)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+        id.Hex(), song.AudioURL, song.Artwork, song.Title, song.Artist,
+        song.Album, song.Duration, song.Source, song.AddedBy, song.Codec,
+        song.Bitrate, song.Size, song.Gain, song.Peak, song.Track)
+    if err != nil {
+        return primitive.NilObjectID, err
+    }
+    return id, nil
+}
+
+func (db SQLiteDatabase) SampleSongs() ([]Song,error) {
+    return querySQLiteSongs(db.db,
+        "SELECT " + sqliteSongColumns + " FROM song ORDER BY random() LIMIT 100")
+}
+
+/* Uses the full text index on title, artist and album. Like a MongoDB $text
+ * search, a song matches if it contains any of the terms in the search string
+ * and terms starting with "-" exclude songs containing them. */
+func (db SQLiteDatabase) SearchForSong(search string) ([]Song,error) {
+    var include, exclude []string
+    for _,term := range strings.Fields(search) {
+        t, negated := strings.CutPrefix(term, "-")
+        for _,token := range tokenize(t) {
+            quoted := `"` + token + `"`
+            if negated {
+                exclude = append(exclude, quoted)
+            } else {
+                include = append(include, quoted)
+            }
+        }
+    }
+    if len(include) == 0 {
+        return []Song{}, nil
+    }
+    match := strings.Join(include, " OR ")
+    if len(exclude) > 0 {
+        match = "(" + match + ") NOT (" + strings.Join(exclude, " OR ") + ")"
+    }
+    list, err := querySQLiteSongs(db.db, "SELECT " + sqliteSongColumns +
+        ` FROM song_fts JOIN song ON song.rowid = song_fts.rowid
+        WHERE song_fts MATCH ? ORDER BY song_fts.rank`, match)
+    if err != nil {
+        return []Song{}, err
+    }
+    return list, nil
+}
+
+func (db SQLiteDatabase) GetSongsBySource(sources ...string) ([]Song,error) {
+    if len(sources) == 0 {
+        return []Song{}, nil
+    }
+    args := make([]interface{}, len(sources))
+    for i,source := range sources {
+        args[i] = source
+    }
+    placeholders := strings.TrimSuffix(strings.Repeat("?,", len(sources)), ",")
+    list, err := querySQLiteSongs(db.db, "SELECT " + sqliteSongColumns +
+        " FROM song WHERE source IN (" + placeholders + ")", args...)
+    if err != nil {
+        return []Song{}, fmt.Errorf("SQLiteDatabase.GetSongsBySource: %v", err)
+    }
+    if list == nil {
+        list = []Song{}
+    }
+    return list, nil
+}
+
+func (db SQLiteDatabase) GetSongByAudioURL(audioURL string) (Song,error) {
+    row := db.db.QueryRow("SELECT " + sqliteSongColumns + " FROM song WHERE audio_url = ?",
+        audioURL)
+    song, err := scanSQLiteSong(row)
+    if err == sql.ErrNoRows {
+        return song, fmt.Errorf(
+            "SQLiteDatabase.GetSongByAudioURL %s: %w", audioURL, ErrNotFound)
+    }
+    if err != nil {
+        return song, fmt.Errorf("SQLiteDatabase.GetSongByAudioURL: %v", err)
+    }
+    return song, nil
+}
+
+func (db SQLiteDatabase) PutFingerprint(songId string, fp fingerprint.Fingerprint) error {
+    _, err := db.db.Exec(
+        "INSERT OR REPLACE INTO song_fingerprint (song_id, data) VALUES (?, ?)",
+        songId, fp.Bytes())
+    if err != nil {
+        return fmt.Errorf("SQLiteDatabase.PutFingerprint: %v", err)
+    }
+    return nil
+}
+
+func (db SQLiteDatabase) GetFingerprints() (map[string]fingerprint.Fingerprint,error) {
+    rows, err := db.db.Query("SELECT song_id, data FROM song_fingerprint")
+    if err != nil {
+        return nil, fmt.Errorf("SQLiteDatabase.GetFingerprints: %v", err)
+    }
+    defer rows.Close()
+    fps := make(map[string]fingerprint.Fingerprint)
+    for rows.Next() {
+        var songId string
+        var data []byte
+        if err := rows.Scan(&songId, &data); err != nil {
+            return nil, fmt.Errorf("SQLiteDatabase.GetFingerprints: %v", err)
+        }
+        fps[songId], err = fingerprint.FromBytes(data)
+        if err != nil {
+            return nil, fmt.Errorf("SQLiteDatabase.GetFingerprints Song %s: %v", songId, err)
+        }
+    }
+    return fps, rows.Err()
+}
+
+func (db SQLiteDatabase) GetLibraryFiles() ([]LibraryFile,error) {
+    rows, err := db.db.Query("SELECT path, song_id, size, mod_time, hash FROM library_file")
+    if err != nil {
+        return nil, fmt.Errorf("SQLiteDatabase.GetLibraryFiles: %v", err)
+    }
+    defer rows.Close()
+    list := []LibraryFile{}
+    for rows.Next() {
+        var f LibraryFile
+        if err := rows.Scan(&f.Path, &f.SongId, &f.Size, &f.ModTime, &f.Hash); err != nil {
+            return nil, fmt.Errorf("SQLiteDatabase.GetLibraryFiles: %v", err)
+        }
+        list = append(list, f)
+    }
+    return list, rows.Err()
+}
+
+func (db SQLiteDatabase) PutLibraryFile(file LibraryFile) error {
+    _, err := db.db.Exec(`INSERT OR REPLACE INTO library_file
+        (path, song_id, size, mod_time, hash) VALUES (?, ?, ?, ?, ?)`,
+        file.Path, file.SongId, file.Size, file.ModTime, file.Hash)
+    if err != nil {
+        return fmt.Errorf("SQLiteDatabase.PutLibraryFile: %v", err)
+    }
+    return nil
+}
+
+func (db SQLiteDatabase) DeleteLibraryFile(path string) error {
+    _, err := db.db.Exec("DELETE FROM library_file WHERE path = ?", path)
+    if err != nil {
+        return fmt.Errorf("SQLiteDatabase.DeleteLibraryFile: %v", err)
+    }
+    return nil
+}
+
+func (db SQLiteDatabase) TryLock(name, holder string, expires time.Time) (bool,error) {
+    // the update is skipped, and no row is changed, while another holder has it
+    res, err := db.db.Exec(`INSERT INTO db_lock (name, holder, expires) VALUES (?, ?, ?)
+        ON CONFLICT(name) DO UPDATE SET holder = excluded.holder, expires = excluded.expires
+        WHERE db_lock.holder = excluded.holder OR db_lock.expires < ?`,
+        name, holder, expires.UnixNano(), time.Now().UnixNano())
+    if err != nil {
+        return false, fmt.Errorf("SQLiteDatabase.TryLock: %v", err)
+    }
+    n, err := res.RowsAffected()
+    if err != nil {
+        return false, fmt.Errorf("SQLiteDatabase.TryLock: %v", err)
+    }
+    return n == 1, nil
+}
+
+func (db SQLiteDatabase) Unlock(name, holder string) error {
+    _, err := db.db.Exec("DELETE FROM db_lock WHERE name = ? AND holder = ?", name, holder)
+    if err != nil {
+        return fmt.Errorf("SQLiteDatabase.Unlock: %v", err)
+    }
+    return nil
+}
+
+func (db SQLiteDatabase) GetUserPermissions(email string) ([]string,error) {
+    rows, err := db.db.Query(
+        "SELECT permission FROM user_permission WHERE email = ?", email)
+    if err != nil {
+        return []string{}, err
+    }
+    defer rows.Close()
+    permissions := []string{}
+    for rows.Next() {
+        var p string
+        if err := rows.Scan(&p); err != nil {
+            return []string{}, err
+        }
+        permissions = append(permissions, p)
+    }
+    return permissions, rows.Err()
+}
+
+// Replaces the permissions of the user with the given email
+func (db SQLiteDatabase) SetUserPermissions(email string, permissions []string) error {
+    tx, err := db.db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    _, err = tx.Exec("DELETE FROM user_permission WHERE email = ?", email)
+    if err != nil {
+        return err
+    }
+    for _,p := range permissions {
+        _, err = tx.Exec(
+            "INSERT OR IGNORE INTO user_permission (email, permission) VALUES (?, ?)",
+            email, p)
+        if err != nil {
+            return err
+        }
+    }
+    return tx.Commit()
+}
+
+// Fills in the songs of the playlists, in playlist order
+func (db SQLiteDatabase) expandPlaylists(playlists []Playlist) error {
+    for i := range playlists {
+        songs, err := querySQLiteSongs(db.db, "SELECT " + sqliteSongColumns +
+            ` FROM playlist_song JOIN song ON song.id = playlist_song.song_id
+            WHERE playlist_song.playlist_id = ? ORDER BY playlist_song.position`,
+            playlists[i].Id)
+        if err != nil {
+            return err
+        }
+        if songs == nil {
+            songs = []Song{}
+        }
+        playlists[i].Songs = songs
+    }
+    return nil
+}
+
+func (db SQLiteDatabase) queryPlaylists(query string, args ...interface{}) ([]Playlist,error) {
+    rows, err := db.db.Query(query, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    playlists := make([]Playlist, 0)
+    for rows.Next() {
+        var p Playlist
+        err = rows.Scan(&p.Id, &p.Artwork, &p.Title, &p.Description, &p.Owner)
+        if err != nil {
+            return nil, err
+        }
+        playlists = append(playlists, p)
+    }
+    err = rows.Err()
+    if err != nil {
+        return nil, err
+    }
+    rows.Close()
+    err = db.expandPlaylists(playlists)
+    if err != nil {
+        return nil, err
+    }
+    return playlists, nil
+}
+
+func (db SQLiteDatabase) GetPlaylist(playlistId string) (Playlist,error) {
+    if _,err := primitive.ObjectIDFromHex(playlistId); err != nil {
+        return Playlist{}, fmt.Errorf(
+            "SQLiteDatabase.GetPlaylist Invalid ObjectID %s: %w", playlistId, ErrInvalidId)
+    }
+    playlists, err := db.queryPlaylists(
+        "SELECT id, artwork, title, description, owner FROM playlist WHERE id = ?",
+        playlistId)
+    if err != nil {
+        return Playlist{}, fmt.Errorf("SQLiteDatabase.GetPlaylist: %v", err)
+    }
+    if len(playlists) == 0 {
+        return Playlist{}, fmt.Errorf(
+            "SQLiteDatabase.GetPlaylist Playlist %s: %w", playlistId, ErrNotFound)
+    }
+    return playlists[0], nil
+}
+
+func (db SQLiteDatabase) GetPersonalPlaylists(uid string) ([]Playlist,error) {
+    playlists, err := db.queryPlaylists(
+        "SELECT id, artwork, title, description, owner FROM playlist WHERE owner = ? ORDER BY id",
+        uid)
+    if err != nil {
+        return []Playlist{}, fmt.Errorf("SQLiteDatabase.GetPersonalPlaylists: %v", err)
+    }
+    return playlists, nil
+}
+
+func (db SQLiteDatabase) SamplePlaylists() ([]Playlist, error) {
+    return db.queryPlaylists(
+        "SELECT id, artwork, title, description, owner FROM playlist ORDER BY random() LIMIT 25")
+}
+
+func (db SQLiteDatabase) PostPlaylist(playlist NormalizedPlaylist) (primitive.ObjectID,error) {
+    id := primitive.NewObjectID()
+    tx, err := db.db.Begin()
+    if err != nil {
+        return primitive.NilObjectID, err
+    }
+    defer tx.Rollback()
+    _, err = tx.Exec(`INSERT INTO playlist (id, artwork, title, description, owner)
+        VALUES (?, ?, ?, ?, ?)`,
+        id.Hex(), playlist.Artwork, playlist.Title, playlist.Description, playlist.Owner)
+    if err != nil {
+        return primitive.NilObjectID, err
+    }
+    for i, sid := range playlist.Songs {
+        _, err = tx.Exec(
+            "INSERT INTO playlist_song (playlist_id, position, song_id) VALUES (?, ?, ?)",
+            id.Hex(), i, sid.Hex())
+        if err != nil {
+            return primitive.NilObjectID, err
+        }
+    }
+    err = tx.Commit()
+    if err != nil {
+        return primitive.NilObjectID, err
+    }
+    return id, nil
+}
+
+func (db SQLiteDatabase) UpdatePlaylist(uid string, playlistId string, data Playlist) error {
+    _, err := db.db.Exec(`UPDATE playlist SET title = ?, description = ?, artwork = ?
+        WHERE id = ? AND owner = ?`,
+        data.Title, data.Description, data.Artwork, playlistId, uid)
+    return err
+}
+
+func (db SQLiteDatabase) AddSongToPlaylist(uid string, playlistId string, songId string) error {
+    sid,_ := primitive.ObjectIDFromHex(songId)
+    _, err := db.db.Exec(`INSERT INTO playlist_song (playlist_id, position, song_id)
+        SELECT id, (SELECT coalesce(max(position) + 1, 0) FROM playlist_song WHERE playlist_id = ?), ?
+        FROM playlist WHERE id = ? AND owner = ?`,
+        playlistId, sid.Hex(), playlistId, uid)
+    return err
+}
+
+func (db SQLiteDatabase) RemoveSongFromPlaylist(uid string, playlistId string, songId string) error {
+    sid,_ := primitive.ObjectIDFromHex(songId)
+    _, err := db.db.Exec(`DELETE FROM playlist_song
+        WHERE playlist_id = (SELECT id FROM playlist WHERE id = ? AND owner = ?)
+        AND song_id = ?`,
+        playlistId, uid, sid.Hex())
+    return err
+}
+
+// The number of rows read at a time by the Each functions
+const sqlitePageSize = 500
+
+func (db SQLiteDatabase) EachSong(fn func(Song) error) error {
+    after := ""
+    for {
+        songs, err := querySQLiteSongs(db.db, "SELECT " + sqliteSongColumns +
+            " FROM song WHERE id > ? ORDER BY id LIMIT ?", after, sqlitePageSize)
+        if err != nil {
+            return fmt.Errorf("SQLiteDatabase.EachSong: %v", err)
+        }
+        for _,song := range songs {
+            if err := fn(song); err != nil {
+                return err
+            }
+        }
+        if len(songs) < sqlitePageSize {
+            return nil
+        }
+        after = songs[len(songs)-1].Id
+    }
+}
+
+func (db SQLiteDatabase) EachPlaylist(fn func(NormalizedPlaylist) error) error {
+    after := ""
+    for {
+        rows, err := db.db.Query(`SELECT id, artwork, title, description, owner
+            FROM playlist WHERE id > ? ORDER BY id LIMIT ?`, after, sqlitePageSize)
+        if err != nil {
+            return fmt.Errorf("SQLiteDatabase.EachPlaylist: %v", err)
+        }
+        var playlists []NormalizedPlaylist
+        for rows.Next() {
+            var p NormalizedPlaylist
+            err = rows.Scan(&p.Id, &p.Artwork, &p.Title, &p.Description, &p.Owner)
+            if err != nil {
+                rows.Close()
+                return fmt.Errorf("SQLiteDatabase.EachPlaylist: %v", err)
+            }
+            playlists = append(playlists, p)
+        }
+        rows.Close()
+        if err = rows.Err(); err != nil {
+            return fmt.Errorf("SQLiteDatabase.EachPlaylist: %v", err)
+        }
+        for _,p := range playlists {
+            p.Songs, err = db.playlistSongIds(p.Id)
+            if err != nil {
+                return fmt.Errorf("SQLiteDatabase.EachPlaylist: %v", err)
+            }
+            if err := fn(p); err != nil {
+                return err
+            }
+        }
+        if len(playlists) < sqlitePageSize {
+            return nil
+        }
+        after = playlists[len(playlists)-1].Id
+    }
+}
+
+// returns the ids of the songs in the playlist in order, including the ids
+// of songs that no longer exist
+func (db SQLiteDatabase) playlistSongIds(playlistId string) ([]primitive.ObjectID,error) {
+    rows, err := db.db.Query(
+        "SELECT song_id FROM playlist_song WHERE playlist_id = ? ORDER BY position",
+        playlistId)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    songs := []primitive.ObjectID{}
+    for rows.Next() {
+        var hex string
+        if err := rows.Scan(&hex); err != nil {
+            return nil, err
+        }
+        id, err := primitive.ObjectIDFromHex(hex)
+        if err != nil {
+            return nil, err
+        }
+        songs = append(songs, id)
+    }
+    return songs, rows.Err()
+}
+
+func (db SQLiteDatabase) EachUserPermissions(fn func(string, []string) error) error {
+    rows, err := db.db.Query(
+        "SELECT email, permission FROM user_permission ORDER BY email, permission")
+    if err != nil {
+        return fmt.Errorf("SQLiteDatabase.EachUserPermissions: %v", err)
+    }
+    var emails []string
+    permissions := make(map[string][]string)
+    for rows.Next() {
+        var email, p string
+        if err := rows.Scan(&email, &p); err != nil {
+            rows.Close()
+            return fmt.Errorf("SQLiteDatabase.EachUserPermissions: %v", err)
+        }
+        if _,ok := permissions[email]; !ok {
+            emails = append(emails, email)
+        }
+        permissions[email] = append(permissions[email], p)
+    }
+    rows.Close()
+    if err = rows.Err(); err != nil {
+        return fmt.Errorf("SQLiteDatabase.EachUserPermissions: %v", err)
+    }
+    for _,email := range emails {
+        if err := fn(email, permissions[email]); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (db SQLiteDatabase) ImportSong(song Song) error {
+    if _,err := primitive.ObjectIDFromHex(song.Id); err != nil {
+        return fmt.Errorf(
+            "SQLiteDatabase.ImportSong Invalid ObjectID %s: %w", song.Id, ErrInvalidId)
+    }
+    // an upsert rather than INSERT OR REPLACE so that the update trigger keeps
+    // the full text index in sync
+    _, err := db.db.Exec(`INSERT INTO song
+        (id, audio_url, artwork, title, artist, album, duration, source, added_by,
+            codec, bitrate, size, gain, peak, track)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+        ON CONFLICT(id) DO UPDATE SET
+            audio_url = excluded.audio_url, artwork = excluded.artwork,
+            title = excluded.title, artist = excluded.artist,
+            album = excluded.album, duration = excluded.duration,
+            source = excluded.source, added_by = excluded.added_by,
+            codec = excluded.codec, bitrate = excluded.bitrate, size = excluded.size,
+            gain = excluded.gain, peak = excluded.peak, track = excluded.track`,
+        song.Id, song.AudioURL, song.Artwork, song.Title, song.Artist,
+        song.Album, song.Duration, song.Source, song.AddedBy, song.Codec,
+        song.Bitrate, song.Size, song.Gain, song.Peak, song.Track)
+    return err
+}
+
+func (db SQLiteDatabase) ImportPlaylist(playlist NormalizedPlaylist) error {
+    if _,err := primitive.ObjectIDFromHex(playlist.Id); err != nil {
+        return fmt.Errorf(
+            "SQLiteDatabase.ImportPlaylist Invalid ObjectID %s: %w", playlist.Id, ErrInvalidId)
+    }
+    tx, err := db.db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    _, err = tx.Exec(`INSERT INTO playlist (id, artwork, title, description, owner)
+        VALUES (?, ?, ?, ?, ?)
+        ON CONFLICT(id) DO UPDATE SET
+            artwork = excluded.artwork, title = excluded.title,
+            description = excluded.description, owner = excluded.owner`,
+        playlist.Id, playlist.Artwork, playlist.Title, playlist.Description, playlist.Owner)
+    if err != nil {
+        return err
+    }
+    _, err = tx.Exec("DELETE FROM playlist_song WHERE playlist_id = ?", playlist.Id)
+    if err != nil {
+        return err
+    }
+    for i, sid := range playlist.Songs {
+        _, err = tx.Exec(
+            "INSERT INTO playlist_song (playlist_id, position, song_id) VALUES (?, ?, ?)",
+            playlist.Id, i, sid.Hex())
+        if err != nil {
+            return err
+        }
+    }
+    return tx.Commit()
+}
+
+func (db SQLiteDatabase) CreateJob(job jobs.Job) (string,error) {
+    job.Id = primitive.NewObjectID().Hex()
+    data, err := json.Marshal(job)
+    if err != nil {
+        return "", err
+    }
+    _, err = db.db.Exec(`INSERT INTO job (id, state, created_at, data) VALUES (?, ?, ?, ?)`,
+        job.Id, job.State, job.CreatedAt.UnixNano(), string(data))
+    if err != nil {
+        return "", fmt.Errorf("SQLiteDatabase.CreateJob: %v", err)
+    }
+    return job.Id, nil
+}
+
+func (db SQLiteDatabase) UpdateJob(job jobs.Job) error {
+    data, err := json.Marshal(job)
+    if err != nil {
+        return err
+    }
+    res, err := db.db.Exec(`UPDATE job SET state = ?, data = ? WHERE id = ?`,
+        job.State, string(data), job.Id)
+    if err != nil {
+        return fmt.Errorf("SQLiteDatabase.UpdateJob: %v", err)
+    }
+    if n, err := res.RowsAffected(); err == nil && n == 0 {
+        return fmt.Errorf("SQLiteDatabase.UpdateJob Job %s: %w", job.Id, ErrNotFound)
+    }
+    return nil
+}
+
+func (db SQLiteDatabase) GetJob(jobId string) (jobs.Job,error) {
+    var job jobs.Job
+    if _,err := primitive.ObjectIDFromHex(jobId); err != nil {
+        return job, fmt.Errorf(
+            "SQLiteDatabase.GetJob Invalid ObjectID %s: %w", jobId, ErrInvalidId)
+    }
+    var data string
+    err := db.db.QueryRow(`SELECT data FROM job WHERE id = ?`, jobId).Scan(&data)
+    if err == sql.ErrNoRows {
+        return job, fmt.Errorf("SQLiteDatabase.GetJob Job %s: %w", jobId, ErrNotFound)
+    }
+    if err != nil {
+        return job, fmt.Errorf("SQLiteDatabase.GetJob: %v", err)
+    }
+    err = json.Unmarshal([]byte(data), &job)
+    return job, err
+}
+
+func (db SQLiteDatabase) ListJobs(states ...jobs.State) ([]jobs.Job,error) {
+    query := `SELECT data FROM job`
+    var args []interface{}
+    if len(states) > 0 {
+        query += ` WHERE state IN (?` + strings.Repeat(`, ?`, len(states) - 1) + `)`
+        for _,state := range states {
+            args = append(args, state)
+        }
+    }
+    rows, err := db.db.Query(query + ` ORDER BY created_at, id`, args...)
+    if err != nil {
+        return nil, fmt.Errorf("SQLiteDatabase.ListJobs: %v", err)
+    }
+    defer rows.Close()
+    list := []jobs.Job{}
+    for rows.Next() {
+        var data string
+        var job jobs.Job
+        err = rows.Scan(&data)
+        if err == nil {
+            err = json.Unmarshal([]byte(data), &job)
+        }
+        if err != nil {
+            return nil, fmt.Errorf("SQLiteDatabase.ListJobs: %v", err)
+        }
+        list = append(list, job)
+    }
+    return list, rows.Err()
+}
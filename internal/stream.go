@@ -0,0 +1,266 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TSchreiber/melo/internal/cache"
+	"github.com/TSchreiber/melo/internal/ffmpeg"
+	"github.com/gorilla/mux"
+)
+
+// The directory that downloaded songs are saved to and streamed from
+const songDirectory = "static/song"
+
+type TranscodeConfig struct {
+    // Where converted songs are cached, defaults to "cache/transcode"
+    CacheDirectory string
+    // The maximum size of the cache in megabytes, defaults to 1024
+    CacheSizeMB int64
+}
+
+func newTranscodeCache(config TranscodeConfig) (*cache.DiskCache,error) {
+    dir := config.CacheDirectory
+    if dir == "" {
+        dir = "cache/transcode"
+    }
+    size := config.CacheSizeMB
+    if size == 0 {
+        size = 1024
+    }
+    return cache.NewDiskCache(dir, size * 1024 * 1024)
+}
+
+/* Streams the audio of the song with the id in the "id" route variable. Byte
+ * ranges and conditional requests are handled by http.ServeContent, so
+ * clients can seek without downloading the whole file. Songs are resolved by
+ * id through the database, a request can never name a file directly.
+ *
+ * The "format" and "bitrate" query parameters, ex. ?format=aac&bitrate=96k,
+ * request the song in a different format. Converted songs are kept in the
+ * transcodes cache so that later requests can seek. */
+func createStreamSongHandler(meloDB MeloDatabase, transcodes *cache.DiskCache) http.HandlerFunc {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        songId := mux.Vars(r)["id"]
+        song, err := meloDB.GetSong(songId)
+        if errors.Is(err, ErrInvalidId) {
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprintf(w, "400 - Invalid song id, \"%s\"", songId)
+            return
+        }
+        if errors.Is(err, ErrNotFound) {
+            w.WriteHeader(http.StatusNotFound)
+            return
+        }
+        if err != nil {
+            log.Printf("\"GET /song/%s\": %v\n", songId, err)
+            w.WriteHeader(http.StatusInternalServerError)
+            return
+        }
+
+        var opts *ffmpeg.Options
+        contentType := ""
+        if format := r.URL.Query().Get("format"); format != "" {
+            opts = &ffmpeg.Options{
+                Codec: format,
+                Bitrate: r.URL.Query().Get("bitrate"),
+            }
+            if err := opts.Validate(); err != nil {
+                w.WriteHeader(http.StatusBadRequest)
+                fmt.Fprintf(w, "400 - %v", err)
+                return
+            }
+            contentType = ffmpeg.Codecs[opts.Codec].ContentType
+        }
+
+        path, err := songFilePath(song)
+        if err != nil {
+            log.Printf("\"GET /song/%s\": %v\n", songId, err)
+            w.WriteHeader(http.StatusNotFound)
+            return
+        }
+        if contentType == "" {
+            contentType = mime.TypeByExtension(filepath.Ext(path))
+        }
+        if contentType == "" {
+            contentType = "application/octet-stream"
+        }
+        if !acceptsMediaType(r.Header.Get("Accept"), contentType) {
+            w.WriteHeader(http.StatusNotAcceptable)
+            fmt.Fprintf(w, "406 - The song is not available as any of the accepted types")
+            return
+        }
+
+        f, err := os.Open(path)
+        if err != nil {
+            log.Printf("\"GET /song/%s\": %v\n", songId, err)
+            w.WriteHeader(http.StatusNotFound)
+            return
+        }
+        defer f.Close()
+        info, err := f.Stat()
+        if err != nil || info.IsDir() {
+            w.WriteHeader(http.StatusNotFound)
+            return
+        }
+
+        disableWriteTimeout(w)
+        w.Header().Set("Content-Type", contentType)
+        w.Header().Set("Cache-Control", "private, max-age=0, must-revalidate")
+        if opts != nil {
+            serveTranscodedSong(w, r, song, path, info, *opts, transcodes)
+            return
+        }
+        w.Header().Set("Accept-Ranges", "bytes")
+        w.Header().Set("ETag", fmt.Sprintf("\"%s-%x-%x\"",
+            song.Id, info.Size(), info.ModTime().UnixNano()))
+        http.ServeContent(w, r, filepath.Base(path), info.ModTime(), f)
+    })
+}
+
+/* The name of the cached conversion of the song's audio file, which changes
+ * whenever the audio file is replaced */
+func transcodeCacheKey(song Song, info os.FileInfo, opts ffmpeg.Options) string {
+    bitrate := opts.Bitrate
+    if bitrate == "" {
+        bitrate = "default"
+    }
+    return fmt.Sprintf("%s-%x-%s.%s", song.Id, info.ModTime().UnixNano(),
+        bitrate, ffmpeg.Codecs[opts.Codec].Extension)
+}
+
+/* Serves the cached conversion of the song if there is one. Otherwise the
+ * song is converted while it is being sent, which means that the response
+ * has no length and ranges are ignored, and the result is added to the cache
+ * once the conversion finishes. */
+func serveTranscodedSong(w http.ResponseWriter, r *http.Request, song Song,
+path string, info os.FileInfo, opts ffmpeg.Options, transcodes *cache.DiskCache) {
+    key := transcodeCacheKey(song, info, opts)
+    if cached, ok := transcodes.Get(key); ok {
+        f, err := os.Open(cached)
+        if err == nil {
+            defer f.Close()
+            w.Header().Set("Accept-Ranges", "bytes")
+            w.Header().Set("ETag", "\"" + key + "\"")
+            http.ServeContent(w, r, key, info.ModTime(), f)
+            return
+        }
+    }
+
+    w.Header().Set("Accept-Ranges", "none")
+    if r.Method == "HEAD" {
+        w.WriteHeader(http.StatusOK)
+        return
+    }
+    var out io.Writer = w
+    cw, err := transcodes.Create(key)
+    if err == nil {
+        out = io.MultiWriter(w, cw)
+    } else if !errors.Is(err, cache.ErrInProgress) {
+        log.Printf("\"GET /song/%s\": Failed to cache the conversion: %v\n", song.Id, err)
+    }
+    err = ffmpeg.Transcode(r.Context(), path, out, opts)
+    if err != nil {
+        if cw != nil {
+            cw.Abort()
+        }
+        if r.Context().Err() == nil {
+            log.Printf("\"GET /song/%s\": %v\n", song.Id, err)
+        }
+        return
+    }
+    if cw != nil {
+        if err := cw.Commit(); err != nil {
+            log.Printf("\"GET /song/%s\": Failed to cache the conversion: %v\n", song.Id, err)
+        }
+    }
+}
+
+/* Returns the path of the song's audio file. The file must be inside of
+ * songDirectory, or a library directory for a library song, an audio URL that
+ * points anywhere else (such as one containing "..") is an error. */
+func songFilePath(song Song) (string,error) {
+    if isLibrarySong(song) {
+        return libraryFilePath(song)
+    }
+    name, ok := strings.CutPrefix(song.AudioURL, "/song/")
+    if !ok || name == "" {
+        return "", fmt.Errorf("Song %s has an unexpected audio URL, \"%s\"",
+            song.Id, song.AudioURL)
+    }
+    dir, err := filepath.Abs(songDirectory)
+    if err != nil {
+        return "", err
+    }
+    path := filepath.Join(dir, filepath.FromSlash(name))
+    rel, err := filepath.Rel(dir, path)
+    if err != nil || rel == "." || rel == ".." ||
+    strings.HasPrefix(rel, ".." + string(filepath.Separator)) {
+        return "", fmt.Errorf("Song %s has an audio URL outside of %s, \"%s\"",
+            song.Id, songDirectory, song.AudioURL)
+    }
+    return path, nil
+}
+
+/* Reports whether the media type is acceptable according to the Accept header.
+ * A missing header accepts everything. The most specific range that matches
+ * decides, so "audio/*, audio/mpeg;q=0" refuses audio/mpeg, see RFC 9110
+ * section 12.5.1. Parameters other than q are ignored. */
+func acceptsMediaType(accept string, mediaType string) bool {
+    if strings.TrimSpace(accept) == "" {
+        return true
+    }
+    mediaType = strings.ToLower(mediaType)
+    if i := strings.IndexByte(mediaType, ';'); i != -1 {
+        mediaType = strings.TrimSpace(mediaType[:i])
+    }
+    typ, _, _ := strings.Cut(mediaType, "/")
+    // 0 for */*, 1 for type/* and 2 for the media type itself
+    specificity, q := -1, 0.0
+    for _,part := range strings.Split(accept, ",") {
+        rng, params, _ := strings.Cut(strings.ToLower(part), ";")
+        var s int
+        switch strings.TrimSpace(rng) {
+        case "*/*":
+            s = 0
+        case typ + "/*":
+            s = 1
+        case mediaType:
+            s = 2
+        default:
+            continue
+        }
+        if s <= specificity {
+            continue
+        }
+        specificity, q = s, 1
+        for _,param := range strings.Split(params, ";") {
+            if v, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+                // a malformed q-value is taken as a refusal
+                var err error
+                if q, err = strconv.ParseFloat(strings.TrimSpace(v), 64); err != nil {
+                    q = 0
+                }
+            }
+        }
+    }
+    return q > 0
+}
+
+/* Removes the server's WriteTimeout for this response. Long songs on slow
+ * connections take longer than the timeout to send. */
+func disableWriteTimeout(w http.ResponseWriter) {
+    err := http.NewResponseController(w).SetWriteDeadline(time.Time{})
+    if err != nil && !errors.Is(err, http.ErrNotSupported) {
+        log.Printf("Failed to disable the write timeout: %v\n", err)
+    }
+}
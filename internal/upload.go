@@ -0,0 +1,234 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/TSchreiber/melo/internal/download"
+	"github.com/TSchreiber/melo/internal/ffmpeg"
+	"github.com/TSchreiber/melo/internal/jobs"
+)
+
+// The largest file that can be uploaded unless the config says otherwise
+const defaultMaxUploadSize = 512 << 20
+
+/* Returns the extension of the kind of audio file that head, the start of a
+ * file, belongs to, or "" if it doesn't look like audio. ffprobe has the
+ * final say, this only keeps it from being run on anything that was sent. */
+func sniffAudio(head []byte) string {
+    switch {
+    case bytes.HasPrefix(head, []byte("ID3")):
+        return ".mp3"
+    case len(head) >= 2 && head[0] == 0xFF && head[1] & 0xE0 == 0xE0:
+        // an MPEG audio frame without tags, layer 0 is an AAC ADTS frame
+        if head[1] & 0x06 == 0 {
+            return ".aac"
+        }
+        return ".mp3"
+    case bytes.HasPrefix(head, []byte("fLaC")):
+        return ".flac"
+    case bytes.HasPrefix(head, []byte("OggS")):
+        return ".ogg"
+    case bytes.HasPrefix(head, []byte("RIFF")) && len(head) >= 12 && string(head[8:12]) == "WAVE":
+        return ".wav"
+    case bytes.HasPrefix(head, []byte("FORM")) && len(head) >= 12 &&
+    (string(head[8:12]) == "AIFF" || string(head[8:12]) == "AIFC"):
+        return ".aiff"
+    case len(head) >= 8 && string(head[4:8]) == "ftyp":
+        return ".m4a"
+    case bytes.HasPrefix(head, []byte{ 0x1A, 0x45, 0xDF, 0xA3 }):
+        return ".webm"
+    }
+    return ""
+}
+
+/* Accepts an audio file in the "file" field of a multipart form and queues it
+ * to be converted and saved like a download, see jobs.Queue.EnqueueFile. The
+ * "title", "artist", "album" and "artwork" fields default to the file's tags,
+ * and the title to the file's name, "codec", "bitrate" and "quality" to the
+ * server's download options. Files larger than maxSize are refused, and like
+ * POST /download/song, a song that is already in the library is a 409 unless
+ * ?force=true. */
+func createUploadSongHandler(queue *jobs.Queue, meloDB MeloDatabase,
+defaults ffmpeg.Options, maxSize int64) http.HandlerFunc {
+    return http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+        // an upload can take much longer than the server's timeouts
+        rc := http.NewResponseController(w)
+        err := rc.SetReadDeadline(time.Time{})
+        if err != nil && !errors.Is(err, http.ErrNotSupported) {
+            log.Printf("Failed to disable the read timeout: %v\n", err)
+        }
+        disableWriteTimeout(w)
+
+        // leaves room for the other fields of the form
+        r.Body = http.MaxBytesReader(w, r.Body, maxSize + 64 << 10)
+        err = r.ParseMultipartForm(1 << 20)
+        var maxErr *http.MaxBytesError
+        if errors.As(err, &maxErr) {
+            w.WriteHeader(http.StatusRequestEntityTooLarge)
+            fmt.Fprintf(w, "413 - The file is larger than %d bytes", maxSize)
+            return
+        }
+        if err != nil {
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprintf(w, "400 - %v", err)
+            return
+        }
+        defer r.MultipartForm.RemoveAll()
+        file, header, err := r.FormFile("file")
+        if err != nil {
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprint(w, "400 - Form field, \"file\" is required")
+            return
+        }
+        defer file.Close()
+        if header.Size > maxSize {
+            w.WriteHeader(http.StatusRequestEntityTooLarge)
+            fmt.Fprintf(w, "413 - The file is larger than %d bytes", maxSize)
+            return
+        }
+
+        head := make([]byte, 512)
+        n, _ := io.ReadFull(file, head)
+        ext := sniffAudio(head[:n])
+        if ext == "" {
+            w.WriteHeader(http.StatusUnsupportedMediaType)
+            fmt.Fprint(w, "415 - The file is not audio")
+            return
+        }
+        name, err := saveUpload(io.MultiReader(bytes.NewReader(head[:n]), file), ext)
+        if err != nil {
+            log.Printf("\"POST /download/upload\": %v\n", err)
+            w.WriteHeader(http.StatusInternalServerError)
+            return
+        }
+        // the job removes the file once it has been converted
+        queued := false
+        defer func() {
+            if !queued {
+                os.Remove(name)
+            }
+        }()
+        info, err := ffmpeg.Probe(name)
+        if err != nil || info.Codec == "" {
+            w.WriteHeader(http.StatusUnsupportedMediaType)
+            fmt.Fprint(w, "415 - The file is not audio that ffmpeg can read")
+            return
+        }
+
+        var req download.DownloadRequest
+        form := r.MultipartForm.Value
+        fileTitle := strings.TrimSuffix(filepath.Base(header.Filename), filepath.Ext(header.Filename))
+        req.Title = firstNonEmpty(formValue(form, "title"), info.Tags["title"], fileTitle)
+        req.Artist = firstNonEmpty(formValue(form, "artist"), info.Tags["artist"], info.Tags["album_artist"])
+        req.Album = firstNonEmpty(formValue(form, "album"), info.Tags["album"])
+        req.Artwork = formValue(form, "artwork")
+        req.Duration = int64(info.Duration / 1000)
+        req.Codec = formValue(form, "codec")
+        req.Bitrate = formValue(form, "bitrate")
+        req.Quality = formValue(form, "quality")
+        if req.Title == "" {
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprint(w, "400 - The song needs a title")
+            return
+        }
+        req.ApplyDefaults(defaults)
+        if err := req.Validate(); err != nil {
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprintf(w, "400 - %v", err)
+            return
+        }
+        if r.URL.Query().Get("force") != "true" {
+            dup, err := findDuplicate(meloDB, queue, req)
+            if err != nil {
+                log.Printf("\"POST /download/upload\": %v\n", err)
+                w.WriteHeader(http.StatusInternalServerError)
+                return
+            }
+            if dup != nil {
+                b,_ := json.Marshal(dup)
+                w.Header().Set("Content-Type", "application/json")
+                w.WriteHeader(http.StatusConflict)
+                w.Write(b)
+                return
+            }
+        }
+        claims := r.Context().Value("user_claims").(map[string]interface{})
+        uid,_ := claims["email"].(string)
+
+        job, err := queue.EnqueueFile(req, name, uid)
+        if err != nil {
+            log.Printf("\"POST /download/upload\": %v\n", err)
+            w.WriteHeader(http.StatusInternalServerError)
+            return
+        }
+        queued = true
+        var res struct {
+            JobId string `json:"jobId"`
+            Steps []jobs.Step `json:"steps"`
+            // The song's details, with the defaults that were filled in
+            Request download.DownloadRequest `json:"request"`
+        }
+        res.JobId = job.Id
+        res.Steps = jobs.FileSteps
+        res.Request = req
+        b,_ := json.Marshal(res)
+        w.Header().Set("Content-Type", "application/json")
+        w.Header().Set("Location", "/download/jobs/" + job.Id)
+        w.WriteHeader(http.StatusAccepted)
+        w.Write(b)
+    })
+}
+
+/* Writes an uploaded file to the working directory, where downloads are
+ * written, under a random name since the uploader's can be anything */
+func saveUpload(r io.Reader, ext string) (string,error) {
+    b := make([]byte, 8)
+    _, err := rand.Read(b)
+    if err != nil {
+        return "", fmt.Errorf("saveUpload: %v", err)
+    }
+    name := "./upload-" + hex.EncodeToString(b) + ext
+    f, err := os.OpenFile(name, os.O_WRONLY | os.O_CREATE | os.O_EXCL, 0644)
+    if err != nil {
+        return "", fmt.Errorf("saveUpload: %v", err)
+    }
+    _, err = io.Copy(f, r)
+    if e := f.Close(); err == nil {
+        err = e
+    }
+    if err != nil {
+        os.Remove(name)
+        return "", fmt.Errorf("saveUpload: %v", err)
+    }
+    return name, nil
+}
+
+// Returns the first of values that isn't empty, or ""
+func firstNonEmpty(values ...string) string {
+    for _,v := range values {
+        if v != "" {
+            return v
+        }
+    }
+    return ""
+}
+
+// Returns the first value of a form field, trimmed
+func formValue(form map[string][]string, key string) string {
+    if len(form[key]) == 0 {
+        return ""
+    }
+    return strings.TrimSpace(form[key][0])
+}
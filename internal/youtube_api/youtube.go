@@ -6,8 +6,12 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"strings"
 )
 
+// The YouTube Data API, replaced in tests
+var BaseURL = "https://www.googleapis.com/youtube/v3"
+
 type YouTubeSearchListResponse struct {
     Items []struct {
         Id struct {
@@ -30,7 +34,7 @@ type YouTubeSearchListResponse struct {
 
 func Search(searchInput string) (YouTubeSearchListResponse, error) {
     key := os.Getenv("MELO_YT_API_KEY")
-    req, _ := http.NewRequest("GET", "https://www.googleapis.com/youtube/v3/search", nil)
+    req, _ := http.NewRequest("GET", BaseURL + "/search", nil)
     q := fmt.Sprintf(`%s audio`, searchInput)
     query := req.URL.Query()
     query.Add("key", key)
@@ -86,28 +90,47 @@ type YouTubeVideo struct {
 }
 
 func GetVideoDetails(vid string) (YouTubeVideo,error) {
+    videos, err := GetVideos([]string{vid})
+    if err != nil {
+        return YouTubeVideo{}, err
+    }
+    if len(videos) == 0 {
+        return YouTubeVideo{}, fmt.Errorf("Video metadata could not be found")
+    }
+    return videos[0], nil
+}
+
+// The most videos that can be requested at once
+const maxVideosPerRequest = 50
+
+/* Fetches the details of up to 50 videos in one request, which costs as much
+ * of the API quota as fetching one. Videos that do not exist are left out. */
+func GetVideos(vids []string) ([]YouTubeVideo,error) {
+    if len(vids) > maxVideosPerRequest {
+        return nil, fmt.Errorf("Can not get more than %d videos at once", maxVideosPerRequest)
+    }
     key := os.Getenv("MELO_YT_API_KEY")
-    req, _ := http.NewRequest("GET", "https://www.googleapis.com/youtube/v3/videos", nil)
+    req, _ := http.NewRequest("GET", BaseURL + "/videos", nil)
     query := req.URL.Query()
     query.Add("key", key)
     query.Add("part", "snippet,contentDetails,statistics")
-    query.Add("id", vid)
+    query.Add("id", strings.Join(vids, ","))
     req.URL.RawQuery = query.Encode()
 
     client := http.Client{}
     res,err := client.Do(req)
     if err != nil {
-        return YouTubeVideo{}, err
+        return nil, err
     }
     defer res.Body.Close()
     if res.StatusCode != 200 {
-        return YouTubeVideo{}, fmt.Errorf(
+        return nil, fmt.Errorf(
             "Request to the YouTube Data API \"GET /videos\" endpoint returned with status code, \"%s\"",
             res.Status)
     }
     body,err := io.ReadAll(res.Body)
     if err != nil {
-        return YouTubeVideo{}, err
+        return nil, err
     }
 
     var searchResult struct {
@@ -115,10 +138,7 @@ func GetVideoDetails(vid string) (YouTubeVideo,error) {
     }
     err = json.Unmarshal(body, &searchResult)
     if err != nil {
-        return YouTubeVideo{}, err
-    }
-    if len(searchResult.Videos) == 0 {
-        return YouTubeVideo{}, fmt.Errorf("Video metadata could not be found")
+        return nil, err
     }
-    return searchResult.Videos[0], nil
+    return searchResult.Videos, nil
 }
@@ -0,0 +1,118 @@
+package yt_dlp
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// What went wrong with a download, parsed from yt-dlp's ERROR: lines
+type ErrorKind string
+
+const (
+    ErrorUnknown ErrorKind = "unknown"
+    // The video was removed, made private or is otherwise gone
+    ErrorUnavailable ErrorKind = "unavailable"
+    // The video can only be watched when signed in
+    ErrorSignIn ErrorKind = "sign-in"
+    // yt-dlp does not know how to download from the URL
+    ErrorUnsupportedURL ErrorKind = "unsupported-url"
+    // The site is rate limiting the downloads, HTTP 429
+    ErrorThrottled ErrorKind = "throttled"
+    // The site refused the request, HTTP 403, often an expired signed URL
+    ErrorForbidden ErrorKind = "forbidden"
+    // The site could not be reached
+    ErrorNetwork ErrorKind = "network"
+    // The yt-dlp executable could not be found
+    ErrorNotInstalled ErrorKind = "not-installed"
+)
+
+// The kind of error for each message, the first match wins
+var errorPatterns = []struct{
+    substr string
+    kind ErrorKind
+}{
+    { "Video unavailable", ErrorUnavailable },
+    { "Private video", ErrorUnavailable },
+    { "This video has been removed", ErrorUnavailable },
+    { "This video is no longer available", ErrorUnavailable },
+    { "blocked it on copyright grounds", ErrorUnavailable },
+    { "This live event will begin", ErrorUnavailable },
+    { "Requested format is not available", ErrorUnavailable },
+    { "Sign in to confirm your age", ErrorSignIn },
+    { "members-only", ErrorSignIn },
+    { "Sign in to confirm you", ErrorForbidden },
+    { "Unsupported URL", ErrorUnsupportedURL },
+    { "is not a valid URL", ErrorUnsupportedURL },
+    { "HTTP Error 429", ErrorThrottled },
+    { "HTTP Error 403", ErrorForbidden },
+    { "timed out", ErrorNetwork },
+    { "Connection reset", ErrorNetwork },
+    { "Connection refused", ErrorNetwork },
+    { "Temporary failure in name resolution", ErrorNetwork },
+    { "Unable to download webpage", ErrorNetwork },
+    { "IncompleteRead", ErrorNetwork },
+}
+
+// The most lines of stderr kept in an Error when yt-dlp printed no ERROR: lines
+const maxErrorLines = 5
+
+// A failed yt-dlp run
+type Error struct {
+    Kind ErrorKind
+    // yt-dlp's ERROR: lines without the prefix, or the last lines of stderr
+    // if it did not print any
+    Messages []string
+    // The error from running the process, ex. exit status 1
+    Err error
+}
+
+func (e *Error) Error() string {
+    if len(e.Messages) == 0 {
+        return fmt.Sprintf("yt-dlp: %v", e.Err)
+    }
+    return fmt.Sprintf("yt-dlp: %v: %s", e.Err, strings.Join(e.Messages, "; "))
+}
+
+func (e *Error) Unwrap() error {
+    return e.Err
+}
+
+/* Parses what yt-dlp wrote to stderr into an Error, along with the WARNING:
+ * lines, which are returned even if err is nil. */
+func parseStderr(stderr string, err error) (*Error, []string) {
+    var warnings, errorLines, lines []string
+    for _,line := range strings.Split(stderr, "\n") {
+        line = strings.TrimSpace(line)
+        if line == "" {
+            continue
+        }
+        lines = append(lines, line)
+        if msg,ok := strings.CutPrefix(line, "WARNING: "); ok {
+            warnings = append(warnings, msg)
+        } else if msg,ok := strings.CutPrefix(line, "ERROR: "); ok {
+            errorLines = append(errorLines, msg)
+        }
+    }
+    if err == nil {
+        return nil, warnings
+    }
+    e := &Error{ Kind: ErrorUnknown, Messages: errorLines, Err: err }
+    if len(e.Messages) == 0 {
+        e.Messages = lines[max(0, len(lines) - maxErrorLines):]
+    }
+    if errors.Is(err, exec.ErrNotFound) {
+        e.Kind = ErrorNotInstalled
+        return e, warnings
+    }
+    for _,msg := range e.Messages {
+        for _,pattern := range errorPatterns {
+            if strings.Contains(msg, pattern.substr) {
+                e.Kind = pattern.kind
+                return e, warnings
+            }
+        }
+    }
+    return e, warnings
+}
@@ -0,0 +1,126 @@
+package yt_dlp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// A playlist, channel or album as listed by yt-dlp --flat-playlist
+type Playlist struct {
+    Id string `json:"id"`
+    Title string `json:"title"`
+    // The channel or user that made the playlist
+    Uploader string `json:"uploader"`
+    Channel string `json:"channel"`
+    WebpageURL string `json:"webpage_url"`
+    Entries []PlaylistEntry `json:"entries"`
+}
+
+type PlaylistEntry struct {
+    // "url" for a video, or "playlist" for a list inside the playlist, ex. a
+    // channel's tabs
+    Type string `json:"_type"`
+    // The extractor that handles the entry, ex. "Youtube" or "Soundcloud"
+    IEKey string `json:"ie_key"`
+    Id string `json:"id"`
+    URL string `json:"url"`
+    Title string `json:"title"`
+    // Duration in seconds, 0 if unknown
+    Duration float64 `json:"duration"`
+    Uploader string `json:"uploader"`
+    Channel string `json:"channel"`
+    Thumbnails []Thumbnail `json:"thumbnails"`
+}
+
+type Thumbnail struct {
+    URL string `json:"url"`
+    Width int `json:"width"`
+    Height int `json:"height"`
+}
+
+/* Lists the entries of a playlist or channel URL without downloading them.
+ * Entries that are lists themselves, like the tabs of a channel, are left
+ * out, a channel's /videos URL lists its videos. */
+func ListPlaylist(ctx context.Context, url string) (Playlist,error) {
+    var playlist Playlist
+    cmd := exec.CommandContext(ctx, Path, "--flat-playlist", "-J", "--", url)
+    var stderr strings.Builder
+    cmd.Stderr = &stderr
+    out, err := cmd.Output()
+    if e, _ := parseStderr(stderr.String(), err); e != nil {
+        return playlist, e
+    }
+    err = json.Unmarshal(out, &playlist)
+    if err != nil {
+        return playlist, fmt.Errorf("yt_dlp.ListPlaylist Could not parse the playlist: %v", err)
+    }
+    entries := playlist.Entries[:0]
+    for _,entry := range playlist.Entries {
+        if entry.Type == "playlist" || entry.IEKey == "YoutubeTab" || entry.Id == "" {
+            continue
+        }
+        entries = append(entries, entry)
+    }
+    playlist.Entries = entries
+    return playlist, nil
+}
+
+/* A single video as described by yt-dlp -J. Music that YouTube knows the
+ * details of, ex. the uploads of a "- Topic" channel, has a Track, Artist and
+ * Album. */
+type Video struct {
+    Id string `json:"id"`
+    Title string `json:"title"`
+    Track string `json:"track"`
+    Artist string `json:"artist"`
+    Album string `json:"album"`
+    // Duration in seconds, 0 if unknown
+    Duration float64 `json:"duration"`
+    Uploader string `json:"uploader"`
+    Channel string `json:"channel"`
+    // The URL of the best thumbnail
+    Thumbnail string `json:"thumbnail"`
+    WebpageURL string `json:"webpage_url"`
+    // The chapters that the uploader marked, in order, ex. the tracks of a
+    // full album. Empty if the video has none
+    Chapters []Chapter `json:"chapters"`
+}
+
+// A chapter of a video, its times are in seconds from the start of the video
+type Chapter struct {
+    Title string `json:"title"`
+    StartTime float64 `json:"start_time"`
+    EndTime float64 `json:"end_time"`
+}
+
+/* Looks up the details of a video id or URL without downloading it. A URL of
+ * a video in a playlist is only the video. */
+func GetVideo(ctx context.Context, url string) (Video,error) {
+    var video Video
+    cmd := exec.CommandContext(ctx, Path, "-J", "--no-playlist", "--", url)
+    var stderr strings.Builder
+    cmd.Stderr = &stderr
+    out, err := cmd.Output()
+    if e, _ := parseStderr(stderr.String(), err); e != nil {
+        return video, e
+    }
+    err = json.Unmarshal(out, &video)
+    if err != nil {
+        return video, fmt.Errorf("yt_dlp.GetVideo Could not parse the video: %v", err)
+    }
+    return video, nil
+}
+
+// Returns the URL of the widest thumbnail, or "" if there are none
+func (entry PlaylistEntry) Thumbnail() string {
+    best := Thumbnail{ Width: -1 }
+    for _,t := range entry.Thumbnails {
+        if t.Width > best.Width {
+            best = t
+        }
+    }
+    return best.URL
+}
@@ -2,17 +2,26 @@ package yt_dlp
 
 import (
 	"bufio"
-	"io"
+	"context"
+	"fmt"
+	"os"
 	"os/exec"
 	"strconv"
 	"strings"
 	"sync"
 )
 
+// The yt-dlp executable, a name without a slash is looked up in $PATH
+var Path = "yt-dlp"
+
 type Downloader struct {
     onProgressUpdate func(uint8)
     wg sync.WaitGroup
     filepath string
+    // every file that yt-dlp said it was writing, removed if the download is
+    // cancelled
+    files []string
+    warnings []string
     err error
 }
 
@@ -24,62 +33,109 @@ func (d *Downloader) Wait() {
     d.wg.Wait()
 }
 
-//returns the filepath of the downloaded audio file or the first error that occured
+/* returns the filepath of the downloaded audio file or the first error that
+ * occured, an *Error if yt-dlp failed */
 func (d *Downloader) GetFilepath() (string,error) {
     return d.filepath,d.err
 }
 
+// returns yt-dlp's WARNING: lines without the prefix, only valid after Wait
+func (d *Downloader) Warnings() []string {
+    return d.warnings
+}
+
 // Asynchronously downloades the file
 func (d *Downloader) DownloadAudio(vid string) {
+    d.DownloadAudioContext(context.Background(), vid)
+}
+
+/* Asynchronously downloads the file. Cancelling ctx kills yt-dlp and removes
+ * the files that it had written so far, GetFilepath then returns ctx.Err(). */
+func (d *Downloader) DownloadAudioContext(ctx context.Context, vid string) {
     d.wg.Add(1)
     go func() {
         defer d.wg.Done()
-        cmd := exec.Command("yt-dlp", "--newline", "--extract-audio",
-            "-o", "%(id)s.%(ext)s", vid)
-        stdout, err := cmd.StdoutPipe()
-        if err != nil {
-            d.err = err
-            return
+        d.err = d.download(ctx, vid)
+        if ctx.Err() != nil {
+            d.err = ctx.Err()
+            d.removeFiles()
         }
-        defer stdout.Close()
+    }()
+}
 
-        err = cmd.Start()
-        if err != nil {
-            d.err = err
-            return
-        }
+func (d *Downloader) download(ctx context.Context, vid string) error {
+    cmd := exec.CommandContext(ctx, Path, "--newline", "--extract-audio",
+        "-o", "%(id)s.%(ext)s", "--", vid)
+    var stderr strings.Builder
+    cmd.Stderr = &stderr
+    stdout, err := cmd.StdoutPipe()
+    if err != nil {
+        return err
+    }
+    err = cmd.Start()
+    if err != nil {
+        e, _ := parseStderr("", err)
+        return e
+    }
 
-        reader := bufio.NewReader(stdout)
-        var bytes []byte
-        for err != io.EOF {
-            bytes,_,err = reader.ReadLine()
-             if err != nil && err != io.EOF {
-                 d.err = err
-                 return
-            }
-            line := string(bytes)
-            if msg,ok := strings.CutPrefix(line, "[ExtractAudio] "); ok {
-                if dest,ok := strings.CutPrefix(msg, "Destination: "); ok {
-                    d.filepath = dest
-                }
-                continue
-            }
-            msg,ok := strings.CutPrefix(line, "[download] ")
-            if !ok {
-                continue
-            }
-            i := strings.IndexByte(msg, '%')
-            if i == -1 {
-                continue
-            }
-            percentF, err := strconv.ParseFloat(strings.TrimSpace(msg[0:i]), 32)
-            if err != nil {
-                continue
+    scanner := bufio.NewScanner(stdout)
+    for scanner.Scan() {
+        d.parseLine(scanner.Text())
+    }
+    // the files are only complete, and stderr only fully written, once yt-dlp
+    // has exited
+    err = cmd.Wait()
+    e, warnings := parseStderr(stderr.String(), err)
+    d.warnings = warnings
+    if e != nil {
+        return e
+    }
+    if d.filepath == "" {
+        return fmt.Errorf("yt-dlp did not report where the audio was saved")
+    }
+    return nil
+}
+
+// handles a line of yt-dlp's output
+func (d *Downloader) parseLine(line string) {
+    if msg,ok := strings.CutPrefix(line, "[ExtractAudio] "); ok {
+        if dest,ok := strings.CutPrefix(msg, "Destination: "); ok {
+            d.filepath = dest
+            d.files = append(d.files, dest)
+        } else if rest,ok := strings.CutPrefix(msg, "Not converting audio "); ok {
+            // "Not converting audio a.opus; file is already in target format opus"
+            if i := strings.Index(rest, "; "); i != -1 {
+                d.filepath = rest[:i]
             }
-            percent := uint8(percentF)
-            d.onProgressUpdate(percent)
         }
-    }()
+        return
+    }
+    msg,ok := strings.CutPrefix(line, "[download] ")
+    if !ok {
+        return
+    }
+    if dest,ok := strings.CutPrefix(msg, "Destination: "); ok {
+        d.files = append(d.files, dest)
+        return
+    }
+    i := strings.IndexByte(msg, '%')
+    if i == -1 {
+        return
+    }
+    percentF, err := strconv.ParseFloat(strings.TrimSpace(msg[0:i]), 32)
+    if err != nil {
+        return
+    }
+    if d.onProgressUpdate != nil {
+        d.onProgressUpdate(uint8(percentF))
+    }
 }
 
-
+// removes the downloaded files along with yt-dlp's partial and resume files
+func (d *Downloader) removeFiles() {
+    for _,file := range d.files {
+        os.Remove(file)
+        os.Remove(file + ".part")
+        os.Remove(file + ".ytdl")
+    }
+}
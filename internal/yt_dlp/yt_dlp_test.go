@@ -1,6 +1,9 @@
 package yt_dlp
 
-import "testing"
+import (
+	"errors"
+	"testing"
+)
 
 func TestDownloadAudio(t *testing.T) {
     var downloader Downloader
@@ -16,3 +19,59 @@ func TestDownloadAudio(t *testing.T) {
     }
     t.Logf("File saved to, \"%s\"\n", file)
 }
+
+func TestParseLine(t *testing.T) {
+    var progress []uint8
+    var d Downloader
+    d.OnProgressUpdate(func(p uint8) {
+        progress = append(progress, p)
+    })
+    for _,line := range []string{
+        "[youtube] Extracting URL: abc",
+        "[download] Destination: abc.webm",
+        "[download]   0.0% of    3.21MiB at  Unknown B/s ETA Unknown",
+        "[download]  45.3% of    3.21MiB at    1.20MiB/s ETA 00:01",
+        "[download] 100% of    3.21MiB in 00:00:02 at 1.43MiB/s",
+        "[ExtractAudio] Destination: abc.mp3",
+        "Deleting original file abc.webm (pass -k to keep)",
+    } {
+        d.parseLine(line)
+    }
+    if d.filepath != "abc.mp3" || len(d.files) != 2 {
+        t.Errorf("Expected abc.mp3 and 2 files, got %s %v", d.filepath, d.files)
+    }
+    if len(progress) != 3 || progress[1] != 45 || progress[2] != 100 {
+        t.Errorf("Expected progress 0, 45, 100, got %v", progress)
+    }
+
+    d = Downloader{}
+    d.parseLine("[ExtractAudio] Not converting audio abc.opus; file is already in target format opus")
+    if d.filepath != "abc.opus" {
+        t.Errorf("Expected an audio file that is already extracted to be used, got %s", d.filepath)
+    }
+}
+
+func TestParseStderr(t *testing.T) {
+    stderr := "WARNING: [youtube] Falling back to generic n function search\n" +
+        "ERROR: [youtube] abc: Video unavailable. This video has been removed by the uploader\n"
+    exitErr := errors.New("exit status 1")
+    e, warnings := parseStderr(stderr, exitErr)
+    if e.Kind != ErrorUnavailable || len(e.Messages) != 1 || !errors.Is(e, exitErr) {
+        t.Errorf("Expected an unavailable error, got %+v", e)
+    }
+    if len(warnings) != 1 || warnings[0] != "[youtube] Falling back to generic n function search" {
+        t.Errorf("Expected the warning, got %v", warnings)
+    }
+    e, _ = parseStderr("ERROR: unable to download video data: HTTP Error 429: Too Many Requests", exitErr)
+    if e.Kind != ErrorThrottled {
+        t.Errorf("Expected a throttled error, got %+v", e)
+    }
+    // without an ERROR: line the end of stderr is kept
+    e, _ = parseStderr("Traceback (most recent call last):\n  ...\nKeyError: 'formats'\n", exitErr)
+    if e.Kind != ErrorUnknown || len(e.Messages) != 3 || e.Messages[2] != "KeyError: 'formats'" {
+        t.Errorf("Expected the end of stderr, got %+v", e)
+    }
+    if e, warnings := parseStderr(stderr, nil); e != nil || len(warnings) != 1 {
+        t.Errorf("Expected only warnings for a successful run, got %v %v", e, warnings)
+    }
+}
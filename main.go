@@ -3,12 +3,26 @@ package main
 import (
 	"flag"
 	"log"
+	"os"
 	"path/filepath"
 
 	"github.com/TSchreiber/melo/internal"
 )
 
 func main() {
+    if len(os.Args) > 1 && os.Args[1] == "migrate" {
+        migrate(os.Args[2:])
+        return
+    }
+    if len(os.Args) > 1 && os.Args[1] == "fingerprint" {
+        fingerprint(os.Args[2:])
+        return
+    }
+    if len(os.Args) > 1 && os.Args[1] == "scan" {
+        scan(os.Args[2:])
+        return
+    }
+
     defaultConfigFilePath := "config.json"
     configFilePathPtr := flag.String("config", defaultConfigFilePath,
         "The path to the server configuration file")
@@ -22,3 +36,63 @@ func main() {
     config := internal.ParseConfig(configFilePath)
     internal.Launch(config)
 }
+
+// melo migrate -from config.json -to sqlite_config.json [-dry-run]
+func migrate(args []string) {
+    flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+    fromPtr := flags.String("from", "config.json",
+        "The configuration file of the server to copy the library from")
+    toPtr := flags.String("to", "",
+        "The configuration file of the server to copy the library to")
+    dryRunPtr := flags.Bool("dry-run", false,
+        "Count the records that would be copied without writing anything")
+    flags.Parse(args)
+    if *toPtr == "" {
+        log.Fatal("The -to flag is required")
+    }
+    fromPath,err := filepath.Abs(*fromPtr)
+    if err != nil {
+        log.Fatal(err)
+    }
+    toPath,err := filepath.Abs(*toPtr)
+    if err != nil {
+        log.Fatal(err)
+    }
+    log.Printf("Migrating from \"%s\" to \"%s\"\n", fromPath, toPath)
+
+    from := internal.ParseConfig(fromPath)
+    to := internal.ParseConfig(toPath)
+    internal.LaunchMigration(from.Database, to.Database, *dryRunPtr)
+}
+
+// melo fingerprint -config config.json
+func fingerprint(args []string) {
+    flags := flag.NewFlagSet("fingerprint", flag.ExitOnError)
+    configPtr := flags.String("config", "config.json",
+        "The configuration file of the server whose library is fingerprinted")
+    flags.Parse(args)
+    configPath,err := filepath.Abs(*configPtr)
+    if err != nil {
+        log.Fatal(err)
+    }
+    log.Printf("Fingerprinting the library of \"%s\"\n", configPath)
+
+    config := internal.ParseConfig(configPath)
+    internal.LaunchFingerprint(config.Database)
+}
+
+// melo scan -config config.json
+func scan(args []string) {
+    flags := flag.NewFlagSet("scan", flag.ExitOnError)
+    configPtr := flags.String("config", "config.json",
+        "The configuration file of the server whose library directories are scanned")
+    flags.Parse(args)
+    configPath,err := filepath.Abs(*configPtr)
+    if err != nil {
+        log.Fatal(err)
+    }
+    log.Printf("Scanning the library directories of \"%s\"\n", configPath)
+
+    config := internal.ParseConfig(configPath)
+    internal.LaunchScan(config)
+}
@@ -8,6 +8,14 @@
 * @property {string} audioURL The Melo resource URL
 * @property {string} artwork The URL for the song's artwork
 * @property {string} title
+* @property {number} [duration] The duration of the song in seconds
+* @property {string} [source] The video id or URL the song was downloaded from
+* @property {string} [addedBy] The email of the user that added the song
+* @property {string} [codec] The codec of the audio file, ex. "mp3" or "opus"
+* @property {number} [bitrate] The average bitrate of the audio file in bits per second
+* @property {number} [size] The size of the audio file in bytes
+* @property {number} [gain] The ReplayGain track gain in dB
+* @property {number} [peak] The true peak of the audio as a linear amplitude
 */
 
 /**
@@ -43,7 +51,17 @@ const nullPlaylist = {
 */
 function getSongMetadata(songId, idToken) {
     return new Promise((resolve, reject) => {
-        reject("getSongMetadata is not implemented");
+        let headers = new Headers();
+        headers.set("Authorization", idToken);
+        fetch ("/api/song/metadata?id=" + encodeURIComponent(songId), { headers })
+        .then(res => {
+            if (!res.ok) {
+                throw new Error(`GET /api/song/metadata returned with status code, "${res.status}"`);
+            }
+            return res.json();
+        })
+        .then(json => resolve(json))
+        .catch(err => reject(err));
     });
 }
 
@@ -97,7 +115,7 @@ function getBlobURLForSong(song, idToken) {
     return new Promise((resolve, reject) => {
         let headers = new Headers();
         headers.set("Authorization", idToken);
-        fetch (song.audioURL, { headers })
+        fetch ("/song/" + encodeURIComponent(song.id), { headers })
         .then(res => res.blob())
         .then(blob => {
             const blobUrl = URL.createObjectURL(blob);
@@ -124,33 +142,384 @@ function externalSearch(idToken, query) {
 }
 
 /**
+* @typedef DownloadJob {object}
+* @property {string} jobId
+* @property {string[]} steps The names of the job's steps, in the order that they are run
+*/
+
+/**
+* @typedef Duplicate {object}
+* @property {string} reason "source" if the song was downloaded from the same
+* video, "similar" if it has the same title, artist and duration, or "queued"
+* if the video is already being downloaded
+* @property {MeloSongMetadata} [song] The song in the library
+* @property {{id:string, request:{title:string}}} [job] The download in progress
+* @property {number} [entry] The index of the playlist entry that is a duplicate
+*/
+
+/**
+* Rejected by postSong, uploadSong and postPlaylistImport when a song is already in the
+* library or is being downloaded. The request can be sent again with force to
+* download it anyway.
+*/
+class DuplicateSongError extends Error {
+    /**
+    * @param {string} message
+    * @param {Duplicate[]} duplicates
+    */
+    constructor(message, duplicates) {
+        super(message);
+        this.duplicates = duplicates;
+    }
+}
+
+/**
+* Queues a download, its progress can be followed with watchDownloadJob
 * @param {{
 *   title:string,
 *   artist:string,
 *   album:string,
 *   artwork:string,
-*   source:string
+*   source:string,
+*   duration?:number
 * }} song
 * @param {string} idToken The id token used to authorize the request
-* @return {Promise<ReadableStreamDefaultReader<Uint8Array>>}
+* @param {boolean} [force] Download the song even if it is already in the library
+* @return {Promise<DownloadJob>}
+* @throws {DuplicateSongError}
 */
-function postSong(song, idToken) {
+function postSong(song, idToken, force = false) {
     return new Promise((resolve, reject) => {
         let headers = new Headers();
         headers.set("Authorization", idToken);
-        fetch ("/download/song", {
+        fetch (force ? "/download/song?force=true" : "/download/song", {
             method: "POST",
             headers,
             body: JSON.stringify(song),
         })
-        .then(res => {
-            if (!res.body) throw new Error("Missing response body");
-            resolve(res.body.getReader());
+        .then(async res => {
+            if (res.status == 409) {
+                throw new DuplicateSongError("The song is already in the library", [await res.json()]);
+            }
+            if (!res.ok) {
+                throw new Error(`POST /download/song returned with status code, "${res.status}": ${await res.text()}`);
+            }
+            return res.json();
+        })
+        .then(json => resolve(json))
+        .catch(err => reject(err));
+    });
+}
+
+/**
+* Uploads an audio file to be converted and added to the library like a
+* download. The song's title, artist and album are read from the file's tags
+* unless they are given.
+* @param {File} file
+* @param {string} idToken The id token used to authorize the request
+* @param {boolean} [force] Add the song even if it is already in the library
+* @param {{title?:string, artist?:string, album?:string, artwork?:string}} [song]
+* @return {Promise<DownloadJob>}
+* @throws {DuplicateSongError}
+*/
+function uploadSong(file, idToken, force = false, song = {}) {
+    return new Promise((resolve, reject) => {
+        let headers = new Headers();
+        headers.set("Authorization", idToken);
+        let body = new FormData();
+        for (let [key, value] of Object.entries(song)) {
+            if (value) body.set(key, value);
+        }
+        body.set("file", file);
+        fetch (force ? "/download/upload?force=true" : "/download/upload", {
+            method: "POST",
+            headers,
+            body,
+        })
+        .then(async res => {
+            if (res.status == 409) {
+                throw new DuplicateSongError("The song is already in the library", [await res.json()]);
+            }
+            if (!res.ok) {
+                throw new Error(`POST /download/upload returned with status code, "${res.status}": ${await res.text()}`);
+            }
+            return res.json();
+        })
+        .then(json => resolve(json))
+        .catch(err => reject(err));
+    });
+}
+
+/**
+* @typedef PlaylistPreviewEntry {object}
+* @property {string} title
+* @property {string} artist
+* @property {string} album
+* @property {string} artwork
+* @property {string} source The video id or URL that the song is downloaded from
+* @property {string} videoTitle The title of the video as it was uploaded
+* @property {number} duration The duration of the video in seconds, 0 if unknown
+* @property {number} [start] The start of the song in the video in seconds, for
+* the chapters of a video
+* @property {number} [end] The end of the song in the video in seconds
+* @property {number} [track] The song's number on its album
+*/
+
+/**
+* @typedef PlaylistPreview {object}
+* @property {string} title
+* @property {string} uploader
+* @property {string} url
+* @property {PlaylistPreviewEntry[]} entries
+*/
+
+/**
+* Lists the entries of a YouTube or SoundCloud playlist or channel, with the
+* metadata of each guessed from its title
+* @param {string} idToken The id token used to authorize the request
+* @param {string} url
+* @return {Promise<PlaylistPreview>}
+*/
+function previewPlaylist(idToken, url) {
+    return new Promise((resolve, reject) => {
+        let headers = new Headers();
+        headers.set("Authorization", idToken);
+        fetch (`/download/playlist?url=${encodeURIComponent(url)}`, { headers })
+        .then(async res => {
+            if (!res.ok) {
+                throw new Error(`GET /download/playlist returned with status code, "${res.status}": ${await res.text()}`);
+            }
+            return res.json();
         })
+        .then(json => resolve(json))
         .catch(err => reject(err));
     });
 }
 
+/**
+* Lists the chapters of a video, ex. a full album, as the entries of a playlist
+* with each chapter's section of the video
+* @param {string} idToken The id token used to authorize the request
+* @param {string} url
+* @return {Promise<PlaylistPreview>}
+*/
+function previewChapters(idToken, url) {
+    return new Promise((resolve, reject) => {
+        let headers = new Headers();
+        headers.set("Authorization", idToken);
+        fetch (`/download/chapters?url=${encodeURIComponent(url)}`, { headers })
+        .then(async res => {
+            if (!res.ok) {
+                throw new Error(`GET /download/chapters returned with status code, "${res.status}": ${await res.text()}`);
+            }
+            return res.json();
+        })
+        .then(json => resolve(json))
+        .catch(err => reject(err));
+    });
+}
+
+/**
+* @typedef ResolvedSource {object}
+* @property {string} title
+* @property {string} artist
+* @property {string} album
+* @property {string} artwork
+* @property {string} source
+* @property {number} duration
+*/
+
+/**
+* Looks up what a download source knows of a song, ex. the title of a video or
+* the tags of an audio file
+* @param {string} idToken The id token used to authorize the request
+* @param {string} source A video id, URL or path on the server
+* @return {Promise<ResolvedSource>}
+*/
+function resolveSource(idToken, source) {
+    return new Promise((resolve, reject) => {
+        let headers = new Headers();
+        headers.set("Authorization", idToken);
+        fetch (`/download/resolve?source=${encodeURIComponent(source)}`, { headers })
+        .then(async res => {
+            if (!res.ok) {
+                throw new Error(`GET /download/resolve returned with status code, "${res.status}": ${await res.text()}`);
+            }
+            return res.json();
+        })
+        .then(json => resolve(json))
+        .catch(err => reject(err));
+    });
+}
+
+/**
+* @typedef SpotifyTrackMatch {object}
+* @property {string} spotifyId
+* @property {{title:string, artist:string, album:string, artwork:string, duration:number}} track
+* @property {Array<{video:Object, confidence:number}>} candidates The videos
+* that could be the track, most likely first. The confidence is from 0 to 1
+* @property {string} [error] Why no videos were found
+*/
+
+/**
+* @typedef SpotifyPlaylistMatches {object}
+* @property {string} title
+* @property {string} description
+* @property {string} artwork
+* @property {SpotifyTrackMatch[]} tracks
+*/
+
+/**
+* Fetches a Spotify playlist and searches YouTube for each of its tracks. This
+* can take a while for a long playlist.
+* @param {string} idToken The id token used to authorize the request
+* @param {string} url A Spotify playlist link
+* @return {Promise<SpotifyPlaylistMatches>}
+*/
+function matchSpotifyPlaylist(idToken, url) {
+    return new Promise((resolve, reject) => {
+        let headers = new Headers();
+        headers.set("Authorization", idToken);
+        fetch (`/download/spotify/playlist?url=${encodeURIComponent(url)}`, { headers })
+        .then(async res => {
+            if (!res.ok) {
+                throw new Error(`GET /download/spotify/playlist returned with status code, "${res.status}": ${await res.text()}`);
+            }
+            return res.json();
+        })
+        .then(json => resolve(json))
+        .catch(err => reject(err));
+    });
+}
+
+/**
+* @typedef PlaylistImport {object}
+* @property {string} group
+* @property {string} [playlistId] The Melo playlist that the songs are added to
+* @property {string[]} jobIds The job of each entry, in order
+* @property {string[]} steps The names of each job's steps
+*/
+
+/**
+* Queues a download for each entry. If playlist is given the songs are added
+* to a new playlist, in order, once they have all been downloaded.
+* @param {string} idToken The id token used to authorize the request
+* @param {Array<{
+*   title:string,
+*   artist:string,
+*   album:string,
+*   artwork:string,
+*   source:string,
+*   duration?:number
+* }>} entries
+* @param {{title:string, description?:string, artwork?:string}} [playlist]
+* @param {boolean} [force] Download the songs even if some are already in the library
+* @return {Promise<PlaylistImport>}
+* @throws {DuplicateSongError} Nothing is queued if any of the entries is a duplicate
+*/
+function postPlaylistImport(idToken, entries, playlist, force = false) {
+    return new Promise((resolve, reject) => {
+        let headers = new Headers();
+        headers.set("Authorization", idToken);
+        fetch (force ? "/download/playlist?force=true" : "/download/playlist", {
+            method: "POST",
+            headers,
+            body: JSON.stringify({ entries, playlist }),
+        })
+        .then(async res => {
+            if (res.status == 409) {
+                let { duplicates } = await res.json();
+                throw new DuplicateSongError(`${duplicates.length} of the songs are already in the library`, duplicates);
+            }
+            if (!res.ok) {
+                throw new Error(`POST /download/playlist returned with status code, "${res.status}": ${await res.text()}`);
+            }
+            return res.json();
+        })
+        .then(json => resolve(json))
+        .catch(err => reject(err));
+    });
+}
+
+/**
+* @typedef DownloadJobEvent {object}
+* @property {string} event One of "step-start", "progress", "warning", "done" or "error"
+* @property {{
+*   step?:string,
+*   progress?:number,
+*   message?:string,
+*   songId?:string,
+*   state?:string
+* }} data
+*/
+
+/**
+* Follows the progress of a download job. The event stream is read with fetch
+* since EventSource can not send the Authorization header. If the connection
+* drops it is opened again, the server resends the current step.
+* @param {string} jobId
+* @param {string} idToken The id token used to authorize the request
+* @param {function(DownloadJobEvent):void} onEvent
+* @return {Promise<DownloadJobEvent>} The done or error event that ended the job
+*/
+async function watchDownloadJob(jobId, idToken, onEvent) {
+    let lastEventId = "";
+    for (let retries = 0; ; retries++) {
+        let headers = new Headers();
+        headers.set("Authorization", idToken);
+        if (lastEventId) headers.set("Last-Event-ID", lastEventId);
+        try {
+            let res = await fetch(`/download/jobs/${encodeURIComponent(jobId)}/events`, { headers });
+            if (!res.ok || !res.body) {
+                throw new Error(`GET /download/jobs/${jobId}/events returned with status code, "${res.status}"`);
+            }
+            let reader = res.body.pipeThrough(new TextDecoderStream()).getReader();
+            let buffer = "";
+            while (true) {
+                let { value, done } = await reader.read();
+                if (done) break;
+                buffer += value;
+                let end;
+                while ((end = buffer.indexOf("\n\n")) != -1) {
+                    let event = parseServerSentEvent(buffer.substring(0, end));
+                    buffer = buffer.substring(end + 2);
+                    if (!event) continue;
+                    retries = 0;
+                    if (event.id) lastEventId = event.id;
+                    onEvent(event);
+                    if (event.event == "done" || event.event == "error") {
+                        reader.cancel();
+                        return event;
+                    }
+                }
+            }
+        } catch (err) {
+            if (retries >= 5) throw err;
+            console.error(err);
+        }
+        await new Promise(resolve => setTimeout(resolve, 1000 * 2 ** retries));
+    }
+}
+
+/**
+* @param {string} block The lines of a single event
+* @return {DownloadJobEvent & {id?:string} | null} null for a comment
+*/
+function parseServerSentEvent(block) {
+    let event = "message", id = "", data = "";
+    for (let line of block.split("\n")) {
+        let i = line.indexOf(":");
+        if (i == 0) continue;
+        let field = i == -1 ? line : line.substring(0, i);
+        let value = i == -1 ? "" : line.substring(i + 1).replace(/^ /, "");
+        if (field == "event") event = value;
+        else if (field == "id") id = value;
+        else if (field == "data") data += value;
+    }
+    if (!data) return null;
+    return { event, id, data: JSON.parse(data) };
+}
+
 /**
  * @param {string} playlistId
  * @param {string} idToken The id token used to authorize the request
@@ -220,6 +589,38 @@ function samplePlaylists(idToken) {
     });
 }
 
+/**
+ * Changes the title, artist, album and artwork of a song, requires the admin
+ * permission
+ * @param {string} idToken The id token used to authorize the request
+ * @param {MeloSongMetadata} song
+ * @return {Promise<void>}
+ */
+function updateSongMetadata(idToken, song) {
+    return new Promise((resolve, reject) => {
+        let headers = new Headers();
+        headers.set("Authorization", idToken);
+        fetch ("/api/song/metadata", {
+            headers,
+            method: "POST",
+            body: JSON.stringify({
+                songId: song.id,
+                title: song.title,
+                artist: song.artist,
+                album: song.album,
+                artwork: song.artwork,
+            }),
+        })
+        .then(res => {
+            if (!res.ok) {
+                throw new Error(`POST /api/song/metadata returned with status code, "${res.status}"`);
+            }
+            resolve();
+        })
+        .catch(err => reject(err));
+    });
+}
+
 /**
  *
  * @param {string} idToken The id token used to authorize the request
@@ -321,6 +722,15 @@ export default {
     getBlobURLForSong,
     externalSearch,
     postSong,
+    uploadSong,
+    DuplicateSongError,
+    previewPlaylist,
+    previewChapters,
+    resolveSource,
+    matchSpotifyPlaylist,
+    postPlaylistImport,
+    watchDownloadJob,
+    updateSongMetadata,
     getPlaylist,
     getPersonalPlaylists,
     samplePlaylists,
@@ -287,6 +287,46 @@ function timeToString(t) {
 }
 
 
+/**
+* The audio player is routed through this node so that songs can be made louder
+* as well as quieter, the volume of the element can not go above 1
+* @private
+* @type {GainNode|null}
+*/
+let gainNode = null;
+
+/**
+* Applies the song's track gain so that every song plays at about the same
+* loudness. The gain is limited by the song's peak to avoid clipping.
+* @private
+* @param {MeloSongMetadata} song
+*/
+function applyTrackGain(song) {
+    try {
+        if (!gainNode) {
+            const context = new AudioContext();
+            gainNode = context.createGain();
+            context.createMediaElementSource(audioPlayer()).connect(gainNode);
+            gainNode.connect(context.destination);
+        }
+        // contexts created before the user interacted with the page start suspended
+        if (gainNode.context.state === "suspended") {
+            /** @type {AudioContext} */ (gainNode.context).resume();
+        }
+    } catch (e) {
+        console.warn("Track gain is not supported", e);
+        return;
+    }
+    let gain = 1;
+    if (song.gain) {
+        gain = Math.pow(10, song.gain / 20);
+        if (song.peak) {
+            gain = Math.min(gain, 1 / song.peak);
+        }
+    }
+    gainNode.gain.value = gain;
+}
+
 /**
 * @see [MeloAPI~MeloSongMetadata](./module-MeloAPI.html#~MeloSongMetadata)
 * @typedef {import('./melo_api.mjs').MeloSongMetadata} MeloSongMetadata
@@ -308,6 +348,7 @@ export function setSong(song) {
             const blobUrl = await MeloApi.getBlobURLForSong(song, idToken);
             audioSource().setAttribute("src", blobUrl);
             audioPlayer().load();
+            applyTrackGain(song);
             if ('mediaSession' in navigator) {
                 navigator.mediaSession.metadata = new MediaMetadata({
                     title: song.title,
@@ -12,6 +12,14 @@ import Auth from "./auth.mjs"
  * @typedef {Object} SearchResults
  * @property {Array<Video>} videos - An array of video objects.
  * @property {Array<Song>} songs - An array of song objects.
+ * @property {Array<Suggestion>} suggestions - The videos ranked for each song.
+ */
+
+/**
+ * @typedef {Object} Suggestion
+ * @property {number} song - The index of the song in SearchResults.songs.
+ * @property {Array<{id:string, confidence:number}>} videos - The ids of the
+ * videos, most likely to be the song first, with how likely they are from 0 to 1.
  */
 
 /**
@@ -41,6 +49,8 @@ window.addEventListener("load", () => {
     _main = /** @type {HTMLElement} */
         (document.querySelector("main"));
     getElementById("search-form").onsubmit = _submitSearch;
+    getElementById("playlist-form").onsubmit = _submitPlaylist;
+    getElementById("upload-form").onsubmit = _submitUpload;
 });
 
 function showSearch() {
@@ -62,6 +72,7 @@ function showSearch() {
             <input id="search"
                 name="search"
                 type="search"
+                placeholder="Song, video URL or audio file"
                 autocomplete="off"
                 class="border-none bg-none w-full"
                 style="margin-bottom: 0">
@@ -70,8 +81,45 @@ function showSearch() {
         </label>
         <button type="submit" class="w-full py-1 rounded text-lg bg-white">Search</button>
     </form>
+    <h1>Import a playlist</h1>
+    <form id="playlist-form"
+        class="rounded-lg flex flex-column gap-4">
+        <label for="playlist-url"
+            class="flex space-between rounded border-black border-2 border-solid bg-white">
+            <input id="playlist-url"
+                name="playlist-url"
+                type="url"
+                placeholder="YouTube, SoundCloud or Spotify playlist URL, or a full album video"
+                autocomplete="off"
+                class="border-none bg-none w-full"
+                style="margin-bottom: 0">
+            </input>
+            <div class="material-icons">playlist_add</div>
+        </label>
+        <button type="submit" class="w-full py-1 rounded text-lg bg-white">List songs</button>
+    </form>
+    <h1>Upload a file</h1>
+    <form id="upload-form"
+        class="rounded-lg flex flex-column gap-4">
+        <label for="upload-file"
+            class="flex space-between rounded border-black border-2 border-solid bg-white">
+            <input id="upload-file"
+                name="upload-file"
+                type="file"
+                accept="audio/*"
+                class="border-none bg-none w-full"
+                style="margin-bottom: 0">
+            </input>
+            <div class="material-icons">upload_file</div>
+        </label>
+        <button type="submit" class="w-full py-1 rounded text-lg bg-white">Upload</button>
+    </form>
     `;
-    setTimeout(() => getElementById("search-form").onsubmit = _submitSearch, 0);
+    setTimeout(() => {
+        getElementById("search-form").onsubmit = _submitSearch;
+        getElementById("playlist-form").onsubmit = _submitPlaylist;
+        getElementById("upload-form").onsubmit = _submitUpload;
+    }, 0);
 }
 
 function _submitSearch() {
@@ -81,6 +129,12 @@ function _submitSearch() {
         if (!query) return false;
         let idToken = Auth.getIdToken() || /** @type {string} */
             (await Auth.refreshIdToken());
+        if (isSourceReference(query)) {
+            // there is nothing to search for, the song is downloaded from it
+            let song = await MeloApi.resolveSource(idToken, query.trim());
+            showResolvedSource(song);
+            return;
+        }
         /** @type {SearchResults} */
         let res = await MeloApi.externalSearch(idToken, query)
         console.log(res);
@@ -89,6 +143,83 @@ function _submitSearch() {
     return false;
 }
 
+/**
+ * @param {string} query
+ * @returns {boolean} Whether the query is a URL or a path on the server
+ * instead of words to search for
+ */
+function isSourceReference(query) {
+    query = query.trim();
+    return /^(https?|file):\/\/\S+$/.test(query) || /^\/\S/.test(query);
+}
+
+/**
+ * @see [MeloAPI~ResolvedSource](./module-MeloAPI.html#~ResolvedSource)
+ * @typedef {import('./melo_api.mjs').ResolvedSource} ResolvedSource
+ */
+
+/**
+ * Shows what the source knows of the song so that it can be corrected before
+ * it is downloaded
+ * @param {ResolvedSource} resolved
+ */
+function showResolvedSource(resolved) {
+    _main.innerHTML = `
+    <div class="text-4xl text-center">Confirm Song</div>
+    <div class="flex align-center gap-4">
+        <img id="resolved-artwork" class="h-24">
+        <div class="flex flex-column gap-2 w-full">
+            <input id="resolved-title" type="text" placeholder="Title" class="rounded p-1 text-lg">
+            <input id="resolved-artist" type="text" placeholder="Artist" class="rounded p-1">
+            <input id="resolved-album" type="text" placeholder="Album" class="rounded p-1">
+            <div id="resolved-source" class="text-zinc-300 text-sm"></div>
+        </div>
+    </div>
+    `;
+    let artwork = /**@type {HTMLImageElement}*/ (getElementById("resolved-artwork"));
+    if (resolved.artwork) {
+        artwork.src = resolved.artwork;
+    } else {
+        artwork.remove();
+    }
+    let title = /**@type {HTMLInputElement}*/ (getElementById("resolved-title"));
+    let artist = /**@type {HTMLInputElement}*/ (getElementById("resolved-artist"));
+    let album = /**@type {HTMLInputElement}*/ (getElementById("resolved-album"));
+    title.value = resolved.title;
+    artist.value = resolved.artist;
+    album.value = resolved.album;
+    getElementById("resolved-source").innerText = resolved.duration
+        ? `${resolved.source} (${secondsToDurationString(resolved.duration)})`
+        : resolved.source;
+
+    let submit = document.createElement("button");
+    submit.innerText = "Confirm & Download";
+    submit.classList.add("bg-white","w-full","text-lg","py-1","rounded");
+    submit.onclick = async () => {
+        if (!title.value) return;
+        let idToken = Auth.getIdToken() || /** @type {string} */
+            (await Auth.refreshIdToken());
+        let song = {
+            title: title.value,
+            artist: artist.value,
+            album: album.value,
+            artwork: resolved.artwork,
+            source: resolved.source,
+            duration: resolved.duration,
+        };
+        let job;
+        try {
+            job = await MeloApi.postSong(song, idToken);
+        } catch (err) {
+            if (!(err instanceof MeloApi.DuplicateSongError)) throw err;
+            if (!confirmDuplicates(err.duplicates, [song.title])) return;
+            job = await MeloApi.postSong(song, idToken, true);
+        }
+        showProgress(job, idToken);
+    };
+    _main.appendChild(submit);
+}
+
 /**
  * @param {SearchResults} searchResults
  */
@@ -150,6 +281,14 @@ function showSpotifyResults(searchResults) {
     _main.appendChild(style);
 }
 
+/**
+ * @param {number} confidence How likely a video is to be a song, from 0 to 1
+ * @returns {string} ex. "92% match"
+ */
+function confidenceToString(confidence) {
+    return `${Math.round(confidence * 100)}% match`;
+}
+
 /**
  * @param {number} duration Duration in seconds
  * @returns {string} The string representation of the duration
@@ -199,13 +338,27 @@ function showYouTubeResults(searchResults, selectedSong) {
         showConfirmAndDownload(selectedSong,selectedVideo);
     };
 
-    for (let video of searchResults.videos) {
+    // the videos most likely to be the selected song are listed first
+    let suggestion = searchResults.suggestions?.find(s =>
+        searchResults.songs[s.song] === selectedSong);
+    /** @type {Map<string,number>} */
+    let confidence = new Map(suggestion?.videos.map(v => [v.id, v.confidence]));
+    let videos = suggestion
+        ? suggestion.videos.map(v => /** @type {Video} */
+            (searchResults.videos.find(video => video.id == v.id)))
+        : searchResults.videos;
+
+    for (let video of videos) {
         let el = document.createElement("div");
         el.classList.add("flex","align-center","gap-4","cursor-pointer");
+        let match = confidence.has(video.id)
+            ? `<div class="text-zinc-300 text-sm">${confidenceToString(/** @type {number} */ (confidence.get(video.id)))}</div>`
+            : "";
         el.innerHTML = `
             <img src="${video.thumbnail}" class="h-24">
             <div>
                 <div class="text-2xl">${video.title}</div>
+                ${match}
                 <div class="flex gap-2 text-zinc-300 text-sm">
                     <div>${viewCountToString(video.viewCount)}</div>
                     <div>:</div>
@@ -223,6 +376,12 @@ function showYouTubeResults(searchResults, selectedSong) {
         });
         results.appendChild(el);
     }
+    // a likely match is selected already, the admin only has to confirm it
+    let best = suggestion?.videos[0];
+    if (best && best.confidence >= likelyMatchConfidence) {
+        /** @type {HTMLElement} */
+        (results.children[0]).click();
+    }
 
     let style = document.createElement("style");
     style.innerText = `
@@ -333,82 +492,41 @@ function showConfirmAndDownload(selectedSong, selectedVideo) {
     submit.onclick = async () => {
         let idToken = Auth.getIdToken() || /** @type {string} */
             (await Auth.refreshIdToken());
-        let stream = await MeloApi.postSong({
+        let song = {
             title: selectedSong.title,
             artist: selectedSong.artist,
             album: selectedSong.album,
             artwork: selectedSong.artwork,
             source: selectedVideo.id,
-        }, idToken);
-        showProgress(stream);
+            duration: selectedVideo.duration,
+        };
+        let job;
+        try {
+            job = await MeloApi.postSong(song, idToken);
+        } catch (err) {
+            if (!(err instanceof MeloApi.DuplicateSongError)) throw err;
+            if (!confirmDuplicates(err.duplicates, [song.title])) return;
+            job = await MeloApi.postSong(song, idToken, true);
+        }
+        showProgress(job, idToken);
     };
     _main.appendChild(submit);
 }
 
 /**
- * @returns {ReadableStreamDefaultReader}
+ * @see [MeloAPI~DownloadJob](./module-MeloAPI.html#~DownloadJob)
+ * @typedef {import('./melo_api.mjs').DownloadJob} DownloadJob
  */
-function createTestStream() {
-    const data = [
-        {steps: ["Download","Extract"]},
-        {step: "Download", progress:    0, done: false },
-        {step: "Download", progress:    0, done: false },
-        {step: "Download", progress:    0, done: false },
-        {step: "Download", progress:    0, done: false },
-        {step: "Download", progress:  .01, done: false },
-        {step: "Download", progress:  .02, done: false },
-        {step: "Download", progress:  .04, done: false },
-        {step: "Download", progress:  .09, done: false },
-        {step: "Download", progress:  .18, done: false },
-        {step: "Download", progress:  .36, done: false },
-        {step: "Download", progress:  .73, done: false },
-        {step: "Download", progress:    1, done: false },
-        {step: "Download", progress:    1, done: true  },
-        {step: "Extract" , progress:  .13, done: false },
-        {step: "Extract" , progress:  .29, done: false },
-        {step: "Extract" , progress:  .45, done: false },
-        {step: "Extract" , progress:  .61, done: false },
-        {step: "Extract" , progress:  .76, done: false },
-        {step: "Extract" , progress:  .92, done: false },
-        {step: "Extract" , progress:  .99, done: false },
-        {step: "Extract" , progress:    1, done: true  },
-    ];
-    let encoder = new TextEncoder();
-    const stream = new ReadableStream({
-        start(controller) {
-            let index = 0;
-            const intervalId = setInterval(() => {
-                let json = JSON.stringify(data[index]);
-                let bytes = encoder.encode(json);
-                controller.enqueue(bytes);
-                index++;
-                if (index >= data.length) {
-                    controller.close();
-                    clearInterval(intervalId);
-                }
-            }, 250);
-        },
-    });
-    return stream.getReader();
-}
 
 /**
- * @param {ReadableStreamDefaultReader<Uint8Array>} stream
+ * @param {DownloadJob} job
+ * @param {string} idToken
  */
-async function showProgress(stream) {
+async function showProgress(job, idToken) {
     _main.innerHTML = `
         <div class="text-4xl text-center">Progress</div>
     `
 
-    let decoder = new TextDecoder();
-    let res = await stream.read();
-    if (!res.value) {
-        return;
-    }
-    let json = decoder.decode(res.value);
-    let { steps: stepNames } = JSON.parse(json)
-    let steps = {};
-
     /**
      * @typedef Step
      * @property {HTMLElement} element
@@ -443,39 +561,494 @@ async function showProgress(stream) {
     grid.style.columnGap = "1rem"
     _main.appendChild(grid);
 
-    for (let s of stepNames) {
+    /** @type {Object<string,Step>} */
+    let steps = {};
+    for (let s of job.steps) {
         steps[s] = newStep(s);
         grid.appendChild(steps[s].element);
     }
 
+    let messages = document.createElement("div");
+    messages.classList.add("flex","flex-column","gap-2","text-sm");
+    _main.appendChild(messages);
+    /** @param {string} text */
+    function showMessage(text) {
+        let el = document.createElement("div");
+        el.innerText = text;
+        messages.appendChild(el);
+    }
+
     let resetButton = document.createElement("button");
     resetButton.innerText = "Download another song";
     resetButton.classList.add("bg-white","w-full","text-lg","py-1","rounded");
     resetButton.addEventListener("click", showSearch);
     _main.appendChild(resetButton);
 
+    // the steps before the current one have finished, even if their
+    // progress was never received
+    /** @param {string} step */
+    function finishStepsBefore(step) {
+        for (let s of job.steps) {
+            if (s == step) break;
+            steps[s].setProgress(100);
+        }
+    }
+
+    try {
+        await MeloApi.watchDownloadJob(job.jobId, idToken, ({ event, data }) => {
+            switch (event) {
+            case "step-start":
+                finishStepsBefore(/** @type {string} */ (data.step));
+                break;
+            case "progress":
+                steps[/** @type {string} */ (data.step)]?.setProgress(data.progress || 0);
+                break;
+            case "warning":
+                showMessage("Warning: " + data.message);
+                break;
+            case "done":
+                for (let s of job.steps) steps[s].setProgress(100);
+                showMessage("Done");
+                break;
+            case "error":
+                showMessage("Error: " + data.message);
+                break;
+            }
+        });
+    } catch (err) {
+        console.error(err);
+        showMessage("Lost track of the download, it may still finish");
+    }
+}
+
+/**
+ * @see [MeloAPI~PlaylistPreview](./module-MeloAPI.html#~PlaylistPreview)
+ * @typedef {import('./melo_api.mjs').PlaylistPreview} PlaylistPreview
+ * @see [MeloAPI~PlaylistImport](./module-MeloAPI.html#~PlaylistImport)
+ * @typedef {import('./melo_api.mjs').PlaylistImport} PlaylistImport
+ * @see [MeloAPI~PlaylistPreviewEntry](./module-MeloAPI.html#~PlaylistPreviewEntry)
+ * @typedef {import('./melo_api.mjs').PlaylistPreviewEntry} PlaylistPreviewEntry
+ * @see [MeloAPI~SpotifyPlaylistMatches](./module-MeloAPI.html#~SpotifyPlaylistMatches)
+ * @typedef {import('./melo_api.mjs').SpotifyPlaylistMatches} SpotifyPlaylistMatches
+ */
+
+function _submitPlaylist() {
+    (async () => {
+        let url = /**@type {HTMLInputElement}*/
+            (getElementById("playlist-url")).value
+        if (!url) return false;
+        let idToken = Auth.getIdToken() || /** @type {string} */
+            (await Auth.refreshIdToken());
+        try {
+            if (/^(https:\/\/open\.spotify\.com\/|spotify:)/.test(url)) {
+                _main.innerHTML = `<div class="text-2xl text-center">Finding the songs on YouTube...</div>`;
+                showSpotifyMatches(await MeloApi.matchSpotifyPlaylist(idToken, url));
+            } else {
+                let preview = await MeloApi.previewPlaylist(idToken, url);
+                if (preview.entries.length == 0) {
+                    // a single video, ex. a full album, is split by its chapters
+                    preview = await MeloApi.previewChapters(idToken, url);
+                }
+                showPlaylistPreview(preview);
+            }
+        } catch (err) {
+            console.error(err);
+            alert("The playlist could not be listed");
+        }
+    })();
+    return false;
+}
+
+function _submitUpload() {
+    (async () => {
+        let file = /**@type {HTMLInputElement}*/
+            (getElementById("upload-file")).files?.[0];
+        if (!file) return false;
+        let idToken = Auth.getIdToken() || /** @type {string} */
+            (await Auth.refreshIdToken());
+        _main.innerHTML = `<div class="text-2xl text-center">Uploading...</div>`;
+        let job;
+        try {
+            try {
+                job = await MeloApi.uploadSong(file, idToken);
+            } catch (err) {
+                if (!(err instanceof MeloApi.DuplicateSongError)) throw err;
+                if (!confirmDuplicates(err.duplicates, [file.name])) {
+                    showSearch();
+                    return;
+                }
+                job = await MeloApi.uploadSong(file, idToken, true);
+            }
+        } catch (err) {
+            console.error(err);
+            alert("The file could not be uploaded");
+            showSearch();
+            return;
+        }
+        showProgress(job, idToken);
+    })();
+    return false;
+}
+
+/**
+ * Lists the playlist's entries for review. Each entry can be left out and its
+ * metadata corrected before it is downloaded.
+ * @param {PlaylistPreview} preview
+ */
+function showPlaylistPreview(preview) {
+    _main.innerHTML = `
+    <div class="text-4xl text-center"></div>
+    <div class="text-zinc-300 text-sm text-center"></div>
+    `;
+    /** @type {HTMLElement} */
+    (_main.children[0]).innerText = preview.title;
+    /** @type {HTMLElement} */
+    (_main.children[1]).innerText = `${preview.uploader} : ${preview.entries.length} songs`;
+
     /**
-     * @typedef ProgressUpdate
-     * @property {string} step
-     * @property {number} progress
-     * @property {boolean} done
+     * @param {string} name
+     * @param {string} value
+     * @returns {HTMLInputElement}
      */
+    function newInput(name, value) {
+        let input = document.createElement("input");
+        input.placeholder = name;
+        input.value = value;
+        input.classList.add("w-full","rounded","px-1");
+        return input;
+    }
 
-    var streamDone = false;
-    while (!streamDone) {
-        stream.read()
-        .then(res => {
-            streamDone = res.done
-            if (!res.value) return;
-            let json = decoder.decode(res.value);
-            /** @type {ProgressUpdate} */
-                let update = JSON.parse(json);
-            steps[update.step].setProgress(update.progress);
-        })
-        .catch(err => {
+    let results = document.createElement("div");
+    results.classList.add("flex","flex-column","gap-2");
+    _main.appendChild(results);
+
+    /** @type {Array<{entry:PlaylistPreviewEntry, selected:HTMLInputElement, title:HTMLInputElement, artist:HTMLInputElement, album:HTMLInputElement}>} */
+    let rows = [];
+    for (let entry of preview.entries) {
+        let el = document.createElement("div");
+        el.classList.add("flex","align-center","gap-4");
+        let selected = document.createElement("input");
+        selected.type = "checkbox";
+        selected.checked = true;
+        el.appendChild(selected);
+        let img = document.createElement("img");
+        img.src = entry.artwork;
+        img.classList.add("h-24");
+        el.appendChild(img);
+        let fields = document.createElement("div");
+        fields.classList.add("flex","flex-column","gap-1","w-full");
+        let videoTitle = document.createElement("div");
+        videoTitle.classList.add("text-zinc-300","text-sm");
+        videoTitle.innerText = entry.duration
+            ? `${entry.videoTitle} : ${secondsToDurationString(entry.duration)}`
+            : entry.videoTitle;
+        let row = {
+            entry,
+            selected,
+            title: newInput("Title", entry.title),
+            artist: newInput("Artist", entry.artist),
+            album: newInput("Album", entry.album),
+        };
+        fields.append(videoTitle, row.title, row.artist, row.album);
+        el.appendChild(fields);
+        results.appendChild(el);
+        rows.push(row);
+    }
+
+    let createPlaylist = document.createElement("label");
+    createPlaylist.classList.add("flex","align-center","gap-2","text-white");
+    createPlaylist.innerHTML = `<input type="checkbox" checked> Create a playlist named`;
+    let createPlaylistCheckbox = /** @type {HTMLInputElement} */
+        (createPlaylist.querySelector("input"));
+    let playlistTitle = newInput("Playlist title", preview.title);
+    _main.append(createPlaylist, playlistTitle);
+
+    let submit = document.createElement("button");
+    submit.innerText = "Download selected songs";
+    submit.classList.add("bg-white","w-full","text-lg","py-1","rounded");
+    submit.onclick = async () => {
+        let entries = rows
+            .filter(row => row.selected.checked)
+            .map(row => ({
+                title: row.title.value,
+                artist: row.artist.value,
+                album: row.album.value,
+                artwork: row.entry.artwork,
+                source: row.entry.source,
+                duration: row.entry.duration,
+                start: row.entry.start,
+                end: row.entry.end,
+                track: row.entry.track,
+            }));
+        if (entries.length == 0) return;
+        if (entries.some(entry => !entry.title)) {
+            alert("Every selected song needs a title");
+            return;
+        }
+        let playlist = createPlaylistCheckbox.checked && playlistTitle.value
+            ? { title: playlistTitle.value, artwork: entries[0].artwork }
+            : undefined;
+        submit.disabled = true;
+        let idToken = Auth.getIdToken() || /** @type {string} */
+            (await Auth.refreshIdToken());
+        try {
+            let playlistImport = await postPlaylistImport(idToken, entries, playlist);
+            if (!playlistImport) {
+                submit.disabled = false;
+                return;
+            }
+            showPlaylistProgress(playlistImport, entries.map(entry => entry.title), idToken);
+        } catch (err) {
             console.error(err);
-        });
+            alert("The songs could not be queued");
+            submit.disabled = false;
+        }
+    };
+    _main.appendChild(submit);
+}
+
+// Matches at least this confident are selected for download at first
+const likelyMatchConfidence = 0.5;
+
+/**
+ * Lists each track of a Spotify playlist with the YouTube video that it was
+ * matched to. Another of the candidates can be picked, and tracks without a
+ * likely match are left out unless they are selected.
+ * @param {SpotifyPlaylistMatches} matches
+ */
+function showSpotifyMatches(matches) {
+    _main.innerHTML = `
+    <div class="text-4xl text-center"></div>
+    <div class="text-zinc-300 text-sm text-center"></div>
+    `;
+    /** @type {HTMLElement} */
+    (_main.children[0]).innerText = matches.title;
+    /** @type {HTMLElement} */
+    (_main.children[1]).innerText = `${matches.tracks.length} songs`;
+
+    let results = document.createElement("div");
+    results.classList.add("flex","flex-column","gap-2");
+    _main.appendChild(results);
+
+    /** @type {Array<{match:import('./melo_api.mjs').SpotifyTrackMatch, selected:HTMLInputElement, video:HTMLSelectElement}>} */
+    let rows = [];
+    for (let match of matches.tracks) {
+        let el = document.createElement("div");
+        el.classList.add("flex","align-center","gap-4");
+        let selected = document.createElement("input");
+        selected.type = "checkbox";
+        let best = match.candidates[0];
+        selected.checked = !!best && best.confidence >= likelyMatchConfidence;
+        selected.disabled = !best;
+        el.appendChild(selected);
+        let img = document.createElement("img");
+        img.src = match.track.artwork;
+        img.classList.add("h-24");
+        el.appendChild(img);
+
+        let details = document.createElement("div");
+        details.classList.add("flex","flex-column","gap-1","w-full");
+        let title = document.createElement("div");
+        title.classList.add("text-2xl");
+        title.innerText = match.track.title;
+        let artist = document.createElement("div");
+        artist.classList.add("text-zinc-300","text-sm");
+        artist.innerText = `${match.track.artist} : ${secondsToDurationString(match.track.duration)}`;
+        details.append(title, artist);
+
+        let video = document.createElement("select");
+        video.classList.add("w-full","rounded");
+        for (let candidate of match.candidates) {
+            let option = document.createElement("option");
+            option.value = candidate.video.id;
+            option.innerText = `${confidenceToString(candidate.confidence)} : ` +
+                `${candidate.video.title} : ${candidate.video.channelTitle} : ` +
+                secondsToDurationString(candidate.video.duration);
+            video.appendChild(option);
+        }
+        if (match.candidates.length > 0) {
+            details.appendChild(video);
+        } else {
+            let error = document.createElement("div");
+            error.classList.add("text-sm");
+            error.innerText = "No videos were found" + (match.error ? `: ${match.error}` : "");
+            details.appendChild(error);
+        }
+        el.appendChild(details);
+        results.appendChild(el);
+        rows.push({ match, selected, video });
     }
+
+    let createPlaylist = document.createElement("label");
+    createPlaylist.classList.add("flex","align-center","gap-2","text-white");
+    createPlaylist.innerHTML = `<input type="checkbox" checked> Create a playlist named`;
+    let createPlaylistCheckbox = /** @type {HTMLInputElement} */
+        (createPlaylist.querySelector("input"));
+    let playlistTitle = document.createElement("input");
+    playlistTitle.value = matches.title;
+    playlistTitle.classList.add("w-full","rounded","px-1");
+    _main.append(createPlaylist, playlistTitle);
+
+    let submit = document.createElement("button");
+    submit.innerText = "Download selected songs";
+    submit.classList.add("bg-white","w-full","text-lg","py-1","rounded");
+    submit.onclick = async () => {
+        let entries = rows
+            .filter(row => row.selected.checked && row.video.value)
+            .map(row => ({
+                title: row.match.track.title,
+                artist: row.match.track.artist,
+                album: row.match.track.album,
+                artwork: row.match.track.artwork,
+                source: row.video.value,
+                duration: row.match.candidates
+                    .find(candidate => candidate.video.id == row.video.value)?.video.duration,
+            }));
+        if (entries.length == 0) return;
+        let playlist = createPlaylistCheckbox.checked && playlistTitle.value
+            ? { title: playlistTitle.value, description: matches.description, artwork: matches.artwork }
+            : undefined;
+        submit.disabled = true;
+        let idToken = Auth.getIdToken() || /** @type {string} */
+            (await Auth.refreshIdToken());
+        try {
+            let playlistImport = await postPlaylistImport(idToken, entries, playlist);
+            if (!playlistImport) {
+                submit.disabled = false;
+                return;
+            }
+            showPlaylistProgress(playlistImport, entries.map(entry => entry.title), idToken);
+        } catch (err) {
+            console.error(err);
+            alert("The songs could not be queued");
+            submit.disabled = false;
+        }
+    };
+    _main.appendChild(submit);
+}
+
+/**
+ * Asks the admin whether to download songs that are already in the library
+ * @param {import('./melo_api.mjs').Duplicate[]} duplicates
+ * @param {string[]} titles The titles of the songs that were being downloaded
+ * @returns {boolean} Whether they should be downloaded anyway
+ */
+function confirmDuplicates(duplicates, titles) {
+    let lines = duplicates.map(duplicate => {
+        let title = titles[duplicate.entry ?? 0];
+        if (duplicate.job) {
+            return `"${title}" is already being downloaded`;
+        }
+        let song = duplicate.song;
+        return duplicate.reason == "source"
+            ? `"${title}" was already downloaded as "${song?.title}" by ${song?.artist}`
+            : `"${title}" looks like "${song?.title}" by ${song?.artist}, which is already in the library`;
+    });
+    return confirm(lines.join("\n") + "\n\nDownload anyway?");
+}
+
+/**
+ * Queues the entries, asking the admin first if any are already in the library
+ * @param {string} idToken
+ * @param {Parameters<typeof MeloApi.postPlaylistImport>[1]} entries
+ * @param {Parameters<typeof MeloApi.postPlaylistImport>[2]} playlist
+ * @returns {Promise<PlaylistImport|undefined>}
+ * Nothing if the admin chose not to download the duplicates
+ */
+async function postPlaylistImport(idToken, entries, playlist) {
+    try {
+        return await MeloApi.postPlaylistImport(idToken, entries, playlist);
+    } catch (err) {
+        if (!(err instanceof MeloApi.DuplicateSongError)) throw err;
+        if (!confirmDuplicates(err.duplicates, entries.map(entry => entry.title))) return;
+        return await MeloApi.postPlaylistImport(idToken, entries, playlist, true);
+    }
+}
+
+/**
+ * Shows the progress of each song of a playlist import, every job is followed
+ * at the same time
+ * @param {PlaylistImport} playlistImport
+ * @param {string[]} titles The title of each job's song
+ * @param {string} idToken
+ */
+function showPlaylistProgress(playlistImport, titles, idToken) {
+    _main.innerHTML = `
+        <div class="text-4xl text-center">Progress</div>
+    `
+
+    let grid = document.createElement("div");
+    grid.classList.add("grid","grid-flow-column");
+    grid.style.gridTemplateColumns = "auto 1fr auto";
+    grid.style.rowGap = "0.5rem"
+    grid.style.columnGap = "1rem"
+    _main.appendChild(grid);
+
+    let summary = document.createElement("div");
+    summary.classList.add("text-sm");
+    _main.appendChild(summary);
+
+    let resetButton = document.createElement("button");
+    resetButton.innerText = "Download more songs";
+    resetButton.classList.add("bg-white","w-full","text-lg","py-1","rounded");
+    resetButton.addEventListener("click", showSearch);
+    _main.appendChild(resetButton);
+
+    let steps = playlistImport.steps;
+    let finished = 0, failed = 0;
+    let watches = playlistImport.jobIds.map(async (jobId, i) => {
+        let label = document.createElement("div");
+        label.style.textAlign = "right";
+        label.innerText = titles[i];
+        let progress = document.createElement("progress");
+        progress.value = 0;
+        let status = document.createElement("div");
+        status.classList.add("text-sm");
+        status.innerText = "Queued";
+        grid.append(label, progress, status);
+
+        // the job's progress is the progress through all of its steps
+        /** @param {string} step @param {number} p */
+        function setProgress(step, p) {
+            let n = Math.max(steps.indexOf(step), 0);
+            progress.value = (n + p / 100) / steps.length;
+        }
+
+        try {
+            let last = await MeloApi.watchDownloadJob(jobId, idToken, ({ event, data }) => {
+                switch (event) {
+                case "step-start":
+                    status.innerText = /** @type {string} */ (data.step);
+                    setProgress(/** @type {string} */ (data.step), 0);
+                    break;
+                case "progress":
+                    setProgress(/** @type {string} */ (data.step), data.progress || 0);
+                    break;
+                case "done":
+                    progress.value = 1;
+                    status.innerText = "Done";
+                    break;
+                case "error":
+                    status.innerText = "Error";
+                    status.title = data.message || "";
+                    break;
+                }
+            });
+            if (last.event == "error") failed++;
+        } catch (err) {
+            console.error(err);
+            status.innerText = "Lost track";
+            failed++;
+        }
+        finished++;
+        summary.innerText = `${finished} of ${playlistImport.jobIds.length} finished, ${failed} failed`;
+    });
+
+    Promise.all(watches).then(() => {
+        if (playlistImport.playlistId) {
+            summary.innerText += ", the downloaded songs were added to the playlist";
+        }
+    });
 }
 
 /**